@@ -0,0 +1,357 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	KIND_OMISSION      = "omission"
+	KIND_TRANSPOSITION = "transposition"
+	KIND_HOMOGLYPH     = "homoglyph"
+	KIND_IDN_HOMOGLYPH = "idn_homoglyph"
+	KIND_TLD_SWAP      = "tld_swap"
+	KIND_BITSQUATTING  = "bitsquatting"
+	KIND_HYPHENATION   = "hyphenation"
+
+	MAX_LABEL_LENGTH = 63
+)
+
+// Lookalike is a candidate domain which could be registered to impersonate an asset.
+type Lookalike struct {
+	Domain *string `json:"domain,omitempty" bson:"domain,omitempty"` //unicode form, same as ascii unless IDN
+	ASCII  *string `json:"ascii,omitempty" bson:"ascii,omitempty"`   //punycode form as it appears in DNS and WHOIS
+	Kind   *string `json:"kind,omitempty" bson:"kind,omitempty"`
+}
+
+var (
+	//multi-label public suffixes we expect to see on customer domains
+	secondLevelSuffixes = map[string]bool{
+		"co.uk": true, "org.uk": true, "ac.uk": true, "gov.uk": true, "me.uk": true,
+		"com.au": true, "net.au": true, "org.au": true,
+		"co.nz": true, "co.za": true, "co.jp": true, "com.br": true, "com.mx": true,
+		"com.cn": true, "com.sg": true, "com.hk": true, "co.in": true, "co.il": true,
+	}
+
+	swapTLDs = []string{
+		"com", "net", "org", "info", "biz", "co", "io", "us", "uk", "co.uk", "eu", "de", "se", "nl",
+		"fr", "ru", "cn", "in", "me", "cc", "online", "site", "xyz", "top", "app", "dev", "shop",
+	}
+
+	asciiHomoglyphs = map[string][]string{
+		"o":  {"0"},
+		"0":  {"o"},
+		"l":  {"1", "i"},
+		"i":  {"1", "l"},
+		"1":  {"l", "i"},
+		"m":  {"rn", "nn"},
+		"rn": {"m"},
+		"w":  {"vv"},
+		"vv": {"w"},
+		"d":  {"cl"},
+		"cl": {"d"},
+		"s":  {"5"},
+		"e":  {"3"},
+		"a":  {"4"},
+		"g":  {"q", "9"},
+		"q":  {"g"},
+		"b":  {"6"},
+		"z":  {"2"},
+	}
+
+	idnHomoglyphs = map[rune][]rune{
+		'a': {'а', 'ạ', 'á', 'à', 'ä'},
+		'c': {'с', 'ç'},
+		'd': {'ԁ'},
+		'e': {'е', 'ė', 'é', 'ë'},
+		'g': {'ɡ', 'ġ'},
+		'h': {'һ'},
+		'i': {'і', 'í', 'ï'},
+		'j': {'ј'},
+		'k': {'κ'},
+		'l': {'ӏ', 'ḷ'},
+		'n': {'ո', 'ń'},
+		'o': {'о', 'ο', 'ó', 'ö', 'ø'},
+		'p': {'р'},
+		'q': {'ԛ'},
+		's': {'ѕ', 'ś'},
+		'u': {'υ', 'ú', 'ü'},
+		'v': {'ν'},
+		'w': {'ԝ'},
+		'x': {'х'},
+		'y': {'у', 'ý'},
+		'z': {'ż'},
+	}
+)
+
+// SplitDomain separates the registrable label from its public suffix,
+// e.g "mail.example.co.uk" becomes "example" and "co.uk".
+func SplitDomain(domain string) (string, string, error) {
+	domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+	labels := strings.Split(domain, ".")
+
+	if len(labels) < 2 {
+		return "", "", errors.New("Invalid domain: " + domain)
+	}
+
+	n := len(labels)
+	if n > 2 && secondLevelSuffixes[labels[n-2]+"."+labels[n-1]] {
+		return labels[n-3], labels[n-2] + "." + labels[n-1], nil
+	}
+
+	return labels[n-2], labels[n-1], nil
+}
+
+func validLabel(label string) bool {
+	if label == "" || len(label) > MAX_LABEL_LENGTH {
+		return false
+	}
+
+	if strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+		return false
+	}
+
+	for _, r := range label {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r > utf8.RuneSelf {
+			continue
+		}
+		return false
+	}
+
+	return true
+}
+
+type candidateSet struct {
+	original string
+	seen     map[string]bool
+	out      []*Lookalike
+}
+
+func (c *candidateSet) add(label string, tld string, kind string) {
+	if !validLabel(label) {
+		return
+	}
+
+	domain := label + "." + tld
+	if domain == c.original || c.seen[domain] {
+		return
+	}
+
+	ascii, err := ToASCII(label)
+	if err != nil {
+		return
+	}
+	ascii = ascii + "." + tld
+
+	c.seen[domain] = true
+	c.out = append(c.out, &Lookalike{
+		Domain: &domain,
+		ASCII:  &ascii,
+		Kind:   &kind,
+	})
+}
+
+// GenerateLookalikes returns the typo-squatting permutations of a domain.
+func GenerateLookalikes(domain string) ([]*Lookalike, error) {
+	name, tld, err := SplitDomain(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	c := candidateSet{
+		original: name + "." + tld,
+		seen:     make(map[string]bool),
+	}
+
+	runes := []rune(name)
+
+	//omission
+	for i := range runes {
+		c.add(string(runes[:i])+string(runes[i+1:]), tld, KIND_OMISSION)
+	}
+
+	//transposition of adjacent characters
+	for i := 0; i < len(runes)-1; i++ {
+		if runes[i] == runes[i+1] {
+			continue
+		}
+		t := make([]rune, len(runes))
+		copy(t, runes)
+		t[i], t[i+1] = t[i+1], t[i]
+		c.add(string(t), tld, KIND_TRANSPOSITION)
+	}
+
+	//ascii homoglyphs, including multi-character ones such as rn/m
+	for glyph, replacements := range asciiHomoglyphs {
+		for i := 0; i+len(glyph) <= len(name); i++ {
+			if name[i:i+len(glyph)] != glyph {
+				continue
+			}
+			for _, r := range replacements {
+				c.add(name[:i]+r+name[i+len(glyph):], tld, KIND_HOMOGLYPH)
+			}
+		}
+	}
+
+	//unicode homoglyphs, registered as punycode IDNs
+	for i, r := range runes {
+		for _, h := range idnHomoglyphs[r] {
+			t := make([]rune, len(runes))
+			copy(t, runes)
+			t[i] = h
+			c.add(string(t), tld, KIND_IDN_HOMOGLYPH)
+		}
+	}
+
+	//tld swaps
+	for _, t := range swapTLDs {
+		if t != tld {
+			c.add(name, t, KIND_TLD_SWAP)
+		}
+	}
+
+	//bitsquatting, a single flipped bit in one character
+	for i := 0; i < len(name); i++ {
+		for bit := uint(0); bit < 8; bit++ {
+			b := name[i] ^ (1 << bit)
+			if b >= 'A' && b <= 'Z' || b >= utf8.RuneSelf {
+				//DNS is case insensitive so upper case resolves to the original
+				continue
+			}
+			c.add(name[:i]+string(b)+name[i+1:], tld, KIND_BITSQUATTING)
+		}
+	}
+
+	//hyphenation
+	for i := 1; i < len(runes); i++ {
+		if runes[i-1] == '-' || runes[i] == '-' {
+			continue
+		}
+		c.add(string(runes[:i])+"-"+string(runes[i:]), tld, KIND_HYPHENATION)
+	}
+
+	sort.Slice(c.out, func(i, j int) bool {
+		if *c.out[i].Kind != *c.out[j].Kind {
+			return *c.out[i].Kind < *c.out[j].Kind
+		}
+		return *c.out[i].Domain < *c.out[j].Domain
+	})
+
+	return c.out, nil
+}
+
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+)
+
+func punyAdapt(delta int, numPoints int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+
+	delta += delta / numPoints
+
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
+
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+// ToASCII encodes a single label with punycode (RFC 3492), leaving ascii labels untouched.
+func ToASCII(label string) (string, error) {
+	runes := []rune(label)
+
+	var out []byte
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			out = append(out, byte(r))
+		}
+	}
+
+	basic := len(out)
+	if basic == len(runes) {
+		return label, nil
+	}
+
+	if basic > 0 {
+		out = append(out, '-')
+	}
+
+	n := punyInitialN
+	delta := 0
+	bias := punyInitialBias
+
+	for h := basic; h < len(runes); {
+		m := int(^uint(0) >> 1)
+		for _, r := range runes {
+			if int(r) >= n && int(r) < m {
+				m = int(r)
+			}
+		}
+
+		delta += (m - n) * (h + 1)
+		n = m
+
+		for _, r := range runes {
+			if int(r) < n {
+				delta++
+			}
+
+			if int(r) != n {
+				continue
+			}
+
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := k - bias
+				if t < punyTMin {
+					t = punyTMin
+				} else if t > punyTMax {
+					t = punyTMax
+				}
+
+				if q < t {
+					break
+				}
+
+				out = append(out, punyDigit(t+(q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+
+			out = append(out, punyDigit(q))
+			bias = punyAdapt(delta, h+1, h == basic)
+			delta = 0
+			h++
+		}
+
+		delta++
+		n++
+	}
+
+	encoded := "xn--" + string(out)
+	if len(encoded) > MAX_LABEL_LENGTH {
+		return "", errors.New("Label too long: " + label)
+	}
+
+	return encoded, nil
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"net/url"
 	"reflect"
 	"strings"
@@ -90,13 +91,14 @@ type AssetWhois struct {
 }
 
 type AssetLocation struct {
-	StreetNumber *int64   `json:"street_number,omitempty" bson:"street_number,omitempty"`
-	PostalTown   *string  `json:"postal_town,omitempty" bson:"postal_town,omitempty"`
-	Country      *string  `json:"country,omitempty" bson:"country,omitempty"`
-	StreetName   *string  `json:"street_name,omitempty" bson:"street_name,omitempty"`
-	Premise      *string  `json:"premise,omitempty" bson:"premise,omitempty"`
-	Lat          *float64 `json:"lat,omitempty" bson:"lat,omitempty"`
-	Lng          *float64 `json:"lng,omitempty" bson:"lng,omitempty"`
+	StreetNumber *int64    `json:"street_number,omitempty" bson:"street_number,omitempty"`
+	PostalTown   *string   `json:"postal_town,omitempty" bson:"postal_town,omitempty"`
+	Country      *string   `json:"country,omitempty" bson:"country,omitempty"`
+	StreetName   *string   `json:"street_name,omitempty" bson:"street_name,omitempty"`
+	Premise      *string   `json:"premise,omitempty" bson:"premise,omitempty"`
+	Lat          *float64  `json:"lat,omitempty" bson:"lat,omitempty"`
+	Lng          *float64  `json:"lng,omitempty" bson:"lng,omitempty"`
+	Geo          *GeoPoint `json:"geo,omitempty" bson:"geo,omitempty"`
 }
 
 type AssetName struct {
@@ -146,6 +148,8 @@ type Asset struct {
 	//person
 	Brands *Strings `json:"brands,omitempty" bson:"brands,omitempty"`
 
+	SearchKeys []*SearchKey `json:"search_keys,omitempty" bson:"search_keys,omitempty"`
+
 	IncidentCount *int64 `json:"incident_count,omitempty" bson:"-"`
 }
 
@@ -177,24 +181,22 @@ type ErrorResponse struct {
 }
 
 func (data Asset) GetName() string {
-	var name string
-	if data.Name.Common != nil {
-		name = *data.Name.Common
-	} else {
-		if data.Name.Last != nil {
-			name = *data.Name.Last
-		}
+	if data.Name == nil {
+		return ""
+	}
 
-		if data.Name.Middle != nil {
-			name += " " + *data.Name.Middle
-		}
+	if data.Name.Common != nil {
+		return *data.Name.Common
+	}
 
-		if data.Name.First != nil {
-			name += " " + *data.Name.First
+	var parts []string
+	for _, part := range []*string{data.Name.First, data.Name.Middle, data.Name.Last} {
+		if part != nil && *part != "" {
+			parts = append(parts, *part)
 		}
 	}
 
-	return name
+	return strings.Join(parts, " ")
 }
 
 func ServeError(message string, code int) events.APIGatewayProxyResponse {
@@ -739,6 +741,21 @@ func UpdateAsset(id string, data Asset) error {
 		return errors.New("Unable to verify case group permissions")
 	}
 
+	err = NormaliseAssetNetwork(&data)
+	if err != nil {
+		return err
+	}
+
+	err = ApplySearchKeys(current, &data)
+	if err != nil {
+		return err
+	}
+
+	err = SetAssetGeo(&data)
+	if err != nil {
+		return err
+	}
+
 	update_data, err := StructToBsonMap(data)
 	if err != nil {
 		return err
@@ -761,6 +778,15 @@ func UpdateAsset(id string, data Asset) error {
 		return errors.New("Unable to find the object to update")
 	}
 
+	//the asset is saved either way, sets that failed to generate are filled in by the lookalikes migrate job
+	updated, err := GetAsset(id)
+	if err == nil {
+		_, err = GenerateAssetLookalikes(updated)
+	}
+	if err != nil {
+		log.Printf("Unable to generate lookalikes for asset %s: %s", id, err.Error())
+	}
+
 	return nil
 }
 
@@ -781,6 +807,18 @@ func NewAsset(data *Asset) error {
 		return errors.New("Object must contain case_id")
 	}
 
+	err := NormaliseAssetNetwork(data)
+	if err != nil {
+		return err
+	}
+
+	data.SearchKeys = DeriveSearchKeys(*data, data.SearchKeys)
+
+	err = SetAssetGeo(data)
+	if err != nil {
+		return err
+	}
+
 	insert_data, err := StructToBsonMap(*data)
 	if err != nil {
 		return err
@@ -795,6 +833,11 @@ func NewAsset(data *Asset) error {
 
 	data.ID = &nid
 
+	_, err = GenerateAssetLookalikes(*data)
+	if err != nil {
+		log.Printf("Unable to generate lookalikes for asset %s: %s", nid, err.Error())
+	}
+
 	return nil
 }
 
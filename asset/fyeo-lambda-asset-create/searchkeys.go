@@ -0,0 +1,335 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	KEY_NAME            = "name"
+	KEY_NAME_VARIANT    = "name_variant"
+	KEY_NICKNAME        = "nickname"
+	KEY_TRANSLITERATION = "transliteration"
+	KEY_EMAIL_LOCAL     = "email_local"
+	KEY_DOMAIN_LABEL    = "domain_label"
+	KEY_BRAND           = "brand"
+	KEY_ORGANIZATION    = "organization"
+	KEY_MANUAL          = "manual"
+
+	MIN_KEY_LENGTH = 3
+)
+
+// SearchKey is a normalised term the matcher searches for on behalf of an asset.
+type SearchKey struct {
+	Value      *string `json:"value,omitempty" bson:"value,omitempty"`
+	Kind       *string `json:"kind,omitempty" bson:"kind,omitempty"`
+	Source     *string `json:"source,omitempty" bson:"source,omitempty"` //asset field the key was derived from
+	Manual     *bool   `json:"manual,omitempty" bson:"manual,omitempty"`
+	Suppressed *bool   `json:"suppressed,omitempty" bson:"suppressed,omitempty"`
+}
+
+var (
+	//latin letters which do not decompose into a base letter and a combining mark
+	foldedLetters = map[rune]string{
+		'ß': "ss", 'æ': "ae", 'ø': "o", 'œ': "oe", 'đ': "d", 'ð': "d", 'þ': "th", 'ł': "l", 'ı': "i",
+		'á': "a", 'à': "a", 'â': "a", 'ä': "a", 'ã': "a", 'å': "a", 'ā': "a", 'ą': "a",
+		'ç': "c", 'ć': "c", 'č': "c",
+		'é': "e", 'è': "e", 'ê': "e", 'ë': "e", 'ē': "e", 'ę': "e", 'ě': "e",
+		'í': "i", 'ì': "i", 'î': "i", 'ï': "i", 'ī': "i",
+		'ñ': "n", 'ń': "n", 'ň': "n",
+		'ó': "o", 'ò': "o", 'ô': "o", 'ö': "o", 'õ': "o", 'ō': "o", 'ő': "o",
+		'ř': "r", 'ś': "s", 'š': "s", 'ş': "s", 'ť': "t", 'ţ': "t",
+		'ú': "u", 'ù': "u", 'û': "u", 'ü': "u", 'ū': "u", 'ů': "u", 'ű': "u",
+		'ý': "y", 'ÿ': "y", 'ź': "z", 'ż': "z", 'ž': "z",
+	}
+
+	transliterations = map[rune]string{
+		//cyrillic
+		'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "e", 'ж': "zh", 'з': "z",
+		'и': "i", 'й': "y", 'к': "k", 'л': "l", 'м': "m", 'н': "n", 'о': "o", 'п': "p", 'р': "r",
+		'с': "s", 'т': "t", 'у': "u", 'ф': "f", 'х': "kh", 'ц': "ts", 'ч': "ch", 'ш': "sh", 'щ': "shch",
+		'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "yu", 'я': "ya", 'і': "i", 'ї': "yi", 'є': "ye",
+		//greek
+		'α': "a", 'β': "v", 'γ': "g", 'δ': "d", 'ε': "e", 'ζ': "z", 'η': "i", 'θ': "th", 'ι': "i",
+		'κ': "k", 'λ': "l", 'μ': "m", 'ν': "n", 'ξ': "x", 'ο': "o", 'π': "p", 'ρ': "r", 'σ': "s",
+		'ς': "s", 'τ': "t", 'υ': "y", 'φ': "f", 'χ': "ch", 'ψ': "ps", 'ω': "o",
+	}
+
+	nicknames = map[string][]string{
+		"alexander":   {"alex", "sasha"},
+		"andrew":      {"andy", "drew"},
+		"anthony":     {"tony"},
+		"benjamin":    {"ben"},
+		"catherine":   {"cathy", "kate"},
+		"charles":     {"charlie", "chuck"},
+		"christopher": {"chris"},
+		"daniel":      {"dan", "danny"},
+		"david":       {"dave"},
+		"edward":      {"ed", "ted"},
+		"elizabeth":   {"liz", "beth"},
+		"james":       {"jim", "jimmy"},
+		"jennifer":    {"jen", "jenny"},
+		"john":        {"jack", "johnny"},
+		"jonathan":    {"jon"},
+		"joseph":      {"joe"},
+		"katherine":   {"kathy", "kate"},
+		"margaret":    {"maggie", "peggy"},
+		"matthew":     {"matt"},
+		"michael":     {"mike", "mick"},
+		"nicholas":    {"nick"},
+		"patricia":    {"pat", "tricia"},
+		"patrick":     {"pat"},
+		"peter":       {"pete"},
+		"rebecca":     {"becky"},
+		"richard":     {"rick", "dick"},
+		"robert":      {"rob", "bob"},
+		"samuel":      {"sam"},
+		"stephen":     {"steve"},
+		"steven":      {"steve"},
+		"susan":       {"sue"},
+		"thomas":      {"tom", "tommy"},
+		"timothy":     {"tim"},
+		"william":     {"will", "bill"},
+	}
+)
+
+// NormaliseKey lower cases a term, folds accents and collapses punctuation and whitespace.
+func NormaliseKey(input string) string {
+	var sb strings.Builder
+
+	for _, r := range strings.ToLower(input) {
+		if f, ok := foldedLetters[r]; ok {
+			sb.WriteString(f)
+			continue
+		}
+
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '@' || r == '.' || r == '-' {
+			sb.WriteRune(r)
+			continue
+		}
+
+		sb.WriteRune(' ')
+	}
+
+	return strings.Join(strings.Fields(sb.String()), " ")
+}
+
+// Transliterate writes cyrillic and greek letters in latin script.
+func Transliterate(input string) string {
+	var sb strings.Builder
+
+	for _, r := range input {
+		if t, ok := transliterations[r]; ok {
+			sb.WriteString(t)
+			continue
+		}
+		sb.WriteRune(r)
+	}
+
+	return sb.String()
+}
+
+type keySet struct {
+	seen map[string]bool
+	out  []*SearchKey
+}
+
+func (k *keySet) add(value string, kind string, source string) {
+	value = NormaliseKey(value)
+	if len([]rune(value)) < MIN_KEY_LENGTH || k.seen[value] {
+		return
+	}
+
+	k.seen[value] = true
+	k.out = append(k.out, &SearchKey{
+		Value:  &value,
+		Kind:   &kind,
+		Source: &source,
+	})
+
+	t := Transliterate(value)
+	if t != value && !k.seen[t] {
+		k.seen[t] = true
+		transliteration := KEY_TRANSLITERATION
+		k.out = append(k.out, &SearchKey{
+			Value:  &t,
+			Kind:   &transliteration,
+			Source: &source,
+		})
+	}
+}
+
+// domainLabel returns the registrable label of a domain or url, e.g "example" for "https://www.example.co.uk/about".
+func domainLabel(input string) string {
+	host := strings.ToLower(strings.TrimSpace(input))
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+3:]
+	}
+	if i := strings.IndexAny(host, "/?#:"); i >= 0 {
+		host = host[:i]
+	}
+
+	labels := strings.Split(strings.TrimSuffix(host, "."), ".")
+	if len(labels) < 2 {
+		return ""
+	}
+
+	n := len(labels)
+	//second level public suffixes such as co.uk or com.au
+	if n > 2 && len(labels[n-2]) <= 3 && len(labels[n-1]) == 2 {
+		return labels[n-3]
+	}
+
+	return labels[n-2]
+}
+
+func initial(s string) string {
+	for _, r := range s {
+		return string(r)
+	}
+	return ""
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return strings.TrimSpace(*s)
+}
+
+// DeriveSearchKeys builds the search keys of an asset from its fields. Keys added by analysts
+// are kept and keys they suppressed stay suppressed when they are derived again.
+func DeriveSearchKeys(data Asset, existing []*SearchKey) []*SearchKey {
+	k := keySet{seen: make(map[string]bool)}
+
+	if data.Name != nil {
+		common := deref(data.Name.Common)
+		first := deref(data.Name.First)
+		middle := deref(data.Name.Middle)
+		last := deref(data.Name.Last)
+		nick := deref(data.Name.Nick)
+
+		if common != "" {
+			k.add(common, KEY_NAME, "name.common")
+		}
+
+		if first != "" && last != "" {
+			k.add(first+" "+last, KEY_NAME, "name")
+			k.add(last+" "+first, KEY_NAME_VARIANT, "name")
+			k.add(last+", "+first, KEY_NAME_VARIANT, "name")
+			k.add(initial(first)+". "+last, KEY_NAME_VARIANT, "name")
+
+			if middle != "" {
+				k.add(first+" "+middle+" "+last, KEY_NAME_VARIANT, "name")
+				k.add(first+" "+initial(middle)+" "+last, KEY_NAME_VARIANT, "name")
+			}
+
+			for _, n := range nicknames[NormaliseKey(first)] {
+				k.add(n+" "+last, KEY_NICKNAME, "name.first")
+			}
+		} else if last != "" {
+			k.add(last, KEY_NAME, "name.last")
+		}
+
+		if nick != "" {
+			k.add(nick, KEY_NICKNAME, "name.nick")
+			if last != "" {
+				k.add(nick+" "+last, KEY_NICKNAME, "name.nick")
+			}
+		}
+
+		if data.Type != nil && *data.Type == "domain" && common != "" {
+			k.add(domainLabel(common), KEY_DOMAIN_LABEL, "name.common")
+		}
+	}
+
+	for _, e := range data.Emails {
+		if e == nil || e.Value == nil {
+			continue
+		}
+
+		parts := strings.SplitN(strings.TrimSpace(*e.Value), "@", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		k.add(parts[0], KEY_EMAIL_LOCAL, "emails")
+		k.add(strings.NewReplacer(".", " ", "_", " ", "-", " ").Replace(parts[0]), KEY_EMAIL_LOCAL, "emails")
+		k.add(domainLabel(parts[1]), KEY_DOMAIN_LABEL, "emails")
+	}
+
+	if data.Whois != nil && data.Whois.Domain != nil {
+		k.add(domainLabel(*data.Whois.Domain), KEY_DOMAIN_LABEL, "whois.domain")
+	}
+
+	if data.Urls != nil {
+		for _, u := range *data.Urls {
+			k.add(domainLabel(u), KEY_DOMAIN_LABEL, "urls")
+		}
+	}
+
+	if data.Brands != nil {
+		for _, b := range *data.Brands {
+			k.add(b, KEY_BRAND, "brands")
+		}
+	}
+
+	if data.Organization != nil && data.Organization.Name != nil {
+		k.add(*data.Organization.Name, KEY_ORGANIZATION, "organization.name")
+	}
+
+	suppressed := make(map[string]bool)
+	for _, e := range existing {
+		if e == nil || e.Value == nil {
+			continue
+		}
+
+		if e.Suppressed != nil && *e.Suppressed {
+			suppressed[*e.Value] = true
+		}
+
+		if e.Manual != nil && *e.Manual && !k.seen[*e.Value] {
+			k.seen[*e.Value] = true
+			k.out = append(k.out, e)
+		}
+	}
+
+	for _, key := range k.out {
+		if suppressed[*key.Value] {
+			t := true
+			key.Suppressed = &t
+		}
+	}
+
+	sort.SliceStable(k.out, func(i, j int) bool {
+		return *k.out[i].Value < *k.out[j].Value
+	})
+
+	return k.out
+}
+
+// ApplySearchKeys derives the search keys of an asset update from the stored asset
+// merged with the changes, so a partial update does not drop keys of untouched fields.
+func ApplySearchKeys(current Asset, data *Asset) error {
+	b, err := bson.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	merged := current
+	err = bson.Unmarshal(b, &merged)
+	if err != nil {
+		return err
+	}
+
+	data.SearchKeys = DeriveSearchKeys(merged, current.SearchKeys)
+
+	return nil
+}
@@ -177,24 +177,22 @@ type ErrorResponse struct {
 }
 
 func (data Asset) GetName() string {
-	var name string
-	if data.Name.Common != nil {
-		name = *data.Name.Common
-	} else {
-		if data.Name.Last != nil {
-			name = *data.Name.Last
-		}
+	if data.Name == nil {
+		return ""
+	}
 
-		if data.Name.Middle != nil {
-			name += " " + *data.Name.Middle
-		}
+	if data.Name.Common != nil {
+		return *data.Name.Common
+	}
 
-		if data.Name.First != nil {
-			name += " " + *data.Name.First
+	var parts []string
+	for _, part := range []*string{data.Name.First, data.Name.Middle, data.Name.Last} {
+		if part != nil && *part != "" {
+			parts = append(parts, *part)
 		}
 	}
 
-	return name
+	return strings.Join(parts, " ")
 }
 
 func ServeError(message string, code int) events.APIGatewayProxyResponse {
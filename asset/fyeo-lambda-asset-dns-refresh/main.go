@@ -0,0 +1,498 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	EXPIRY_WARNING_DAYS = 30
+	LOOKUP_TIMEOUT      = 20 * time.Second
+
+	//time kept back from the lambda timeout, enough for one more asset's lookups to finish
+	REFRESH_MARGIN = LOOKUP_TIMEOUT + 5*time.Second
+
+	EVENT_SOURCE_TYPE = "asset_monitor"
+
+	EVENT_IP_CHANGE        = "ip_change"
+	EVENT_MX_CHANGE        = "mx_change"
+	EVENT_NS_CHANGE        = "ns_change"
+	EVENT_REGISTRAR_CHANGE = "registrar_change"
+	EVENT_WHOIS_EXPIRY     = "whois_expiry"
+)
+
+var (
+	MongoClient *mongo.Client
+	DNSResolver Resolver
+
+	RESOLVER          = os.Getenv("RESOLVER")
+	RESOLVER_FIXTURES = os.Getenv("RESOLVER_FIXTURES")
+)
+
+type Strings []string
+
+type AssetWhois struct {
+	Domain      *string    `json:"domain,omitempty" bson:"domain,omitempty"`
+	CreatedAt   *time.Time `json:"created_at,omitempty" bson:"created_at,omitempty"`
+	UpdatedAt   *time.Time `json:"updated_at,omitempty" bson:"updated_at,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
+	Registrar   *string    `json:"registrar,omitempty" bson:"registrar,omitempty"`
+	Registrant  *string    `json:"registrant,omitempty" bson:"registrant,omitempty"`
+	Nameservers *Strings   `json:"nameservers,omitempty" bson:"names_servers,omitempty"`
+	Status      *string    `json:"status,omitempty" bson:"status,omitempty"`
+}
+
+type AssetName struct {
+	Common *string `json:"common,omitempty" bson:"common,omitempty"`
+	First  *string `json:"first,omitempty" bson:"first,omitempty"`
+	Last   *string `json:"last,omitempty" bson:"last,omitempty"`
+	Middle *string `json:"middle,omitempty" bson:"middle,omitempty"`
+	Nick   *string `json:"nick,omitempty" bson:"nick,omitempty"`
+}
+
+type Asset struct {
+	ID        *string     `json:"id,omitempty" bson:"_id,omitempty"`
+	CaseID    *string     `json:"case_id,omitempty" bson:"case_id,omitempty"`
+	IPs       *Strings    `json:"ips,omitempty" bson:"ips,omitempty"`
+	Name      *AssetName  `json:"name,omitempty" bson:"name,omitempty"`
+	UpdatedAt *time.Time  `json:"updated_at,omitempty" bson:"updated_at,omitempty"`
+	Type      *string     `json:"type,omitempty" bson:"type,omitempty"`
+	IsActive  *bool       `json:"is_active,omitempty" bson:"is_active,omitempty"`
+	Whois     *AssetWhois `json:"whois,omitempty" bson:"whois,omitempty"`
+	Mx        *Strings    `json:"mx,omitempty" bson:"mx,omitempty"`
+	Ns        *Strings    `json:"ns,omitempty" bson:"ns,omitempty"`
+
+	//when the records were last looked up, the oldest are refreshed first
+	RefreshedAt *time.Time `json:"refreshed_at,omitempty" bson:"refreshed_at,omitempty"`
+}
+
+type AssetChange struct {
+	Field    *string  `json:"field,omitempty" bson:"field,omitempty"`
+	Previous *Strings `json:"previous,omitempty" bson:"previous,omitempty"`
+	Current  *Strings `json:"current,omitempty" bson:"current,omitempty"`
+}
+
+type Event struct {
+	ID          *string      `json:"id,omitempty" bson:"_id,omitempty"`
+	CaseID      *string      `json:"case_id" bson:"case_id,omitempty"`
+	AssetID     *string      `json:"asset_id,omitempty" bson:"asset_id,omitempty"`
+	Title       *string      `json:"title,omitempty" bson:"title,omitempty"`
+	SourceType  *string      `json:"source_type,omitempty" bson:"source_type,omitempty"`
+	Type        *string      `json:"type,omitempty" bson:"type,omitempty"`
+	Site        *string      `json:"site,omitempty" bson:"site,omitempty"`
+	ThreatLevel *int64       `json:"threat_level,omitempty" bson:"threat_level,omitempty"`
+	CreatedAt   *time.Time   `json:"created_at,omitempty" bson:"created_at,omitempty"`
+	Change      *AssetChange `json:"change,omitempty" bson:"change,omitempty"`
+}
+
+type RefreshReport struct {
+	Checked   int64    `json:"checked"`
+	Updated   int64    `json:"updated"`
+	Events    int64    `json:"events"`
+	Remaining int64    `json:"remaining"`
+	Errors    []string `json:"errors,omitempty"`
+}
+
+func main() {
+	lambda.Start(Handler)
+}
+
+func Init() error {
+	var err error
+
+	err = ReuseMongo()
+	if err != nil {
+		return err
+	}
+
+	err = ReuseResolver()
+	if err != nil {
+		return err
+	}
+
+	return err
+}
+
+func UrlEncoded(str string) (string, error) {
+	u, err := url.Parse(str)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+func ReuseMongo() error {
+
+	if MongoClient != nil {
+		return nil
+	} else {
+		var err error
+		username := "stage"
+		password := "GK!2f&Wf#z&RS3"
+
+		password, err = UrlEncoded(password)
+		if err != nil {
+			return err
+		}
+
+		ctx := context.Background()
+
+		MongoClient, err = mongo.Connect(ctx, options.Client().ApplyURI(fmt.Sprintf("mongodb://%s:%s@192.168.0.17:27017/?authSource=admin&ssl=false", username, password)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func ReuseResolver() error {
+	if DNSResolver != nil {
+		return nil
+	}
+
+	if RESOLVER == "fake" {
+		fake, err := LoadFakeResolver(RESOLVER_FIXTURES)
+		if err != nil {
+			return err
+		}
+		DNSResolver = fake
+		return nil
+	}
+
+	DNSResolver = NewNetResolver()
+
+	return nil
+}
+
+func (data Asset) GetDomain() string {
+	if data.Name != nil && data.Name.Common != nil {
+		return NormaliseHost(*data.Name.Common)
+	}
+
+	if data.Whois != nil && data.Whois.Domain != nil {
+		return NormaliseHost(*data.Whois.Domain)
+	}
+
+	return ""
+}
+
+// GetDomainAssets returns the domain assets, the ones never refreshed or refreshed longest ago
+// first so a run cut short by the timeout is picked up where it stopped.
+func GetDomainAssets() ([]Asset, error) {
+	var out []Asset
+
+	filter := bson.M{"type": "domain", "is_active": true, "is_archived": bson.M{"$ne": true}}
+	opts := options.Find().SetSort(bson.D{{Key: "refreshed_at", Value: 1}, {Key: "_id", Value: 1}})
+
+	res, err := MongoClient.Database("fyeo-di").Collection("assets").Find(context.Background(), filter, opts)
+	if err != nil {
+		return out, err
+	}
+
+	for res.Next(context.Background()) {
+		var doc Asset
+		err := res.Decode(&doc)
+		if err != nil {
+			return out, err
+		}
+		out = append(out, doc)
+	}
+
+	return out, nil
+}
+
+func NewEvent(data *Event) error {
+	res, err := MongoClient.Database("fyeo-di").Collection("events").InsertOne(context.Background(), data)
+	if err != nil {
+		return err
+	}
+
+	nid := res.InsertedID.(primitive.ObjectID).Hex()
+
+	data.ID = &nid
+
+	return nil
+}
+
+// HasRecentEvent reports whether an event of the given type was already raised for the asset since the given time.
+func HasRecentEvent(asset_id string, kind string, since time.Time) (bool, error) {
+	filter := bson.M{"asset_id": asset_id, "type": kind, "created_at": bson.M{"$gte": since}}
+
+	count, err := MongoClient.Database("fyeo-di").Collection("events").CountDocuments(context.Background(), filter, options.Count().SetLimit(1))
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+func SameStrings(a *Strings, b []string) bool {
+	var current []string
+	if a != nil {
+		current = SortedUnique(*a)
+	}
+
+	b = SortedUnique(b)
+
+	if len(current) != len(b) {
+		return false
+	}
+
+	for i := range current {
+		if current[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func sameTime(a *time.Time, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+
+	//stored dates only keep milliseconds
+	return a.Truncate(time.Millisecond).Equal(b.Truncate(time.Millisecond))
+}
+
+func sameString(a *string, b *string) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}
+
+// SameWhois reports whether a lookup found the registration details already stored.
+func SameWhois(stored *AssetWhois, current *AssetWhois) bool {
+	if stored == nil || current == nil {
+		return stored == nil && current == nil
+	}
+
+	var ns []string
+	if current.Nameservers != nil {
+		ns = *current.Nameservers
+	}
+
+	return sameString(stored.Domain, current.Domain) &&
+		sameString(stored.Registrar, current.Registrar) &&
+		sameString(stored.Registrant, current.Registrant) &&
+		sameString(stored.Status, current.Status) &&
+		sameTime(stored.CreatedAt, current.CreatedAt) &&
+		sameTime(stored.UpdatedAt, current.UpdatedAt) &&
+		sameTime(stored.ExpiresAt, current.ExpiresAt) &&
+		SameStrings(stored.Nameservers, ns)
+}
+
+func ChangeEvent(asset Asset, kind string, field string, title string, previous *Strings, current []string) Event {
+	now := time.Now()
+	site := asset.GetDomain()
+	source_type := EVENT_SOURCE_TYPE
+	threat_level := int64(DefaultThreatLevel(kind))
+
+	c := Strings(current)
+
+	return Event{
+		CaseID:      asset.CaseID,
+		AssetID:     asset.ID,
+		Title:       &title,
+		SourceType:  &source_type,
+		Type:        &kind,
+		Site:        &site,
+		ThreatLevel: &threat_level,
+		CreatedAt:   &now,
+		Change: &AssetChange{
+			Field:    &field,
+			Previous: previous,
+			Current:  &c,
+		},
+	}
+}
+
+func DefaultThreatLevel(kind string) int {
+	switch kind {
+	case EVENT_NS_CHANGE, EVENT_REGISTRAR_CHANGE, EVENT_WHOIS_EXPIRY:
+		return 3
+	default:
+		return 2
+	}
+}
+
+// LookupChanges looks up the current records of a domain asset and returns the fields which
+// changed and the events to raise for them. notified tells if an event of the kind was already
+// raised for the asset since the given time.
+func LookupChanges(ctx context.Context, resolver Resolver, asset Asset, notified func(kind string, since time.Time) (bool, error)) (bson.M, []Event, error) {
+	var changes []Event
+
+	domain := asset.GetDomain()
+	if domain == "" {
+		return nil, changes, errors.New("No domain found for asset " + *asset.ID)
+	}
+
+	lctx, cancel := context.WithTimeout(ctx, LOOKUP_TIMEOUT)
+	defer cancel()
+
+	update := bson.M{}
+
+	//a failed lookup keeps the stored records, it should not be reported as the records being removed
+	ips, err := resolver.LookupIPs(lctx, domain)
+	if err == nil && !SameStrings(asset.IPs, ips) {
+		update["ips"] = ips
+		if asset.IPs != nil {
+			changes = append(changes, ChangeEvent(asset, EVENT_IP_CHANGE, "ips", fmt.Sprintf("IP addresses changed for %s", domain), asset.IPs, ips))
+		}
+	}
+
+	mx, err := resolver.LookupMX(lctx, domain)
+	if err == nil && !SameStrings(asset.Mx, mx) {
+		update["mx"] = mx
+		if asset.Mx != nil {
+			changes = append(changes, ChangeEvent(asset, EVENT_MX_CHANGE, "mx", fmt.Sprintf("Mail servers changed for %s", domain), asset.Mx, mx))
+		}
+	}
+
+	ns, err := resolver.LookupNS(lctx, domain)
+	if err == nil && !SameStrings(asset.Ns, ns) {
+		update["ns"] = ns
+		if asset.Ns != nil {
+			changes = append(changes, ChangeEvent(asset, EVENT_NS_CHANGE, "ns", fmt.Sprintf("Nameservers changed for %s", domain), asset.Ns, ns))
+		}
+	}
+
+	whois, err := resolver.Whois(lctx, domain)
+	if err == nil && whois != nil {
+		if !SameWhois(asset.Whois, whois) {
+			update["whois"] = whois
+
+			if asset.Whois != nil && asset.Whois.Registrar != nil && whois.Registrar != nil && *asset.Whois.Registrar != *whois.Registrar {
+				previous := Strings{*asset.Whois.Registrar}
+				changes = append(changes, ChangeEvent(asset, EVENT_REGISTRAR_CHANGE, "whois.registrar", fmt.Sprintf("Registrar changed for %s", domain), &previous, []string{*whois.Registrar}))
+			}
+		}
+
+		//checked on every lookup, the expiry date rarely changes while it gets closer
+		if whois.ExpiresAt != nil && time.Until(*whois.ExpiresAt) < EXPIRY_WARNING_DAYS*24*time.Hour {
+			since := time.Now().AddDate(0, 0, -EXPIRY_WARNING_DAYS)
+			seen, err := notified(EVENT_WHOIS_EXPIRY, since)
+			if err != nil {
+				return nil, changes, err
+			}
+
+			if !seen {
+				expires := whois.ExpiresAt.Format("2006-01-02")
+				changes = append(changes, ChangeEvent(asset, EVENT_WHOIS_EXPIRY, "whois.expires_at", fmt.Sprintf("Registration for %s expires on %s", domain, expires), nil, []string{expires}))
+			}
+		}
+	}
+
+	return update, changes, nil
+}
+
+// RefreshAsset looks up the current records of a domain asset, stores the ones that changed and
+// returns the changes found. The asset is marked as refreshed either way.
+func RefreshAsset(ctx context.Context, resolver Resolver, asset Asset) ([]Event, bool, error) {
+	update, changes, err := LookupChanges(ctx, resolver, asset, func(kind string, since time.Time) (bool, error) {
+		return HasRecentEvent(*asset.ID, kind, since)
+	})
+	if err != nil {
+		return changes, false, err
+	}
+
+	now := time.Now()
+	updated := len(update) > 0
+	if updated {
+		update["updated_at"] = now
+	}
+	update["refreshed_at"] = now
+
+	o_id, err := primitive.ObjectIDFromHex(*asset.ID)
+	if err != nil {
+		return changes, false, err
+	}
+
+	res, err := MongoClient.Database("fyeo-di").Collection("assets").UpdateOne(ctx, bson.M{"_id": o_id}, bson.M{"$set": update})
+	if err != nil {
+		return changes, false, err
+	}
+
+	if res.MatchedCount < 1 {
+		return changes, false, errors.New("Unable to find the object to update")
+	}
+
+	return changes, updated, nil
+}
+
+func Refresh(ctx context.Context, resolver Resolver) (RefreshReport, error) {
+	var report RefreshReport
+
+	assets, err := GetDomainAssets()
+	if err != nil {
+		return report, err
+	}
+
+	deadline, has_deadline := ctx.Deadline()
+
+	for i, asset := range assets {
+		//stop before the lambda is killed mid lookup, the next run starts from the assets left
+		if has_deadline && time.Until(deadline) < REFRESH_MARGIN {
+			report.Remaining = int64(len(assets) - i)
+			break
+		}
+
+		report.Checked++
+
+		changes, updated, err := RefreshAsset(ctx, resolver, asset)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", *asset.ID, err.Error()))
+			continue
+		}
+
+		if updated {
+			report.Updated++
+		}
+
+		for i := range changes {
+			err := NewEvent(&changes[i])
+			if err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", *asset.ID, err.Error()))
+				continue
+			}
+			report.Events++
+		}
+	}
+
+	return report, nil
+}
+
+func Handler(ctx context.Context, event events.CloudWatchEvent) (RefreshReport, error) {
+	err := Init()
+	if err != nil {
+		return RefreshReport{}, err
+	}
+
+	report, err := Refresh(ctx, DNSResolver)
+	if err != nil {
+		return report, err
+	}
+
+	log.Printf("checked %d domain assets, updated %d, raised %d events, %d left for the next run", report.Checked, report.Updated, report.Events, report.Remaining)
+	if len(report.Errors) > 0 {
+		log.Printf("errors: %s", strings.Join(report.Errors, "; "))
+	}
+
+	return report, nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func testAsset(domain string) Asset {
+	id := "615c3a6f2f1b4e0001a1b2c3"
+	case_id := "615c3a6f2f1b4e0001a1b2c4"
+	kind := "domain"
+
+	return Asset{
+		ID:     &id,
+		CaseID: &case_id,
+		Type:   &kind,
+		Name:   &AssetName{Common: &domain},
+	}
+}
+
+func strs(values ...string) *Strings {
+	out := Strings(values)
+	return &out
+}
+
+func never(kind string, since time.Time) (bool, error) {
+	return false, nil
+}
+
+func eventTypes(changes []Event) []string {
+	var out []string
+	for _, c := range changes {
+		out = append(out, *c.Type)
+	}
+	return out
+}
+
+func TestLookupChangesFirstLookup(t *testing.T) {
+	registrar := "Example Registrar"
+	expires := time.Now().AddDate(1, 0, 0)
+
+	r := NewFakeResolver()
+	r.IPs["example.com"] = []string{"93.184.216.34"}
+	r.MX["example.com"] = []string{"mail.example.com"}
+	r.NS["example.com"] = []string{"b.iana-servers.net", "a.iana-servers.net"}
+	r.Registrations["example.com"] = &AssetWhois{Registrar: &registrar, ExpiresAt: &expires}
+
+	update, changes, err := LookupChanges(context.Background(), r, testAsset("Example.com."), never)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, field := range []string{"ips", "mx", "ns", "whois"} {
+		if _, ok := update[field]; !ok {
+			t.Errorf("update has no %s: %v", field, update)
+		}
+	}
+
+	//nothing was stored before, so nothing changed
+	if len(changes) != 0 {
+		t.Errorf("changes = %v, want none", eventTypes(changes))
+	}
+}
+
+func TestLookupChangesUnchanged(t *testing.T) {
+	registrar := "Example Registrar"
+	expires := time.Now().AddDate(1, 0, 0)
+	stored := expires.Add(400 * time.Microsecond)
+
+	asset := testAsset("example.com")
+	asset.IPs = strs("93.184.216.34", "93.184.216.35")
+	asset.Mx = strs("mail.example.com")
+	asset.Ns = strs("a.iana-servers.net", "b.iana-servers.net")
+	asset.Whois = &AssetWhois{Registrar: &registrar, ExpiresAt: &stored}
+
+	r := NewFakeResolver()
+	r.IPs["example.com"] = []string{"93.184.216.35", "93.184.216.34", "93.184.216.34"}
+	r.MX["example.com"] = []string{"mail.example.com"}
+	r.NS["example.com"] = []string{"b.iana-servers.net", "a.iana-servers.net"}
+	r.Registrations["example.com"] = &AssetWhois{Registrar: &registrar, ExpiresAt: &expires}
+
+	update, changes, err := LookupChanges(context.Background(), r, asset, never)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(update) != 0 {
+		t.Errorf("update = %v, want nothing", update)
+	}
+	if len(changes) != 0 {
+		t.Errorf("changes = %v, want none", eventTypes(changes))
+	}
+}
+
+func TestLookupChangesFailedLookup(t *testing.T) {
+	asset := testAsset("example.com")
+	asset.IPs = strs("93.184.216.34")
+	asset.Ns = strs("a.iana-servers.net")
+
+	//the fake has no records for the domain, every lookup fails
+	update, changes, err := LookupChanges(context.Background(), NewFakeResolver(), asset, never)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(update) != 0 {
+		t.Errorf("update = %v, want the stored records kept", update)
+	}
+	if len(changes) != 0 {
+		t.Errorf("changes = %v, want none", eventTypes(changes))
+	}
+}
+
+func TestLookupChangesRecordChanges(t *testing.T) {
+	old_registrar := "Old Registrar"
+	new_registrar := "New Registrar"
+	expires := time.Now().AddDate(1, 0, 0)
+
+	asset := testAsset("example.com")
+	asset.IPs = strs("93.184.216.34")
+	asset.Mx = strs("mail.example.com")
+	asset.Ns = strs("a.iana-servers.net")
+	asset.Whois = &AssetWhois{Registrar: &old_registrar, ExpiresAt: &expires}
+
+	r := NewFakeResolver()
+	r.IPs["example.com"] = []string{"203.0.113.7"}
+	r.MX["example.com"] = []string{"mx.other.net"}
+	r.NS["example.com"] = []string{"ns1.other.net"}
+	r.Registrations["example.com"] = &AssetWhois{Registrar: &new_registrar, ExpiresAt: &expires}
+
+	update, changes, err := LookupChanges(context.Background(), r, asset, never)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{EVENT_IP_CHANGE, EVENT_MX_CHANGE, EVENT_NS_CHANGE, EVENT_REGISTRAR_CHANGE}
+	got := eventTypes(changes)
+	if len(got) != len(want) {
+		t.Fatalf("changes = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("changes = %v, want %v", got, want)
+			break
+		}
+	}
+
+	ip := changes[0]
+	if *ip.Change.Field != "ips" || (*ip.Change.Previous)[0] != "93.184.216.34" || (*ip.Change.Current)[0] != "203.0.113.7" {
+		t.Errorf("ip change = %+v", *ip.Change)
+	}
+	if *ip.AssetID != *asset.ID || *ip.CaseID != *asset.CaseID || *ip.SourceType != EVENT_SOURCE_TYPE {
+		t.Errorf("ip change not raised for the asset: %+v", ip)
+	}
+	if *changes[2].ThreatLevel != 3 || *ip.ThreatLevel != 2 {
+		t.Errorf("threat levels = %d, %d", *changes[2].ThreatLevel, *ip.ThreatLevel)
+	}
+
+	for _, field := range []string{"ips", "mx", "ns", "whois"} {
+		if _, ok := update[field]; !ok {
+			t.Errorf("update has no %s: %v", field, update)
+		}
+	}
+}
+
+func TestLookupChangesExpiry(t *testing.T) {
+	registrar := "Example Registrar"
+	soon := time.Now().AddDate(0, 0, 10)
+	later := time.Now().AddDate(0, 0, 90)
+
+	tests := []struct {
+		name     string
+		expires  time.Time
+		notified bool
+		want     bool
+	}{
+		{"expiring", soon, false, true},
+		{"expiring already warned", soon, true, false},
+		{"not expiring", later, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expires := tt.expires
+
+			//the registration is unchanged, the warning still has to be raised
+			asset := testAsset("example.com")
+			asset.Whois = &AssetWhois{Registrar: &registrar, ExpiresAt: &expires}
+
+			r := NewFakeResolver()
+			r.Registrations["example.com"] = &AssetWhois{Registrar: &registrar, ExpiresAt: &expires}
+
+			var asked string
+			notified := func(kind string, since time.Time) (bool, error) {
+				asked = kind
+				return tt.notified, nil
+			}
+
+			update, changes, err := LookupChanges(context.Background(), r, asset, notified)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(update) != 0 {
+				t.Errorf("update = %v, want nothing", update)
+			}
+
+			got := len(changes) == 1 && *changes[0].Type == EVENT_WHOIS_EXPIRY
+			if got != tt.want || (!tt.want && len(changes) != 0) {
+				t.Errorf("changes = %v, want expiry warning %v", eventTypes(changes), tt.want)
+			}
+
+			if tt.expires.Equal(soon) && asked != EVENT_WHOIS_EXPIRY {
+				t.Errorf("earlier warnings not looked up, asked for %q", asked)
+			}
+		})
+	}
+}
+
+func TestLookupChangesNotifiedError(t *testing.T) {
+	soon := time.Now().AddDate(0, 0, 10)
+
+	r := NewFakeResolver()
+	r.Registrations["example.com"] = &AssetWhois{ExpiresAt: &soon}
+
+	failing := func(kind string, since time.Time) (bool, error) {
+		return false, errors.New("no database")
+	}
+
+	_, _, err := LookupChanges(context.Background(), r, testAsset("example.com"), failing)
+	if err == nil {
+		t.Error("LookupChanges gave no error")
+	}
+}
+
+func TestLookupChangesNoDomain(t *testing.T) {
+	asset := testAsset("")
+	asset.Name = nil
+
+	_, _, err := LookupChanges(context.Background(), NewFakeResolver(), asset, never)
+	if err == nil {
+		t.Error("LookupChanges gave no error for an asset without a domain")
+	}
+}
+
+func TestSameWhois(t *testing.T) {
+	registrar := "Example Registrar"
+	other := "Other Registrar"
+	expires := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	stored := expires.Add(300 * time.Microsecond)
+	moved := expires.Add(time.Hour)
+
+	tests := []struct {
+		name    string
+		stored  *AssetWhois
+		current *AssetWhois
+		want    bool
+	}{
+		{"both missing", nil, nil, true},
+		{"nothing stored", nil, &AssetWhois{}, false},
+		{"same", &AssetWhois{Registrar: &registrar, ExpiresAt: &stored}, &AssetWhois{Registrar: &registrar, ExpiresAt: &expires}, true},
+		{"registrar", &AssetWhois{Registrar: &registrar}, &AssetWhois{Registrar: &other}, false},
+		{"expiry", &AssetWhois{ExpiresAt: &expires}, &AssetWhois{ExpiresAt: &moved}, false},
+		{"nameserver order", &AssetWhois{Nameservers: strs("b.net", "a.net")}, &AssetWhois{Nameservers: strs("a.net", "b.net")}, true},
+		{"nameservers", &AssetWhois{Nameservers: strs("a.net")}, &AssetWhois{Nameservers: strs("a.net", "b.net")}, false},
+	}
+
+	for _, tt := range tests {
+		if got := SameWhois(tt.stored, tt.current); got != tt.want {
+			t.Errorf("%s: SameWhois() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	WHOIS_ROOT_SERVER = "whois.iana.org"
+	WHOIS_TIMEOUT     = 10 * time.Second
+)
+
+// Resolver looks up the DNS records and WHOIS registration of a domain.
+type Resolver interface {
+	LookupIPs(ctx context.Context, domain string) ([]string, error)
+	LookupMX(ctx context.Context, domain string) ([]string, error)
+	LookupNS(ctx context.Context, domain string) ([]string, error)
+	Whois(ctx context.Context, domain string) (*AssetWhois, error)
+}
+
+// NetResolver resolves records through the system resolver and queries WHOIS over port 43.
+type NetResolver struct {
+	DNS *net.Resolver
+}
+
+func NewNetResolver() *NetResolver {
+	return &NetResolver{DNS: net.DefaultResolver}
+}
+
+func (r *NetResolver) LookupIPs(ctx context.Context, domain string) ([]string, error) {
+	addrs, err := r.DNS.LookupIPAddr(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []string
+	for _, a := range addrs {
+		out = append(out, a.IP.String())
+	}
+
+	return SortedUnique(out), nil
+}
+
+func (r *NetResolver) LookupMX(ctx context.Context, domain string) ([]string, error) {
+	records, err := r.DNS.LookupMX(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []string
+	for _, mx := range records {
+		out = append(out, NormaliseHost(mx.Host))
+	}
+
+	return SortedUnique(out), nil
+}
+
+func (r *NetResolver) LookupNS(ctx context.Context, domain string) ([]string, error) {
+	records, err := r.DNS.LookupNS(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []string
+	for _, ns := range records {
+		out = append(out, NormaliseHost(ns.Host))
+	}
+
+	return SortedUnique(out), nil
+}
+
+func (r *NetResolver) Whois(ctx context.Context, domain string) (*AssetWhois, error) {
+	labels := strings.Split(domain, ".")
+	tld := labels[len(labels)-1]
+
+	referral, err := whoisQuery(ctx, WHOIS_ROOT_SERVER, tld)
+	if err != nil {
+		return nil, err
+	}
+
+	server := whoisField(referral, "refer", "whois")
+	if server == "" {
+		return nil, errors.New("No WHOIS server found for ." + tld)
+	}
+
+	raw, err := whoisQuery(ctx, server, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	//thin registries (e.g .com) only hold the registrar's server, the registrar has the full record
+	registrar_server := whoisField(raw, "registrar whois server")
+	if registrar_server != "" && registrar_server != server {
+		full, err := whoisQuery(ctx, registrar_server, domain)
+		if err == nil {
+			raw = full
+		}
+	}
+
+	return ParseWhois(domain, raw), nil
+}
+
+func whoisQuery(ctx context.Context, server string, query string) (string, error) {
+	dialer := net.Dialer{Timeout: WHOIS_TIMEOUT}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(server, "43"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(WHOIS_TIMEOUT))
+
+	_, err = fmt.Fprintf(conn, "%s\r\n", query)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		sb.WriteString(scanner.Text())
+		sb.WriteString("\n")
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	return sb.String(), nil
+}
+
+// whoisField returns the first value found for any of the given keys.
+func whoisField(raw string, keys ...string) string {
+	values := whoisFields(raw, keys...)
+	if len(values) < 1 {
+		return ""
+	}
+
+	return values[0]
+}
+
+func whoisFields(raw string, keys ...string) []string {
+	var out []string
+
+	for _, line := range strings.Split(raw, "\n") {
+		i := strings.Index(line, ":")
+		if i < 1 {
+			continue
+		}
+
+		key := strings.ToLower(strings.TrimSpace(line[:i]))
+		value := strings.TrimSpace(line[i+1:])
+		if value == "" {
+			continue
+		}
+
+		for _, k := range keys {
+			if key == k {
+				out = append(out, value)
+				break
+			}
+		}
+	}
+
+	return out
+}
+
+var whoisDateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05Z0700",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+	"02-Jan-2006",
+	"2006.01.02",
+}
+
+func parseWhoisDate(value string) *time.Time {
+	if value == "" {
+		return nil
+	}
+
+	//some registries append the timezone name, e.g "2021-01-01 00:00:00 CLST"
+	fields := strings.Fields(value)
+	candidates := []string{value}
+	if len(fields) > 1 {
+		candidates = append(candidates, strings.Join(fields[:2], " "), fields[0])
+	}
+
+	for _, c := range candidates {
+		for _, layout := range whoisDateLayouts {
+			t, err := time.Parse(layout, c)
+			if err == nil {
+				t = t.UTC()
+				return &t
+			}
+		}
+	}
+
+	return nil
+}
+
+// ParseWhois extracts the registration details from a raw WHOIS response.
+func ParseWhois(domain string, raw string) *AssetWhois {
+	out := AssetWhois{
+		Domain: &domain,
+	}
+
+	registrar := whoisField(raw, "registrar", "sponsoring registrar", "registrar name")
+	if registrar != "" {
+		out.Registrar = &registrar
+	}
+
+	registrant := whoisField(raw, "registrant organization", "registrant", "registrant name")
+	if registrant != "" {
+		out.Registrant = &registrant
+	}
+
+	status := whoisField(raw, "domain status", "status")
+	if status != "" {
+		//strip the ICANN reference url
+		status = strings.Fields(status)[0]
+		out.Status = &status
+	}
+
+	out.CreatedAt = parseWhoisDate(whoisField(raw, "creation date", "created", "registered on", "registration time"))
+	out.UpdatedAt = parseWhoisDate(whoisField(raw, "updated date", "last updated", "last-update", "changed"))
+	out.ExpiresAt = parseWhoisDate(whoisField(raw, "registry expiry date", "registrar registration expiration date", "expiration date", "expiry date", "expires", "paid-till"))
+
+	var ns []string
+	for _, n := range whoisFields(raw, "name server", "nserver", "nameserver", "name servers") {
+		ns = append(ns, NormaliseHost(strings.Fields(n)[0]))
+	}
+
+	if len(ns) > 0 {
+		nameservers := Strings(SortedUnique(ns))
+		out.Nameservers = &nameservers
+	}
+
+	return &out
+}
+
+// FakeResolver serves fixed records so the refresh job can run without network access.
+type FakeResolver struct {
+	IPs           map[string][]string    `json:"ips"`
+	MX            map[string][]string    `json:"mx"`
+	NS            map[string][]string    `json:"ns"`
+	Registrations map[string]*AssetWhois `json:"whois"`
+}
+
+func NewFakeResolver() *FakeResolver {
+	return &FakeResolver{
+		IPs:           make(map[string][]string),
+		MX:            make(map[string][]string),
+		NS:            make(map[string][]string),
+		Registrations: make(map[string]*AssetWhois),
+	}
+}
+
+// LoadFakeResolver reads the fake records from a JSON fixture file.
+func LoadFakeResolver(path string) (*FakeResolver, error) {
+	out := NewFakeResolver()
+
+	if path == "" {
+		return out, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return out, err
+	}
+
+	err = json.Unmarshal(b, out)
+	if err != nil {
+		return out, err
+	}
+
+	return out, nil
+}
+
+func (r *FakeResolver) LookupIPs(ctx context.Context, domain string) ([]string, error) {
+	return fakeRecords(r.IPs, domain)
+}
+
+func (r *FakeResolver) LookupMX(ctx context.Context, domain string) ([]string, error) {
+	return fakeRecords(r.MX, domain)
+}
+
+func (r *FakeResolver) LookupNS(ctx context.Context, domain string) ([]string, error) {
+	return fakeRecords(r.NS, domain)
+}
+
+func (r *FakeResolver) Whois(ctx context.Context, domain string) (*AssetWhois, error) {
+	w, ok := r.Registrations[domain]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: domain, IsNotFound: true}
+	}
+
+	return w, nil
+}
+
+func fakeRecords(records map[string][]string, domain string) ([]string, error) {
+	out, ok := records[domain]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: domain, IsNotFound: true}
+	}
+
+	return SortedUnique(out), nil
+}
+
+func NormaliseHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+}
+
+func SortedUnique(input []string) []string {
+	seen := make(map[string]bool)
+	var out []string
+
+	for _, s := range input {
+		if s == "" || seen[s] {
+			continue
+		}
+		seen[s] = true
+		out = append(out, s)
+	}
+
+	sort.Strings(out)
+
+	return out
+}
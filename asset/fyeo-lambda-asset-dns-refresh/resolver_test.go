@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadFakeResolver(t *testing.T) {
+	fixture := `{
+		"ips": {"example.com": ["93.184.216.34", "93.184.216.34"]},
+		"ns": {"example.com": ["b.iana-servers.net", "a.iana-servers.net"]},
+		"whois": {"example.com": {"registrar": "Example Registrar", "expires_at": "2022-08-13T04:00:00Z"}}
+	}`
+
+	path := filepath.Join(t.TempDir(), "fixtures.json")
+	err := ioutil.WriteFile(path, []byte(fixture), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := LoadFakeResolver(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+
+	ips, err := r.LookupIPs(ctx, "example.com")
+	if err != nil || len(ips) != 1 || ips[0] != "93.184.216.34" {
+		t.Errorf("LookupIPs() = %v, %v", ips, err)
+	}
+
+	ns, err := r.LookupNS(ctx, "example.com")
+	if err != nil || len(ns) != 2 || ns[0] != "a.iana-servers.net" {
+		t.Errorf("LookupNS() = %v, %v", ns, err)
+	}
+
+	//no mx in the fixture, a failed lookup and not an empty record set
+	_, err = r.LookupMX(ctx, "example.com")
+	if dns_err, ok := err.(*net.DNSError); !ok || !dns_err.IsNotFound {
+		t.Errorf("LookupMX() error = %v, want not found", err)
+	}
+
+	w, err := r.Whois(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Registrar == nil || *w.Registrar != "Example Registrar" {
+		t.Errorf("Whois() registrar = %v", w.Registrar)
+	}
+	if w.ExpiresAt == nil || !w.ExpiresAt.Equal(time.Date(2022, 8, 13, 4, 0, 0, 0, time.UTC)) {
+		t.Errorf("Whois() expires_at = %v", w.ExpiresAt)
+	}
+
+	_, err = r.Whois(ctx, "example.org")
+	if err == nil {
+		t.Error("Whois() of an unknown domain gave no error")
+	}
+}
+
+func TestLoadFakeResolverEmpty(t *testing.T) {
+	r, err := LoadFakeResolver("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = r.LookupIPs(context.Background(), "example.com")
+	if err == nil {
+		t.Error("LookupIPs() gave no error without fixtures")
+	}
+}
+
+func TestParseWhois(t *testing.T) {
+	raw := `Domain Name: EXAMPLE.COM
+Registry Domain ID: 2336799_DOMAIN_COM-VRSN
+Registrar WHOIS Server: whois.iana.org
+Updated Date: 2021-08-14T07:01:44Z
+Creation Date: 1995-08-14T04:00:00Z
+Registry Expiry Date: 2022-08-13T04:00:00Z
+Registrar: RESERVED-Internet Assigned Numbers Authority
+Domain Status: clientDeleteProhibited https://icann.org/epp#clientDeleteProhibited
+Name Server: B.IANA-SERVERS.NET
+Name Server: A.IANA-SERVERS.NET.
+`
+
+	w := ParseWhois("example.com", raw)
+
+	if w.Registrar == nil || *w.Registrar != "RESERVED-Internet Assigned Numbers Authority" {
+		t.Errorf("registrar = %v", w.Registrar)
+	}
+	if w.Status == nil || *w.Status != "clientDeleteProhibited" {
+		t.Errorf("status = %v", w.Status)
+	}
+	if w.CreatedAt == nil || !w.CreatedAt.Equal(time.Date(1995, 8, 14, 4, 0, 0, 0, time.UTC)) {
+		t.Errorf("created_at = %v", w.CreatedAt)
+	}
+	if w.ExpiresAt == nil || !w.ExpiresAt.Equal(time.Date(2022, 8, 13, 4, 0, 0, 0, time.UTC)) {
+		t.Errorf("expires_at = %v", w.ExpiresAt)
+	}
+	if w.Nameservers == nil || len(*w.Nameservers) != 2 || (*w.Nameservers)[0] != "a.iana-servers.net" {
+		t.Errorf("nameservers = %v", w.Nameservers)
+	}
+}
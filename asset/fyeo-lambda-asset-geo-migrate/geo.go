@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// GeoPoint is a GeoJSON point. Coordinates are ordered [lng, lat] as GeoJSON requires.
+type GeoPoint struct {
+	Type        *string   `json:"type,omitempty" bson:"type,omitempty"`
+	Coordinates []float64 `json:"coordinates,omitempty" bson:"coordinates,omitempty"`
+}
+
+func NewGeoPoint(lat float64, lng float64) (*GeoPoint, error) {
+	if lat < -90 || lat > 90 {
+		return nil, errors.New(fmt.Sprintf("Invalid latitude: %v", lat))
+	}
+
+	if lng < -180 || lng > 180 {
+		return nil, errors.New(fmt.Sprintf("Invalid longitude: %v", lng))
+	}
+
+	t := "Point"
+	return &GeoPoint{Type: &t, Coordinates: []float64{lng, lat}}, nil
+}
+
+// SetAssetGeo fills location.geo from the lat/lng pair so located assets can be queried spatially.
+func SetAssetGeo(data *Asset) error {
+	if data.Location == nil {
+		return nil
+	}
+
+	data.Location.Geo = nil
+
+	if data.Location.Lat == nil && data.Location.Lng == nil {
+		return nil
+	}
+
+	if data.Location.Lat == nil || data.Location.Lng == nil {
+		return errors.New("Location must contain both lat and lng")
+	}
+
+	geo, err := NewGeoPoint(*data.Location.Lat, *data.Location.Lng)
+	if err != nil {
+		return err
+	}
+
+	data.Location.Geo = geo
+
+	return nil
+}
+
+// EnsureGeoIndex is run by the geo migrate job, asset writes rely on the index being there.
+func EnsureGeoIndex() error {
+	_, err := MongoClient.Database("fyeo-di").Collection("assets").Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{Key: "location.geo", Value: "2dsphere"}},
+	})
+
+	return err
+}
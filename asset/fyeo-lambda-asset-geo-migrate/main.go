@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	BATCH_SIZE = 500
+)
+
+var (
+	MongoClient *mongo.Client
+)
+
+type AssetLocation struct {
+	Lat *float64  `json:"lat,omitempty" bson:"lat,omitempty"`
+	Lng *float64  `json:"lng,omitempty" bson:"lng,omitempty"`
+	Geo *GeoPoint `json:"geo,omitempty" bson:"geo,omitempty"`
+}
+
+type Asset struct {
+	ID       *string        `json:"id,omitempty" bson:"_id,omitempty"`
+	Location *AssetLocation `json:"location,omitempty" bson:"location,omitempty"`
+}
+
+type MigrateReport struct {
+	Checked  int64    `json:"checked"`
+	Migrated int64    `json:"migrated"`
+	Invalid  int64    `json:"invalid"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+func main() {
+	lambda.Start(Handler)
+}
+
+func Init() error {
+	var err error
+
+	err = ReuseMongo()
+	if err != nil {
+		return err
+	}
+
+	return err
+}
+
+func UrlEncoded(str string) (string, error) {
+	u, err := url.Parse(str)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+func ReuseMongo() error {
+
+	if MongoClient != nil {
+		return nil
+	} else {
+		var err error
+		username := "stage"
+		password := "GK!2f&Wf#z&RS3"
+
+		password, err = UrlEncoded(password)
+		if err != nil {
+			return err
+		}
+
+		ctx := context.Background()
+
+		MongoClient, err = mongo.Connect(ctx, options.Client().ApplyURI(fmt.Sprintf("mongodb://%s:%s@192.168.0.17:27017/?authSource=admin&ssl=false", username, password)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func WriteBatch(ctx context.Context, models []mongo.WriteModel) (int64, error) {
+	if len(models) == 0 {
+		return 0, nil
+	}
+
+	res, err := MongoClient.Database("fyeo-di").Collection("assets").BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return 0, err
+	}
+
+	return res.ModifiedCount, nil
+}
+
+// Migrate sets location.geo on every asset that has a lat/lng pair but no GeoJSON point yet.
+// It only touches assets missing the point, so it is safe to run again.
+func Migrate(ctx context.Context) (MigrateReport, error) {
+	var report MigrateReport
+
+	err := EnsureGeoIndex()
+	if err != nil {
+		return report, err
+	}
+
+	filter := bson.M{
+		"location.lat": bson.M{"$exists": true},
+		"location.lng": bson.M{"$exists": true},
+		"location.geo": bson.M{"$exists": false},
+	}
+	projection := bson.M{"_id": 1, "location.lat": 1, "location.lng": 1}
+
+	cur, err := MongoClient.Database("fyeo-di").Collection("assets").Find(ctx, filter, options.Find().SetProjection(projection))
+	if err != nil {
+		return report, err
+	}
+	defer cur.Close(ctx)
+
+	var models []mongo.WriteModel
+	for cur.Next(ctx) {
+		var doc bson.M
+		err := cur.Decode(&doc)
+		if err != nil {
+			return report, err
+		}
+
+		report.Checked++
+
+		var asset Asset
+		err = cur.Decode(&asset)
+		if err != nil {
+			report.Invalid++
+			report.Errors = append(report.Errors, fmt.Sprintf("%v: %s", doc["_id"], err.Error()))
+			continue
+		}
+
+		err = SetAssetGeo(&asset)
+		if err != nil {
+			report.Invalid++
+			report.Errors = append(report.Errors, fmt.Sprintf("%v: %s", doc["_id"], err.Error()))
+			continue
+		}
+
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": doc["_id"]}).
+			SetUpdate(bson.M{"$set": bson.M{"location.geo": asset.Location.Geo}}))
+
+		if len(models) >= BATCH_SIZE {
+			n, err := WriteBatch(ctx, models)
+			if err != nil {
+				return report, err
+			}
+			report.Migrated += n
+			models = nil
+		}
+	}
+
+	if cur.Err() != nil {
+		return report, cur.Err()
+	}
+
+	n, err := WriteBatch(ctx, models)
+	if err != nil {
+		return report, err
+	}
+	report.Migrated += n
+
+	return report, nil
+}
+
+func Handler(ctx context.Context, event events.CloudWatchEvent) (MigrateReport, error) {
+	err := Init()
+	if err != nil {
+		return MigrateReport{}, err
+	}
+
+	report, err := Migrate(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	log.Printf("checked %d located assets, migrated %d, %d invalid", report.Checked, report.Migrated, report.Invalid)
+	if len(report.Errors) > 0 {
+		log.Printf("errors: %s", strings.Join(report.Errors, "; "))
+	}
+
+	return report, nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// NormaliseIP returns the canonical form of an IP address or CIDR range.
+// IPv4-mapped IPv6 addresses are written as IPv4 and host bits are cleared from ranges.
+func NormaliseIP(input string) (string, error) {
+	input = strings.TrimSpace(input)
+	if input == "" {
+		return "", errors.New("Empty IP address")
+	}
+
+	if !strings.Contains(input, "/") {
+		ip := net.ParseIP(input)
+		if ip == nil {
+			return "", errors.New("Invalid IP address: " + input)
+		}
+
+		return ip.String(), nil
+	}
+
+	ip, ipnet, err := net.ParseCIDR(input)
+	if err != nil {
+		return "", errors.New("Invalid CIDR range: " + input)
+	}
+
+	ones, bits := ipnet.Mask.Size()
+	network := ip.Mask(ipnet.Mask)
+
+	if bits == 8*net.IPv6len && ip.To4() != nil {
+		if ones < 96 {
+			//wider than the IPv4-mapped block, it has to stay an IPv6 range
+			return network.To16().String() + "/" + strconv.Itoa(ones), nil
+		}
+		ones -= 96
+	}
+
+	if network.To4() != nil {
+		network = network.To4()
+	}
+
+	return network.String() + "/" + strconv.Itoa(ones), nil
+}
+
+// NormaliseIPs normalises a list of addresses and ranges, dropping duplicates.
+func NormaliseIPs(input []string) ([]string, error) {
+	var out []string
+	seen := make(map[string]bool)
+
+	for _, s := range input {
+		n, err := NormaliseIP(s)
+		if err != nil {
+			return out, err
+		}
+
+		if seen[n] {
+			continue
+		}
+
+		seen[n] = true
+		out = append(out, n)
+	}
+
+	return out, nil
+}
+
+// NormaliseASN returns an AS number in the "AS1234" form.
+func NormaliseASN(input string) (string, error) {
+	s := strings.ToUpper(strings.TrimSpace(input))
+	s = strings.TrimPrefix(s, "AS")
+
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return "", errors.New("Invalid AS number: " + input)
+	}
+
+	return "AS" + strconv.FormatUint(n, 10), nil
+}
+
+// Prefix is an address or range held as 16 bytes so IPv4 and IPv6 share one trie.
+type Prefix struct {
+	IP   net.IP
+	Bits int
+}
+
+func ParsePrefix(input string) (Prefix, error) {
+	n, err := NormaliseIP(input)
+	if err != nil {
+		return Prefix{}, err
+	}
+
+	if !strings.Contains(n, "/") {
+		ip := net.ParseIP(n).To16()
+		return Prefix{IP: ip, Bits: 128}, nil
+	}
+
+	_, ipnet, err := net.ParseCIDR(n)
+	if err != nil {
+		return Prefix{}, err
+	}
+
+	ones, bits := ipnet.Mask.Size()
+	if bits == 8*net.IPv4len {
+		ones += 96
+	}
+
+	return Prefix{IP: ipnet.IP.To16(), Bits: ones}, nil
+}
+
+func (p Prefix) bit(i int) int {
+	return int(p.IP[i/8]>>(7-uint(i%8))) & 1
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	values   []string
+}
+
+// PrefixTrie is a binary trie of address ranges. Finding every range that contains
+// an address walks at most 128 nodes regardless of how many ranges are stored.
+type PrefixTrie struct {
+	root *trieNode
+	size int
+}
+
+func NewPrefixTrie() *PrefixTrie {
+	return &PrefixTrie{root: &trieNode{}}
+}
+
+func (t *PrefixTrie) Len() int {
+	return t.size
+}
+
+// Insert stores a value against an address or CIDR range.
+func (t *PrefixTrie) Insert(input string, value string) error {
+	p, err := ParsePrefix(input)
+	if err != nil {
+		return err
+	}
+
+	node := t.root
+	for i := 0; i < p.Bits; i++ {
+		b := p.bit(i)
+		if node.children[b] == nil {
+			node.children[b] = &trieNode{}
+		}
+		node = node.children[b]
+	}
+
+	node.values = append(node.values, value)
+	t.size++
+
+	return nil
+}
+
+// Containing returns the values of every stored range that contains the given address or range.
+func (t *PrefixTrie) Containing(input string) ([]string, error) {
+	p, err := ParsePrefix(input)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []string
+	seen := make(map[string]bool)
+
+	node := t.root
+	for i := 0; node != nil; i++ {
+		for _, v := range node.values {
+			if !seen[v] {
+				seen[v] = true
+				out = append(out, v)
+			}
+		}
+
+		if i >= p.Bits {
+			break
+		}
+
+		node = node.children[p.bit(i)]
+	}
+
+	return out, nil
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	gMap        = make(map[string]bool)
+	groups      []string
+	MongoClient *mongo.Client
+
+	defaultHeaders = map[string]string{
+		"Content-Type":                 "application/json",
+		"Access-Control-Allow-Headers": "*",
+		"Access-Control-Allow-Origin":  "*",
+		"Access-Control-Allow-Methods": "GET, OPTIONS, POST",
+		"Allow":                        "GET, OPTIONS, POST",
+	}
+)
+
+type Strings []string
+
+type Case struct {
+	ID           *string  `json:"id,omitempty" bson:"_id,omitempty"`
+	Name         *string  `json:"name,omitempty" bson:"name,omitempty"`
+	Evidence     *bool    `json:"evidence,omitempty" bson:"evidence,omitempty"` //not sure what this is for?
+	Emails       *Strings `json:"emails,omitempty" bson:"emails,omitempty"`
+	AlertLevel   *int64   `json:"alert_level,omitempty" bson:"alert_level,omitempty"`
+	Group        *string  `json:"group,omitempty" bson:"group,omitempty"`
+	ShouldNotify *bool    `json:"should_notify,omitempty" bson:"should_notify,omitempty"`
+}
+
+type AssetNetloc struct {
+	Cidr     *string `json:"cidr,omitempty" bson:"cidr,omitempty"`
+	AsNumber *string `json:"as_number,omitempty" bson:"as_number,omitempty"`
+}
+
+type AssetWhois struct {
+	Domain      *string    `json:"domain,omitempty" bson:"domain,omitempty"`
+	CreatedAt   *time.Time `json:"created_at,omitempty" bson:"created_at,omitempty"`
+	UpdatedAt   *time.Time `json:"updated_at,omitempty" bson:"updated_at,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
+	Registrar   *string    `json:"registrar,omitempty" bson:"registrar,omitempty"`
+	Registrant  *string    `json:"registrant,omitempty" bson:"registrant,omitempty"`
+	Nameservers *Strings   `json:"nameservers,omitempty" bson:"names_servers,omitempty"`
+	Status      *string    `json:"status,omitempty" bson:"status,omitempty"`
+}
+
+type AssetLocation struct {
+	StreetNumber *int64   `json:"street_number,omitempty" bson:"street_number,omitempty"`
+	PostalTown   *string  `json:"postal_town,omitempty" bson:"postal_town,omitempty"`
+	Country      *string  `json:"country,omitempty" bson:"country,omitempty"`
+	StreetName   *string  `json:"street_name,omitempty" bson:"street_name,omitempty"`
+	Premise      *string  `json:"premise,omitempty" bson:"premise,omitempty"`
+	Lat          *float64 `json:"lat,omitempty" bson:"lat,omitempty"`
+	Lng          *float64 `json:"lng,omitempty" bson:"lng,omitempty"`
+}
+
+type AssetName struct {
+	Common *string `json:"common,omitempty" bson:"common,omitempty"`
+	First  *string `json:"first,omitempty" bson:"first,omitempty"`
+	Last   *string `json:"last,omitempty" bson:"last,omitempty"`
+	Middle *string `json:"middle,omitempty" bson:"middle,omitempty"`
+	Nick   *string `json:"nick,omitempty" bson:"nick,omitempty"`
+}
+
+type AssetOrganization struct {
+	Role *string `json:"role,omitempty" bson:"role,omitempty"`
+	Name *string `json:"name,omitempty" bson:"name,omitempty"`
+}
+
+type Asset struct {
+	CaseName          *string      `json:"case_name,omitempty" bson:"-"`
+	ID                *string      `json:"id,omitempty" bson:"_id,omitempty"`
+	CaseID            *string      `json:"case_id,omitempty" bson:"case_id,omitempty"`
+	SocialMedia       []*TagPair   `json:"social_media,omitempty" bson:"social_media,omitempty"`
+	IPs               *Strings     `json:"ips,omitempty" bson:"ips,omitempty"`
+	Name              *AssetName   `json:"name,omitempty" bson:"name,omitempty"`
+	Netloc            *AssetNetloc `json:"netloc,omitempty" bson:"netloc,omitempty"`
+	CreatedAt         *time.Time   `json:"created_at,omitempty" bson:"created_at,omitempty"`
+	DumpSearchedAt    *time.Time   `json:"dump_searched_at,omitempty" bson:"dump_searched_at,omitempty"`
+	SimilarSearchedAt *time.Time   `json:"similar_searched_at,omitempty" bson:"similar_searched_at,omitempty"`
+	UpdatedAt         *time.Time   `json:"updated_at,omitempty" bson:"updated_at,omitempty"`
+	IndexCount        *int64       `json:"index_count,omitempty" bson:"index_count,omitempty"`
+	SearchedAt        *time.Time   `json:"searched_at,omitempty" bson:"searched_at,omitempty"`
+	IconURL           *string      `json:"icon_url,omitempty" bson:"icon_url,omitempty"`
+
+	RequiredScore   *float64           `json:"required_score,omitempty" bson:"required_score,omitempty"`
+	Type            *string            `json:"type,omitempty" bson:"type,omitempty"`
+	IsActive        *bool              `json:"is_active,omitempty" bson:"is_active,omitempty"`
+	IsThreatActor   *bool              `json:"is_threat_actor,omitempty" bson:"is_threat_actor,omitempty"`
+	Location        *AssetLocation     `json:"location,omitempty" bson:"location,omitempty"`
+	Organization    *AssetOrganization `json:"organization,omitempty" bson:"organization,omitempty"`
+	Emails          []*TagPair         `json:"emails,omitempty" bson:"emails,omitempty"`
+	PhoneNumbers    []*TagPair         `json:"phone_numbers,omitempty" bson:"phone_numbers,omitempty"`
+	WalletAddresses []*TagPair         `json:"wallet_addresses,omitempty" bson:"wallet_addresses,omitempty"`
+	Urls            *Strings           `json:"urls,omitempty" bson:"urls,omitempty"`
+
+	//domain
+	Whois *AssetWhois `json:"whois,omitempty" bson:"whois,omitempty"`
+	Mx    *Strings    `json:"mx,omitempty" bson:"mx,omitempty"`
+	Ns    *Strings    `json:"ns,omitempty" bson:"ns,omitempty"`
+
+	//person
+	Brands *Strings `json:"brands,omitempty" bson:"brands,omitempty"`
+
+	IncidentCount *int64 `json:"incident_count,omitempty" bson:"-"`
+}
+
+type TagPair struct {
+	Tag   *string `json:"tag,omitempty" bson:"tag,omitempty"`
+	Value *string `json:"value,omitempty" bson:"value,omitempty"`
+}
+
+type ErrorResponse struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+func ServeError(message string, code int) events.APIGatewayProxyResponse {
+	js, _ := json.Marshal(ErrorResponse{
+		Code:    code,
+		Message: message,
+	})
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: code,
+		Body:       string(js),
+		Headers:    defaultHeaders,
+	}
+}
+
+func main() {
+	lambda.Start(Handler)
+}
+
+func Init() error {
+	var err error
+
+	err = ReuseMongo()
+	if err != nil {
+		return err
+	}
+
+	return err
+}
+
+func UrlEncoded(str string) (string, error) {
+	u, err := url.Parse(str)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+func ReuseMongo() error {
+
+	if MongoClient != nil {
+		return nil
+	} else {
+		var err error
+		username := "stage"
+		password := "GK!2f&Wf#z&RS3"
+
+		password, err = UrlEncoded(password)
+		if err != nil {
+			return err
+		}
+
+		ctx := context.Background()
+
+		MongoClient, err = mongo.Connect(ctx, options.Client().ApplyURI(fmt.Sprintf("mongodb://%s:%s@192.168.0.17:27017/?authSource=admin&ssl=false", username, password)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func GetCases(filter bson.M) ([]Case, error) {
+	var out []Case
+
+	filter["is_archived"] = bson.M{"$ne": true}
+
+	res, err := MongoClient.Database("fyeo-di").Collection("cases").Find(context.Background(), filter)
+
+	if err != nil {
+		return out, err
+	}
+
+	for res.Next(context.Background()) {
+		var doc Case
+		err := res.Decode(&doc)
+		if err != nil {
+			return out, err
+		}
+		out = append(out, doc)
+	}
+
+	return out, nil
+}
+
+func CasePermissions(input Case) bool {
+	if input.Group != nil {
+		_, ok := gMap[*input.Group]
+		return ok
+	}
+
+	return false
+}
+
+func VerifyRequest(request events.APIGatewayProxyRequest) error {
+
+	claims := request.RequestContext.Authorizer["claims"]
+	if claims == nil {
+		return errors.New("No claims found for " + request.RequestContext.Identity.CognitoIdentityID)
+	}
+
+	rg := claims.(map[string]interface{})["cognito:groups"]
+
+	if rg == nil {
+		return errors.New("No group permissions set")
+	}
+
+	groups = strings.Split(rg.(string), ",")
+
+	//warm containers keep gMap, start from nothing for every caller
+	gMap = make(map[string]bool)
+	for _, g := range groups {
+		gMap[g] = true
+	}
+
+	return nil
+}
+
+type EventIPs struct {
+	ID         *string  `json:"id,omitempty" bson:"_id,omitempty"`
+	CaseID     *string  `json:"case_id,omitempty" bson:"case_id,omitempty"`
+	LegacyCase *string  `json:"-" bson:"caseId,omitempty"`
+	IPs        *Strings `json:"ips,omitempty" bson:"ips,omitempty"`
+	LegacyIP   *Strings `json:"-" bson:"ip,omitempty"`
+}
+
+type LookupResult struct {
+	Query  string   `json:"query"`
+	Assets []*Asset `json:"assets"`
+}
+
+func GetEventIPs(id string) (EventIPs, error) {
+	var out EventIPs
+	o_id, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return out, err
+	}
+
+	filter := bson.M{"_id": o_id, "is_archived": bson.M{"$ne": true}}
+
+	res := MongoClient.Database("fyeo-di").Collection("events").FindOne(context.Background(), filter, options.FindOne().SetProjection(bson.M{"_id": 1, "case_id": 1, "caseId": 1, "ips": 1, "ip": 1}))
+	if res.Err() != nil {
+		return out, res.Err()
+	}
+
+	err = res.Decode(&out)
+	if err != nil {
+		return out, err
+	}
+
+	if out.CaseID == nil {
+		out.CaseID = out.LegacyCase
+	}
+
+	//events moved to the current shape may still hold addresses under the legacy key
+	if out.LegacyIP != nil {
+		var merged Strings
+		seen := make(map[string]bool)
+		for _, list := range []*Strings{out.IPs, out.LegacyIP} {
+			if list == nil {
+				continue
+			}
+			for _, ip := range *list {
+				if !seen[ip] {
+					seen[ip] = true
+					merged = append(merged, ip)
+				}
+			}
+		}
+		out.IPs = &merged
+	}
+
+	return out, nil
+}
+
+// GetNetworkAssets returns the assets of the given cases which hold IP addresses or a CIDR range.
+func GetNetworkAssets(case_ids []string) ([]Asset, error) {
+	var out []Asset
+
+	filter := bson.M{
+		"case_id":     bson.M{"$in": case_ids},
+		"is_archived": bson.M{"$ne": true},
+		"$or": []bson.M{
+			{"ips.0": bson.M{"$exists": true}},
+			{"netloc.cidr": bson.M{"$exists": true}},
+		},
+	}
+
+	res, err := MongoClient.Database("fyeo-di").Collection("assets").Find(context.Background(), filter)
+	if err != nil {
+		return out, err
+	}
+
+	for res.Next(context.Background()) {
+		var doc Asset
+		err := res.Decode(&doc)
+		if err != nil {
+			return out, err
+		}
+		out = append(out, doc)
+	}
+
+	return out, nil
+}
+
+// BuildAssetTrie indexes every IP and CIDR range of the assets by asset ID.
+// Stored values which fail to parse are skipped so one bad asset does not break the lookup.
+func BuildAssetTrie(assets []Asset) *PrefixTrie {
+	trie := NewPrefixTrie()
+
+	for _, a := range assets {
+		if a.ID == nil {
+			continue
+		}
+
+		if a.IPs != nil {
+			for _, ip := range *a.IPs {
+				trie.Insert(ip, *a.ID)
+			}
+		}
+
+		if a.Netloc != nil && a.Netloc.Cidr != nil {
+			trie.Insert(*a.Netloc.Cidr, *a.ID)
+		}
+	}
+
+	return trie
+}
+
+func LookupIPs(trie *PrefixTrie, asset_map map[string]*Asset, queries []string) ([]LookupResult, error) {
+	var out []LookupResult
+
+	for _, q := range queries {
+		n, err := NormaliseIP(q)
+		if err != nil {
+			return out, err
+		}
+
+		ids, err := trie.Containing(n)
+		if err != nil {
+			return out, err
+		}
+
+		result := LookupResult{Query: n, Assets: []*Asset{}}
+		for _, id := range ids {
+			result.Assets = append(result.Assets, asset_map[id])
+		}
+
+		out = append(out, result)
+	}
+
+	return out, nil
+}
+
+func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var err error
+
+	err = VerifyRequest(request)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	err = Init()
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	cases, err := GetCases(bson.M{"group": bson.M{"$in": groups}})
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	if len(cases) < 1 {
+		return ServeError("No cases found with provided group permissions", 400), nil
+	}
+
+	case_map := make(map[string]Case)
+	var case_ids []string
+	for _, c := range cases {
+		case_map[*c.ID] = c
+		case_ids = append(case_ids, *c.ID)
+	}
+
+	var queries []string
+
+	q_ip, ok := request.QueryStringParameters["ip"]
+	if ok {
+		for _, ip := range strings.Split(q_ip, ",") {
+			if strings.TrimSpace(ip) != "" {
+				queries = append(queries, ip)
+			}
+		}
+	}
+
+	q_event, ok := request.QueryStringParameters["event_id"]
+	if ok {
+		event, err := GetEventIPs(q_event)
+		if err != nil {
+			return ServeError(err.Error(), 400), nil
+		}
+
+		if event.CaseID == nil {
+			js, _ := json.Marshal(event)
+			return ServeError(fmt.Sprintf("No case ID found for object: %s", string(js)), 400), nil
+		}
+
+		_, ok := case_map[*event.CaseID]
+		if !ok {
+			return ServeError("Unable to verify case group permissions", 400), nil
+		}
+
+		if event.IPs != nil {
+			for _, ip := range *event.IPs {
+				//matchers store whatever looked like an address, only keep the ones that parse
+				if _, err := NormaliseIP(ip); err == nil {
+					queries = append(queries, ip)
+				}
+			}
+		}
+	}
+
+	if len(queries) < 1 && q_event == "" {
+		return ServeError("No IP address or event ID provided", 400), nil
+	}
+
+	assets, err := GetNetworkAssets(case_ids)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	asset_map := make(map[string]*Asset)
+	for i := range assets {
+		assets[i].CaseName = case_map[*assets[i].CaseID].Name
+		asset_map[*assets[i].ID] = &assets[i]
+	}
+
+	trie := BuildAssetTrie(assets)
+
+	out, err := LookupIPs(trie, asset_map, queries)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	if out == nil {
+		out = []LookupResult{}
+	}
+
+	js, err := json.Marshal(out)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		Body:       string(js),
+		StatusCode: 200,
+		Headers:    defaultHeaders,
+	}, nil
+}
@@ -0,0 +1,8 @@
+module fyeo-lambda-asset-lookalikes-migrate
+
+go 1.16
+
+require (
+	github.com/aws/aws-lambda-go v1.26.0
+	go.mongodb.org/mongo-driver v1.7.1
+)
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	MongoClient *mongo.Client
+)
+
+type Strings []string
+
+type AssetWhois struct {
+	Domain *string `json:"domain,omitempty" bson:"domain,omitempty"`
+}
+
+type AssetName struct {
+	Common *string `json:"common,omitempty" bson:"common,omitempty"`
+}
+
+type Asset struct {
+	ID     *string     `json:"id,omitempty" bson:"_id,omitempty"`
+	CaseID *string     `json:"case_id,omitempty" bson:"case_id,omitempty"`
+	Type   *string     `json:"type,omitempty" bson:"type,omitempty"`
+	Name   *AssetName  `json:"name,omitempty" bson:"name,omitempty"`
+	Whois  *AssetWhois `json:"whois,omitempty" bson:"whois,omitempty"`
+}
+
+type MigrateReport struct {
+	Checked   int64    `json:"checked"`
+	Generated int64    `json:"generated"`
+	Errors    []string `json:"errors,omitempty"`
+}
+
+func main() {
+	lambda.Start(Handler)
+}
+
+func Init() error {
+	var err error
+
+	err = ReuseMongo()
+	if err != nil {
+		return err
+	}
+
+	return err
+}
+
+func UrlEncoded(str string) (string, error) {
+	u, err := url.Parse(str)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+func ReuseMongo() error {
+
+	if MongoClient != nil {
+		return nil
+	} else {
+		var err error
+		username := "stage"
+		password := "GK!2f&Wf#z&RS3"
+
+		password, err = UrlEncoded(password)
+		if err != nil {
+			return err
+		}
+
+		ctx := context.Background()
+
+		MongoClient, err = mongo.Connect(ctx, options.Client().ApplyURI(fmt.Sprintf("mongodb://%s:%s@192.168.0.17:27017/?authSource=admin&ssl=false", username, password)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// EnsureLookalikeIndexes lets similar-domain events be matched with a single query on the punycode form.
+func EnsureLookalikeIndexes(ctx context.Context) error {
+	_, err := MongoClient.Database("fyeo-di").Collection("asset_lookalikes").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "asset_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "candidates.ascii", Value: 1}}},
+	})
+
+	return err
+}
+
+// Migrate creates the lookalike indexes and generates the candidate sets of domain assets which
+// have none yet or whose domain changed since. Sets already up to date are left alone, so it is
+// safe to run again.
+func Migrate(ctx context.Context) (MigrateReport, error) {
+	var report MigrateReport
+
+	err := EnsureLookalikeIndexes(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	filter := bson.M{"type": "domain", "is_archived": bson.M{"$ne": true}}
+	projection := bson.M{"_id": 1, "case_id": 1, "type": 1, "name.common": 1, "whois.domain": 1}
+
+	cur, err := MongoClient.Database("fyeo-di").Collection("assets").Find(ctx, filter, options.Find().SetProjection(projection))
+	if err != nil {
+		return report, err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var asset Asset
+		err := cur.Decode(&asset)
+		if err != nil {
+			return report, err
+		}
+
+		report.Checked++
+
+		generated, err := GenerateAssetLookalikes(asset)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", *asset.ID, err.Error()))
+			continue
+		}
+
+		if generated {
+			report.Generated++
+		}
+	}
+
+	if cur.Err() != nil {
+		return report, cur.Err()
+	}
+
+	return report, nil
+}
+
+func Handler(ctx context.Context, event events.CloudWatchEvent) (MigrateReport, error) {
+	err := Init()
+	if err != nil {
+		return MigrateReport{}, err
+	}
+
+	report, err := Migrate(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	log.Printf("checked %d domain assets, generated %d lookalike sets", report.Checked, report.Generated)
+	if len(report.Errors) > 0 {
+		log.Printf("errors: %s", strings.Join(report.Errors, "; "))
+	}
+
+	return report, nil
+}
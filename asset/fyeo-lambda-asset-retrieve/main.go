@@ -90,13 +90,19 @@ type AssetWhois struct {
 }
 
 type AssetLocation struct {
-	StreetNumber *int64   `json:"street_number,omitempty" bson:"street_number,omitempty"`
-	PostalTown   *string  `json:"postal_town,omitempty" bson:"postal_town,omitempty"`
-	Country      *string  `json:"country,omitempty" bson:"country,omitempty"`
-	StreetName   *string  `json:"street_name,omitempty" bson:"street_name,omitempty"`
-	Premise      *string  `json:"premise,omitempty" bson:"premise,omitempty"`
-	Lat          *float64 `json:"lat,omitempty" bson:"lat,omitempty"`
-	Lng          *float64 `json:"lng,omitempty" bson:"lng,omitempty"`
+	StreetNumber *int64    `json:"street_number,omitempty" bson:"street_number,omitempty"`
+	PostalTown   *string   `json:"postal_town,omitempty" bson:"postal_town,omitempty"`
+	Country      *string   `json:"country,omitempty" bson:"country,omitempty"`
+	StreetName   *string   `json:"street_name,omitempty" bson:"street_name,omitempty"`
+	Premise      *string   `json:"premise,omitempty" bson:"premise,omitempty"`
+	Lat          *float64  `json:"lat,omitempty" bson:"lat,omitempty"`
+	Lng          *float64  `json:"lng,omitempty" bson:"lng,omitempty"`
+	Geo          *GeoPoint `json:"geo,omitempty" bson:"geo,omitempty"`
+}
+
+type GeoPoint struct {
+	Type        *string   `json:"type,omitempty" bson:"type,omitempty"`
+	Coordinates []float64 `json:"coordinates,omitempty" bson:"coordinates,omitempty"`
 }
 
 type AssetName struct {
@@ -147,6 +153,8 @@ type Asset struct {
 	//person
 	Brands *Strings `json:"brands,omitempty" bson:"brands,omitempty"`
 
+	SearchKeys []*SearchKey `json:"search_keys,omitempty" bson:"search_keys,omitempty"`
+
 	IncidentCount *int64 `json:"incident_count,omitempty" bson:"-"`
 }
 
@@ -155,6 +163,14 @@ type TagPair struct {
 	Value *string `json:"value,omitempty" bson:"value,omitempty"`
 }
 
+type SearchKey struct {
+	Value      *string `json:"value,omitempty" bson:"value,omitempty"`
+	Kind       *string `json:"kind,omitempty" bson:"kind,omitempty"`
+	Source     *string `json:"source,omitempty" bson:"source,omitempty"`
+	Manual     *bool   `json:"manual,omitempty" bson:"manual,omitempty"`
+	Suppressed *bool   `json:"suppressed,omitempty" bson:"suppressed,omitempty"`
+}
+
 type Event struct {
 	ID                *string    `json:"id,omitempty" bson:"_id,omitempty"`
 	CaseID            *string    `json:"case_id" bson:"case_id,omitempty"`
@@ -178,24 +194,22 @@ type ErrorResponse struct {
 }
 
 func (data Asset) GetName() string {
-	var name string
-	if data.Name.Common != nil {
-		name = *data.Name.Common
-	} else {
-		if data.Name.Last != nil {
-			name = *data.Name.Last
-		}
+	if data.Name == nil {
+		return ""
+	}
 
-		if data.Name.Middle != nil {
-			name += " " + *data.Name.Middle
-		}
+	if data.Name.Common != nil {
+		return *data.Name.Common
+	}
 
-		if data.Name.First != nil {
-			name += " " + *data.Name.First
+	var parts []string
+	for _, part := range []*string{data.Name.First, data.Name.Middle, data.Name.Last} {
+		if part != nil && *part != "" {
+			parts = append(parts, *part)
 		}
 	}
 
-	return name
+	return strings.Join(parts, " ")
 }
 
 func ServeError(message string, code int) events.APIGatewayProxyResponse {
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	gMap        = make(map[string]bool)
+	MongoClient *mongo.Client
+
+	defaultHeaders = map[string]string{
+		"Content-Type":                 "application/json",
+		"Access-Control-Allow-Headers": "*",
+		"Access-Control-Allow-Origin":  "*",
+		"Access-Control-Allow-Methods": "GET, OPTIONS, POST",
+		"Allow":                        "GET, OPTIONS, POST",
+	}
+)
+
+type Strings []string
+
+type Case struct {
+	ID           *string  `json:"id,omitempty" bson:"_id,omitempty"`
+	Name         *string  `json:"name,omitempty" bson:"name,omitempty"`
+	Evidence     *bool    `json:"evidence,omitempty" bson:"evidence,omitempty"` //not sure what this is for?
+	Emails       *Strings `json:"emails,omitempty" bson:"emails,omitempty"`
+	AlertLevel   *int64   `json:"alert_level,omitempty" bson:"alert_level,omitempty"`
+	Group        *string  `json:"group,omitempty" bson:"group,omitempty"`
+	ShouldNotify *bool    `json:"should_notify,omitempty" bson:"should_notify,omitempty"`
+}
+
+type AssetNetloc struct {
+	Cidr     *string `json:"cidr,omitempty" bson:"cidr,omitempty"`
+	AsNumber *string `json:"as_number,omitempty" bson:"as_number,omitempty"`
+}
+
+type AssetWhois struct {
+	Domain      *string    `json:"domain,omitempty" bson:"domain,omitempty"`
+	CreatedAt   *time.Time `json:"created_at,omitempty" bson:"created_at,omitempty"`
+	UpdatedAt   *time.Time `json:"updated_at,omitempty" bson:"updated_at,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
+	Registrar   *string    `json:"registrar,omitempty" bson:"registrar,omitempty"`
+	Registrant  *string    `json:"registrant,omitempty" bson:"registrant,omitempty"`
+	Nameservers *Strings   `json:"nameservers,omitempty" bson:"names_servers,omitempty"`
+	Status      *string    `json:"status,omitempty" bson:"status,omitempty"`
+}
+
+type AssetLocation struct {
+	StreetNumber *int64   `json:"street_number,omitempty" bson:"street_number,omitempty"`
+	PostalTown   *string  `json:"postal_town,omitempty" bson:"postal_town,omitempty"`
+	Country      *string  `json:"country,omitempty" bson:"country,omitempty"`
+	StreetName   *string  `json:"street_name,omitempty" bson:"street_name,omitempty"`
+	Premise      *string  `json:"premise,omitempty" bson:"premise,omitempty"`
+	Lat          *float64 `json:"lat,omitempty" bson:"lat,omitempty"`
+	Lng          *float64 `json:"lng,omitempty" bson:"lng,omitempty"`
+}
+
+type AssetName struct {
+	Common *string `json:"common,omitempty" bson:"common,omitempty"`
+	First  *string `json:"first,omitempty" bson:"first,omitempty"`
+	Last   *string `json:"last,omitempty" bson:"last,omitempty"`
+	Middle *string `json:"middle,omitempty" bson:"middle,omitempty"`
+	Nick   *string `json:"nick,omitempty" bson:"nick,omitempty"`
+}
+
+type AssetOrganization struct {
+	Role *string `json:"role,omitempty" bson:"role,omitempty"`
+	Name *string `json:"name,omitempty" bson:"name,omitempty"`
+}
+
+type Asset struct {
+	CaseName          *string      `json:"case_name,omitempty" bson:"-"`
+	ID                *string      `json:"id,omitempty" bson:"_id,omitempty"`
+	CaseID            *string      `json:"case_id,omitempty" bson:"case_id,omitempty"`
+	SocialMedia       []*TagPair   `json:"social_media,omitempty" bson:"social_media,omitempty"`
+	IPs               *Strings     `json:"ips,omitempty" bson:"ips,omitempty"`
+	Name              *AssetName   `json:"name,omitempty" bson:"name,omitempty"`
+	Netloc            *AssetNetloc `json:"netloc,omitempty" bson:"netloc,omitempty"`
+	CreatedAt         *time.Time   `json:"created_at,omitempty" bson:"created_at,omitempty"`
+	DumpSearchedAt    *time.Time   `json:"dump_searched_at,omitempty" bson:"dump_searched_at,omitempty"`
+	SimilarSearchedAt *time.Time   `json:"similar_searched_at,omitempty" bson:"similar_searched_at,omitempty"`
+	UpdatedAt         *time.Time   `json:"updated_at,omitempty" bson:"updated_at,omitempty"`
+	IndexCount        *int64       `json:"index_count,omitempty" bson:"index_count,omitempty"`
+	SearchedAt        *time.Time   `json:"searched_at,omitempty" bson:"searched_at,omitempty"`
+	IconURL           *string      `json:"icon_url,omitempty" bson:"icon_url,omitempty"`
+
+	RequiredScore   *float64           `json:"required_score,omitempty" bson:"required_score,omitempty"`
+	Type            *string            `json:"type,omitempty" bson:"type,omitempty"`
+	IsActive        *bool              `json:"is_active,omitempty" bson:"is_active,omitempty"`
+	IsThreatActor   *bool              `json:"is_threat_actor,omitempty" bson:"is_threat_actor,omitempty"`
+	Location        *AssetLocation     `json:"location,omitempty" bson:"location,omitempty"`
+	Organization    *AssetOrganization `json:"organization,omitempty" bson:"organization,omitempty"`
+	Emails          []*TagPair         `json:"emails,omitempty" bson:"emails,omitempty"`
+	PhoneNumbers    []*TagPair         `json:"phone_numbers,omitempty" bson:"phone_numbers,omitempty"`
+	WalletAddresses []*TagPair         `json:"wallet_addresses,omitempty" bson:"wallet_addresses,omitempty"`
+	Urls            *Strings           `json:"urls,omitempty" bson:"urls,omitempty"`
+
+	//domain
+	Whois *AssetWhois `json:"whois,omitempty" bson:"whois,omitempty"`
+	Mx    *Strings    `json:"mx,omitempty" bson:"mx,omitempty"`
+	Ns    *Strings    `json:"ns,omitempty" bson:"ns,omitempty"`
+
+	//person
+	Brands *Strings `json:"brands,omitempty" bson:"brands,omitempty"`
+
+	SearchKeys []*SearchKey `json:"search_keys,omitempty" bson:"search_keys,omitempty"`
+
+	IncidentCount *int64 `json:"incident_count,omitempty" bson:"-"`
+}
+
+type TagPair struct {
+	Tag   *string `json:"tag,omitempty" bson:"tag,omitempty"`
+	Value *string `json:"value,omitempty" bson:"value,omitempty"`
+}
+
+type ErrorResponse struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+func ServeError(message string, code int) events.APIGatewayProxyResponse {
+	js, _ := json.Marshal(ErrorResponse{
+		Code:    code,
+		Message: message,
+	})
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: code,
+		Body:       string(js),
+		Headers:    defaultHeaders,
+	}
+}
+
+func main() {
+	lambda.Start(Handler)
+}
+
+func Init() error {
+	var err error
+
+	err = ReuseMongo()
+	if err != nil {
+		return err
+	}
+
+	return err
+}
+
+func UrlEncoded(str string) (string, error) {
+	u, err := url.Parse(str)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+func ReuseMongo() error {
+
+	if MongoClient != nil {
+		return nil
+	} else {
+		var err error
+		username := "stage"
+		password := "GK!2f&Wf#z&RS3"
+
+		password, err = UrlEncoded(password)
+		if err != nil {
+			return err
+		}
+
+		ctx := context.Background()
+
+		MongoClient, err = mongo.Connect(ctx, options.Client().ApplyURI(fmt.Sprintf("mongodb://%s:%s@192.168.0.17:27017/?authSource=admin&ssl=false", username, password)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func GetCase(id string) (Case, error) {
+	var out Case
+	o_id, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return out, err
+	}
+
+	filter := bson.M{"_id": o_id, "is_archived": bson.M{"$ne": true}}
+	res := MongoClient.Database("fyeo-di").Collection("cases").FindOne(context.Background(), filter)
+
+	if res.Err() != nil {
+		return out, res.Err()
+	}
+
+	err = res.Decode(&out)
+
+	if err != nil {
+
+		return out, err
+	}
+
+	return out, nil
+}
+
+func GetAsset(id string) (Asset, error) {
+	var out Asset
+	o_id, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return out, err
+	}
+
+	filter := bson.M{"_id": o_id}
+	filter["is_archived"] = bson.M{"$ne": true}
+
+	res := MongoClient.Database("fyeo-di").Collection("assets").FindOne(context.Background(), filter)
+
+	if res.Err() != nil {
+		return out, res.Err()
+	}
+
+	err = res.Decode(&out)
+
+	if err != nil {
+
+		return out, err
+	}
+
+	return out, nil
+}
+
+func CasePermissions(input Case) bool {
+	if input.Group != nil {
+		_, ok := gMap[*input.Group]
+		return ok
+	}
+
+	return false
+}
+
+func VerifyRequest(request events.APIGatewayProxyRequest) error {
+
+	claims := request.RequestContext.Authorizer["claims"]
+	if claims == nil {
+		return errors.New("No claims found for " + request.RequestContext.Identity.CognitoIdentityID)
+	}
+
+	rg := claims.(map[string]interface{})["cognito:groups"]
+
+	if rg == nil {
+		return errors.New("No group permissions set")
+	}
+
+	groups := strings.Split(rg.(string), ",")
+
+	//warm containers keep gMap, start from nothing for every caller
+	gMap = make(map[string]bool)
+	for _, g := range groups {
+		gMap[g] = true
+	}
+
+	return nil
+}
+
+type SearchKeyChanges struct {
+	Add      []string `json:"add,omitempty"`
+	Suppress []string `json:"suppress,omitempty"`
+	Restore  []string `json:"restore,omitempty"`
+}
+
+// ApplySearchKeyChanges adds manual keys and sets or clears the suppressed flag of existing ones.
+func ApplySearchKeyChanges(keys []*SearchKey, changes SearchKeyChanges) []*SearchKey {
+	index := make(map[string]*SearchKey)
+	for _, k := range keys {
+		if k != nil && k.Value != nil {
+			index[*k.Value] = k
+		}
+	}
+
+	for _, v := range changes.Add {
+		v = NormaliseKey(v)
+		if v == "" {
+			continue
+		}
+
+		manual := true
+		k, ok := index[v]
+		if !ok {
+			kind := KEY_MANUAL
+			source := KEY_MANUAL
+			k = &SearchKey{Value: &v, Kind: &kind, Source: &source}
+			index[v] = k
+			keys = append(keys, k)
+		}
+		k.Manual = &manual
+		k.Suppressed = nil
+	}
+
+	for _, v := range changes.Suppress {
+		k, ok := index[NormaliseKey(v)]
+		if ok {
+			suppressed := true
+			k.Suppressed = &suppressed
+		}
+	}
+
+	for _, v := range changes.Restore {
+		k, ok := index[NormaliseKey(v)]
+		if ok {
+			k.Suppressed = nil
+		}
+	}
+
+	return keys
+}
+
+func UpdateSearchKeys(id string, keys []*SearchKey) error {
+	o_id, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	update := bson.M{"$set": bson.M{"search_keys": keys, "updated_at": now}}
+
+	res, err := MongoClient.Database("fyeo-di").Collection("assets").UpdateOne(context.Background(), bson.M{"_id": o_id}, update)
+	if err != nil {
+		return err
+	}
+
+	if res.MatchedCount < 1 {
+		return errors.New("Unable to find the object to update")
+	}
+
+	return nil
+}
+
+func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var err error
+
+	id := request.PathParameters["id"]
+	if id == "" {
+		return ServeError("No ID provided", 400), nil
+	}
+
+	err = VerifyRequest(request)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	err = Init()
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	asset, err := GetAsset(id)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	if asset.CaseID == nil {
+		js, _ := json.Marshal(asset)
+		return ServeError(fmt.Sprintf("No case ID found for object: %s", string(js)), 400), nil
+	}
+
+	ca, err := GetCase(*asset.CaseID)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	if !CasePermissions(ca) {
+		return ServeError("Unable to verify case group permissions", 400), nil
+	}
+
+	keys := asset.SearchKeys
+
+	if request.HTTPMethod == "POST" {
+		var input SearchKeyChanges
+		err = json.Unmarshal([]byte(request.Body), &input)
+		if err != nil {
+			return ServeError(err.Error(), 400), nil
+		}
+
+		keys = DeriveSearchKeys(asset, ApplySearchKeyChanges(asset.SearchKeys, input))
+
+		err = UpdateSearchKeys(id, keys)
+		if err != nil {
+			return ServeError(err.Error(), 400), nil
+		}
+	} else if keys == nil {
+		//assets created before search keys were introduced
+		keys = DeriveSearchKeys(asset, nil)
+	}
+
+	js, err := json.Marshal(keys)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    defaultHeaders,
+		Body:       string(js),
+	}, nil
+}
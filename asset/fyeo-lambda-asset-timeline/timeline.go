@@ -0,0 +1,479 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	ENTRY_EVENT               = "event"
+	ENTRY_ASSET_CHANGE        = "asset_change"
+	ENTRY_INCIDENT_CREATED    = "incident_created"
+	ENTRY_INCIDENT_CLASSIFIED = "incident_classified"
+	ENTRY_INCIDENT_CLOSED     = "incident_closed"
+	ENTRY_COMMENT             = "comment"
+
+	//events written by the dns/whois refresh job
+	ASSET_CHANGE_SOURCE = "asset_monitor"
+
+	DEFAULT_LIMIT = 50
+	MAX_LIMIT     = 200
+)
+
+var (
+	entryTypes = []string{
+		ENTRY_EVENT, ENTRY_ASSET_CHANGE, ENTRY_INCIDENT_CREATED, ENTRY_INCIDENT_CLASSIFIED, ENTRY_INCIDENT_CLOSED, ENTRY_COMMENT,
+	}
+
+	//the date each incident entry is ordered by, current name first
+	incidentDateFields = map[string][]string{
+		ENTRY_INCIDENT_CREATED:    {"created_at", "date"},
+		ENTRY_INCIDENT_CLASSIFIED: {"classified_at", "classifiedDate", "classified_date"},
+		ENTRY_INCIDENT_CLOSED:     {"closed_at", "closed_date"},
+	}
+)
+
+type TimelineIncident struct {
+	ID           string     `json:"id" bson:"_id"`
+	Title        *string    `json:"title,omitempty" bson:"title,omitempty"`
+	Type         *string    `json:"type,omitempty" bson:"type,omitempty"`
+	Severity     *int64     `json:"severity,omitempty" bson:"severity,omitempty"`
+	CaseID       *string    `json:"case_id,omitempty" bson:"case_id,omitempty"`
+	ParentID     *string    `json:"-" bson:"parentId,omitempty"`
+	AssetID      *string    `json:"asset_id,omitempty" bson:"asset_id,omitempty"`
+	ClassifiedBy *string    `json:"classified_by,omitempty" bson:"classified_by,omitempty"`
+	IsActive     *bool      `json:"is_active,omitempty" bson:"is_active,omitempty"`
+	Date         *time.Time `json:"date,omitempty" bson:"-"`
+}
+
+type Comment struct {
+	ID         string     `json:"id" bson:"_id"`
+	CaseID     *string    `json:"case_id,omitempty" bson:"case_id,omitempty"`
+	AssetID    *string    `json:"asset_id,omitempty" bson:"asset_id,omitempty"`
+	IncidentID *string    `json:"incident_id,omitempty" bson:"incident_id,omitempty"`
+	EventID    *string    `json:"event_id,omitempty" bson:"event_id,omitempty"`
+	Author     *string    `json:"author,omitempty" bson:"author,omitempty"`
+	Body       *string    `json:"body,omitempty" bson:"body,omitempty"`
+	CreatedAt  *time.Time `json:"created_at,omitempty" bson:"created_at,omitempty"`
+}
+
+type TimelineEntry struct {
+	Type    string      `json:"type"`
+	Date    time.Time   `json:"date"`
+	ID      string      `json:"id"`
+	CaseID  *string     `json:"case_id,omitempty"`
+	AssetID *string     `json:"asset_id,omitempty"`
+	Title   *string     `json:"title,omitempty"`
+	Data    interface{} `json:"data"`
+}
+
+type TimelinePage struct {
+	Entries    []*TimelineEntry `json:"entries"`
+	NextCursor *string          `json:"next_cursor,omitempty"`
+}
+
+// TimelineCursor is the last entry of a page, the next page starts after it.
+type TimelineCursor struct {
+	Date time.Time
+	Type string
+	ID   string
+}
+
+func (c TimelineCursor) Encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(c.Date.UTC().Format(time.RFC3339Nano) + "|" + c.Type + "|" + c.ID))
+}
+
+func DecodeCursor(input string) (*TimelineCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(input)
+	if err != nil {
+		return nil, errors.New("Invalid cursor")
+	}
+
+	parts := strings.SplitN(string(b), "|", 3)
+	if len(parts) != 3 {
+		return nil, errors.New("Invalid cursor")
+	}
+
+	date, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return nil, errors.New("Invalid cursor")
+	}
+
+	return &TimelineCursor{Date: date, Type: parts[1], ID: parts[2]}, nil
+}
+
+// TimelineQuery is one page of the timeline of a case, or of one asset in it.
+type TimelineQuery struct {
+	CaseID  string
+	AssetID string
+	Types   map[string]bool
+	From    *time.Time
+	To      *time.Time
+	Cursor  *TimelineCursor
+	Limit   int
+}
+
+// ParseTimelineQuery reads types, date_from, date_to, limit and cursor.
+func ParseTimelineQuery(params map[string]string) (TimelineQuery, error) {
+	q := TimelineQuery{Types: make(map[string]bool), Limit: DEFAULT_LIMIT}
+
+	q_types, ok := params["types"]
+	if ok && q_types != "" {
+		known := make(map[string]bool)
+		for _, t := range entryTypes {
+			known[t] = true
+		}
+		for _, t := range strings.Split(q_types, ",") {
+			t = strings.TrimSpace(t)
+			if !known[t] {
+				return q, errors.New("Unknown entry type: " + t)
+			}
+			q.Types[t] = true
+		}
+	} else {
+		for _, t := range entryTypes {
+			q.Types[t] = true
+		}
+	}
+
+	q_from, ok := params["date_from"]
+	if ok {
+		from, err := time.Parse(time.RFC3339, q_from)
+		if err != nil {
+			return q, errors.New("Invalid date_from: " + q_from)
+		}
+		q.From = &from
+	}
+
+	q_to, ok := params["date_to"]
+	if ok {
+		to, err := time.Parse(time.RFC3339, q_to)
+		if err != nil {
+			return q, errors.New("Invalid date_to: " + q_to)
+		}
+		q.To = &to
+	}
+
+	q_limit, ok := params["limit"]
+	if ok {
+		limit, err := strconv.Atoi(q_limit)
+		if err != nil || limit < 1 {
+			return q, errors.New("Invalid limit: " + q_limit)
+		}
+		if limit > MAX_LIMIT {
+			limit = MAX_LIMIT
+		}
+		q.Limit = limit
+	}
+
+	q_cursor, ok := params["cursor"]
+	if ok && q_cursor != "" {
+		cursor, err := DecodeCursor(q_cursor)
+		if err != nil {
+			return q, err
+		}
+		q.Cursor = cursor
+	}
+
+	return q, nil
+}
+
+// Newer orders entries newest first, ties broken by type then id so pages never overlap.
+func Newer(a *TimelineEntry, b *TimelineEntry) bool {
+	if !a.Date.Equal(b.Date) {
+		return a.Date.After(b.Date)
+	}
+	if a.Type != b.Type {
+		return a.Type < b.Type
+	}
+	return a.ID > b.ID
+}
+
+func (q TimelineQuery) after(e *TimelineEntry) bool {
+	if q.Cursor == nil {
+		return true
+	}
+	return Newer(&TimelineEntry{Date: q.Cursor.Date, Type: q.Cursor.Type, ID: q.Cursor.ID}, e)
+}
+
+func (q TimelineQuery) dateCond() bson.M {
+	cond := bson.M{"$type": "date"}
+	if q.From != nil {
+		cond["$gte"] = *q.From
+	}
+	if q.To != nil {
+		cond["$lte"] = *q.To
+	}
+	if q.Cursor != nil && (q.To == nil || q.Cursor.Date.Before(*q.To)) {
+		cond["$lte"] = q.Cursor.Date
+	}
+	return cond
+}
+
+// cursorCond keeps the documents of one entry type that come after the cursor in the order of
+// Newer, the ones dated the same as the cursor are told apart by type and then by id.
+func (q TimelineQuery) cursorCond(field string, entry_type string) bson.M {
+	if q.Cursor == nil || q.Cursor.Type < entry_type {
+		return nil
+	}
+
+	if q.Cursor.Type > entry_type {
+		return bson.M{field: bson.M{"$lt": q.Cursor.Date}}
+	}
+
+	var id interface{} = q.Cursor.ID
+	o_id, err := primitive.ObjectIDFromHex(q.Cursor.ID)
+	if err == nil {
+		id = o_id
+	}
+
+	return bson.M{"$or": []bson.M{
+		{field: bson.M{"$lt": q.Cursor.Date}},
+		{field: q.Cursor.Date, "_id": bson.M{"$lt": id}},
+	}}
+}
+
+type datedDoc struct {
+	Date time.Time
+	Raw  bson.Raw
+}
+
+// findByDate runs one query per name of the date field, legacy documents only have the old
+// name and one sort over both would put them all last. A document is dated by the first name
+// it has. Documents with the same date are in id order, as Newer has them.
+func (q TimelineQuery) findByDate(ctx context.Context, collection string, entry_type string, filter []bson.M, date_fields []string) ([]datedDoc, error) {
+	var out []datedDoc
+	seen := make(map[string]bool)
+
+	for i, field := range date_fields {
+		and := append([]bson.M{{field: q.dateCond()}, {"is_archived": bson.M{"$ne": true}}}, filter...)
+		for _, prev := range date_fields[:i] {
+			and = append(and, bson.M{prev: bson.M{"$exists": false}})
+		}
+		if cond := q.cursorCond(field, entry_type); cond != nil {
+			and = append(and, cond)
+		}
+		opts := options.Find().SetSort(bson.D{{Key: field, Value: -1}, {Key: "_id", Value: -1}}).SetLimit(int64(q.Limit + 1))
+
+		res, err := MongoClient.Database("fyeo-di").Collection(collection).Find(ctx, bson.M{"$and": and}, opts)
+		if err != nil {
+			return out, err
+		}
+
+		for res.Next(ctx) {
+			raw := make(bson.Raw, len(res.Current))
+			copy(raw, res.Current)
+
+			id := raw.Lookup("_id").String()
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+
+			date, ok := raw.Lookup(field).TimeOK()
+			if !ok {
+				continue
+			}
+
+			out = append(out, datedDoc{Date: date, Raw: raw})
+		}
+
+		err = res.Err()
+		res.Close(ctx)
+		if err != nil {
+			return out, err
+		}
+	}
+
+	return out, nil
+}
+
+func (q TimelineQuery) timelineEvents(ctx context.Context, entry_type string) ([]*TimelineEntry, error) {
+	var out []*TimelineEntry
+
+	filter := []bson.M{AnyField("case_id", q.CaseID)}
+	if q.AssetID != "" {
+		filter = append(filter, AnyField("asset_id", q.AssetID))
+	}
+	if entry_type == ENTRY_ASSET_CHANGE {
+		filter = append(filter, bson.M{"source_type": ASSET_CHANGE_SOURCE})
+	} else {
+		filter = append(filter, bson.M{"source_type": bson.M{"$ne": ASSET_CHANGE_SOURCE}})
+	}
+
+	docs, err := q.findByDate(ctx, "events", entry_type, filter, EventFieldNames("created_at"))
+	if err != nil {
+		return out, err
+	}
+
+	for _, d := range docs {
+		var e Event
+		err := bson.Unmarshal(d.Raw, &e)
+		if err != nil {
+			return out, err
+		}
+
+		id := ""
+		if e.ID != nil {
+			id = *e.ID
+		}
+
+		out = append(out, &TimelineEntry{
+			Type:    entry_type,
+			Date:    d.Date,
+			ID:      id,
+			CaseID:  e.CaseID,
+			AssetID: e.AssetID,
+			Title:   e.Title,
+			Data:    e,
+		})
+	}
+
+	return out, nil
+}
+
+func (q TimelineQuery) timelineIncidents(ctx context.Context, entry_type string) ([]*TimelineEntry, error) {
+	var out []*TimelineEntry
+
+	filter := []bson.M{{"$or": []bson.M{{"case_id": q.CaseID}, {"parentId": q.CaseID}}}}
+	if q.AssetID != "" {
+		filter = append(filter, bson.M{"$or": []bson.M{{"asset_id": q.AssetID}, {"target_ids": q.AssetID}}})
+	}
+
+	docs, err := q.findByDate(ctx, "incidents", entry_type, filter, incidentDateFields[entry_type])
+	if err != nil {
+		return out, err
+	}
+
+	for _, d := range docs {
+		var i TimelineIncident
+		err := bson.Unmarshal(d.Raw, &i)
+		if err != nil {
+			return out, err
+		}
+
+		if i.CaseID == nil {
+			i.CaseID = i.ParentID
+		}
+
+		date := d.Date
+		i.Date = &date
+
+		out = append(out, &TimelineEntry{
+			Type:    entry_type,
+			Date:    d.Date,
+			ID:      i.ID,
+			CaseID:  i.CaseID,
+			AssetID: i.AssetID,
+			Title:   i.Title,
+			Data:    i,
+		})
+	}
+
+	return out, nil
+}
+
+func (q TimelineQuery) timelineComments(ctx context.Context) ([]*TimelineEntry, error) {
+	var out []*TimelineEntry
+
+	filter := []bson.M{{"case_id": q.CaseID}}
+	if q.AssetID != "" {
+		filter = append(filter, bson.M{"asset_id": q.AssetID})
+	}
+
+	docs, err := q.findByDate(ctx, "comments", ENTRY_COMMENT, filter, []string{"created_at"})
+	if err != nil {
+		return out, err
+	}
+
+	for _, d := range docs {
+		var c Comment
+		err := bson.Unmarshal(d.Raw, &c)
+		if err != nil {
+			return out, err
+		}
+
+		out = append(out, &TimelineEntry{
+			Type:    ENTRY_COMMENT,
+			Date:    d.Date,
+			ID:      c.ID,
+			CaseID:  c.CaseID,
+			AssetID: c.AssetID,
+			Data:    c,
+		})
+	}
+
+	return out, nil
+}
+
+// Timeline merges every requested entry type into one page, newest first. Each source is
+// asked for one more than the limit so it is known whether there is another page.
+func Timeline(ctx context.Context, q TimelineQuery) (TimelinePage, error) {
+	out := TimelinePage{Entries: []*TimelineEntry{}}
+
+	var all []*TimelineEntry
+	for _, t := range entryTypes {
+		if !q.Types[t] {
+			continue
+		}
+
+		var entries []*TimelineEntry
+		var err error
+		switch t {
+		case ENTRY_EVENT, ENTRY_ASSET_CHANGE:
+			entries, err = q.timelineEvents(ctx, t)
+		case ENTRY_COMMENT:
+			entries, err = q.timelineComments(ctx)
+		default:
+			entries, err = q.timelineIncidents(ctx, t)
+		}
+		if err != nil {
+			return out, err
+		}
+
+		for _, e := range entries {
+			if q.after(e) {
+				all = append(all, e)
+			}
+		}
+	}
+
+	sort.SliceStable(all, func(i, j int) bool {
+		return Newer(all[i], all[j])
+	})
+
+	if len(all) > q.Limit {
+		all = all[:q.Limit]
+		last := all[len(all)-1]
+		cursor := TimelineCursor{Date: last.Date, Type: last.Type, ID: last.ID}.Encode()
+		out.NextCursor = &cursor
+	}
+
+	out.Entries = append(out.Entries, all...)
+
+	return out, nil
+}
+
+// AnyField matches a condition against the current and legacy names of an event field.
+func AnyField(canonical string, cond interface{}) bson.M {
+	names := EventFieldNames(canonical)
+	if len(names) == 1 {
+		return bson.M{canonical: cond}
+	}
+
+	var or []bson.M
+	for _, n := range names {
+		or = append(or, bson.M{n: cond})
+	}
+
+	return bson.M{"$or": or}
+}
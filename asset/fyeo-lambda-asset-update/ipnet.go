@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// NormaliseIP returns the canonical form of an IP address or CIDR range.
+// IPv4-mapped IPv6 addresses are written as IPv4 and host bits are cleared from ranges.
+func NormaliseIP(input string) (string, error) {
+	input = strings.TrimSpace(input)
+	if input == "" {
+		return "", errors.New("Empty IP address")
+	}
+
+	if !strings.Contains(input, "/") {
+		ip := net.ParseIP(input)
+		if ip == nil {
+			return "", errors.New("Invalid IP address: " + input)
+		}
+
+		return ip.String(), nil
+	}
+
+	ip, ipnet, err := net.ParseCIDR(input)
+	if err != nil {
+		return "", errors.New("Invalid CIDR range: " + input)
+	}
+
+	ones, bits := ipnet.Mask.Size()
+	network := ip.Mask(ipnet.Mask)
+
+	if bits == 8*net.IPv6len && ip.To4() != nil {
+		if ones < 96 {
+			//wider than the IPv4-mapped block, it has to stay an IPv6 range
+			return network.To16().String() + "/" + strconv.Itoa(ones), nil
+		}
+		ones -= 96
+	}
+
+	if network.To4() != nil {
+		network = network.To4()
+	}
+
+	return network.String() + "/" + strconv.Itoa(ones), nil
+}
+
+// NormaliseIPs normalises a list of addresses and ranges, dropping duplicates.
+func NormaliseIPs(input []string) ([]string, error) {
+	var out []string
+	seen := make(map[string]bool)
+
+	for _, s := range input {
+		n, err := NormaliseIP(s)
+		if err != nil {
+			return out, err
+		}
+
+		if seen[n] {
+			continue
+		}
+
+		seen[n] = true
+		out = append(out, n)
+	}
+
+	return out, nil
+}
+
+// NormaliseASN returns an AS number in the "AS1234" form.
+func NormaliseASN(input string) (string, error) {
+	s := strings.ToUpper(strings.TrimSpace(input))
+	s = strings.TrimPrefix(s, "AS")
+
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return "", errors.New("Invalid AS number: " + input)
+	}
+
+	return "AS" + strconv.FormatUint(n, 10), nil
+}
+
+// NormaliseAssetNetwork validates and normalises the IP addresses, CIDR range and AS number of an asset.
+func NormaliseAssetNetwork(data *Asset) error {
+	if data.IPs != nil {
+		ips, err := NormaliseIPs(*data.IPs)
+		if err != nil {
+			return err
+		}
+
+		normalised := Strings(ips)
+		data.IPs = &normalised
+	}
+
+	if data.Netloc != nil {
+		if data.Netloc.Cidr != nil {
+			cidr, err := NormaliseIP(*data.Netloc.Cidr)
+			if err != nil {
+				return err
+			}
+
+			if !strings.Contains(cidr, "/") {
+				return errors.New("Invalid CIDR range: " + *data.Netloc.Cidr)
+			}
+
+			data.Netloc.Cidr = &cidr
+		}
+
+		if data.Netloc.AsNumber != nil {
+			asn, err := NormaliseASN(*data.Netloc.AsNumber)
+			if err != nil {
+				return err
+			}
+
+			data.Netloc.AsNumber = &asn
+		}
+	}
+
+	return nil
+}
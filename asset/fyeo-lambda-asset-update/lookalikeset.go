@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AssetLookalikes is the candidate set generated for a domain asset, kept in asset_lookalikes.
+type AssetLookalikes struct {
+	ID          *string      `json:"id,omitempty" bson:"_id,omitempty"`
+	AssetID     *string      `json:"asset_id,omitempty" bson:"asset_id,omitempty"`
+	CaseID      *string      `json:"case_id,omitempty" bson:"case_id,omitempty"`
+	Domain      *string      `json:"domain,omitempty" bson:"domain,omitempty"`
+	Candidates  []*Lookalike `json:"candidates,omitempty" bson:"candidates,omitempty"`
+	GeneratedAt *time.Time   `json:"generated_at,omitempty" bson:"generated_at,omitempty"`
+}
+
+func (data Asset) GetDomain() string {
+	if data.Name != nil && data.Name.Common != nil {
+		return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(*data.Name.Common)), ".")
+	}
+
+	if data.Whois != nil && data.Whois.Domain != nil {
+		return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(*data.Whois.Domain)), ".")
+	}
+
+	return ""
+}
+
+func GetAssetLookalikes(asset_id string) (AssetLookalikes, error) {
+	var out AssetLookalikes
+
+	res := MongoClient.Database("fyeo-di").Collection("asset_lookalikes").FindOne(context.Background(), bson.M{"asset_id": asset_id})
+	if res.Err() != nil {
+		return out, res.Err()
+	}
+
+	err := res.Decode(&out)
+	if err != nil {
+		return out, err
+	}
+
+	return out, nil
+}
+
+// SaveAssetLookalikes replaces the stored candidate set of an asset.
+func SaveAssetLookalikes(data *AssetLookalikes) error {
+	opts := options.FindOneAndReplace().SetUpsert(true).SetReturnDocument(options.After)
+
+	res := MongoClient.Database("fyeo-di").Collection("asset_lookalikes").FindOneAndReplace(context.Background(), bson.M{"asset_id": *data.AssetID}, data, opts)
+	if res.Err() != nil {
+		return res.Err()
+	}
+
+	return res.Decode(data)
+}
+
+// GenerateAssetLookalikes stores the candidate set of a domain asset when it has none yet or
+// its domain changed since, and reports whether it did. Other assets are left alone.
+func GenerateAssetLookalikes(asset Asset) (bool, error) {
+	if asset.ID == nil || asset.Type == nil || *asset.Type != "domain" {
+		return false, nil
+	}
+
+	domain := asset.GetDomain()
+	if domain == "" {
+		return false, nil
+	}
+
+	current, err := GetAssetLookalikes(*asset.ID)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return false, err
+	}
+
+	if err == nil && current.Domain != nil && *current.Domain == domain {
+		return false, nil
+	}
+
+	candidates, err := GenerateLookalikes(domain)
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	out := AssetLookalikes{
+		AssetID:     asset.ID,
+		CaseID:      asset.CaseID,
+		Domain:      &domain,
+		Candidates:  candidates,
+		GeneratedAt: &now,
+	}
+
+	err = SaveAssetLookalikes(&out)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -41,6 +41,26 @@ type Case struct {
 	AlertLevel   *int64   `json:"alert_level,omitempty" bson:"alert_level,omitempty"`
 	Group        *string  `json:"group,omitempty" bson:"group,omitempty"`
 	ShouldNotify *bool    `json:"should_notify,omitempty" bson:"should_notify,omitempty"`
+
+	Retention *CaseRetention `json:"retention,omitempty" bson:"retention,omitempty"`
+	AutoClose *CaseAutoClose `json:"auto_close,omitempty" bson:"auto_close,omitempty"`
+
+	//characters left for translating events, only staff top it up
+	TranslationWallet *int64 `json:"translation_wallet,omitempty" bson:"translation_wallet,omitempty"`
+}
+
+type CaseRetention struct {
+	UnlinkedDays           *int64 `json:"unlinked_days,omitempty" bson:"unlinked_days,omitempty"`
+	UnlinkedMaxThreatLevel *int64 `json:"unlinked_max_threat_level,omitempty" bson:"unlinked_max_threat_level,omitempty"`
+	ClosedIncidentDays     *int64 `json:"closed_incident_days,omitempty" bson:"closed_incident_days,omitempty"`
+}
+
+type CaseAutoClose struct {
+	KnownSubdomains *Strings `json:"known_subdomains,omitempty" bson:"known_subdomains,omitempty"`
+	OwnedDomains    *Strings `json:"owned_domains,omitempty" bson:"owned_domains,omitempty"`
+	TrustedSources  *Strings `json:"trusted_sources,omitempty" bson:"trusted_sources,omitempty"`
+	TrustedSites    *Strings `json:"trusted_sites,omitempty" bson:"trusted_sites,omitempty"`
+	NeverAlert      *Strings `json:"never_alert,omitempty" bson:"never_alert,omitempty"`
 }
 
 type Incident struct {
@@ -177,24 +197,22 @@ type ErrorResponse struct {
 }
 
 func (data Asset) GetName() string {
-	var name string
-	if data.Name.Common != nil {
-		name = *data.Name.Common
-	} else {
-		if data.Name.Last != nil {
-			name = *data.Name.Last
-		}
+	if data.Name == nil {
+		return ""
+	}
 
-		if data.Name.Middle != nil {
-			name += " " + *data.Name.Middle
-		}
+	if data.Name.Common != nil {
+		return *data.Name.Common
+	}
 
-		if data.Name.First != nil {
-			name += " " + *data.Name.First
+	var parts []string
+	for _, part := range []*string{data.Name.First, data.Name.Middle, data.Name.Last} {
+		if part != nil && *part != "" {
+			parts = append(parts, *part)
 		}
 	}
 
-	return name
+	return strings.Join(parts, " ")
 }
 
 func ServeError(message string, code int) events.APIGatewayProxyResponse {
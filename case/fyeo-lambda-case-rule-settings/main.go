@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	STAFF_GROUP = "staff"
+
+	DefaultThreatLevel = 3
+
+	//threat level of events about an asset that is itself one of the event's threat actors
+	ThreatActorThreatLevel = 3
+
+	RULES_ENGINE_USER  = "rules-engine"
+	RULES_ENGINE_AGENT = "rules_engine"
+
+	//only events from the last week are looked at by the rules
+	LOOKBACK = 7 * 24 * time.Hour
+)
+
+var (
+	gMap        = make(map[string]bool)
+	MongoClient *mongo.Client
+
+	defaultHeaders = map[string]string{
+		"Content-Type":                 "application/json",
+		"Access-Control-Allow-Headers": "*",
+		"Access-Control-Allow-Origin":  "*",
+		"Access-Control-Allow-Methods": "GET, OPTIONS, POST",
+		"Allow":                        "GET, OPTIONS, POST",
+	}
+)
+
+type Strings []string
+
+type Case struct {
+	ID    *string `json:"id,omitempty" bson:"_id,omitempty"`
+	Name  *string `json:"name,omitempty" bson:"name,omitempty"`
+	Group *string `json:"group,omitempty" bson:"group,omitempty"`
+}
+
+// ResolvedRule is an active rule as the engine runs it on the case's events.
+type ResolvedRule struct {
+	Name       string                 `json:"name"`
+	Action     string                 `json:"action"`
+	Enabled    bool                   `json:"enabled"`
+	Filter     map[string]interface{} `json:"filter,omitempty"`
+	Update     map[string]interface{} `json:"update,omitempty"`
+	Params     RuleParams             `json:"params"`
+	AlertLevel int64                  `json:"alert_level,omitempty"`
+	Changes    []string               `json:"changes,omitempty"`
+}
+
+// CaseRuleSettings is the case's settings next to the rules they resolve to.
+type CaseRuleSettings struct {
+	CaseID       string         `json:"case_id"`
+	AlertLevel   *int64         `json:"alert_level,omitempty"`
+	RuleSettings *RuleSettings  `json:"rule_settings,omitempty"`
+	Version      int64          `json:"version"`
+	Rules        []ResolvedRule `json:"rules"`
+}
+
+func main() {
+	lambda.Start(Handler)
+}
+
+func Init() error {
+	var err error
+
+	err = ReuseMongo()
+	if err != nil {
+		return err
+	}
+
+	return err
+}
+
+func ReuseMongo() error {
+	if MongoClient != nil {
+		return nil
+	} else {
+		var err error
+		ctx := context.Background()
+
+		uri := "mongodb://192.168.0.229:27017"
+
+		MongoClient, err = mongo.Connect(ctx, options.Client().ApplyURI(uri))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type ErrorResponse struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+func ServeError(message string, code int) events.APIGatewayProxyResponse {
+	js, _ := json.Marshal(ErrorResponse{
+		Code:    code,
+		Message: message,
+	})
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: code,
+		Body:       string(js),
+		Headers:    defaultHeaders,
+	}
+}
+
+func GetCase(ctx context.Context, id string) (Case, error) {
+	var out Case
+	o_id, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return out, err
+	}
+
+	filter := bson.M{"_id": o_id, "is_archived": bson.M{"$ne": true}}
+	opts := options.FindOne().SetProjection(bson.M{"name": 1, "group": 1})
+	err = MongoClient.Database("fyeo-di").Collection("cases").FindOne(ctx, filter, opts).Decode(&out)
+
+	return out, err
+}
+
+func CasePermissions(input Case) bool {
+	if input.Group != nil {
+		_, ok := gMap[*input.Group]
+		return ok
+	}
+
+	return false
+}
+
+func VerifyRequest(request events.APIGatewayProxyRequest) error {
+	//the container is reused between requests, groups from an earlier caller must not carry over
+	gMap = make(map[string]bool)
+
+	claims := request.RequestContext.Authorizer["claims"]
+	if claims == nil {
+		return errors.New("No claims found for " + request.RequestContext.Identity.CognitoIdentityID)
+	}
+
+	rg := claims.(map[string]interface{})["cognito:groups"]
+	if rg == nil {
+		return errors.New("No group permissions set")
+	}
+
+	for _, g := range strings.Split(rg.(string), ",") {
+		gMap[g] = true
+	}
+
+	return nil
+}
+
+func IsStaff() bool {
+	return gMap[STAFF_GROUP]
+}
+
+// SaveCaseSettings replaces the case's alert level and rule settings. Settings left empty
+// are removed, so the case goes back to the global rules.
+func SaveCaseSettings(ctx context.Context, c CaseSettings) error {
+	o_id, err := primitive.ObjectIDFromHex(c.ID)
+	if err != nil {
+		return err
+	}
+
+	set := bson.M{}
+	unset := bson.M{}
+
+	if c.AlertLevel != nil && *c.AlertLevel > 0 {
+		set["alert_level"] = *c.AlertLevel
+	} else {
+		unset["alert_level"] = ""
+	}
+
+	if c.RuleSettings != nil && (len(c.RuleSettings.Rules) > 0 || len(c.RuleSettings.Severities) > 0) {
+		set["rule_settings"] = c.RuleSettings
+	} else {
+		unset["rule_settings"] = ""
+	}
+
+	update := bson.M{}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+
+	res, err := MongoClient.Database("fyeo-di").Collection("cases").UpdateOne(ctx, bson.M{"_id": o_id, "is_archived": bson.M{"$ne": true}}, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
+// ResolveCaseRules resolves each of the active rules with the case's settings.
+func ResolveCaseRules(c CaseSettings, rules []Rule, version int64) CaseRuleSettings {
+	out := CaseRuleSettings{
+		CaseID:       c.ID,
+		AlertLevel:   c.AlertLevel,
+		RuleSettings: c.RuleSettings,
+		Version:      version,
+		Rules:        []ResolvedRule{},
+	}
+
+	for _, rule := range rules {
+		resolved, enabled, changes := c.Resolve(rule)
+		out.Rules = append(out.Rules, ResolvedRule{
+			Name:       resolved.Name,
+			Action:     resolved.Action,
+			Enabled:    enabled,
+			Filter:     resolved.Filter,
+			Update:     resolved.Update,
+			Params:     resolved.Params,
+			AlertLevel: resolved.AlertLevel,
+			Changes:    changes,
+		})
+	}
+
+	return out
+}
+
+// Handler serves a case's rule settings and the rules they resolve to on
+// GET /case/{id}/rule-settings, and replaces the settings on POST.
+func Handler(rctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var err error
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	id := request.PathParameters["id"]
+	if id == "" {
+		return ServeError("No ID provided", 400), nil
+	}
+
+	if _, err := primitive.ObjectIDFromHex(id); err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	err = VerifyRequest(request)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	err = Init()
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	ca, err := GetCase(ctx, id)
+	if err == mongo.ErrNoDocuments {
+		return ServeError("Case not found", 404), nil
+	}
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	if !CasePermissions(ca) && !IsStaff() {
+		return ServeError("Unable to verify case group permissions", 403), nil
+	}
+
+	now := time.Now().UTC()
+	rules, version, err := GetActiveRules(ctx, now)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	var settings CaseSettings
+
+	switch request.HTTPMethod {
+	case "POST":
+		err = json.Unmarshal([]byte(request.Body), &settings)
+		if err != nil {
+			return ServeError(err.Error(), 400), nil
+		}
+		settings.ID = id
+
+		err = settings.Validate(rules)
+		if err != nil {
+			return ServeError(err.Error(), 400), nil
+		}
+
+		err = SaveCaseSettings(ctx, settings)
+		if err == mongo.ErrNoDocuments {
+			return ServeError("Case not found", 404), nil
+		}
+		if err != nil {
+			return ServeError(err.Error(), 400), nil
+		}
+	case "GET", "":
+		settings, err = GetCaseSettings(ctx, id)
+		if err == mongo.ErrNoDocuments {
+			return ServeError("Case not found", 404), nil
+		}
+		if err != nil {
+			return ServeError(err.Error(), 400), nil
+		}
+	default:
+		return ServeError("Method "+request.HTTPMethod+" not allowed", 405), nil
+	}
+
+	out := ResolveCaseRules(settings, rules, version)
+
+	js, err := json.Marshal(out)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		Body:       string(js),
+		StatusCode: 200,
+		Headers:    defaultHeaders,
+	}, nil
+}
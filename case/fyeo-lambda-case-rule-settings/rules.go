@@ -0,0 +1,520 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	RULES_FILE = "incident_rules.yaml"
+
+	ACTION_UPDATE   = "update"
+	ACTION_INCIDENT = "incident"
+)
+
+var (
+	certSourceRe = regexp.MustCompile(`'([0-9a-z.\-]*\.[a-z]+)'`)
+	ruleNameRe   = regexp.MustCompile(`^[A-Za-z0-9_\-]+$`)
+
+	//operators the evaluator supports, a filter using any other is rejected
+	filterOperators = map[string]bool{
+		"$eq": true, "$ne": true, "$gt": true, "$gte": true, "$lt": true, "$lte": true,
+		"$in": true, "$nin": true, "$all": true, "$exists": true, "$regex": true, "$options": true,
+		"$not": true, "$size": true, "$elemMatch": true,
+	}
+
+	//fields an update rule may set and the kind of value each takes
+	updateFields = map[string]string{
+		"threat_level":         "level",
+		"is_man_classified":    "bool",
+		"is_seen":              "bool",
+		"staff_classified":     "bool",
+		"stop_auto_classifier": "bool",
+		"event_type":           "string",
+		"status":               "string",
+	}
+)
+
+// RuleParams are the options of the incident action. threatLevel is the spelling used by the
+// older rules and is read when threat_level is not set.
+type RuleParams struct {
+	IncidentType      string `json:"incident_type,omitempty" bson:"incident_type,omitempty" yaml:"incident_type"`
+	ThreatLevel       *int64 `json:"threat_level,omitempty" bson:"threat_level,omitempty" yaml:"threat_level"`
+	LegacyThreatLevel *int64 `json:"threatLevel,omitempty" bson:"threatLevel,omitempty" yaml:"threatLevel"`
+	ThreatActor       bool   `json:"threat_actor,omitempty" bson:"threat_actor,omitempty" yaml:"threat_actor"`
+	Dump              bool   `json:"dump,omitempty" bson:"dump,omitempty" yaml:"dump"`
+	IsManClassified   bool   `json:"isManClassified,omitempty" bson:"isManClassified,omitempty" yaml:"isManClassified"`
+
+	//severity of the rule's incidents, over that of the incident type
+	Severity *int64 `json:"severity,omitempty" bson:"severity,omitempty" yaml:"severity"`
+}
+
+type Rule struct {
+	Name   string                 `json:"name" yaml:"name"`
+	Filter map[string]interface{} `json:"filter,omitempty" yaml:"filter"`
+	Action string                 `json:"action" yaml:"action"`
+	Update map[string]interface{} `json:"update,omitempty" yaml:"update"`
+	Params RuleParams             `json:"params" yaml:"params"`
+
+	//set on the rules resolved for a case's settings, see ResolveRules
+	Case       string `json:"case,omitempty" yaml:"-"`
+	AlertLevel int64  `json:"alert_level,omitempty" yaml:"-"`
+
+	//the filter before the cases with their own copy were left out of it, see Hash
+	BaseFilter map[string]interface{} `json:"-" yaml:"-"`
+}
+
+// RulesPath is where the rules file is deployed, next to the binary.
+func RulesPath() string {
+	return filepath.Join(os.Getenv("LAMBDA_TASK_ROOT"), RULES_FILE)
+}
+
+// GetRules loads the rules in the order they are applied.
+func GetRules(path string) ([]Rule, error) {
+	var data []Rule
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return data, err
+	}
+
+	err = yaml.Unmarshal(b, &data)
+	if err != nil {
+		return data, err
+	}
+
+	err = PrepareRules(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// PrepareRules validates a rule set, rule names have to be unique, and gives the filters
+// and updates string keys throughout.
+func PrepareRules(rules []Rule) error {
+	names := make(map[string]bool)
+
+	for i := range rules {
+		rules[i].Filter = normalizeYAML(rules[i].Filter).(map[string]interface{})
+		rules[i].Update = normalizeYAML(rules[i].Update).(map[string]interface{})
+
+		err := rules[i].Validate()
+		if err != nil {
+			return err
+		}
+
+		if names[rules[i].Name] {
+			return errors.New("Rule " + rules[i].Name + " is defined more than once")
+		}
+		names[rules[i].Name] = true
+
+		//levels read from json are floats, they are stored as integers
+		for k, v := range rules[i].Update {
+			if l, ok := toFloat(v); ok && updateFields[CanonicalEventKey(k)] == "level" {
+				rules[i].Update[k] = int64(l)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (rule *Rule) Validate() error {
+	if rule.Name == "" {
+		return errors.New("Rule must contain name")
+	}
+
+	if !ruleNameRe.MatchString(rule.Name) {
+		return errors.New("Rule name " + rule.Name + " may only contain letters, digits, _ and -")
+	}
+
+	switch rule.Action {
+	case ACTION_UPDATE:
+		if len(rule.Update) == 0 {
+			return errors.New("Rule " + rule.Name + " must contain update")
+		}
+		err := ValidateUpdate(rule.Update)
+		if err != nil {
+			return errors.New("Rule " + rule.Name + ": " + err.Error())
+		}
+	case ACTION_INCIDENT:
+		if rule.Params.IncidentType == "" {
+			return errors.New("Rule " + rule.Name + " must contain params.incident_type")
+		}
+		level := rule.Params.Level()
+		if level < 0 || level > 5 {
+			return errors.New("Rule " + rule.Name + ": threat_level must be between 0 and 5")
+		}
+		if s := rule.Params.Severity; s != nil && (*s < 0 || *s > 5) {
+			return errors.New("Rule " + rule.Name + ": severity must be between 0 and 5")
+		}
+	default:
+		return errors.New("Rule " + rule.Name + " has unknown action " + rule.Action)
+	}
+
+	err := ValidateFilter(rule.Filter)
+	if err != nil {
+		return errors.New("Rule " + rule.Name + ": " + err.Error())
+	}
+
+	return nil
+}
+
+func isNumber(v interface{}) bool {
+	switch v.(type) {
+	case int, int32, int64, float32, float64:
+		return true
+	}
+	return false
+}
+
+func asStringMap(v interface{}) (map[string]interface{}, bool) {
+	m, ok := v.(map[string]interface{})
+	return m, ok
+}
+
+// ValidateFilter checks a rule filter only uses operators the evaluator supports, with
+// arguments of the right kind.
+func ValidateFilter(filter map[string]interface{}) error {
+	for key, cond := range filter {
+		if key == "$and" || key == "$or" || key == "$nor" {
+			list, ok := cond.([]interface{})
+			if !ok || len(list) == 0 {
+				return errors.New(key + " must be a list of conditions")
+			}
+			for _, c := range list {
+				m, ok := asStringMap(c)
+				if !ok || len(m) == 0 {
+					return errors.New(key + " must be a list of conditions")
+				}
+				err := ValidateFilter(m)
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if strings.HasPrefix(key, "$") {
+			return errors.New("Unsupported operator " + key)
+		}
+
+		for _, part := range strings.Split(key, ".") {
+			if part == "" || strings.Contains(part, "$") {
+				return errors.New("Invalid field " + key)
+			}
+		}
+
+		err := validateCondition(key, cond)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func validateCondition(key string, cond interface{}) error {
+	ops, ok := asStringMap(cond)
+	if !ok {
+		return nil
+	}
+
+	operators := 0
+	for op := range ops {
+		if strings.HasPrefix(op, "$") {
+			operators++
+		}
+	}
+
+	if operators == 0 {
+		return nil
+	}
+
+	if operators != len(ops) {
+		return errors.New(key + " mixes operators and fields")
+	}
+
+	for op, arg := range ops {
+		if !filterOperators[op] {
+			return errors.New("Unsupported operator " + op + " on " + key)
+		}
+
+		switch op {
+		case "$gt", "$gte", "$lt", "$lte":
+			_, isString := arg.(string)
+			_, isTime := arg.(time.Time)
+			if !isNumber(arg) && !isString && !isTime {
+				return errors.New(op + " on " + key + " must be a number, string or date")
+			}
+		case "$in", "$nin", "$all":
+			if _, ok := arg.([]interface{}); !ok {
+				return errors.New(op + " on " + key + " must be a list")
+			}
+		case "$exists":
+			if _, ok := arg.(bool); !ok && !isNumber(arg) {
+				return errors.New("$exists on " + key + " must be true or false")
+			}
+		case "$size":
+			if !isNumber(arg) {
+				return errors.New("$size on " + key + " must be a number")
+			}
+		case "$regex":
+			pattern, ok := arg.(string)
+			if !ok {
+				return errors.New("$regex on " + key + " must be a string")
+			}
+			options, _ := ops["$options"].(string)
+			_, err := CompileRegex(pattern, options)
+			if err != nil {
+				return errors.New("$regex on " + key + ": " + err.Error())
+			}
+		case "$options":
+			options, ok := arg.(string)
+			if !ok || strings.Trim(options, "imsx") != "" {
+				return errors.New("$options on " + key + " may only contain i, m, s and x")
+			}
+		case "$not":
+			m, ok := asStringMap(arg)
+			if !ok || len(m) == 0 {
+				return errors.New("$not on " + key + " must hold operators")
+			}
+			err := validateCondition(key, m)
+			if err != nil {
+				return err
+			}
+		case "$elemMatch":
+			m, ok := asStringMap(arg)
+			if !ok || len(m) == 0 {
+				return errors.New("$elemMatch on " + key + " must be a document")
+			}
+			//operators for arrays of values, a query for arrays of documents
+			var err error
+			if _, isOps := isOperatorDocument(m); isOps {
+				err = validateCondition(key, m)
+			} else {
+				err = ValidateFilter(m)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// ValidateUpdate checks an update only sets the fields rules may change.
+func ValidateUpdate(update map[string]interface{}) error {
+	for key, v := range update {
+		kind, ok := updateFields[CanonicalEventKey(key)]
+		if !ok {
+			return errors.New("Rules can not update " + key)
+		}
+
+		switch kind {
+		case "level":
+			if !isNumber(v) {
+				return errors.New(key + " must be a number")
+			}
+			if l, _ := toFloat(v); l < 0 || l > 5 || l != float64(int64(l)) {
+				return errors.New(key + " must be between 0 and 5")
+			}
+		case "bool":
+			if _, ok := v.(bool); !ok {
+				return errors.New(key + " must be true or false")
+			}
+		case "string":
+			if _, ok := v.(string); !ok {
+				return errors.New(key + " must be a string")
+			}
+		}
+	}
+
+	return nil
+}
+
+// normalizeYAML turns the map[interface{}]interface{} values yaml decodes nested mappings
+// into, which the bson encoder does not accept, into string keyed maps.
+func normalizeYAML(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(t))
+		for k, val := range t {
+			out[fmt.Sprint(k)] = normalizeYAML(val)
+		}
+		return out
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(t))
+		for k, val := range t {
+			out[k] = normalizeYAML(val)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(t))
+		for i := range t {
+			out[i] = normalizeYAML(t[i])
+		}
+		return out
+	case nil:
+		return map[string]interface{}{}
+	}
+
+	return v
+}
+
+// Level is the threat level the events of an incident rule are classified with.
+// BelowAlertLevel is true for rules resolved for a case whose alert level is over the
+// rule's threat level.
+func (rule *Rule) BelowAlertLevel() bool {
+	return rule.AlertLevel > rule.Params.Level()
+}
+
+func (p RuleParams) Level() int64 {
+	if p.ThreatLevel != nil {
+		return *p.ThreatLevel
+	}
+
+	if p.LegacyThreatLevel != nil {
+		return *p.LegacyThreatLevel
+	}
+
+	return DefaultThreatLevel
+}
+
+func nestedNames(key string) []string {
+	canonical := key
+	if c, ok := nestedEventAliases[key]; ok {
+		canonical = c
+	}
+
+	out := []string{canonical}
+	for legacy, c := range nestedEventAliases {
+		if c == canonical {
+			out = append(out, legacy)
+		}
+	}
+
+	return out
+}
+
+// FieldPaths returns every spelling of a dotted event field, e.g asset_matches.match.keyword_type
+// is also stored as assetMatches.match.keywordType by the legacy matcher.
+func FieldPaths(path string) []string {
+	parts := strings.Split(path, ".")
+	out := EventFieldNames(CanonicalEventKey(parts[0]))
+
+	for _, p := range parts[1:] {
+		names := []string{p}
+		if _, err := strconv.Atoi(p); err != nil {
+			names = nestedNames(p)
+		}
+
+		var next []string
+		for _, prefix := range out {
+			for _, n := range names {
+				next = append(next, prefix+"."+n)
+			}
+		}
+		out = next
+	}
+
+	return out
+}
+
+func urlPart(u *string, i int) string {
+	if u == nil {
+		return ""
+	}
+
+	parts := strings.Split(*u, "/")
+	if len(parts) > i {
+		return parts[i]
+	}
+
+	return ""
+}
+
+// GetDumpSource is the name of the dump, the first path segment of the event url.
+func (event *Event) GetDumpSource() string {
+	source := urlPart(event.URL, 3)
+	if source == "" {
+		return "NA"
+	}
+	return source
+}
+
+// GetSourceCert is the host a certificate was issued for, from the url or else the first
+// quoted domain in the cut which is not the one searched for.
+func (event *Event) GetSourceCert() string {
+	source := urlPart(event.URL, 4)
+	if source != "" {
+		return source
+	}
+
+	if len(event.Cuts) == 0 || event.Cuts[0] == nil || event.Cuts[0].Cut == nil {
+		return ""
+	}
+
+	var term string
+	if m := event.Cuts[0].Matched; m != nil && m.SearchTerm != nil {
+		term = *m.SearchTerm
+	}
+
+	for _, m := range certSourceRe.FindAllStringSubmatch(*event.Cuts[0].Cut, -1) {
+		if m[1] != term {
+			return m[1]
+		}
+	}
+
+	return ""
+}
+
+// Source is what the incident is about, the incidents of a case are deduplicated on it.
+func (rule *Rule) Source(event Event) string {
+	switch {
+	case rule.Params.Dump:
+		return event.GetDumpSource()
+	case rule.Params.IncidentType == "similar_domain" || rule.Params.IncidentType == "existing_similar_domain":
+		source := urlPart(event.URL, 4)
+		if source == "" {
+			source = urlPart(event.URL, 3)
+		}
+		return source
+	case rule.Params.IncidentType == "new_cert_discovered" || rule.Params.IncidentType == "new_multi_cert":
+		return event.GetSourceCert()
+	}
+
+	if event.Site != nil {
+		return *event.Site
+	}
+
+	return ""
+}
+
+// IsOwnThreatActor is true for events about an asset which is one of its own threat actors,
+// these are classified without raising an incident.
+func (event *Event) IsOwnThreatActor() bool {
+	if event.AssetID == nil || event.ThreatActors == nil {
+		return false
+	}
+
+	for _, ta := range *event.ThreatActors {
+		if ta == *event.AssetID {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Event is the canonical event model. Documents written by the legacy matcher use camelCase keys
+// and are renamed to the snake_case keys below when decoded, see eventAliases.
+type Event struct {
+	ID         *string `json:"id" bson:"_id,omitempty"`
+	CaseID     *string `json:"case_id" bson:"case_id,omitempty"`
+	AssetID    *string `json:"asset_id,omitempty" bson:"asset_id,omitempty"`
+	IncidentID *string `json:"incident_id,omitempty" bson:"incident_id,omitempty"`
+	Status     *string `json:"status,omitempty" bson:"status,omitempty"`
+
+	URL             *string `json:"url,omitempty" bson:"url,omitempty"`
+	Site            *string `json:"site,omitempty" bson:"site,omitempty"`
+	Title           *string `json:"title,omitempty" bson:"title,omitempty"`
+	TranslatedTitle *string `json:"translated_title,omitempty" bson:"translated_title,omitempty"`
+	Hash            *string `json:"hash,omitempty" bson:"hash,omitempty"`
+	ContentHash     *string `json:"content_hash,omitempty" bson:"content_hash,omitempty"`
+	URLHash         *string `json:"url_hash,omitempty" bson:"url_hash,omitempty"`
+	TitleHash       *string `json:"title_hash,omitempty" bson:"title_hash,omitempty"`
+	PageRank        *int64  `json:"page_rank,omitempty" bson:"page_rank,omitempty"`
+
+	//shared with the events other cases have for the same url and title
+	SourceDocumentID *string `json:"source_document_id,omitempty" bson:"source_document_id,omitempty"`
+
+	//full content as fetched, stored gzipped in the object store under snapshot_key
+	ContentSHA256       *string `json:"content_sha256,omitempty" bson:"content_sha256,omitempty"`
+	SnapshotKey         *string `json:"snapshot_key,omitempty" bson:"snapshot_key,omitempty"`
+	SnapshotSize        *int64  `json:"snapshot_size,omitempty" bson:"snapshot_size,omitempty"`
+	SnapshotContentType *string `json:"snapshot_content_type,omitempty" bson:"snapshot_content_type,omitempty"`
+
+	Type              *string `json:"type,omitempty" bson:"type,omitempty"`
+	EventType         *string `json:"event_type,omitempty" bson:"event_type,omitempty"`
+	SourceType        *string `json:"source_type,omitempty" bson:"source_type,omitempty"`
+	SourceContentType *string `json:"source_content_type,omitempty" bson:"source_content_type,omitempty"`
+	SourceNetwork     *string `json:"source_network,omitempty" bson:"source_network,omitempty"`
+	Agent             *string `json:"agent,omitempty" bson:"agent,omitempty"`
+	OriginMatcher     *string `json:"origin_matcher,omitempty" bson:"origin_matcher,omitempty"`
+	MatcherPID        *int64  `json:"matcher_pid,omitempty" bson:"matcher_pid,omitempty"`
+	Version           *int64  `json:"version,omitempty" bson:"version,omitempty"`
+
+	CaseType        *string          `json:"case_type,omitempty" bson:"case_type,omitempty"`
+	AssetName       *string          `json:"asset_name,omitempty" bson:"asset_name,omitempty"`
+	AssetType       *string          `json:"asset_type,omitempty" bson:"asset_type,omitempty"`
+	ThreatActors    *Strings         `json:"threat_actors,omitempty" bson:"threat_actors,omitempty"`
+	ThreatLevel     *int64           `json:"threat_level,omitempty" bson:"threat_level,omitempty"`
+	ConfidenceScore *float64         `json:"confidence_score,omitempty" bson:"confidence_score,omitempty"`
+	AssetMatches    *EventAssetMatch `json:"asset_matches,omitempty" bson:"asset_matches,omitempty"`
+	Cuts            []*EventCut      `json:"cuts,omitempty" bson:"cuts,omitempty"`
+	CutCount        *int64           `json:"cut_count,omitempty" bson:"cut_count,omitempty"`
+	URLCount        *int64           `json:"url_count,omitempty" bson:"url_count,omitempty"`
+
+	Language           *string  `json:"language,omitempty" bson:"language,omitempty"`
+	Languages          *Strings `json:"languages,omitempty" bson:"languages,omitempty"`
+	ParsedDates        *Strings `json:"parsed_dates,omitempty" bson:"parsed_dates,omitempty"`
+	IsTranslated       *bool    `json:"is_translated,omitempty" bson:"is_translated,omitempty"`
+	TranslationNeeded  *bool    `json:"translation_needed,omitempty" bson:"translation_needed,omitempty"`
+	TranslationWallet  *int64   `json:"translation_wallet,omitempty" bson:"translation_wallet,omitempty"`
+	TranslationCounter *int64   `json:"translation_counter,omitempty" bson:"translation_counter,omitempty"`
+	TranslatorVersion  *int64   `json:"translator_version,omitempty" bson:"translator_version,omitempty"`
+
+	IsStarred          *bool `json:"is_starred,omitempty" bson:"is_starred,omitempty"`
+	IsSeen             *bool `json:"is_seen,omitempty" bson:"is_seen,omitempty"`
+	IsAutoClassified   *bool `json:"is_auto_classified,omitempty" bson:"is_auto_classified,omitempty"`
+	IsManClassified    *bool `json:"is_man_classified,omitempty" bson:"is_man_classified,omitempty"`
+	StopAutoClassifier *bool `json:"stop_auto_classifier,omitempty" bson:"stop_auto_classifier,omitempty"`
+	StaffStarred       *bool `json:"staff_starred,omitempty" bson:"staff_starred,omitempty"`
+	StaffSeen          *bool `json:"staff_seen,omitempty" bson:"staff_seen,omitempty"`
+	StaffClassified    *bool `json:"staff_classified,omitempty" bson:"staff_classified,omitempty"`
+
+	//usernames of the analysts who have seen or starred the event
+	SeenBy       *Strings `json:"seen_by,omitempty" bson:"seen_by,omitempty"`
+	StarredBy    *Strings `json:"starred_by,omitempty" bson:"starred_by,omitempty"`
+	ClassifiedBy *string  `json:"classified_by,omitempty" bson:"classified_by,omitempty"`
+
+	History []*EventHistory `json:"history,omitempty" bson:"history,omitempty"`
+
+	//indicators found in the content
+	Links    *Strings `json:"links,omitempty" bson:"links,omitempty"`
+	Emails   *Strings `json:"emails,omitempty" bson:"emails,omitempty"`
+	IPs      *Strings `json:"ips,omitempty" bson:"ips,omitempty"`
+	Hashtags *Strings `json:"hashtags,omitempty" bson:"hashtags,omitempty"`
+	Keywords *Strings `json:"keywords,omitempty" bson:"keywords,omitempty"`
+	Crypto   *Strings `json:"crypto,omitempty" bson:"crypto,omitempty"`
+	Targets  *Strings `json:"targets,omitempty" bson:"targets,omitempty"`
+	Hashes   *Strings `json:"hashes,omitempty" bson:"hashes,omitempty"`
+	Phones   *Strings `json:"phones,omitempty" bson:"phones,omitempty"`
+
+	Credentials       []*EventCredential `json:"credentials,omitempty" bson:"credentials,omitempty"`
+	IndicatorsVersion *int64             `json:"indicators_version,omitempty" bson:"indicators_version,omitempty"`
+
+	CreatedAt        *time.Time `json:"created_at,omitempty" bson:"created_at,omitempty"`
+	UpdatedAt        *time.Time `json:"updated_at,omitempty" bson:"updated_at,omitempty"`
+	IngestedAt       *time.Time `json:"ingested_at,omitempty" bson:"ingested_at,omitempty"`
+	SeenAt           *time.Time `json:"seen_at,omitempty" bson:"seen_at,omitempty"`
+	TranslatedAt     *time.Time `json:"translated_at,omitempty" bson:"translated_at,omitempty"`
+	ManClassifiedAt  *time.Time `json:"man_classified_at,omitempty" bson:"man_classified_at,omitempty"`
+	AutoClassifiedAt *time.Time `json:"auto_classified_at,omitempty" bson:"auto_classified_at,omitempty"`
+
+	//set from the case by the endpoints, never stored
+	Group    *string `json:"group,omitempty" bson:"-"`
+	CaseName *string `json:"case_name,omitempty" bson:"-"`
+}
+
+type EventHistory struct {
+	Action      *string    `json:"action,omitempty" bson:"action,omitempty"`
+	User        *string    `json:"user,omitempty" bson:"user,omitempty"`
+	Rule        *string    `json:"rule,omitempty" bson:"rule,omitempty"`
+	ThreatLevel *int64     `json:"threat_level,omitempty" bson:"threat_level,omitempty"`
+	ContentHash *string    `json:"content_hash,omitempty" bson:"content_hash,omitempty"`
+	CutLen      *int64     `json:"cut_len,omitempty" bson:"cut_len,omitempty"`
+	Informer    *bool      `json:"informer,omitempty" bson:"informer,omitempty"`
+	Date        *time.Time `json:"date,omitempty" bson:"date,omitempty"`
+}
+
+type EventAssetMatch struct {
+	Position []int64     `json:"position,omitempty" bson:"position,omitempty"`
+	Term     *string     `json:"term,omitempty" bson:"term,omitempty"`
+	CaseID   *string     `json:"case_id,omitempty" bson:"case_id,omitempty"`
+	CaseType *string     `json:"case_type,omitempty" bson:"case_type,omitempty"`
+	Match    *EventMatch `json:"match,omitempty" bson:"match,omitempty"`
+}
+
+type EventMatch struct {
+	ID              *string  `json:"id,omitempty" bson:"_id,omitempty"`
+	KeywordType     *string  `json:"keyword_type,omitempty" bson:"keyword_type,omitempty"`
+	KeywordSource   *string  `json:"keyword_source,omitempty" bson:"keyword_source,omitempty"`
+	AssetFieldCount *int64   `json:"asset_field_count,omitempty" bson:"asset_field_count,omitempty"`
+	AssetType       *string  `json:"asset_type,omitempty" bson:"asset_type,omitempty"`
+	AssetCaseID     *string  `json:"asset_case_id,omitempty" bson:"asset_case_id,omitempty"`
+	AssetName       *string  `json:"asset_name,omitempty" bson:"asset_name,omitempty"`
+	RequiredScore   *float64 `json:"required_score,omitempty" bson:"required_score,omitempty"`
+	ConfidenceScore *float64 `json:"confidence_score,omitempty" bson:"confidence_score,omitempty"`
+	URL             *string  `json:"url,omitempty" bson:"url,omitempty"`
+}
+
+// EventCredential is a login found in the content. The password is only kept masked and hashed.
+type EventCredential struct {
+	Username       *string `json:"username,omitempty" bson:"username,omitempty"`
+	PasswordMasked *string `json:"password_masked,omitempty" bson:"password_masked,omitempty"`
+	PasswordSHA256 *string `json:"password_sha256,omitempty" bson:"password_sha256,omitempty"`
+}
+
+type EventCut struct {
+	Cut               *string          `json:"cut,omitempty" bson:"cut,omitempty"`
+	Translated        *string          `json:"translated,omitempty" bson:"translated,omitempty"`
+	Base              *string          `json:"base,omitempty" bson:"base,omitempty"`
+	Type              *string          `json:"type,omitempty" bson:"type,omitempty"`
+	Len               *int64           `json:"len,omitempty" bson:"len,omitempty"`
+	StartPos          *int64           `json:"start_pos,omitempty" bson:"start_pos,omitempty"`
+	EndPos            *int64           `json:"end_pos,omitempty" bson:"end_pos,omitempty"`
+	LineHash          *string          `json:"line_hash,omitempty" bson:"line_hash,omitempty"`
+	HashVersion       *int64           `json:"hash_version,omitempty" bson:"hash_version,omitempty"`
+	TagsMax           *int64           `json:"tags_max,omitempty" bson:"tags_max,omitempty"`
+	PotentialKeywords *Strings         `json:"potential_keywords,omitempty" bson:"potential_keywords,omitempty"`
+	Matched           *EventCutMatch   `json:"matched,omitempty" bson:"matched,omitempty"`
+	Matches           []*EventCutMatch `json:"matches,omitempty" bson:"matches,omitempty"`
+}
+
+type EventCutMatch struct {
+	AssetID       *string  `json:"asset_id,omitempty" bson:"asset_id,omitempty"`
+	CaseID        *string  `json:"case_id,omitempty" bson:"case_id,omitempty"`
+	SearchTerm    *string  `json:"search_term,omitempty" bson:"search_term,omitempty"`
+	Matched       *string  `json:"matched,omitempty" bson:"matched,omitempty"`
+	KeywordName   *string  `json:"keyword_name,omitempty" bson:"keyword_name,omitempty"`
+	Expression    *string  `json:"expression,omitempty" bson:"expression,omitempty"`
+	Info          *string  `json:"info,omitempty" bson:"info,omitempty"`
+	Standalone    *bool    `json:"standalone,omitempty" bson:"standalone,omitempty"`
+	Required      *bool    `json:"required,omitempty" bson:"required,omitempty"`
+	IsThreatActor *bool    `json:"is_threat_actor,omitempty" bson:"is_threat_actor,omitempty"`
+	StartPos      *int64   `json:"start_pos,omitempty" bson:"start_pos,omitempty"`
+	EndPos        *int64   `json:"end_pos,omitempty" bson:"end_pos,omitempty"`
+	Score         *float64 `json:"score,omitempty" bson:"score,omitempty"`
+}
+
+var (
+	//top level keys written by the legacy matcher and rules engine, and the key they are stored under now
+	eventAliases = map[string]string{
+		"caseId":             "case_id",
+		"parentId":           "case_id",
+		"assetId":            "asset_id",
+		"incident":           "incident_id",
+		"assetName":          "asset_name",
+		"assetType":          "asset_type",
+		"caseType":           "case_type",
+		"contentHash":        "content_hash",
+		"urlHash":            "url_hash",
+		"titleHash":          "title_hash",
+		"pageRank":           "page_rank",
+		"eventType":          "event_type",
+		"sourceType":         "source_type",
+		"sourceContentType":  "source_content_type",
+		"sourceNetwork":      "source_network",
+		"originMatcher":      "origin_matcher",
+		"matcherPid":         "matcher_pid",
+		"threatActorsList":   "threat_actors",
+		"threatLevel":        "threat_level",
+		"confidenceScore":    "confidence_score",
+		"assetMatches":       "asset_matches",
+		"cutCount":           "cut_count",
+		"urlCnt":             "url_count",
+		"parsedDates":        "parsed_dates",
+		"translatedTitle":    "translated_title",
+		"isTranslated":       "is_translated",
+		"translationNeeded":  "translation_needed",
+		"translationWallet":  "translation_wallet",
+		"translationCounter": "translation_counter",
+		"translatorVersion":  "translator_version",
+		"isStared":           "is_starred",
+		"is_stared":          "is_starred",
+		"isSeen":             "is_seen",
+		"isAutoClassified":   "is_auto_classified",
+		"isManClassified":    "is_man_classified",
+		"stopAutoClassifier": "stop_auto_classifier",
+		"staffStared":        "staff_starred",
+		"staff_stared":       "staff_starred",
+		"staffSeen":          "staff_seen",
+		"staffClassified":    "staff_classified",
+		"time":               "created_at",
+		"seenDate":           "seen_at",
+		"translateDate":      "translated_at",
+		"manClassDate":       "man_classified_at",
+		"autoClassDate":      "auto_classified_at",
+		"link":               "links",
+		"email":              "emails",
+		"ip":                 "ips",
+		"hashtag":            "hashtags",
+		"keyword":            "keywords",
+		"target":             "targets",
+	}
+
+	//keys of embedded documents such as cuts, matches and history entries
+	nestedEventAliases = map[string]string{
+		"caseId":            "case_id",
+		"caseType":          "case_type",
+		"assetId":           "asset_id",
+		"searchTerm":        "search_term",
+		"isThreatActor":     "is_threat_actor",
+		"lineHash":          "line_hash",
+		"hashVersion":       "hash_version",
+		"max_tag":           "tags_max",
+		"tagsMax":           "tags_max",
+		"potentialKeywords": "potential_keywords",
+		"keywordType":       "keyword_type",
+		"keywordSource":     "keyword_source",
+		"assetFieldCount":   "asset_field_count",
+		"assetType":         "asset_type",
+		"assetCaseId":       "asset_case_id",
+		"assetName":         "asset_name",
+		"requiredScore":     "required_score",
+		"confidenceScore":   "confidence_score",
+		"contentHash":       "content_hash",
+		"cutLen":            "cut_len",
+		"threatLevel":       "threat_level",
+	}
+
+	//legacy documents hold flags in some of the date fields, those values are dropped
+	eventTimeFields = map[string]bool{
+		"created_at":         true,
+		"updated_at":         true,
+		"ingested_at":        true,
+		"seen_at":            true,
+		"translated_at":      true,
+		"man_classified_at":  true,
+		"auto_classified_at": true,
+	}
+)
+
+// CanonicalEventKey returns the current name of an event field, e.g "caseId" becomes "case_id".
+func CanonicalEventKey(key string) string {
+	if c, ok := eventAliases[key]; ok {
+		return c
+	}
+	return key
+}
+
+// EventFieldNames returns the current name of a field followed by its legacy spellings,
+// for filters which have to match documents written by either.
+func EventFieldNames(canonical string) []string {
+	out := []string{canonical}
+	for legacy, c := range eventAliases {
+		if c == canonical {
+			out = append(out, legacy)
+		}
+	}
+
+	sort.Strings(out[1:])
+
+	return out
+}
+
+func canonicalValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case primitive.D:
+		return canonicalDocument(t, nestedEventAliases, nil)
+	case primitive.A:
+		out := make(primitive.A, len(t))
+		for i := range t {
+			out[i] = canonicalValue(t[i])
+		}
+		return out
+	}
+
+	return v
+}
+
+func canonicalDocument(doc primitive.D, aliases map[string]string, timeFields map[string]bool) primitive.D {
+	var out primitive.D
+	index := make(map[string]int)
+	canonical := make(map[string]bool)
+
+	for _, e := range doc {
+		key := e.Key
+		alias, isAlias := aliases[key]
+		if isAlias {
+			key = alias
+		}
+
+		if timeFields[key] {
+			if _, ok := e.Value.(primitive.DateTime); !ok {
+				continue
+			}
+		}
+
+		value := canonicalValue(e.Value)
+
+		i, seen := index[key]
+		if !seen {
+			index[key] = len(out)
+			out = append(out, primitive.E{Key: key, Value: value})
+			canonical[key] = !isAlias
+			continue
+		}
+
+		//a document holding both spellings keeps the current one
+		if !isAlias && !canonical[key] {
+			out[i].Value = value
+			canonical[key] = true
+		}
+	}
+
+	return out
+}
+
+// CanonicalEventDocument renames the legacy keys of a raw event document.
+func CanonicalEventDocument(doc primitive.D) primitive.D {
+	return canonicalDocument(doc, eventAliases, eventTimeFields)
+}
+
+// UnmarshalBSON decodes both legacy camelCase and current snake_case event documents.
+func (e *Event) UnmarshalBSON(data []byte) error {
+	var doc primitive.D
+	err := bson.Unmarshal(data, &doc)
+	if err != nil {
+		return err
+	}
+
+	b, err := bson.Marshal(CanonicalEventDocument(doc))
+	if err != nil {
+		return err
+	}
+
+	//plain has the same fields without this method, so decoding it does not recurse
+	type plain Event
+	var out plain
+	err = bson.Unmarshal(b, &out)
+	if err != nil {
+		return err
+	}
+
+	*e = Event(out)
+
+	return nil
+}
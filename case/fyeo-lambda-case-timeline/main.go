@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	gMap        = make(map[string]bool)
+	MongoClient *mongo.Client
+
+	defaultHeaders = map[string]string{
+		"Content-Type":                 "application/json",
+		"Access-Control-Allow-Headers": "*",
+		"Access-Control-Allow-Origin":  "*",
+		"Access-Control-Allow-Methods": "GET, OPTIONS",
+		"Allow":                        "GET, OPTIONS",
+	}
+)
+
+type Strings []string
+
+type Case struct {
+	ID    *string `json:"id,omitempty" bson:"_id,omitempty"`
+	Name  *string `json:"name,omitempty" bson:"name,omitempty"`
+	Group *string `json:"group,omitempty" bson:"group,omitempty"`
+}
+
+type ErrorResponse struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+func ServeError(message string, code int) events.APIGatewayProxyResponse {
+	js, _ := json.Marshal(ErrorResponse{
+		Code:    code,
+		Message: message,
+	})
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: code,
+		Body:       string(js),
+		Headers:    defaultHeaders,
+	}
+}
+
+func main() {
+	lambda.Start(Handler)
+}
+
+func Init() error {
+	var err error
+
+	err = ReuseMongo()
+	if err != nil {
+		return err
+	}
+
+	return err
+}
+
+func ReuseMongo() error {
+	if MongoClient != nil {
+		return nil
+	} else {
+		var err error
+		ctx := context.Background()
+
+		uri := "mongodb://192.168.0.229:27017"
+
+		MongoClient, err = mongo.Connect(ctx, options.Client().ApplyURI(uri))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func GetCase(ctx context.Context, id string) (Case, error) {
+	var out Case
+	o_id, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return out, err
+	}
+
+	filter := bson.M{"_id": o_id, "is_archived": bson.M{"$ne": true}}
+	err = MongoClient.Database("fyeo-di").Collection("cases").FindOne(ctx, filter).Decode(&out)
+
+	return out, err
+}
+
+func CasePermissions(input Case) bool {
+	if input.Group != nil {
+		_, ok := gMap[*input.Group]
+		return ok
+	}
+
+	return false
+}
+
+func VerifyRequest(request events.APIGatewayProxyRequest) error {
+
+	claims := request.RequestContext.Authorizer["claims"]
+	if claims == nil {
+		return errors.New("No claims found for " + request.RequestContext.Identity.CognitoIdentityID)
+	}
+
+	rg := claims.(map[string]interface{})["cognito:groups"]
+
+	if rg == nil {
+		return errors.New("No group permissions set")
+	}
+
+	groups := strings.Split(rg.(string), ",")
+
+	//warm containers keep gMap, start from nothing for every caller
+	gMap = make(map[string]bool)
+	for _, g := range groups {
+		gMap[g] = true
+	}
+
+	return nil
+}
+
+func Handler(rctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var err error
+	ctx, cancel := context.WithTimeout(context.Background(), 25*time.Second)
+	defer cancel()
+
+	id := request.PathParameters["id"]
+	if id == "" {
+		return ServeError("No ID provided", 400), nil
+	}
+
+	err = VerifyRequest(request)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	q, err := ParseTimelineQuery(request.QueryStringParameters)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	err = Init()
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	ca, err := GetCase(ctx, id)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	if !CasePermissions(ca) {
+		return ServeError("Unable to verify case group permissions", 400), nil
+	}
+
+	q.CaseID = id
+
+	out, err := Timeline(ctx, q)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	js, err := json.Marshal(out)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		Body:       string(js),
+		StatusCode: 200,
+		Headers:    defaultHeaders,
+	}, nil
+}
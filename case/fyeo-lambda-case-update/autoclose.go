@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	MAX_AUTO_CLOSE_ENTRIES = 200
+)
+
+// CaseAutoClose is what the case does not want to be alerted about. The rules engine does
+// not open incidents for it and closes the open ones. Domains cover their subdomains,
+// never_alert holds regular expressions matched against the source, title and urls.
+type CaseAutoClose struct {
+	KnownSubdomains *Strings `json:"known_subdomains,omitempty" bson:"known_subdomains,omitempty"`
+	OwnedDomains    *Strings `json:"owned_domains,omitempty" bson:"owned_domains,omitempty"`
+	TrustedSources  *Strings `json:"trusted_sources,omitempty" bson:"trusted_sources,omitempty"`
+	TrustedSites    *Strings `json:"trusted_sites,omitempty" bson:"trusted_sites,omitempty"`
+	NeverAlert      *Strings `json:"never_alert,omitempty" bson:"never_alert,omitempty"`
+}
+
+func validAutoCloseList(field string, list *Strings, check func(string) error) error {
+	if list == nil {
+		return nil
+	}
+
+	if len(*list) > MAX_AUTO_CLOSE_ENTRIES {
+		return errors.New(field + " may hold at most " + strconv.Itoa(MAX_AUTO_CLOSE_ENTRIES) + " entries")
+	}
+
+	for _, v := range *list {
+		if strings.TrimSpace(v) == "" {
+			return errors.New(field + " may not hold empty entries")
+		}
+
+		err := check(v)
+		if err != nil {
+			return errors.New(field + ": " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+func validDomain(v string) error {
+	if strings.ContainsAny(v, " /:*") || !strings.Contains(v, ".") {
+		return errors.New(v + " is not a domain")
+	}
+	return nil
+}
+
+func validPattern(v string) error {
+	_, err := regexp.Compile(v)
+	return err
+}
+
+func (a *CaseAutoClose) Validate() error {
+	domains := map[string]*Strings{
+		"auto_close.known_subdomains": a.KnownSubdomains,
+		"auto_close.owned_domains":    a.OwnedDomains,
+		"auto_close.trusted_sources":  a.TrustedSources,
+		"auto_close.trusted_sites":    a.TrustedSites,
+	}
+
+	for field, list := range domains {
+		err := validAutoCloseList(field, list, validDomain)
+		if err != nil {
+			return err
+		}
+	}
+
+	return validAutoCloseList("auto_close.never_alert", a.NeverAlert, validPattern)
+}
+
+// FlattenAutoClose sets the lists one by one, so updating one list keeps the others.
+func FlattenAutoClose(update_data bson.M) {
+	auto_close, ok := update_data["auto_close"].(bson.M)
+	if !ok {
+		return
+	}
+
+	delete(update_data, "auto_close")
+	for k, v := range auto_close {
+		update_data["auto_close."+k] = v
+	}
+}
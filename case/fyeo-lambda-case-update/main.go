@@ -41,6 +41,9 @@ type Case struct {
 	AlertLevel   *int64   `json:"alert_level,omitempty" bson:"alert_level,omitempty"`
 	Group        *string  `json:"group,omitempty" bson:"group,omitempty"`
 	ShouldNotify *bool    `json:"should_notify,omitempty" bson:"should_notify,omitempty"`
+
+	Retention *CaseRetention `json:"retention,omitempty" bson:"retention,omitempty"`
+	AutoClose *CaseAutoClose `json:"auto_close,omitempty" bson:"auto_close,omitempty"`
 }
 
 type Incident struct {
@@ -177,24 +180,22 @@ type ErrorResponse struct {
 }
 
 func (data Asset) GetName() string {
-	var name string
-	if data.Name.Common != nil {
-		name = *data.Name.Common
-	} else {
-		if data.Name.Last != nil {
-			name = *data.Name.Last
-		}
+	if data.Name == nil {
+		return ""
+	}
 
-		if data.Name.Middle != nil {
-			name += " " + *data.Name.Middle
-		}
+	if data.Name.Common != nil {
+		return *data.Name.Common
+	}
 
-		if data.Name.First != nil {
-			name += " " + *data.Name.First
+	var parts []string
+	for _, part := range []*string{data.Name.First, data.Name.Middle, data.Name.Last} {
+		if part != nil && *part != "" {
+			parts = append(parts, *part)
 		}
 	}
 
-	return name
+	return strings.Join(parts, " ")
 }
 
 func ServeError(message string, code int) events.APIGatewayProxyResponse {
@@ -370,11 +371,28 @@ func UpdateCase(id string, data Case) error {
 		return errors.New("Unable to verify group permissions")
 	}
 
+	if data.Retention != nil {
+		err = data.Retention.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	if data.AutoClose != nil {
+		err = data.AutoClose.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
 	update_data, err := StructToBsonMap(data)
 	if err != nil {
 		return err
 	}
 
+	FlattenRetention(update_data)
+	FlattenAutoClose(update_data)
+
 	update := bson.M{"$set": update_data}
 	o_id, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
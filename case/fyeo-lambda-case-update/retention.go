@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	//the rules engine looks back 7 days, nothing younger can be removed
+	MIN_RETENTION_DAYS = 7
+	MAX_THREAT_LEVEL   = 5
+)
+
+// CaseRetention is how long a case keeps events the retention job may remove. Unset
+// periods keep events forever.
+type CaseRetention struct {
+	UnlinkedDays           *int64 `json:"unlinked_days,omitempty" bson:"unlinked_days,omitempty"`
+	UnlinkedMaxThreatLevel *int64 `json:"unlinked_max_threat_level,omitempty" bson:"unlinked_max_threat_level,omitempty"`
+	ClosedIncidentDays     *int64 `json:"closed_incident_days,omitempty" bson:"closed_incident_days,omitempty"`
+}
+
+func validRetentionDays(field string, days *int64) error {
+	if days != nil && *days < MIN_RETENTION_DAYS {
+		return errors.New(field + " must be at least " + strconv.Itoa(MIN_RETENTION_DAYS) + " days")
+	}
+	return nil
+}
+
+func (r *CaseRetention) Validate() error {
+	err := validRetentionDays("retention.unlinked_days", r.UnlinkedDays)
+	if err != nil {
+		return err
+	}
+
+	err = validRetentionDays("retention.closed_incident_days", r.ClosedIncidentDays)
+	if err != nil {
+		return err
+	}
+
+	if r.UnlinkedMaxThreatLevel != nil && (*r.UnlinkedMaxThreatLevel < 0 || *r.UnlinkedMaxThreatLevel > MAX_THREAT_LEVEL) {
+		return errors.New("retention.unlinked_max_threat_level must be between 0 and " + strconv.Itoa(MAX_THREAT_LEVEL))
+	}
+
+	return nil
+}
+
+// FlattenRetention sets retention settings one by one, so updating one period keeps the others.
+func FlattenRetention(update_data bson.M) {
+	retention, ok := update_data["retention"].(bson.M)
+	if !ok {
+		return
+	}
+
+	delete(update_data, "retention")
+	for k, v := range retention {
+		update_data["retention."+k] = v
+	}
+}
@@ -1,37 +1,608 @@
 package main
 
-type IncidentDescription struct {
-	ID             string `json:"_id" bson:"_id"`
-	Severity       *int64
-	Title          *string
-	Recommendation *string
-	BusinessImpact *string
-	Class          *string
-	Description    *string
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	KNOWN_SUBDOMAIN_RECOMMENDATION = "closed since it is a known subdomain"
+)
+
+// IncidentType is the template incidents of a class are created from. The title, description
+// and recommendation are templates over TemplateData, see template.go.
+type IncidentType struct {
+	ID             *string `json:"id,omitempty" bson:"_id,omitempty"`
+	Severity       *int64  `json:"severity,omitempty" bson:"severity,omitempty"`
+	Title          *string `json:"title,omitempty" bson:"title,omitempty"`
+	Recommendation *string `json:"recommendation,omitempty" bson:"recommendation,omitempty"`
+	BusinessImpact *string `json:"business_impact,omitempty" bson:"business_impact,omitempty"`
+	Class          *string `json:"class,omitempty" bson:"class,omitempty"`
+	Description    *string `json:"description,omitempty" bson:"description,omitempty"`
 }
 
-type Case struct {
+type Incident struct {
+	ID              *string    `json:"id,omitempty" bson:"_id,omitempty"`
+	Title           *string    `json:"title,omitempty" bson:"title,omitempty"`
+	Type            *string    `json:"type,omitempty" bson:"type,omitempty"`
+	Rule            *string    `json:"rule,omitempty" bson:"rule,omitempty"`
+	ClassifiedBy    *string    `json:"classified_by,omitempty" bson:"classified_by,omitempty"`
+	ClassifiedAt    *time.Time `json:"classified_at,omitempty" bson:"classified_at,omitempty"`
+	CreatedAt       *time.Time `json:"created_at,omitempty" bson:"created_at,omitempty"`
+	UpdatedAt       *time.Time `json:"updated_at,omitempty" bson:"updated_at,omitempty"`
+	Description     *string    `json:"description,omitempty" bson:"description,omitempty"`
+	Recommendations *string    `json:"recommendations,omitempty" bson:"recommendations,omitempty"`
+	CaseID          *string    `json:"case_id,omitempty" bson:"case_id,omitempty"`
+	AssetID         *string    `json:"asset_id,omitempty" bson:"asset_id,omitempty"`
+	ThreatActorIDs  *Strings   `json:"threat_actor_ids,omitempty" bson:"threat_actor_ids,omitempty"`
+	Source          *string    `json:"source,omitempty" bson:"source,omitempty"`
+	SourceType      *string    `json:"source_type,omitempty" bson:"source_type,omitempty"`
+	Severity        *int64     `json:"severity,omitempty" bson:"severity,omitempty"`
+	TargetIDs       *Strings   `json:"target_ids,omitempty" bson:"target_ids,omitempty"`
+	Agent           *string    `json:"agent,omitempty" bson:"agent,omitempty"`
+	IsActive        *bool      `json:"is_active,omitempty" bson:"is_active,omitempty"`
+	IsReported      *bool      `json:"is_reported,omitempty" bson:"is_reported,omitempty"`
+	EventIDs        *Strings   `json:"event_ids,omitempty" bson:"event_ids,omitempty"`
 }
 
-func (incident *Incident) Create() error {
+type AssetName struct {
+	Common *string `json:"common,omitempty" bson:"common,omitempty"`
+	First  *string `json:"first,omitempty" bson:"first,omitempty"`
+	Middle *string `json:"middle,omitempty" bson:"middle,omitempty"`
+	Last   *string `json:"last,omitempty" bson:"last,omitempty"`
+}
 
-	return nil
+type Asset struct {
+	ID          *string    `json:"id,omitempty" bson:"_id,omitempty"`
+	Type        *string    `json:"type,omitempty" bson:"type,omitempty"`
+	AssetType   *string    `json:"asset_type,omitempty" bson:"asset_type,omitempty"`
+	Name        *AssetName `json:"name,omitempty" bson:"name,omitempty"`
+	Description *string    `json:"description,omitempty" bson:"description,omitempty"`
+}
+
+type ThreatActor struct {
+	ID          *string
+	Name        *string
+	Description *string
+}
+
+// GetName is the common name of organisations and domains and the full name of people.
+func (a Asset) GetName() string {
+	t := a.Type
+	if t == nil {
+		t = a.AssetType
+	}
+
+	if t == nil || a.Name == nil {
+		return "unknown"
+	}
+
+	switch *t {
+	case "organisation", "organization", "domain":
+		if a.Name.Common != nil {
+			return *a.Name.Common
+		}
+	case "person":
+		var parts []string
+		for _, p := range []*string{a.Name.First, a.Name.Middle, a.Name.Last} {
+			if p != nil && *p != "" {
+				parts = append(parts, *p)
+			}
+		}
+		if len(parts) > 0 {
+			return strings.Join(parts, " ")
+		}
+	}
+
+	return "unknown"
+}
+
+func (threat_actor_info *ThreatActor) GetName() string {
+	if threat_actor_info.Name != nil {
+		return *threat_actor_info.Name
+	} else {
+		return "unknown"
+	}
 }
 
-func GetIncidentTypes() ([]IncidentDescription, error) {
-	var data []IncidentDescription
-	//        self.incident_types = [incident_type for incident_type in self.mongo.incident_types.find()]
-	//need to add incident_type collection to mongodb
-	return data, nil
+// GetIncidentTypes returns the incident templates by class.
+func GetIncidentTypes(ctx context.Context) (map[string]IncidentType, error) {
+	out := make(map[string]IncidentType)
+
+	res, err := MongoClient.Database("fyeo-di").Collection("incident_types").Find(ctx, bson.D{})
+	if err != nil {
+		return out, err
+	}
+	defer res.Close(ctx)
+
+	for res.Next(ctx) {
+		var doc IncidentType
+
+		err := res.Decode(&doc)
+		if err != nil {
+			return out, err
+		}
+
+		if doc.Class != nil {
+			out[*doc.Class] = doc
+		}
+	}
+
+	return out, res.Err()
 }
 
-func GetEvents(filter map[string]interface{}) ([]Event, error) {
+func GetEvents(ctx context.Context, filter bson.M, limit int64) ([]Event, error) {
 	var data []Event
-	return data, nil
+
+	res, err := MongoClient.Database("fyeo-di").Collection("events").Find(ctx, filter, options.Find().SetSort(bson.M{"_id": 1}).SetLimit(limit))
+	if err != nil {
+		return data, err
+	}
+
+	err = res.All(ctx, &data)
+	return data, err
+}
+
+func GetAsset(ctx context.Context, id string) (Asset, error) {
+	var out Asset
+	o_id, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return out, err
+	}
+
+	err = MongoClient.Database("fyeo-di").Collection("assets").FindOne(ctx, bson.M{"_id": o_id}).Decode(&out)
+	return out, err
+}
+
+func GetThreatActorInfo(ctx context.Context, id string) (ThreatActor, error) {
+	var out ThreatActor
+	o_id, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return out, err
+	}
+
+	var doc Asset
+	err = MongoClient.Database("fyeo-di").Collection("assets").FindOne(ctx, bson.M{"_id": o_id, "is_threat_actor": true}).Decode(&doc)
+	if err != nil {
+		return out, err
+	}
+
+	name := doc.GetName()
+
+	return ThreatActor{
+		ID:          &id,
+		Name:        &name,
+		Description: doc.Description,
+	}, nil
+}
+
+// Render fills the templates of the incident type, a type without a title is named after
+// its class.
+func (t IncidentType) Render(data TemplateData) (*string, *string, *string, error) {
+	var out [3]*string
+
+	for i, text := range []*string{t.Title, t.Description, t.Recommendation} {
+		if text == nil {
+			continue
+		}
+
+		v, err := RenderTemplate(*text, data)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		out[i] = &v
+	}
+
+	if out[0] == nil {
+		title := data.IncidentType
+		out[0] = &title
+	}
+
+	return out[0], out[1], out[2], nil
+}
+
+// FormatTitle fills the %s of a legacy template with as many of the values as it has room for.
+func FormatTitle(template string, values ...string) string {
+	n := strings.Count(template, "%s")
+
+	args := make([]interface{}, n)
+	for i := range args {
+		if i < len(values) {
+			args[i] = values[i]
+		} else {
+			args[i] = ""
+		}
+	}
+
+	return fmt.Sprintf(template, args...)
+}
+
+// FindIncident returns the open incident of a case with the same type and source, incidents
+// written by the old engine use parentId and active.
+func FindIncident(ctx context.Context, case_id string, incident_type string, source string) (string, error) {
+	filter := bson.M{"$and": []bson.M{
+		{"$or": []bson.M{{"case_id": case_id}, {"parentId": case_id}}},
+		{"$or": []bson.M{{"is_active": true}, {"active": true}}},
+		{"type": incident_type},
+		{"source": source},
+		{"is_archived": bson.M{"$ne": true}},
+	}}
+
+	var doc struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+
+	err := MongoClient.Database("fyeo-di").Collection("incidents").FindOne(ctx, filter, options.FindOne().SetProjection(bson.M{"_id": 1})).Decode(&doc)
+	if err != nil {
+		return "", err
+	}
+
+	return doc.ID.Hex(), nil
+}
+
+func (incident *Incident) Create(ctx context.Context) error {
+	res, err := MongoClient.Database("fyeo-di").Collection("incidents").InsertOne(ctx, incident)
+	if err != nil {
+		return err
+	}
+
+	nid := res.InsertedID.(primitive.ObjectID).Hex()
+	incident.ID = &nid
+
+	return nil
+}
+
+// CreateIncident returns the open incident the event belongs to, creating it from the
+// incident type when the case has none for the same source yet.
+func CreateIncident(ctx context.Context, event Event, rule Rule, t IncidentType, now time.Time) (string, bool, error) {
+	if event.CaseID == nil {
+		return "", false, errors.New("No case ID found for event")
+	}
+
+	source := rule.Source(event)
+
+	id, err := FindIncident(ctx, *event.CaseID, rule.Params.IncidentType, source)
+	if err == nil {
+		return id, false, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return "", false, err
+	}
+
+	var threat_actor ThreatActor
+	var threat_actor_ids *Strings
+	if rule.Params.ThreatActor && event.ThreatActors != nil && len(*event.ThreatActors) > 0 {
+		ta_id := (*event.ThreatActors)[0]
+		info, err := GetThreatActorInfo(ctx, ta_id)
+		if err == nil {
+			threat_actor = info
+		}
+		threat_actor_ids = &Strings{ta_id}
+	}
+
+	//a rule, or a case's settings for it, may set a severity of its own
+	severity := t.Severity
+	if rule.Params.Severity != nil {
+		severity = rule.Params.Severity
+	}
+
+	data := NewTemplateData(event, source, threat_actor)
+	data.IncidentType = rule.Params.IncidentType
+	data.Rule = rule.Name
+	if severity != nil {
+		data.Severity = *severity
+	}
+
+	title, description, recommendations, err := t.Render(data)
+	if err != nil {
+		return "", false, errors.New("Incident type " + rule.Params.IncidentType + ": " + err.Error())
+	}
+
+	created_at := now
+	if event.CreatedAt != nil {
+		created_at = *event.CreatedAt
+	}
+
+	incident_type := rule.Params.IncidentType
+	rule_name := rule.Name
+	classified_by := RULES_ENGINE_USER
+	agent := RULES_ENGINE_AGENT
+	is_active := true
+	is_reported := false
+
+	incident := Incident{
+		Title:           title,
+		Type:            &incident_type,
+		Rule:            &rule_name,
+		ClassifiedBy:    &classified_by,
+		ClassifiedAt:    &now,
+		CreatedAt:       &created_at,
+		UpdatedAt:       &now,
+		Description:     description,
+		Recommendations: recommendations,
+		CaseID:          event.CaseID,
+		AssetID:         event.AssetID,
+		ThreatActorIDs:  threat_actor_ids,
+		Source:          &source,
+		SourceType:      event.SourceNetwork,
+		Severity:        severity,
+		Agent:           &agent,
+		IsActive:        &is_active,
+		IsReported:      &is_reported,
+	}
+
+	err = incident.Create(ctx)
+	if err != nil {
+		return "", false, err
+	}
+
+	return *incident.ID, true, nil
+}
+
+// AddToIncident links the event and its asset to the incident.
+func (event *Event) AddToIncident(ctx context.Context, incident_id string, now time.Time) error {
+	i_id, err := primitive.ObjectIDFromHex(incident_id)
+	if err != nil {
+		return err
+	}
+
+	e_id, err := primitive.ObjectIDFromHex(*event.ID)
+	if err != nil {
+		return err
+	}
+
+	add := bson.M{"event_ids": *event.ID}
+	if event.AssetID != nil {
+		add["target_ids"] = *event.AssetID
+	}
+
+	res, err := MongoClient.Database("fyeo-di").Collection("incidents").UpdateOne(ctx, bson.M{"_id": i_id}, bson.M{"$addToSet": add, "$set": bson.M{"updated_at": now}})
+	if err != nil {
+		return err
+	}
+
+	if res.MatchedCount < 1 {
+		return errors.New("Unable to find incident " + incident_id)
+	}
+
+	update := bson.M{"$set": bson.M{"incident_id": incident_id, "is_man_classified": true}}
+	unset := legacyUnset([]string{"incident_id", "is_man_classified"})
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+
+	_, err = MongoClient.Database("fyeo-di").Collection("events").UpdateOne(ctx, bson.M{"_id": e_id}, update)
+	return err
+}
+
+func (event *Event) Classify(ctx context.Context, threat_level int64, rule_name string, now time.Time) error {
+	return event.classify(ctx, threat_level, rule_name, nil, now)
+}
+
+// Suppress classifies an event whose incident a policy suppressed, with the reason why.
+func (event *Event) Suppress(ctx context.Context, rule_name string, reason string, now time.Time) error {
+	return event.classify(ctx, SUPPRESSED_THREAT_LEVEL, rule_name, bson.M{"suppressed_reason": reason}, now)
+}
+
+func (event *Event) classify(ctx context.Context, threat_level int64, rule_name string, extra bson.M, now time.Time) error {
+	o_id, err := primitive.ObjectIDFromHex(*event.ID)
+	if err != nil {
+		return err
+	}
+
+	set := bson.M{
+		"is_man_classified":  true,
+		"is_auto_classified": true,
+		"auto_classified_at": now,
+		"threat_level":       threat_level,
+	}
+	for k, v := range extra {
+		set[k] = v
+	}
+
+	update := bson.M{
+		"$set":  set,
+		"$push": bson.M{"history": historyEntry(rule_name, &threat_level, now)},
+	}
+
+	unset := legacyUnset([]string{"is_man_classified", "is_auto_classified", "auto_classified_at", "threat_level"})
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+
+	res, err := MongoClient.Database("fyeo-di").Collection("events").UpdateOne(ctx, bson.M{"_id": o_id}, update)
+	if err != nil {
+		return err
+	}
+
+	if res.MatchedCount < 1 {
+		return errors.New("Unable to classify event " + *event.ID)
+	}
+
+	return nil
 }
 
-func GetCases(ids []string) ([]Case, error) {
-	var out []Case
+// IsKnownSubdomain is true when the lookalike source is the target domain or one of its
+// subdomains, evil-example.com is not a subdomain of example.com.
+func IsKnownSubdomain(source string, target string) bool {
+	source = strings.ToLower(strings.TrimSuffix(source, "."))
+	target = strings.ToLower(strings.TrimSuffix(target, "."))
+
+	if source == "" || target == "" {
+		return false
+	}
+
+	return source == target || strings.HasSuffix(source, "."+target)
+}
+
+// IncidentEventSites returns the sites and urls of the incident's events.
+func IncidentEventSites(ctx context.Context, id primitive.ObjectID, event_ids *Strings) ([]string, []string, error) {
+	filter := bson.M{"incident_id": id.Hex()}
+	if event_ids != nil && len(*event_ids) > 0 {
+		var ids []primitive.ObjectID
+		for _, e := range *event_ids {
+			if o_id, err := primitive.ObjectIDFromHex(e); err == nil {
+				ids = append(ids, o_id)
+			}
+		}
+		filter = bson.M{"_id": bson.M{"$in": ids}}
+	}
+
+	opts := options.Find().SetProjection(bson.M{"site": 1, "url": 1}).SetLimit(MAX_EVENTS_PER_RULE)
+
+	res, err := MongoClient.Database("fyeo-di").Collection("events").Find(ctx, filter, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var events []Event
+	err = res.All(ctx, &events)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var sites, urls []string
+	for _, e := range events {
+		if e.Site != nil {
+			sites = append(sites, *e.Site)
+		}
+		if e.URL != nil {
+			urls = append(urls, *e.URL)
+		}
+	}
+
+	return sites, urls, nil
+}
+
+func CloseIncident(ctx context.Context, id primitive.ObjectID, reason string, now time.Time) error {
+	update := bson.M{
+		"$set": bson.M{
+			"is_active":       false,
+			"recommendations": reason,
+			"close_reason":    reason,
+			"closed_by":       RULES_ENGINE_USER,
+			"closed_at":       now,
+		},
+		"$unset": bson.M{"active": ""},
+	}
+
+	_, err := MongoClient.Database("fyeo-di").Collection("incidents").UpdateOne(ctx, bson.M{"_id": id}, update)
+	return err
+}
+
+// AutoCloseIncidents resolves the open incidents a policy says should not alert, that is the
+// lookalikes of the target's own subdomains and what the case's policy allows. Incidents from
+// the old engine name the target in targets and the case in parentId.
+func AutoCloseIncidents(ctx context.Context, now time.Time, policies *CasePolicies, report *RulesReport) error {
+	case_ids, err := CasesWithPolicies(ctx)
+	if err != nil {
+		return err
+	}
+
+	filter := bson.M{
+		"$and": []bson.M{
+			{"$or": []bson.M{{"is_active": true}, {"active": true}}},
+			{"$or": []bson.M{
+				{"type": SIMILAR_DOMAIN},
+				{"case_id": bson.M{"$in": case_ids}},
+				{"parentId": bson.M{"$in": case_ids}},
+			}},
+		},
+		"is_archived": bson.M{"$ne": true},
+	}
+
+	res, err := MongoClient.Database("fyeo-di").Collection("incidents").Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	defer res.Close(ctx)
+
+	for res.Next(ctx) {
+		var doc struct {
+			ID       primitive.ObjectID `bson:"_id"`
+			Type     *string            `bson:"type"`
+			Title    *string            `bson:"title"`
+			Source   *string            `bson:"source"`
+			Targets  *Strings           `bson:"targets"`
+			AssetID  *string            `bson:"asset_id"`
+			CaseID   *string            `bson:"case_id"`
+			ParentID *string            `bson:"parentId"`
+			EventIDs *Strings           `bson:"event_ids"`
+		}
+
+		err := res.Decode(&doc)
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			continue
+		}
+
+		subject := PolicySubject{
+			Type:   templateString(doc.Type),
+			Title:  templateString(doc.Title),
+			Source: templateString(doc.Source),
+		}
+
+		if subject.Type == SIMILAR_DOMAIN {
+			if doc.Source == nil {
+				report.Errors = append(report.Errors, "Unable to get source from incident "+doc.ID.Hex())
+				continue
+			}
+
+			if doc.Targets != nil && len(*doc.Targets) > 0 {
+				subject.Target = (*doc.Targets)[0]
+			} else if doc.AssetID != nil {
+				asset, err := GetAsset(ctx, *doc.AssetID)
+				if err != nil {
+					report.Errors = append(report.Errors, doc.ID.Hex()+": "+err.Error())
+					continue
+				}
+				subject.Target = asset.GetName()
+			}
+		}
+
+		case_id := templateString(doc.CaseID)
+		if case_id == "" {
+			case_id = templateString(doc.ParentID)
+		}
+
+		var policy *AutoClosePolicy
+		if case_id != "" {
+			policy, err = policies.Get(ctx, case_id)
+			if err != nil {
+				report.Errors = append(report.Errors, doc.ID.Hex()+": "+err.Error())
+				continue
+			}
+		}
+
+		if policy.NeedsEvents() {
+			subject.Sites, subject.URLs, err = IncidentEventSites(ctx, doc.ID, doc.EventIDs)
+			if err != nil {
+				report.Errors = append(report.Errors, doc.ID.Hex()+": "+err.Error())
+				continue
+			}
+		}
+
+		reason := policy.Match(subject)
+		if reason == "" {
+			continue
+		}
+
+		err = CloseIncident(ctx, doc.ID, reason, now)
+		if err != nil {
+			report.Errors = append(report.Errors, doc.ID.Hex()+": "+err.Error())
+			continue
+		}
+
+		report.Closed++
+	}
 
-	return out, nil
+	return res.Err()
 }
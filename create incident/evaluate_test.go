@@ -0,0 +1,269 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type M = map[string]interface{}
+type L = []interface{}
+
+// a document as the driver decodes an event, int64 numbers, primitive.A arrays and dates
+func testDocument() bson.M {
+	return bson.M{
+		"title":            "Leaked credentials for ACME corp",
+		"threat_level":     int64(2),
+		"confidence_score": 0.8,
+		"created_at":       primitive.NewDateTimeFromTime(time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)),
+		"languages":        primitive.A{"en", "de"},
+		"is_starred":       false,
+		"asset_matches": bson.M{
+			"term":  "acme",
+			"match": bson.M{"keyword_type": "domain"},
+		},
+		"cuts": primitive.A{
+			bson.M{"cut": "acme password dump", "len": int64(18)},
+			bson.M{"cut": "user list", "len": int64(9)},
+		},
+	}
+}
+
+func TestMatchFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter M
+		want   bool
+	}{
+		{"equal", M{"threat_level": 2}, true},
+		{"equal other number type", M{"threat_level": 2.0}, true},
+		{"not equal", M{"threat_level": 3}, false},
+		{"equal null matches missing", M{"incident_id": nil}, true},
+		{"equal null does not match a value", M{"title": nil}, false},
+		{"implicit and", M{"threat_level": 2, "is_starred": true}, false},
+
+		{"$gt", M{"threat_level": M{"$gt": 1}}, true},
+		{"$gt equal", M{"confidence_score": M{"$gt": 0.8}}, false},
+		{"$gte equal", M{"confidence_score": M{"$gte": 0.8}}, true},
+		{"$lt and $gt range", M{"threat_level": M{"$gt": 1, "$lt": 3}}, true},
+		{"$lte", M{"threat_level": M{"$lte": 1}}, false},
+		{"compare other type", M{"threat_level": M{"$gt": "1"}}, false},
+		{"compare missing", M{"page_rank": M{"$lt": 10}}, false},
+		{"compare date", M{"created_at": M{"$lt": time.Date(2021, 10, 2, 0, 0, 0, 0, time.UTC)}}, true},
+		{"compare date after", M{"created_at": M{"$gt": time.Date(2021, 10, 2, 0, 0, 0, 0, time.UTC)}}, false},
+		{"compare string", M{"title": M{"$gte": "L"}}, true},
+		{"compare any element", M{"cuts.len": M{"$gt": 10}}, true},
+
+		{"$ne", M{"threat_level": M{"$ne": 2}}, false},
+		{"$ne missing", M{"incident_id": M{"$ne": "x"}}, true},
+		{"$ne array element", M{"languages": M{"$ne": "de"}}, false},
+		{"$eq", M{"is_starred": M{"$eq": false}}, true},
+
+		{"$exists", M{"title": M{"$exists": true}}, true},
+		{"$exists missing", M{"incident_id": M{"$exists": true}}, false},
+		{"$exists false", M{"incident_id": M{"$exists": false}}, true},
+		{"$exists false present", M{"is_starred": M{"$exists": false}}, false},
+		{"$exists number", M{"incident_id": M{"$exists": 0}}, true},
+		{"$exists dotted", M{"asset_matches.match.keyword_type": M{"$exists": true}}, true},
+
+		{"$in", M{"threat_level": M{"$in": L{1, 2}}}, true},
+		{"$in none", M{"threat_level": M{"$in": L{3, 4}}}, false},
+		{"$in array field", M{"languages": M{"$in": L{"fr", "de"}}}, true},
+		{"$in null matches missing", M{"incident_id": M{"$in": L{nil, "x"}}}, true},
+		{"$in regex", M{"title": M{"$in": L{primitive.Regex{Pattern: "^Leaked"}}}}, true},
+		{"$nin", M{"threat_level": M{"$nin": L{3, 4}}}, true},
+		{"$nin array field", M{"languages": M{"$nin": L{"de"}}}, false},
+		{"$nin missing", M{"incident_id": M{"$nin": L{"x"}}}, true},
+
+		{"array element", M{"languages": "de"}, true},
+		{"array whole", M{"languages": L{"en", "de"}}, true},
+		{"array whole other order", M{"languages": L{"de", "en"}}, false},
+		{"$size", M{"languages": M{"$size": 2}}, true},
+		{"$size other", M{"languages": M{"$size": 1}}, false},
+		{"$all", M{"languages": M{"$all": L{"de", "en"}}}, true},
+		{"$all missing element", M{"languages": M{"$all": L{"de", "fr"}}}, false},
+		{"$elemMatch", M{"cuts": M{"$elemMatch": M{"cut": M{"$regex": "^user"}, "len": M{"$lt": 10}}}}, true},
+		{"$elemMatch same element", M{"cuts": M{"$elemMatch": M{"cut": M{"$regex": "^user"}, "len": M{"$gt": 10}}}}, false},
+		{"conditions on different elements", M{"cuts.cut": M{"$regex": "^user"}, "cuts.len": M{"$gt": 10}}, true},
+		{"$elemMatch scalars", M{"languages": M{"$elemMatch": M{"$gte": "d", "$lt": "e"}}}, true},
+
+		{"dotted path", M{"asset_matches.match.keyword_type": "domain"}, true},
+		{"dotted path other value", M{"asset_matches.match.keyword_type": "email"}, false},
+		{"dotted path missing", M{"asset_matches.match.id": "x"}, false},
+		{"dotted path through array", M{"cuts.cut": "user list"}, true},
+		{"dotted path index", M{"cuts.1.len": 9}, true},
+		{"dotted path other index", M{"cuts.0.len": 9}, false},
+		{"dotted path index out of range", M{"cuts.2.len": M{"$exists": true}}, false},
+		{"array index", M{"languages.0": "en"}, true},
+
+		{"$regex", M{"title": M{"$regex": "ACME"}}, true},
+		{"$regex case", M{"title": M{"$regex": "^leaked"}}, false},
+		{"$regex i", M{"title": M{"$regex": "^leaked", "$options": "i"}}, true},
+		{"$regex array element", M{"languages": M{"$regex": "^d"}}, true},
+		{"$regex array of documents", M{"cuts.cut": M{"$regex": "password"}}, true},
+		{"$regex missing", M{"site": M{"$regex": "."}}, false},
+		{"$regex not a string", M{"threat_level": M{"$regex": "2"}}, false},
+		{"$regex value", M{"title": primitive.Regex{Pattern: "corp$"}}, true},
+		{"$regex value options", M{"title": primitive.Regex{Pattern: "CORP$", Options: "i"}}, true},
+		{"$regex x", M{"title": M{"$regex": "leaked \\s credentials  # the title", "$options": "ix"}}, true},
+		{"$regex x escaped space", M{"title": M{"$regex": "ACME\\ corp", "$options": "x"}}, true},
+		{"$regex x class space", M{"title": M{"$regex": "for[ ]ACME", "$options": "x"}}, true},
+		{"$regex x spaces dropped", M{"title": M{"$regex": "for ACME", "$options": "x"}}, false},
+		{"$regex without x keeps spaces", M{"title": M{"$regex": "for ACME"}}, true},
+		{"$regex m", M{"title": M{"$regex": "corp$", "$options": "m"}}, true},
+
+		{"$not", M{"threat_level": M{"$not": M{"$gt": 1}}}, false},
+		{"$not missing", M{"page_rank": M{"$not": M{"$gt": 1}}}, true},
+		{"$not regex", M{"title": M{"$not": primitive.Regex{Pattern: "foo"}}}, true},
+
+		{"$or", M{"$or": L{M{"threat_level": 3}, M{"is_starred": false}}}, true},
+		{"$or none", M{"$or": L{M{"threat_level": 3}, M{"is_starred": true}}}, false},
+		{"$and", M{"$and": L{M{"threat_level": 2}, M{"is_starred": true}}}, false},
+		{"$nor", M{"$nor": L{M{"threat_level": 3}, M{"is_starred": true}}}, true},
+		{"nested logical", M{"$and": L{M{"$or": L{M{"title": M{"$regex": "acme", "$options": "i"}}, M{"site": "x"}}}, M{"threat_level": M{"$lte": 2}}}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := MatchFilter(testDocument(), tt.filter)
+			if err != nil {
+				t.Fatalf("MatchFilter(%v) error: %v", tt.filter, err)
+			}
+			if got != tt.want {
+				t.Errorf("MatchFilter(%v) = %v, want %v", tt.filter, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchFilterErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter M
+	}{
+		{"unsupported operator", M{"title": M{"$where": "true"}}},
+		{"unsupported top level operator", M{"$where": "true"}},
+		{"invalid regex", M{"title": M{"$regex": "("}}},
+		{"$in not a list", M{"threat_level": M{"$in": 2}}},
+		{"$or not a list", M{"$or": M{"threat_level": 2}}},
+		{"$not value", M{"threat_level": M{"$not": 2}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := MatchFilter(testDocument(), tt.filter)
+			if err == nil {
+				t.Errorf("MatchFilter(%v) gave no error", tt.filter)
+			}
+		})
+	}
+}
+
+func TestExtendedPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    string
+	}{
+		{"a b\tc\n", "abc"},
+		{"a # comment\nb", "ab"},
+		{"a\\ b", "a b"},
+		{"a\\#b", "a\\#b"},
+		{"[ #]a", "[ #]a"},
+		{"[] ]a", "[] ]a"},
+		{"[^] ]a b", "[^] ]ab"},
+		{"\\d + # digits", "\\d+"},
+	}
+
+	for _, tt := range tests {
+		got := ExtendedPattern(tt.pattern)
+		if got != tt.want {
+			t.Errorf("ExtendedPattern(%q) = %q, want %q", tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestRuleMatchesEvent(t *testing.T) {
+	now := time.Date(2021, 10, 3, 0, 0, 0, 0, time.UTC)
+	created := now.Add(-24 * time.Hour)
+	level := int64(2)
+	keyword := "domain"
+	title := "Leaked credentials for ACME corp"
+
+	e := Event{
+		Title:        &title,
+		ThreatLevel:  &level,
+		CreatedAt:    &created,
+		AssetMatches: &EventAssetMatch{Match: &EventMatch{KeywordType: &keyword}},
+	}
+
+	doc, err := EventDocument(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		rule Rule
+		want bool
+	}{
+		{"current names", Rule{Name: "a", Action: ACTION_INCIDENT, Filter: M{"asset_matches.match.keyword_type": "domain", "threat_level": M{"$lte": 2}}}, true},
+		{"legacy names", Rule{Name: "b", Action: ACTION_INCIDENT, Filter: M{"assetMatches.match.keywordType": "domain", "threatLevel": 2}}, true},
+		{"no match", Rule{Name: "c", Action: ACTION_INCIDENT, Filter: M{"asset_matches.match.keyword_type": "email"}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.rule.Matches(doc, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	//outside the lookback no rule picks the event up
+	old, err := EventDocument(Event{Title: &title, CreatedAt: &created})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule := Rule{Name: "d", Action: ACTION_INCIDENT, Filter: M{"title": M{"$exists": true}}}
+	got, err := rule.Matches(old, now.Add(LOOKBACK))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got {
+		t.Errorf("Matches() outside the lookback = true, want false")
+	}
+}
+
+func TestMatchingRules(t *testing.T) {
+	now := time.Date(2021, 10, 3, 0, 0, 0, 0, time.UTC)
+	created := now.Add(-time.Hour)
+	title := "Leaked credentials for ACME corp"
+
+	doc, err := EventDocument(Event{Title: &title, CreatedAt: &created})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules := []Rule{
+		{Name: "tag", Action: ACTION_UPDATE, Filter: M{"title": M{"$regex": "leaked", "$options": "i"}}, Update: M{"event_type": "leak"}},
+		{Name: "leak", Action: ACTION_INCIDENT, Filter: M{"event_type": "leak"}},
+		//the incident rule before it has classified the event
+		{Name: "any", Action: ACTION_INCIDENT, Filter: M{"title": M{"$exists": true}}},
+	}
+
+	got, err := MatchingRules(rules, doc, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"tag", "leak"}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("MatchingRules() = %v, want %v", got, want)
+	}
+}
@@ -2,4 +2,8 @@ module fyeo-lambda-event-processing
 
 go 1.16
 
-require go.mongodb.org/mongo-driver v1.7.2 // indirect
+require (
+	github.com/aws/aws-lambda-go v1.27.0
+	go.mongodb.org/mongo-driver v1.7.3
+	gopkg.in/yaml.v2 v2.4.0
+)
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	LEASE_ID = "rules-engine"
+
+	//as long as a lambda may run, a run which dies holding the lease blocks the next ones no longer
+	LEASE_TTL = 15 * time.Minute
+)
+
+type Lease struct {
+	ID        string    `bson:"_id"`
+	Owner     string    `bson:"owner"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+// AcquireLease takes the lease when it is free or expired. When another run holds it, it
+// returns false and when that lease expires.
+func AcquireLease(ctx context.Context, id string, owner string, now time.Time) (bool, time.Time, error) {
+	filter := bson.M{
+		"_id": id,
+		"$or": []bson.M{{"expires_at": bson.M{"$lt": now}}, {"owner": owner}},
+	}
+	update := bson.M{"$set": bson.M{"owner": owner, "expires_at": now.Add(LEASE_TTL)}}
+
+	_, err := MongoClient.Database("fyeo-di").Collection("leases").UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		//the filter did not match and the upsert ran into the lease held by another run
+		var held Lease
+		err = MongoClient.Database("fyeo-di").Collection("leases").FindOne(ctx, bson.M{"_id": id}).Decode(&held)
+		return false, held.ExpiresAt, err
+	}
+	if err != nil {
+		return false, time.Time{}, err
+	}
+
+	return true, now.Add(LEASE_TTL), nil
+}
+
+func ReleaseLease(ctx context.Context, id string, owner string) error {
+	_, err := MongoClient.Database("fyeo-di").Collection("leases").DeleteOne(ctx, bson.M{"_id": id, "owner": owner})
+	return err
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	SIMILAR_DOMAIN = "similar_domain"
+
+	//threat level of events whose incident a policy suppressed, as the irrelevant rules use
+	SUPPRESSED_THREAT_LEVEL = 1
+)
+
+// AutoClosePolicy is what a case does not want to be alerted about, kept on the case as
+// auto_close. Domains cover their subdomains, never_alert holds regular expressions matched
+// against the source, title and urls.
+type AutoClosePolicy struct {
+	KnownSubdomains Strings `json:"known_subdomains,omitempty" bson:"known_subdomains,omitempty"`
+	OwnedDomains    Strings `json:"owned_domains,omitempty" bson:"owned_domains,omitempty"`
+	TrustedSources  Strings `json:"trusted_sources,omitempty" bson:"trusted_sources,omitempty"`
+	TrustedSites    Strings `json:"trusted_sites,omitempty" bson:"trusted_sites,omitempty"`
+	NeverAlert      Strings `json:"never_alert,omitempty" bson:"never_alert,omitempty"`
+
+	patterns []*regexp.Regexp
+}
+
+// PolicySubject is what the policies look at of an incident, or of the incident an event
+// would open.
+type PolicySubject struct {
+	Type   string
+	Source string
+	Title  string
+	Target string
+	Sites  []string
+	URLs   []string
+}
+
+// CasePolicies loads the policy of each case once per run.
+type CasePolicies struct {
+	cases map[string]*AutoClosePolicy
+}
+
+func NewCasePolicies() *CasePolicies {
+	return &CasePolicies{cases: make(map[string]*AutoClosePolicy)}
+}
+
+// Get returns the policy of the case, nil when it has none.
+func (c *CasePolicies) Get(ctx context.Context, case_id string) (*AutoClosePolicy, error) {
+	if p, ok := c.cases[case_id]; ok {
+		return p, nil
+	}
+
+	o_id, err := primitive.ObjectIDFromHex(case_id)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc struct {
+		AutoClose *AutoClosePolicy `bson:"auto_close"`
+	}
+
+	opts := options.FindOne().SetProjection(bson.M{"auto_close": 1})
+	err = MongoClient.Database("fyeo-di").Collection("cases").FindOne(ctx, bson.M{"_id": o_id}, opts).Decode(&doc)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+
+	if doc.AutoClose != nil {
+		doc.AutoClose.compile()
+	}
+
+	c.cases[case_id] = doc.AutoClose
+	return doc.AutoClose, nil
+}
+
+// CasesWithPolicies lists the ids of the cases that set a policy.
+func CasesWithPolicies(ctx context.Context) ([]string, error) {
+	opts := options.Find().SetProjection(bson.M{"_id": 1})
+
+	res, err := MongoClient.Database("fyeo-di").Collection("cases").Find(ctx, bson.M{"auto_close": bson.M{"$exists": true}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close(ctx)
+
+	//an empty list rather than null, it is used with $in
+	out := []string{}
+	for res.Next(ctx) {
+		var doc struct {
+			ID primitive.ObjectID `bson:"_id"`
+		}
+
+		err := res.Decode(&doc)
+		if err != nil {
+			return out, err
+		}
+		out = append(out, doc.ID.Hex())
+	}
+
+	return out, res.Err()
+}
+
+// compile skips patterns which do not compile, the case endpoint does not save them.
+func (p *AutoClosePolicy) compile() {
+	p.patterns = nil
+	for _, s := range p.NeverAlert {
+		re, err := regexp.Compile("(?i)" + s)
+		if err == nil {
+			p.patterns = append(p.patterns, re)
+		}
+	}
+}
+
+// NeedsEvents is true when the policy looks at the sites and urls of the incident's events.
+func (p *AutoClosePolicy) NeedsEvents() bool {
+	return p != nil && (len(p.TrustedSites) > 0 || len(p.patterns) > 0)
+}
+
+// policyHost is the host of a source or site, which may be given as a url.
+func policyHost(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if strings.Contains(s, "://") {
+		if u, err := url.Parse(s); err == nil {
+			s = u.Hostname()
+		}
+	}
+	return strings.TrimSuffix(s, ".")
+}
+
+func isDomainOf(host string, domains Strings) string {
+	for _, d := range domains {
+		if IsKnownSubdomain(policyHost(host), policyHost(d)) {
+			return d
+		}
+	}
+	return ""
+}
+
+// Match returns why the subject should not alert, or an empty string. Lookalikes of the
+// target's own subdomains never alert, whatever the case's policy.
+func (p *AutoClosePolicy) Match(s PolicySubject) string {
+	if s.Type == SIMILAR_DOMAIN && IsKnownSubdomain(policyHost(s.Source), policyHost(s.Target)) {
+		return KNOWN_SUBDOMAIN_RECOMMENDATION
+	}
+
+	if p == nil {
+		return ""
+	}
+
+	source := policyHost(s.Source)
+
+	for _, d := range p.KnownSubdomains {
+		if source != "" && source == policyHost(d) {
+			return "closed since " + d + " is a known subdomain"
+		}
+	}
+
+	if d := isDomainOf(source, p.OwnedDomains); d != "" {
+		return "closed since " + source + " is part of the owned domain " + d
+	}
+
+	if d := isDomainOf(source, p.TrustedSources); d != "" {
+		return "closed since " + source + " is a trusted source"
+	}
+
+	for _, site := range s.Sites {
+		if d := isDomainOf(site, p.TrustedSites); d != "" {
+			return "closed since " + site + " is a trusted site"
+		}
+	}
+
+	for _, re := range p.patterns {
+		for _, v := range append([]string{s.Source, s.Title}, s.URLs...) {
+			if v != "" && re.MatchString(v) {
+				return "closed since it matches the never alert pattern " + re.String()[len("(?i)"):]
+			}
+		}
+	}
+
+	return ""
+}
+
+// EventSubject is the subject of the incident the event would be added to.
+func EventSubject(event Event, incident_type string, source string) PolicySubject {
+	s := PolicySubject{
+		Type:   incident_type,
+		Source: source,
+		Title:  templateString(event.Title),
+		Target: templateString(event.AssetName),
+	}
+
+	if event.Site != nil {
+		s.Sites = append(s.Sites, *event.Site)
+	}
+	if event.URL != nil {
+		s.URLs = append(s.URLs, *event.URL)
+	}
+
+	return s
+}
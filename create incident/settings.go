@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	//event field the confidence cut-offs of the rules are on
+	CONFIDENCE_FIELD = "confidence_score"
+)
+
+var (
+	//bounds of a confidence cut-off a case may move
+	cutoffOperators = map[string]bool{"$gt": true, "$gte": true, "$lt": true, "$lte": true}
+)
+
+// RuleOverride changes one rule for a case. A disabled rule does not run on the case's
+// events, the confidence score moves the rule's confidence cut-off, threat level and
+// severity replace those of the rule's incidents.
+type RuleOverride struct {
+	Disabled        *bool    `json:"disabled,omitempty" bson:"disabled,omitempty"`
+	ConfidenceScore *float64 `json:"confidence_score,omitempty" bson:"confidence_score,omitempty"`
+	ThreatLevel     *int64   `json:"threat_level,omitempty" bson:"threat_level,omitempty"`
+	Severity        *int64   `json:"severity,omitempty" bson:"severity,omitempty"`
+}
+
+// RuleSettings are a case's overrides of the rules, kept on the case as rule_settings.
+// Severities maps incident types to the severity the case's incidents of that type get.
+type RuleSettings struct {
+	Rules      map[string]*RuleOverride `json:"rules,omitempty" bson:"rules,omitempty"`
+	Severities map[string]int64         `json:"severities,omitempty" bson:"severities,omitempty"`
+}
+
+// CaseSettings is what of a case the rules are resolved with. Incident rules below the
+// case's alert level classify its events without opening incidents.
+type CaseSettings struct {
+	ID           string        `json:"id" bson:"_id"`
+	AlertLevel   *int64        `json:"alert_level,omitempty" bson:"alert_level,omitempty"`
+	RuleSettings *RuleSettings `json:"rule_settings,omitempty" bson:"rule_settings,omitempty"`
+}
+
+func validLevel(field string, v *int64) error {
+	if v != nil && (*v < 0 || *v > 5) {
+		return errors.New(field + " must be between 0 and 5")
+	}
+	return nil
+}
+
+// Validate checks the settings against the rules they override.
+func (c *CaseSettings) Validate(rules []Rule) error {
+	err := validLevel("alert_level", c.AlertLevel)
+	if err != nil {
+		return err
+	}
+
+	s := c.RuleSettings
+	if s == nil {
+		return nil
+	}
+
+	by_name := make(map[string]Rule)
+	for _, r := range rules {
+		by_name[r.Name] = r
+	}
+
+	for name, o := range s.Rules {
+		rule, ok := by_name[name]
+		if !ok {
+			return errors.New("No rule named " + name)
+		}
+		if o == nil {
+			continue
+		}
+
+		field := "rule_settings.rules." + name
+		if o.ConfidenceScore != nil {
+			if *o.ConfidenceScore < 0 || *o.ConfidenceScore > 1 {
+				return errors.New(field + ".confidence_score must be between 0 and 1")
+			}
+			if !hasCutoff(rule.Filter) {
+				return errors.New("Rule " + name + " has no confidence cut-off to override")
+			}
+		}
+
+		if (o.ThreatLevel != nil || o.Severity != nil) && rule.Action != ACTION_INCIDENT {
+			return errors.New("Rule " + name + " does not open incidents, only disabled and confidence_score may be overridden")
+		}
+
+		err := validLevel(field+".threat_level", o.ThreatLevel)
+		if err == nil {
+			err = validLevel(field+".severity", o.Severity)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for t, v := range s.Severities {
+		if t == "" {
+			return errors.New("rule_settings.severities may not hold an empty incident type")
+		}
+		v := v
+		err := validLevel("rule_settings.severities."+t, &v)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func GetCaseSettings(ctx context.Context, id string) (CaseSettings, error) {
+	var out CaseSettings
+	o_id, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return out, err
+	}
+
+	opts := options.FindOne().SetProjection(bson.M{"alert_level": 1, "rule_settings": 1})
+	err = MongoClient.Database("fyeo-di").Collection("cases").FindOne(ctx, bson.M{"_id": o_id, "is_archived": bson.M{"$ne": true}}, opts).Decode(&out)
+
+	return out, err
+}
+
+// CasesWithSettings lists the cases which set an alert level or override the rules.
+func CasesWithSettings(ctx context.Context) ([]CaseSettings, error) {
+	var out []CaseSettings
+
+	filter := bson.M{
+		"is_archived": bson.M{"$ne": true},
+		"$or":         []bson.M{{"alert_level": bson.M{"$gt": 0}}, {"rule_settings": bson.M{"$exists": true}}},
+	}
+	opts := options.Find().SetProjection(bson.M{"alert_level": 1, "rule_settings": 1}).SetSort(bson.M{"_id": 1})
+
+	res, err := MongoClient.Database("fyeo-di").Collection("cases").Find(ctx, filter, opts)
+	if err != nil {
+		return out, err
+	}
+
+	err = res.All(ctx, &out)
+	return out, err
+}
+
+// hasCutoff is true when the filter bounds the confidence score, at its top level or in
+// one of its $and, $or or $nor clauses.
+func hasCutoff(filter map[string]interface{}) bool {
+	for key, cond := range filter {
+		if list, ok := cond.([]interface{}); ok && (key == "$and" || key == "$or" || key == "$nor") {
+			for _, c := range list {
+				if m, ok := c.(map[string]interface{}); ok && hasCutoff(m) {
+					return true
+				}
+			}
+			continue
+		}
+
+		if CanonicalEventKey(key) != CONFIDENCE_FIELD {
+			continue
+		}
+		if ops, ok := cond.(map[string]interface{}); ok {
+			for op := range ops {
+				if cutoffOperators[op] {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// withCutoff copies the filter with the bounds of its confidence cut-offs moved to v.
+func withCutoff(filter map[string]interface{}, v float64) map[string]interface{} {
+	out := make(map[string]interface{}, len(filter))
+
+	for key, cond := range filter {
+		if list, ok := cond.([]interface{}); ok && (key == "$and" || key == "$or" || key == "$nor") {
+			var copied []interface{}
+			for _, c := range list {
+				if m, ok := c.(map[string]interface{}); ok {
+					copied = append(copied, withCutoff(m, v))
+				} else {
+					copied = append(copied, c)
+				}
+			}
+			out[key] = copied
+			continue
+		}
+
+		ops, ok := cond.(map[string]interface{})
+		if !ok || CanonicalEventKey(key) != CONFIDENCE_FIELD {
+			out[key] = cond
+			continue
+		}
+
+		moved := make(map[string]interface{}, len(ops))
+		for op, arg := range ops {
+			if cutoffOperators[op] {
+				arg = v
+			}
+			moved[op] = arg
+		}
+		out[key] = moved
+	}
+
+	return out
+}
+
+// Resolve is the rule as it runs on the case's events, whether it runs at all, and what the
+// case changed about it. Rules the case changes nothing about come back as they are.
+func (c CaseSettings) Resolve(rule Rule) (Rule, bool, []string) {
+	var changes []string
+
+	var o *RuleOverride
+	if c.RuleSettings != nil {
+		o = c.RuleSettings.Rules[rule.Name]
+	}
+
+	if o != nil && o.Disabled != nil && *o.Disabled {
+		return rule, false, []string{"disabled for the case"}
+	}
+
+	if o != nil && o.ConfidenceScore != nil && hasCutoff(rule.Filter) {
+		rule.Filter = withCutoff(rule.Filter, *o.ConfidenceScore)
+		changes = append(changes, "confidence cut-off moved to "+strconv.FormatFloat(*o.ConfidenceScore, 'f', -1, 64))
+	}
+
+	if rule.Action == ACTION_INCIDENT {
+		if o != nil && o.ThreatLevel != nil && *o.ThreatLevel != rule.Params.Level() {
+			level := *o.ThreatLevel
+			rule.Params.ThreatLevel = &level
+			changes = append(changes, "threat level "+strconv.FormatInt(level, 10))
+		}
+
+		var severity *int64
+		if o != nil && o.Severity != nil {
+			severity = o.Severity
+		} else if c.RuleSettings != nil {
+			if v, ok := c.RuleSettings.Severities[rule.Params.IncidentType]; ok {
+				severity = &v
+			}
+		}
+		if severity != nil && (rule.Params.Severity == nil || *rule.Params.Severity != *severity) {
+			v := *severity
+			rule.Params.Severity = &v
+			changes = append(changes, "severity "+strconv.FormatInt(v, 10))
+		}
+
+		if c.AlertLevel != nil && *c.AlertLevel > rule.Params.Level() {
+			rule.AlertLevel = *c.AlertLevel
+			changes = append(changes, "threat level "+strconv.FormatInt(rule.Params.Level(), 10)+" is below the case alert level "+strconv.FormatInt(*c.AlertLevel, 10)+", events are classified without an incident")
+		}
+	}
+
+	if len(changes) > 0 {
+		rule.Case = c.ID
+		rule.Filter = withCase(rule.Filter, c.ID)
+	}
+
+	return rule, true, changes
+}
+
+func withCase(filter map[string]interface{}, id string) map[string]interface{} {
+	return withCondition(filter, "case_id", id)
+}
+
+// withCondition copies the filter with the condition added, next to any the filter already
+// has on the field.
+func withCondition(filter map[string]interface{}, key string, cond interface{}) map[string]interface{} {
+	if _, ok := filter[key]; ok {
+		return map[string]interface{}{"$and": []interface{}{filter, map[string]interface{}{key: cond}}}
+	}
+
+	out := make(map[string]interface{}, len(filter)+1)
+	for k, v := range filter {
+		out[k] = v
+	}
+	out[key] = cond
+	return out
+}
+
+// ResolveRules gives each case that changes a rule its own copy of it, right after the rule,
+// and leaves the case's events out of the rule everyone else gets.
+func ResolveRules(rules []Rule, cases []CaseSettings) []Rule {
+	var out []Rule
+
+	for _, rule := range rules {
+		var own []Rule
+		var excluded []string
+
+		for _, c := range cases {
+			resolved, enabled, changes := c.Resolve(rule)
+			if !enabled {
+				excluded = append(excluded, c.ID)
+				continue
+			}
+			if len(changes) > 0 {
+				excluded = append(excluded, c.ID)
+				own = append(own, resolved)
+			}
+		}
+
+		if len(excluded) > 0 {
+			sort.Strings(excluded)
+			nin := make([]interface{}, len(excluded))
+			for i := range excluded {
+				nin[i] = excluded[i]
+			}
+
+			rule.BaseFilter = rule.Filter
+			if rule.BaseFilter == nil {
+				rule.BaseFilter = map[string]interface{}{}
+			}
+			rule.Filter = withCondition(rule.Filter, "case_id", map[string]interface{}{"$nin": nin})
+		}
+
+		out = append(out, rule)
+		out = append(out, own...)
+	}
+
+	return out
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	//keyword weights of the matcher, deployed next to the binary
+	KEYWORD_SCORES_FILE = "keyword_scores.yaml"
+
+	//the events of an incident looked at when scoring it, the most recent first
+	MAX_SCORED_EVENTS = 500
+
+	//required score the matcher uses for assets without one
+	DEFAULT_REQUIRED_SCORE = 0.95
+
+	MAX_SEVERITY = 5
+
+	//how much each factor counts towards the suggested severity
+	WEIGHT_INCIDENT_TYPE = 0.2
+	WEIGHT_THREAT_LEVEL  = 0.35
+	WEIGHT_KEYWORDS      = 0.25
+	WEIGHT_CONFIDENCE    = 0.2
+
+	FACTOR_INCIDENT_TYPE = "incident_type"
+	FACTOR_THREAT_LEVEL  = "threat_level"
+	FACTOR_KEYWORDS      = "keyword_match"
+	FACTOR_CONFIDENCE    = "event_confidence"
+	FACTOR_CORROBORATION = "corroboration"
+)
+
+var (
+	keywordScores map[string]float64
+)
+
+// SeverityFactor is one thing the suggested severity was worked out from. Value is between
+// 0 and 1, the contribution is what it added to the score before it is scaled to a severity.
+type SeverityFactor struct {
+	Factor       string  `json:"factor" bson:"factor"`
+	Value        float64 `json:"value" bson:"value"`
+	Weight       float64 `json:"weight" bson:"weight"`
+	Contribution float64 `json:"contribution" bson:"contribution"`
+	Detail       string  `json:"detail" bson:"detail"`
+}
+
+// SeverityScore is the severity the events of an incident suggest, kept on the incident as
+// severity_score next to the severity an analyst sets. Confidence is between 0 and 1 and
+// grows with the evidence the suggestion rests on.
+type SeverityScore struct {
+	Suggested  int64             `json:"suggested" bson:"suggested"`
+	Score      float64           `json:"score" bson:"score"`
+	Confidence float64           `json:"confidence" bson:"confidence"`
+	Events     int64             `json:"events" bson:"events"`
+	Factors    []*SeverityFactor `json:"factors" bson:"factors"`
+	ScoredAt   time.Time         `json:"scored_at" bson:"scored_at"`
+}
+
+// ScoredEvent is what scoring reads of an event.
+type ScoredEvent struct {
+	ID              *string  `bson:"_id,omitempty"`
+	AssetID         *string  `bson:"asset_id,omitempty"`
+	ThreatLevel     *int64   `bson:"threat_level,omitempty"`
+	ConfidenceScore *float64 `bson:"confidence_score,omitempty"`
+	AssetMatches    *struct {
+		Match *struct {
+			RequiredScore   *float64 `bson:"required_score,omitempty"`
+			ConfidenceScore *float64 `bson:"confidence_score,omitempty"`
+		} `bson:"match,omitempty"`
+	} `bson:"asset_matches,omitempty"`
+	Cuts []*struct {
+		Matches []*struct {
+			Matched     *string `bson:"matched,omitempty"`
+			KeywordName *string `bson:"keyword_name,omitempty"`
+		} `bson:"matches,omitempty"`
+	} `bson:"cuts,omitempty"`
+}
+
+// ScoredIncident is what scoring reads of an incident.
+type ScoredIncident struct {
+	ID       *string  `bson:"_id,omitempty"`
+	Type     *string  `bson:"type,omitempty"`
+	AssetID  *string  `bson:"asset_id,omitempty"`
+	EventIDs *Strings `bson:"event_ids,omitempty"`
+}
+
+// KeywordScoresPath is where the keyword weights are deployed, next to the binary.
+func KeywordScoresPath() string {
+	return filepath.Join(os.Getenv("LAMBDA_TASK_ROOT"), KEYWORD_SCORES_FILE)
+}
+
+// GetKeywordScores loads the keyword weights once per container.
+func GetKeywordScores() (map[string]float64, error) {
+	if keywordScores != nil {
+		return keywordScores, nil
+	}
+
+	b, err := ioutil.ReadFile(KeywordScoresPath())
+	if err != nil {
+		return nil, err
+	}
+
+	data := make(map[string]float64)
+	err = yaml.Unmarshal(b, &data)
+	if err != nil {
+		return nil, err
+	}
+
+	keywordScores = data
+	return keywordScores, nil
+}
+
+// keywordWeight is the matcher's multiplier for the keyword, keywords it has none for count fully.
+func keywordWeight(scores map[string]float64, keyword string) float64 {
+	if w, ok := scores[keyword]; ok {
+		return w
+	}
+	return 1
+}
+
+// fraction reads scores given either between 0 and 1 or as a percentage.
+func fraction(v float64) float64 {
+	if v > 1 {
+		v = v / 100
+	}
+	return math.Max(0, math.Min(1, v))
+}
+
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// KeywordStrength scores the event's best cut as the matcher does, the length of each match
+// times the weight of its keyword, against the score the asset requires.
+func (e ScoredEvent) KeywordStrength(scores map[string]float64, required float64) (float64, bool) {
+	best := -1.0
+	for _, cut := range e.Cuts {
+		if cut == nil {
+			continue
+		}
+
+		total := 0.0
+		for _, m := range cut.Matches {
+			if m == nil || m.Matched == nil || m.KeywordName == nil {
+				continue
+			}
+			total += math.Min(0.2*float64(len(*m.Matched)), 1) * keywordWeight(scores, *m.KeywordName)
+		}
+		best = math.Max(best, total)
+	}
+
+	if best < 0 {
+		return 0, false
+	}
+	if required <= 0 {
+		required = DEFAULT_REQUIRED_SCORE
+	}
+
+	return math.Min(1, best/required), true
+}
+
+func (e ScoredEvent) Confidence() (float64, bool) {
+	if e.ConfidenceScore != nil {
+		return fraction(*e.ConfidenceScore), true
+	}
+	if e.AssetMatches != nil && e.AssetMatches.Match != nil && e.AssetMatches.Match.ConfidenceScore != nil {
+		return fraction(*e.AssetMatches.Match.ConfidenceScore), true
+	}
+	return 0, false
+}
+
+// RequiredScore is the score the event's asset asks of a match, the asset's own over the one
+// the matcher copied onto the event.
+func (e ScoredEvent) RequiredScore(assets map[string]float64) float64 {
+	if e.AssetID != nil {
+		if v, ok := assets[*e.AssetID]; ok {
+			return fraction(v)
+		}
+	}
+	if e.AssetMatches != nil && e.AssetMatches.Match != nil && e.AssetMatches.Match.RequiredScore != nil {
+		return fraction(*e.AssetMatches.Match.RequiredScore)
+	}
+	return DEFAULT_REQUIRED_SCORE
+}
+
+// ComputeSeverity suggests a severity from 1 to 5 for the events. Each factor is scaled to
+// between 0 and 1 and weighted, factors none of the events have are left out and the others
+// weighted up in their place. More events add a little to the score and to the confidence.
+func ComputeSeverity(type_severity *int64, events []ScoredEvent, assets map[string]float64, scores map[string]float64, now time.Time) SeverityScore {
+	out := SeverityScore{Events: int64(len(events)), Factors: []*SeverityFactor{}, ScoredAt: now}
+
+	var factors []*SeverityFactor
+
+	if type_severity != nil {
+		factors = append(factors, &SeverityFactor{
+			Factor: FACTOR_INCIDENT_TYPE,
+			Value:  math.Max(0, math.Min(1, float64(*type_severity)/MAX_SEVERITY)),
+			Weight: WEIGHT_INCIDENT_TYPE,
+			Detail: "incident type severity " + strconv.FormatInt(*type_severity, 10),
+		})
+	}
+
+	var max_level int64 = -1
+	var keywords, confidence []float64
+	for _, e := range events {
+		if e.ThreatLevel != nil && *e.ThreatLevel > max_level {
+			max_level = *e.ThreatLevel
+		}
+		if v, ok := e.KeywordStrength(scores, e.RequiredScore(assets)); ok {
+			keywords = append(keywords, v)
+		}
+		if v, ok := e.Confidence(); ok {
+			confidence = append(confidence, v)
+		}
+	}
+
+	if max_level >= 0 {
+		factors = append(factors, &SeverityFactor{
+			Factor: FACTOR_THREAT_LEVEL,
+			Value:  math.Max(0, math.Min(1, float64(max_level)/MAX_SEVERITY)),
+			Weight: WEIGHT_THREAT_LEVEL,
+			Detail: "highest event threat level " + strconv.FormatInt(max_level, 10),
+		})
+	}
+
+	if len(keywords) > 0 {
+		factors = append(factors, &SeverityFactor{
+			Factor: FACTOR_KEYWORDS,
+			Value:  mean(keywords),
+			Weight: WEIGHT_KEYWORDS,
+			Detail: "keyword matches of " + strconv.Itoa(len(keywords)) + " events against the required score",
+		})
+	}
+
+	if len(confidence) > 0 {
+		factors = append(factors, &SeverityFactor{
+			Factor: FACTOR_CONFIDENCE,
+			Value:  mean(confidence),
+			Weight: WEIGHT_CONFIDENCE,
+			Detail: "average confidence of " + strconv.Itoa(len(confidence)) + " events",
+		})
+	}
+
+	coverage := 0.0
+	for _, f := range factors {
+		coverage += f.Weight
+	}
+	if coverage == 0 {
+		return out
+	}
+
+	score := 0.0
+	for _, f := range factors {
+		f.Value = round2(f.Value)
+		f.Contribution = round2(f.Value * f.Weight / coverage)
+		score += f.Value * f.Weight / coverage
+		out.Factors = append(out.Factors, f)
+	}
+
+	//each event after the first adds a little, up to three
+	if extra := math.Min(float64(len(events)-1), 3); extra > 0 {
+		bonus := 0.05 * extra
+		score += bonus
+		out.Factors = append(out.Factors, &SeverityFactor{
+			Factor:       FACTOR_CORROBORATION,
+			Value:        round2(extra / 3),
+			Weight:       0.15,
+			Contribution: round2(bonus),
+			Detail:       strconv.Itoa(len(events)) + " events",
+		})
+	}
+
+	score = math.Min(1, score)
+	out.Score = round2(score)
+	out.Suggested = int64(math.Max(1, math.Round(score*MAX_SEVERITY)))
+
+	//each event halves the doubt left, scaled by how many of the factors were there to go on
+	out.Confidence = round2(coverage * (1 - math.Pow(0.5, float64(len(events)))))
+
+	sort.SliceStable(out.Factors, func(i, j int) bool { return out.Factors[i].Contribution > out.Factors[j].Contribution })
+
+	return out
+}
+
+func mean(values []float64) float64 {
+	total := 0.0
+	for _, v := range values {
+		total += v
+	}
+	return total / float64(len(values))
+}
+
+func scoredObjectIDs(ids []string) []primitive.ObjectID {
+	out := []primitive.ObjectID{}
+	for _, id := range ids {
+		o_id, err := primitive.ObjectIDFromHex(id)
+		if err == nil {
+			out = append(out, o_id)
+		}
+	}
+	return out
+}
+
+// ScoreIncident works out the severity the incident's events suggest and stores it on the
+// incident. The severity itself is left to the analyst.
+func ScoreIncident(ctx context.Context, incident_id string, now time.Time) (SeverityScore, error) {
+	var out SeverityScore
+
+	scores, err := GetKeywordScores()
+	if err != nil {
+		return out, err
+	}
+
+	i_id, err := primitive.ObjectIDFromHex(incident_id)
+	if err != nil {
+		return out, err
+	}
+
+	var incident ScoredIncident
+	opts := options.FindOne().SetProjection(bson.M{"type": 1, "asset_id": 1, "event_ids": 1})
+	err = MongoClient.Database("fyeo-di").Collection("incidents").FindOne(ctx, bson.M{"_id": i_id}, opts).Decode(&incident)
+	if err != nil {
+		return out, err
+	}
+
+	var type_severity *int64
+	if incident.Type != nil {
+		var t struct {
+			Severity *int64 `bson:"severity,omitempty"`
+		}
+		err := MongoClient.Database("fyeo-di").Collection("incident_types").FindOne(ctx, bson.M{"class": *incident.Type}).Decode(&t)
+		if err == nil {
+			type_severity = t.Severity
+		}
+	}
+
+	var events []ScoredEvent
+	if incident.EventIDs != nil && len(*incident.EventIDs) > 0 {
+		projection := bson.M{"asset_id": 1, "threat_level": 1, "confidence_score": 1, "asset_matches.match": 1, "cuts.matches.matched": 1, "cuts.matches.keyword_name": 1}
+		e_opts := options.Find().SetProjection(projection).SetSort(bson.M{"_id": -1}).SetLimit(MAX_SCORED_EVENTS)
+
+		res, err := MongoClient.Database("fyeo-di").Collection("events").Find(ctx, bson.M{"_id": bson.M{"$in": scoredObjectIDs(*incident.EventIDs)}}, e_opts)
+		if err != nil {
+			return out, err
+		}
+
+		err = res.All(ctx, &events)
+		if err != nil {
+			return out, err
+		}
+	}
+
+	assets, err := requiredScores(ctx, incident.AssetID, events)
+	if err != nil {
+		return out, err
+	}
+
+	out = ComputeSeverity(type_severity, events, assets, scores, now)
+
+	res, err := MongoClient.Database("fyeo-di").Collection("incidents").UpdateOne(ctx, bson.M{"_id": i_id}, bson.M{"$set": bson.M{"severity_score": out}})
+	if err != nil {
+		return out, err
+	}
+
+	if res.MatchedCount < 1 {
+		return out, errors.New("Unable to find incident " + incident_id)
+	}
+
+	return out, nil
+}
+
+// requiredScores returns the required score of each asset the events and incident are about.
+func requiredScores(ctx context.Context, asset_id *string, events []ScoredEvent) (map[string]float64, error) {
+	out := make(map[string]float64)
+
+	var ids []string
+	if asset_id != nil {
+		ids = append(ids, *asset_id)
+	}
+	for _, e := range events {
+		if e.AssetID != nil {
+			ids = append(ids, *e.AssetID)
+		}
+	}
+	if len(ids) == 0 {
+		return out, nil
+	}
+
+	opts := options.Find().SetProjection(bson.M{"required_score": 1})
+	res, err := MongoClient.Database("fyeo-di").Collection("assets").Find(ctx, bson.M{"_id": bson.M{"$in": scoredObjectIDs(ids)}}, opts)
+	if err != nil {
+		return out, err
+	}
+
+	var docs []struct {
+		ID            string   `bson:"_id"`
+		RequiredScore *float64 `bson:"required_score,omitempty"`
+	}
+	err = res.All(ctx, &docs)
+	for _, d := range docs {
+		if d.RequiredScore != nil {
+			out[d.ID] = *d.RequiredScore
+		}
+	}
+
+	return out, err
+}
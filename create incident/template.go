@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	DEFAULT_ASSET_NAME = "asset"
+
+	//legacy templates are filled positionally with these, in this order
+	LEGACY_PLACEHOLDER = "%s"
+)
+
+var (
+	legacyVariables = []string{"{{.Asset.Name}}", "{{.Source}}", "{{.ThreatActor.Name}}"}
+
+	templateFuncs = template.FuncMap{
+		"upper": strings.ToUpper,
+		"lower": strings.ToLower,
+		"join":  strings.Join,
+		//{{.Event.Title | default "untitled"}}
+		"default": func(def string, v string) string {
+			if strings.TrimSpace(v) == "" {
+				return def
+			}
+			return v
+		},
+		//{{.Event.CreatedAt | date "2006-01-02"}}
+		"date": func(layout string, t time.Time) string {
+			if t.IsZero() {
+				return ""
+			}
+			return t.UTC().Format(layout)
+		},
+		"truncate": func(n int, s string) string {
+			r := []rune(s)
+			if n < 0 || len(r) <= n {
+				return s
+			}
+			return string(r[:n])
+		},
+	}
+
+	templateCache   = make(map[string]*template.Template)
+	templateCacheMu sync.Mutex
+)
+
+type TemplateAsset struct {
+	ID   string
+	Name string
+	Type string
+}
+
+type TemplateThreatActor struct {
+	ID          string
+	Name        string
+	Description string
+}
+
+// TemplateEvent is the part of the event templates can refer to, missing values are empty.
+type TemplateEvent struct {
+	ID              string
+	URL             string
+	Site            string
+	Title           string
+	TranslatedTitle string
+	SourceNetwork   string
+	SourceType      string
+	EventType       string
+	Language        string
+	ThreatLevel     int64
+	ConfidenceScore float64
+	CreatedAt       time.Time
+	Emails          []string
+	IPs             []string
+	Links           []string
+	Keywords        []string
+	Crypto          []string
+	Targets         []string
+}
+
+// TemplateData holds the variables of incident titles, descriptions and recommendations, as
+// in {{.Asset.Name}}, {{.Source}}, {{.ThreatActor.Name}} or {{.Event.Site}}.
+type TemplateData struct {
+	Asset        TemplateAsset
+	ThreatActor  TemplateThreatActor
+	Event        TemplateEvent
+	Source       string
+	CaseID       string
+	IncidentType string
+	Rule         string
+	Severity     int64
+}
+
+func templateString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func templateStrings(s *Strings) []string {
+	if s == nil {
+		return nil
+	}
+	return *s
+}
+
+func NewTemplateEvent(e Event) TemplateEvent {
+	out := TemplateEvent{
+		ID:              templateString(e.ID),
+		URL:             templateString(e.URL),
+		Site:            templateString(e.Site),
+		Title:           templateString(e.Title),
+		TranslatedTitle: templateString(e.TranslatedTitle),
+		SourceNetwork:   templateString(e.SourceNetwork),
+		SourceType:      templateString(e.SourceType),
+		EventType:       templateString(e.EventType),
+		Language:        templateString(e.Language),
+		Emails:          templateStrings(e.Emails),
+		IPs:             templateStrings(e.IPs),
+		Links:           templateStrings(e.Links),
+		Keywords:        templateStrings(e.Keywords),
+		Crypto:          templateStrings(e.Crypto),
+		Targets:         templateStrings(e.Targets),
+	}
+
+	if e.ThreatLevel != nil {
+		out.ThreatLevel = *e.ThreatLevel
+	}
+	if e.ConfidenceScore != nil {
+		out.ConfidenceScore = *e.ConfidenceScore
+	}
+	if e.CreatedAt != nil {
+		out.CreatedAt = *e.CreatedAt
+	}
+
+	return out
+}
+
+// NewTemplateData gives the variables for an incident of the event, the asset is named after
+// the event as the engine has always done.
+func NewTemplateData(e Event, source string, threat_actor ThreatActor) TemplateData {
+	out := TemplateData{
+		Asset: TemplateAsset{
+			ID:   templateString(e.AssetID),
+			Name: templateString(e.AssetName),
+			Type: templateString(e.AssetType),
+		},
+		ThreatActor: TemplateThreatActor{
+			ID:          templateString(threat_actor.ID),
+			Name:        templateString(threat_actor.Name),
+			Description: templateString(threat_actor.Description),
+		},
+		Event:  NewTemplateEvent(e),
+		Source: source,
+		CaseID: templateString(e.CaseID),
+	}
+
+	if out.Asset.Name == "" {
+		out.Asset.Name = DEFAULT_ASSET_NAME
+	}
+
+	return out
+}
+
+// SampleTemplateData is what templates are validated against and previewed with when no
+// event is given.
+func SampleTemplateData() TemplateData {
+	created_at := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	return TemplateData{
+		Asset:       TemplateAsset{ID: "000000000000000000000000", Name: "example.com", Type: "domain"},
+		ThreatActor: TemplateThreatActor{ID: "000000000000000000000001", Name: "threat actor", Description: "a known threat actor"},
+		Event: TemplateEvent{
+			ID:              "000000000000000000000002",
+			URL:             "https://paste.example.org/raw/abc123",
+			Site:            "paste.example.org",
+			Title:           "example.com credentials",
+			TranslatedTitle: "example.com credentials",
+			SourceNetwork:   "darknet",
+			SourceType:      "paste",
+			EventType:       "leak",
+			Language:        "en",
+			ThreatLevel:     3,
+			ConfidenceScore: 0.9,
+			CreatedAt:       created_at,
+			Emails:          []string{"admin@example.com"},
+			Targets:         []string{"example.com"},
+		},
+		Source:       "paste.example.org",
+		CaseID:       "000000000000000000000003",
+		IncidentType: "leaked_credentials",
+		Rule:         "leaked_credentials",
+		Severity:     3,
+	}
+}
+
+// IsLegacyTemplate tells the %s templates written for the old engine from named ones.
+func IsLegacyTemplate(text string) bool {
+	return strings.Contains(text, LEGACY_PLACEHOLDER) && !strings.Contains(text, "{{")
+}
+
+func parseTemplate(text string) (*template.Template, error) {
+	templateCacheMu.Lock()
+	defer templateCacheMu.Unlock()
+
+	if t, ok := templateCache[text]; ok {
+		return t, nil
+	}
+
+	t, err := template.New("incident").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	templateCache[text] = t
+	return t, nil
+}
+
+// RenderTemplate fills the template with the data. Templates not migrated yet are filled
+// positionally, like the old engine did.
+func RenderTemplate(text string, data TemplateData) (string, error) {
+	if IsLegacyTemplate(text) {
+		return FormatTitle(text, data.Asset.Name, data.Source, data.ThreatActor.Name), nil
+	}
+
+	t, err := parseTemplate(text)
+	if err != nil {
+		return "", err
+	}
+
+	var b bytes.Buffer
+	err = t.Execute(&b, data)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(b.String()), nil
+}
+
+// ValidateTemplate checks the template parses and only refers to variables that exist.
+func ValidateTemplate(text string) error {
+	if strings.Contains(text, LEGACY_PLACEHOLDER) {
+		return errors.New("Use named variables such as {{.Asset.Name}} instead of %s")
+	}
+
+	t, err := template.New("incident").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return err
+	}
+
+	var b bytes.Buffer
+	return t.Execute(&b, SampleTemplateData())
+}
+
+// MigrateTemplate rewrites a %s template with the named variables the values were filled
+// positionally with.
+func MigrateTemplate(text string) (string, error) {
+	if !IsLegacyTemplate(text) {
+		return text, nil
+	}
+
+	parts := strings.Split(strings.ReplaceAll(text, "%%", "\x00"), LEGACY_PLACEHOLDER)
+	if len(parts)-1 > len(legacyVariables) {
+		return text, errors.New("Template has more %s than there are values for")
+	}
+
+	var b strings.Builder
+	for i, p := range parts {
+		b.WriteString(p)
+		if i < len(parts)-1 {
+			b.WriteString(legacyVariables[i])
+		}
+	}
+
+	return strings.ReplaceAll(b.String(), "\x00", "%"), nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	//field the event pages are sorted on, when the event was ingested
+	INGESTED_KEY = "_ingested"
+)
+
+// EventKey orders events by when they were ingested, then by id. Events written before
+// ingested_at was set, such as those of the legacy matcher, are ordered by when their id was
+// made, their created_at is when the page was seen and can be older than the insert.
+type EventKey struct {
+	IngestedAt time.Time          `json:"ingested_at" bson:"ingested_at"`
+	EventID    primitive.ObjectID `json:"event_id" bson:"event_id"`
+}
+
+// Watermark is the key of the last event a rule has handled, the next run starts after it.
+// It is reset when the rule changes, so a changed rule looks at the whole lookback again,
+// a rule resolved for a case changes with the case's settings.
+type Watermark struct {
+	Rule      string    `bson:"_id"`
+	RuleHash  string    `bson:"rule_hash"`
+	Key       EventKey  `bson:"key"`
+	UpdatedAt time.Time `bson:"updated_at"`
+}
+
+func KeyOf(e Event) EventKey {
+	var k EventKey
+	if e.ID != nil {
+		k.EventID, _ = primitive.ObjectIDFromHex(*e.ID)
+	}
+	if e.IngestedAt != nil {
+		k.IngestedAt = *e.IngestedAt
+	} else {
+		k.IngestedAt = k.EventID.Timestamp()
+	}
+	return k
+}
+
+func (k EventKey) Before(other EventKey) bool {
+	if !k.IngestedAt.Equal(other.IngestedAt) {
+		return k.IngestedAt.Before(other.IngestedAt)
+	}
+	return k.EventID.Hex() < other.EventID.Hex()
+}
+
+// Key names the rule's watermark, the copies of a rule resolved for a case have their own.
+func (rule *Rule) Key() string {
+	if rule.Case == "" {
+		return rule.Name
+	}
+	return rule.Name + "@" + rule.Case
+}
+
+// Hash identifies the rule's definition, json gives map keys in order. The cases left out of
+// the rule are not part of it, a case changing its settings must not start the rule over.
+func (rule *Rule) Hash() string {
+	def := *rule
+	if def.BaseFilter != nil {
+		def.Filter = def.BaseFilter
+	}
+
+	b, _ := json.Marshal(def)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func GetWatermarks(ctx context.Context) (map[string]Watermark, error) {
+	out := make(map[string]Watermark)
+
+	res, err := MongoClient.Database("fyeo-di").Collection("rule_watermarks").Find(ctx, bson.M{})
+	if err != nil {
+		return out, err
+	}
+
+	var docs []Watermark
+	err = res.All(ctx, &docs)
+	if err != nil {
+		return out, err
+	}
+
+	for _, d := range docs {
+		out[d.Rule] = d
+	}
+
+	return out, nil
+}
+
+func SaveWatermark(ctx context.Context, rule Rule, key EventKey, now time.Time) error {
+	w := Watermark{Rule: rule.Key(), RuleHash: rule.Hash(), Key: key, UpdatedAt: now}
+
+	_, err := MongoClient.Database("fyeo-di").Collection("rule_watermarks").ReplaceOne(ctx, bson.M{"_id": rule.Key()}, w, options.Replace().SetUpsert(true))
+	return err
+}
+
+// StartKey is where the rule carries on from. Rules without a watermark, changed since,
+// or idle for longer than the lookback start at the lookback.
+func StartKey(rule Rule, marks map[string]Watermark, now time.Time) EventKey {
+	start := EventKey{IngestedAt: now.Add(-LOOKBACK)}
+
+	w, ok := marks[rule.Key()]
+	if !ok || w.RuleHash != rule.Hash() || w.Key.Before(start) {
+		return start
+	}
+
+	return w.Key
+}
+
+// GetEventsAfter returns the events matching the query after the key, up to the time when
+// given and up to the until key, in key order.
+func GetEventsAfter(ctx context.Context, query bson.M, after EventKey, to *time.Time, until EventKey, limit int64) ([]Event, error) {
+	//narrows the events down on the indexed fields before the key is worked out
+	since := bson.M{"$or": []bson.M{
+		{"ingested_at": bson.M{"$gte": after.IngestedAt}},
+		{"ingested_at": bson.M{"$exists": false}, "_id": bson.M{"$gte": primitive.NewObjectIDFromTimestamp(after.IngestedAt)}},
+	}}
+
+	window := []bson.M{
+		{"$or": []bson.M{
+			{INGESTED_KEY: bson.M{"$gt": after.IngestedAt}},
+			{INGESTED_KEY: after.IngestedAt, "_id": bson.M{"$gt": after.EventID}},
+		}},
+		{"$or": []bson.M{
+			{INGESTED_KEY: bson.M{"$lt": until.IngestedAt}},
+			{INGESTED_KEY: until.IngestedAt, "_id": bson.M{"$lte": until.EventID}},
+		}},
+	}
+	if to != nil {
+		window = append(window, bson.M{INGESTED_KEY: bson.M{"$lte": *to}})
+	}
+
+	pipeline := []bson.M{
+		{"$match": bson.M{"$and": []bson.M{query, since}}},
+		{"$addFields": bson.M{INGESTED_KEY: bson.M{"$ifNull": []interface{}{"$ingested_at", bson.M{"$toDate": "$_id"}}}}},
+		{"$match": bson.M{"$and": window}},
+		{"$sort": bson.D{{Key: INGESTED_KEY, Value: 1}, {Key: "_id", Value: 1}}},
+		{"$limit": limit},
+	}
+
+	res, err := MongoClient.Database("fyeo-di").Collection("events").Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, err
+	}
+
+	var data []Event
+	err = res.All(ctx, &data)
+	return data, err
+}
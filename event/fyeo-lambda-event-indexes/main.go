@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	MongoClient *mongo.Client
+)
+
+// IndexReport lists the indexes created, by collection.
+type IndexReport struct {
+	Created map[string][]string `json:"created"`
+}
+
+func main() {
+	lambda.Start(Handler)
+}
+
+func Init() error {
+	var err error
+
+	err = ReuseMongo()
+	if err != nil {
+		return err
+	}
+
+	return err
+}
+
+func ReuseMongo() error {
+	if MongoClient != nil {
+		return nil
+	} else {
+		var err error
+		ctx := context.Background()
+
+		uri := "mongodb://192.168.0.229:27017"
+
+		MongoClient, err = mongo.Connect(ctx, options.Client().ApplyURI(uri))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// EventIndexes makes a page seen twice for the same asset a duplicate key error. Legacy
+// events have no url_hash and are left out of the unique index.
+func EventIndexes() []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "asset_id", Value: 1}, {Key: "url_hash", Value: 1}, {Key: "content_hash", Value: 1}},
+			Options: options.Index().
+				SetName("ingest_idempotency").
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"url_hash": bson.M{"$exists": true}}),
+		},
+		{Keys: bson.D{{Key: "ingested_at", Value: 1}}},
+	}
+}
+
+// MyEventsIndexes serve the my-events listing, which always filters on the caller's cases and
+// most often narrows it by date, threat level, asset or the caller's stars. Legacy events keep
+// the case under caseId or parentId and the date under time, those branches of the $or get
+// their own index.
+func MyEventsIndexes() []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{Keys: bson.D{{Key: "case_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "case_id", Value: 1}, {Key: "threat_level", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "case_id", Value: 1}, {Key: "asset_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "case_id", Value: 1}, {Key: "starred_by", Value: 1}}},
+		{Keys: bson.D{{Key: "caseId", Value: 1}, {Key: "time", Value: -1}}},
+		{Keys: bson.D{{Key: "parentId", Value: 1}, {Key: "time", Value: -1}}},
+	}
+}
+
+// SourceDocumentIndexes keeps one source document per url and title.
+func SourceDocumentIndexes() []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "url_hash", Value: 1}, {Key: "title_hash", Value: 1}},
+			Options: options.Index().SetName("source_document").SetUnique(true),
+		},
+	}
+}
+
+// EnsureIndexes creates the indexes of each collection. Indexes that already exist are left
+// as they are, so it is safe to run on every deploy.
+func EnsureIndexes(ctx context.Context) (IndexReport, error) {
+	report := IndexReport{Created: make(map[string][]string)}
+
+	collections := []struct {
+		name    string
+		indexes []mongo.IndexModel
+	}{
+		{"events", EventIndexes()},
+		{"events", MyEventsIndexes()},
+		{"source_documents", SourceDocumentIndexes()},
+	}
+
+	for _, c := range collections {
+		names, err := MongoClient.Database("fyeo-di").Collection(c.name).Indexes().CreateMany(ctx, c.indexes)
+		if err != nil {
+			return report, err
+		}
+		report.Created[c.name] = append(report.Created[c.name], names...)
+	}
+
+	return report, nil
+}
+
+// Handler is invoked once when the lambdas are deployed, index builds are kept out of the
+// request handlers.
+func Handler(ctx context.Context, event events.CloudWatchEvent) (IndexReport, error) {
+	err := Init()
+	if err != nil {
+		return IndexReport{}, err
+	}
+
+	report, err := EnsureIndexes(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	for name, created := range report.Created {
+		log.Printf("%s: %s", name, strings.Join(created, ", "))
+	}
+
+	return report, nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	BATCH_SIZE         = 500
+	MAX_EVENTS_PER_RUN = 20000
+
+	//leave time to write the last batch before the lambda is stopped
+	RUN_TIME = 10 * time.Minute
+)
+
+var (
+	MongoClient *mongo.Client
+
+	//indicator fields the backfill sets, legacy spellings are folded into these
+	indicatorFields = []string{"emails", "ips", "links", "crypto", "hashes", "phones"}
+)
+
+type Strings []string
+
+type BackfillReport struct {
+	Checked int64    `json:"checked"`
+	Updated int64    `json:"updated"`
+	Done    bool     `json:"done"`
+	Errors  []string `json:"errors,omitempty"`
+}
+
+func main() {
+	lambda.Start(Handler)
+}
+
+func Init() error {
+	var err error
+
+	err = ReuseMongo()
+	if err != nil {
+		return err
+	}
+
+	return err
+}
+
+func ReuseMongo() error {
+	if MongoClient != nil {
+		return nil
+	} else {
+		var err error
+		ctx := context.Background()
+
+		uri := "mongodb://192.168.0.229:27017"
+
+		MongoClient, err = mongo.Connect(ctx, options.Client().ApplyURI(uri))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func WriteBatch(ctx context.Context, models []mongo.WriteModel) (int64, error) {
+	if len(models) == 0 {
+		return 0, nil
+	}
+
+	res, err := MongoClient.Database("fyeo-di").Collection("events").BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return 0, err
+	}
+
+	return res.ModifiedCount, nil
+}
+
+// IndicatorUpdate sets the merged indicators under their current names and drops the legacy
+// ones, their values are already part of the merge.
+func IndicatorUpdate(e Event) bson.M {
+	set := bson.M{"indicators_version": e.IndicatorsVersion}
+	for k, v := range map[string]*Strings{
+		"emails": e.Emails,
+		"ips":    e.IPs,
+		"links":  e.Links,
+		"crypto": e.Crypto,
+		"hashes": e.Hashes,
+		"phones": e.Phones,
+	} {
+		if v != nil {
+			set[k] = v
+		}
+	}
+	if len(e.Credentials) > 0 {
+		set["credentials"] = e.Credentials
+	}
+
+	update := bson.M{"$set": set}
+
+	unset := bson.M{}
+	for _, f := range indicatorFields {
+		for _, n := range EventFieldNames(f) {
+			if n != f {
+				unset[n] = ""
+			}
+		}
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+
+	return update
+}
+
+// Backfill extracts indicators for events written before extraction, or by an older version
+// of it. Events are taken in _id order and marked as they go, so a run that stops early
+// carries on from where it was on the next schedule.
+func Backfill(ctx context.Context, deadline time.Time) (BackfillReport, error) {
+	var report BackfillReport
+
+	filter := bson.M{"$or": []bson.M{
+		{"indicators_version": bson.M{"$exists": false}},
+		{"indicators_version": bson.M{"$lt": INDICATORS_VERSION}},
+	}}
+	opts := options.Find().SetSort(bson.M{"_id": 1}).SetLimit(MAX_EVENTS_PER_RUN)
+
+	cur, err := MongoClient.Database("fyeo-di").Collection("events").Find(ctx, filter, opts)
+	if err != nil {
+		return report, err
+	}
+	defer cur.Close(ctx)
+
+	var models []mongo.WriteModel
+	for cur.Next(ctx) {
+		report.Checked++
+
+		id := cur.Current.Lookup("_id")
+
+		var e Event
+		err := cur.Decode(&e)
+		if err != nil {
+			//marked anyway, it would otherwise be first in line on every run
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", id.String(), err.Error()))
+			models = append(models, mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"_id": id}).
+				SetUpdate(bson.M{"$set": bson.M{"indicators_version": INDICATORS_VERSION}}))
+			continue
+		}
+
+		ExtractIndicators(EventTexts(&e)...).Apply(&e)
+
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": id}).
+			SetUpdate(IndicatorUpdate(e)))
+
+		if len(models) >= BATCH_SIZE {
+			n, err := WriteBatch(ctx, models)
+			if err != nil {
+				return report, err
+			}
+			report.Updated += n
+			models = nil
+
+			if time.Now().After(deadline) {
+				return report, nil
+			}
+		}
+	}
+
+	if cur.Err() != nil {
+		return report, cur.Err()
+	}
+
+	n, err := WriteBatch(ctx, models)
+	if err != nil {
+		return report, err
+	}
+	report.Updated += n
+	report.Done = report.Checked < MAX_EVENTS_PER_RUN
+
+	return report, nil
+}
+
+func Handler(ctx context.Context, event events.CloudWatchEvent) (BackfillReport, error) {
+	err := Init()
+	if err != nil {
+		return BackfillReport{}, err
+	}
+
+	report, err := Backfill(ctx, time.Now().Add(RUN_TIME))
+	if err != nil {
+		return report, err
+	}
+
+	log.Printf("checked %d events, updated %d, done: %t", report.Checked, report.Updated, report.Done)
+	if len(report.Errors) > 0 {
+		log.Printf("errors: %s", strings.Join(report.Errors, "; "))
+	}
+
+	return report, nil
+}
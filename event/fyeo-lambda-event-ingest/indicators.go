@@ -0,0 +1,339 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math/big"
+	"net"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// INDICATORS_VERSION goes up whenever extraction changes, so the backfill knows what to redo.
+const INDICATORS_VERSION = 1
+
+var (
+	//defanged forms seen in pastes, e.g hxxp://example[.]com or user[at]example(dot)com
+	refanger = strings.NewReplacer(
+		"hxxps://", "https://", "hXXps://", "https://", "hxxp://", "http://", "hXXp://", "http://",
+		"[.]", ".", "(.)", ".", "{.}", ".", "[dot]", ".", "(dot)", ".", "{dot}", ".", " [.] ", ".",
+		"[:]", ":", "[://]", "://",
+		"[@]", "@", "(@)", "@", "[at]", "@", "(at)", "@", "{at}", "@",
+	)
+
+	emailRe    = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+	urlRe      = regexp.MustCompile(`(?i)\b(?:https?|ftp)://[^\s<>"'` + "`" + `]+`)
+	ipv4Re     = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`)
+	ipv6Re     = regexp.MustCompile(`(?i)(?:[0-9a-f]{0,4}:){2,7}[0-9a-f]{0,4}`)
+	btcBase58  = regexp.MustCompile(`\b[13][1-9A-HJ-NP-Za-km-z]{25,34}\b`)
+	btcBech32  = regexp.MustCompile(`\b(?:bc1|BC1)[02-9ac-hj-np-zAC-HJ-NP-Z]{11,71}\b`)
+	ethRe      = regexp.MustCompile(`\b0x[0-9a-fA-F]{40}\b`)
+	xmrRe      = regexp.MustCompile(`\b[48][0-9AB][1-9A-HJ-NP-Za-km-z]{93}(?:[1-9A-HJ-NP-Za-km-z]{11})?\b`)
+	hashRe     = regexp.MustCompile(`\b(?:[0-9a-fA-F]{64}|[0-9a-fA-F]{40}|[0-9a-fA-F]{32})\b`)
+	phoneRe    = regexp.MustCompile(`(?:\+|\btel:\s*\+?)\d[\d\s().\-]{6,20}\d`)
+	comboRe    = regexp.MustCompile(`(?m)^\s*([A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,})\s*[:;|]\s*(\S{3,128})\s*$`)
+	loginRe    = regexp.MustCompile(`(?i)\b(?:user(?:name)?|login)\s*[:=]\s*(\S+)\s+(?:pass(?:word)?|pwd)\s*[:=]\s*(\S+)`)
+	trailingRe = regexp.MustCompile(`[.,;:!?)\]}>'"]+$`)
+
+	base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+	bech32Alphabet = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+)
+
+// Indicators are what ExtractIndicators found, each list without duplicates.
+type Indicators struct {
+	Emails      []string
+	IPs         []string
+	Links       []string
+	Crypto      []string
+	Hashes      []string
+	Phones      []string
+	Credentials []*EventCredential
+}
+
+type stringSet struct {
+	seen map[string]bool
+	list []string
+}
+
+func (s *stringSet) add(v string) {
+	if v == "" {
+		return
+	}
+	if s.seen == nil {
+		s.seen = make(map[string]bool)
+	}
+	if !s.seen[v] {
+		s.seen[v] = true
+		s.list = append(s.list, v)
+	}
+}
+
+// Refang undoes the usual defanging so defanged urls and emails are found too.
+func Refang(input string) string {
+	return refanger.Replace(input)
+}
+
+func validBase58Check(input string) bool {
+	n := new(big.Int)
+	for _, r := range input {
+		i := strings.IndexRune(base58Alphabet, r)
+		if i < 0 {
+			return false
+		}
+		n.Mul(n, big.NewInt(58))
+		n.Add(n, big.NewInt(int64(i)))
+	}
+
+	b := n.Bytes()
+	for _, r := range input {
+		if r != '1' {
+			break
+		}
+		b = append([]byte{0}, b...)
+	}
+
+	if len(b) != 25 {
+		return false
+	}
+
+	first := sha256.Sum256(b[:21])
+	second := sha256.Sum256(first[:])
+	return string(second[:4]) == string(b[21:])
+}
+
+func bech32Polymod(values []int) int {
+	gen := []int{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := 1
+	for _, v := range values {
+		b := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ v
+		for i := 0; i < 5; i++ {
+			if (b>>uint(i))&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	return chk
+}
+
+// validBech32 checks a segwit address checksum, bech32 for v0 and bech32m for later versions.
+func validBech32(input string) bool {
+	input = strings.ToLower(input)
+	pos := strings.LastIndex(input, "1")
+	if pos < 1 || len(input)-pos < 7 {
+		return false
+	}
+
+	hrp := input[:pos]
+	var values []int
+	for _, r := range hrp {
+		values = append(values, int(r)>>5)
+	}
+	values = append(values, 0)
+	for _, r := range hrp {
+		values = append(values, int(r)&31)
+	}
+
+	var data []int
+	for _, r := range input[pos+1:] {
+		i := strings.IndexRune(bech32Alphabet, r)
+		if i < 0 {
+			return false
+		}
+		data = append(data, i)
+	}
+
+	check := bech32Polymod(append(values, data...))
+	if data[0] == 0 {
+		return check == 1
+	}
+	return check == 0x2bc830a3
+}
+
+func mixedHex(input string) bool {
+	return strings.ContainsAny(input, "0123456789") && strings.ContainsAny(strings.ToLower(input), "abcdef")
+}
+
+// MaskPassword keeps the first and last character so analysts can tell passwords apart.
+func MaskPassword(password string) string {
+	n := utf8.RuneCountInString(password)
+	if n <= 2 {
+		return strings.Repeat("*", n)
+	}
+
+	r := []rune(password)
+	return string(r[0]) + strings.Repeat("*", n-2) + string(r[n-1])
+}
+
+func credential(username string, password string) *EventCredential {
+	sum := sha256.Sum256([]byte(password))
+	digest := hex.EncodeToString(sum[:])
+	masked := MaskPassword(password)
+	username = strings.ToLower(username)
+
+	return &EventCredential{
+		Username:       &username,
+		PasswordMasked: &masked,
+		PasswordSHA256: &digest,
+	}
+}
+
+// ExtractIndicators finds emails, ip addresses, urls, wallet addresses, hashes, phone numbers
+// and credential pairs in the given texts.
+func ExtractIndicators(texts ...string) Indicators {
+	var emails, ips, links, crypto, hashes, phones stringSet
+	var creds []*EventCredential
+	seen_creds := make(map[string]bool)
+
+	for _, text := range texts {
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		text = Refang(text)
+
+		for _, m := range urlRe.FindAllString(text, -1) {
+			links.add(trailingRe.ReplaceAllString(m, ""))
+		}
+
+		for _, m := range emailRe.FindAllString(text, -1) {
+			emails.add(strings.ToLower(trailingRe.ReplaceAllString(m, "")))
+		}
+
+		for _, m := range ipv4Re.FindAllString(text, -1) {
+			ip := net.ParseIP(m)
+			if ip != nil && ip.To4() != nil {
+				ips.add(ip.String())
+			}
+		}
+
+		for _, m := range ipv6Re.FindAllString(text, -1) {
+			if strings.Count(m, ":") < 2 || !strings.ContainsAny(m, "0123456789abcdefABCDEF") {
+				continue
+			}
+			ip := net.ParseIP(m)
+			if ip != nil && ip.To4() == nil {
+				ips.add(ip.String())
+			}
+		}
+
+		for _, m := range btcBase58.FindAllString(text, -1) {
+			if validBase58Check(m) {
+				crypto.add(m)
+			}
+		}
+
+		for _, m := range btcBech32.FindAllString(text, -1) {
+			if validBech32(m) {
+				crypto.add(strings.ToLower(m))
+			}
+		}
+
+		for _, m := range ethRe.FindAllString(text, -1) {
+			crypto.add(strings.ToLower(m))
+		}
+
+		for _, m := range xmrRe.FindAllString(text, -1) {
+			crypto.add(m)
+		}
+
+		for _, m := range hashRe.FindAllString(text, -1) {
+			if mixedHex(m) {
+				hashes.add(strings.ToLower(m))
+			}
+		}
+
+		for _, m := range phoneRe.FindAllString(text, -1) {
+			var digits strings.Builder
+			for _, r := range m {
+				if r >= '0' && r <= '9' {
+					digits.WriteRune(r)
+				}
+			}
+			if digits.Len() >= 8 && digits.Len() <= 15 {
+				phones.add("+" + digits.String())
+			}
+		}
+
+		for _, re := range []*regexp.Regexp{comboRe, loginRe} {
+			for _, m := range re.FindAllStringSubmatch(text, -1) {
+				c := credential(m[1], m[2])
+				key := *c.Username + ":" + *c.PasswordSHA256
+				if !seen_creds[key] {
+					seen_creds[key] = true
+					creds = append(creds, c)
+				}
+			}
+		}
+	}
+
+	return Indicators{
+		Emails:      emails.list,
+		IPs:         ips.list,
+		Links:       links.list,
+		Crypto:      crypto.list,
+		Hashes:      hashes.list,
+		Phones:      phones.list,
+		Credentials: creds,
+	}
+}
+
+func mergeStrings(current *Strings, found []string) *Strings {
+	var set stringSet
+	if current != nil {
+		for _, v := range *current {
+			set.add(v)
+		}
+	}
+	for _, v := range found {
+		set.add(v)
+	}
+
+	if len(set.list) == 0 {
+		return current
+	}
+
+	out := Strings(set.list)
+	return &out
+}
+
+// Apply adds the indicators to the event, keeping whatever the matcher already filled in.
+func (ind Indicators) Apply(e *Event) {
+	e.Emails = mergeStrings(e.Emails, ind.Emails)
+	e.IPs = mergeStrings(e.IPs, ind.IPs)
+	e.Links = mergeStrings(e.Links, ind.Links)
+	e.Crypto = mergeStrings(e.Crypto, ind.Crypto)
+	e.Hashes = mergeStrings(e.Hashes, ind.Hashes)
+	e.Phones = mergeStrings(e.Phones, ind.Phones)
+
+	seen := make(map[string]bool)
+	for _, c := range e.Credentials {
+		if c != nil && c.Username != nil && c.PasswordSHA256 != nil {
+			seen[*c.Username+":"+*c.PasswordSHA256] = true
+		}
+	}
+	for _, c := range ind.Credentials {
+		key := *c.Username + ":" + *c.PasswordSHA256
+		if !seen[key] {
+			seen[key] = true
+			e.Credentials = append(e.Credentials, c)
+		}
+	}
+
+	version := int64(INDICATORS_VERSION)
+	e.IndicatorsVersion = &version
+}
+
+// EventTexts is the text indicators are extracted from, the title and the cuts.
+func EventTexts(e *Event) []string {
+	var out []string
+	if e.Title != nil {
+		out = append(out, *e.Title)
+	}
+	for _, c := range e.Cuts {
+		if c != nil && c.Cut != nil {
+			out = append(out, *c.Cut)
+		}
+	}
+	return out
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	_ "embed"
+
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	MAX_BATCH_SIZE = 500
+	MAX_CUTS       = 200
+	MAX_CUT_LENGTH = 10000
+	MAX_TITLE      = 1000
+	MAX_CONTENT    = 5 * 1024 * 1024
+
+	STATUS_ACCEPTED  = "accepted"
+	STATUS_DUPLICATE = "duplicate"
+	STATUS_REJECTED  = "rejected"
+
+	EVENT_AGENT   = "lambda_matcher"
+	EVENT_VERSION = 5
+)
+
+var (
+	sourceNetworks = map[string]bool{
+		"dark-net":     true,
+		"clear-net":    true,
+		"social-media": true,
+	}
+)
+
+// Score accepts a number or a numeric string, the matcher writes asset scores as strings.
+type Score float64
+
+func (s *Score) UnmarshalJSON(data []byte) error {
+	str := strings.Trim(string(data), `"`)
+	if str == "" || str == "null" {
+		*s = 0
+		return nil
+	}
+
+	f, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return errors.New("Invalid score: " + string(data))
+	}
+
+	*s = Score(f)
+	return nil
+}
+
+type IngestMatch struct {
+	AssetID     *string `json:"asset_id"`
+	CaseID      *string `json:"case_id"`
+	AssetScore  *Score  `json:"asset_score"`
+	Matched     *string `json:"matched"`
+	KeywordName *string `json:"keyword_name"`
+	StartPos    *int64  `json:"start_pos"`
+	EndPos      *int64  `json:"end_pos"`
+}
+
+type IngestCut struct {
+	Cut      *string        `json:"cut"`
+	StartPos *int64         `json:"start_pos"`
+	EndPos   *int64         `json:"end_pos"`
+	Matches  []*IngestMatch `json:"matches"`
+}
+
+type IngestDocumentData struct {
+	Title           *string `json:"title"`
+	ContentType     *string `json:"content_type"`
+	ContentLength   *int64  `json:"content_length"`
+	ContentEncoding *string `json:"content_encoding"`
+	ContentLanguage *string `json:"content_language"`
+}
+
+// IngestItem is a MatchEvent as written by the python matcher.
+type IngestItem struct {
+	CaseID          *string             `json:"case_id"`
+	AssetID         *string             `json:"asset_id"`
+	URL             *string             `json:"url"`
+	Title           *string             `json:"title"`
+	Site            *string             `json:"site"`
+	ContentHash     *string             `json:"content_hash"`
+	ContentType     *string             `json:"content_type"`
+	SourceNetwork   *string             `json:"source_network"`
+	Probability     *float64            `json:"probability"`
+	ConfidenceScore *float64            `json:"confidence_score"`
+	DocumentData    *IngestDocumentData `json:"document_data"`
+	Cuts            []*IngestCut        `json:"cuts"`
+	AssetMatches    *EventAssetMatch    `json:"asset_matches"`
+	Agent           *string             `json:"agent"`
+	Content         *string             `json:"content"`
+}
+
+type IngestRequest struct {
+	Events []*IngestItem `json:"events"`
+}
+
+// IngestResult is what happened to one item. Rules are the active rules the event matches,
+// in the order the next run applies them.
+type IngestResult struct {
+	Index  int      `json:"index"`
+	Status string   `json:"status"`
+	ID     *string  `json:"id,omitempty"`
+	Error  *string  `json:"error,omitempty"`
+	Rules  []string `json:"rules,omitempty"`
+}
+
+type IngestResponse struct {
+	Accepted   int             `json:"accepted"`
+	Duplicates int             `json:"duplicates"`
+	Rejected   int             `json:"rejected"`
+	Results    []*IngestResult `json:"results"`
+}
+
+func Hash(input string) string {
+	sum := sha256.Sum256([]byte(input))
+	return hex.EncodeToString(sum[:])
+}
+
+// NormaliseURL lower cases the scheme and host and drops the fragment so the same page hashes the same.
+func NormaliseURL(input string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSpace(input))
+	if err != nil {
+		return nil, errors.New("Invalid url: " + input)
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("Unsupported url scheme: " + input)
+	}
+
+	if u.Host == "" {
+		return nil, errors.New("Url has no host: " + input)
+	}
+
+	u.Host = strings.ToLower(u.Host)
+	u.Fragment = ""
+
+	return u, nil
+}
+
+// SourceNetwork classifies a host the same way the python matcher does.
+func SourceNetwork(host string) string {
+	if strings.HasSuffix(host, ".onion") || strings.Contains(host, "dumps.intelliagg") {
+		return "dark-net"
+	}
+
+	if socialMediaSites[host] || socialMediaSites[strings.TrimPrefix(host, "www.")] {
+		return "social-media"
+	}
+
+	return "clear-net"
+}
+
+//go:embed social_media_sites.yaml
+var socialMediaYaml string //same list the python matcher loads
+
+var socialMediaSites = parseSiteList(socialMediaYaml)
+
+func parseSiteList(input string) map[string]bool {
+	out := make(map[string]bool)
+
+	for _, line := range strings.Split(input, "\n") {
+		line = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "-"))
+		if line != "" && !strings.HasPrefix(line, "#") {
+			out[strings.ToLower(line)] = true
+		}
+	}
+
+	return out
+}
+
+func validObjectID(field string, value *string) error {
+	if value == nil || *value == "" {
+		return errors.New(field + " is required")
+	}
+
+	if !primitive.IsValidObjectID(*value) {
+		return errors.New(field + " is not a valid id: " + *value)
+	}
+
+	return nil
+}
+
+// Validate checks an item and converts it to the event it is stored as.
+func (item *IngestItem) Validate(now time.Time) (*Event, error) {
+	if item == nil {
+		return nil, errors.New("Empty item")
+	}
+
+	err := validObjectID("case_id", item.CaseID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validObjectID("asset_id", item.AssetID)
+	if err != nil {
+		return nil, err
+	}
+
+	if item.URL == nil {
+		return nil, errors.New("url is required")
+	}
+
+	u, err := NormaliseURL(*item.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	if item.Content != nil && len(*item.Content) > MAX_CONTENT {
+		return nil, errors.New("content is longer than " + strconv.Itoa(MAX_CONTENT) + " bytes")
+	}
+
+	if len(item.Cuts) == 0 {
+		return nil, errors.New("At least one cut is required")
+	}
+
+	if len(item.Cuts) > MAX_CUTS {
+		return nil, errors.New("Too many cuts, the limit is " + strconv.Itoa(MAX_CUTS))
+	}
+
+	title := ""
+	if item.Title != nil {
+		title = strings.TrimSpace(*item.Title)
+	} else if item.DocumentData != nil && item.DocumentData.Title != nil {
+		title = strings.TrimSpace(*item.DocumentData.Title)
+	}
+
+	if len(title) > MAX_TITLE {
+		return nil, errors.New("title is longer than " + strconv.Itoa(MAX_TITLE) + " characters")
+	}
+
+	confidence := item.ConfidenceScore
+	if confidence == nil {
+		confidence = item.Probability
+	}
+
+	if confidence == nil {
+		return nil, errors.New("probability is required")
+	}
+
+	if *confidence < 0 || *confidence > 1 {
+		return nil, errors.New("probability must be between 0 and 1")
+	}
+
+	source_network := SourceNetwork(u.Hostname())
+	if item.SourceNetwork != nil && *item.SourceNetwork != "" {
+		if !sourceNetworks[*item.SourceNetwork] {
+			return nil, errors.New("Unknown source_network: " + *item.SourceNetwork)
+		}
+		source_network = *item.SourceNetwork
+	}
+
+	site := u.Host
+	if item.Site != nil && *item.Site != "" {
+		site = strings.ToLower(*item.Site)
+	}
+
+	if item.AssetMatches != nil {
+		if item.AssetMatches.Match == nil {
+			return nil, errors.New("asset_matches.match is required")
+		}
+
+		if item.AssetMatches.Match.KeywordType == nil || *item.AssetMatches.Match.KeywordType == "" {
+			return nil, errors.New("asset_matches.match.keyword_type is required")
+		}
+	}
+
+	var cuts []*EventCut
+	var content []string
+	for i, c := range item.Cuts {
+		if c == nil || c.Cut == nil || strings.TrimSpace(*c.Cut) == "" {
+			return nil, errors.New("cuts[" + strconv.Itoa(i) + "] is empty")
+		}
+
+		if len(*c.Cut) > MAX_CUT_LENGTH {
+			return nil, errors.New("cuts[" + strconv.Itoa(i) + "] is longer than " + strconv.Itoa(MAX_CUT_LENGTH) + " characters")
+		}
+
+		if c.StartPos != nil && c.EndPos != nil && *c.StartPos > *c.EndPos {
+			return nil, errors.New("cuts[" + strconv.Itoa(i) + "] ends before it starts")
+		}
+
+		cut := *c.Cut
+		line_hash := Hash(cut)
+		length := int64(len(cut))
+		content = append(content, cut)
+
+		var matches []*EventCutMatch
+		for j, m := range c.Matches {
+			if m == nil {
+				continue
+			}
+
+			if m.AssetID != nil {
+				err := validObjectID("cuts["+strconv.Itoa(i)+"].matches["+strconv.Itoa(j)+"].asset_id", m.AssetID)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			match := &EventCutMatch{
+				AssetID:     m.AssetID,
+				CaseID:      m.CaseID,
+				Matched:     m.Matched,
+				KeywordName: m.KeywordName,
+				StartPos:    m.StartPos,
+				EndPos:      m.EndPos,
+			}
+
+			if m.AssetScore != nil {
+				score := float64(*m.AssetScore)
+				match.Score = &score
+			}
+
+			matches = append(matches, match)
+		}
+
+		cuts = append(cuts, &EventCut{
+			Cut:      &cut,
+			Len:      &length,
+			LineHash: &line_hash,
+			StartPos: c.StartPos,
+			EndPos:   c.EndPos,
+			Matches:  matches,
+		})
+	}
+
+	normalised := u.String()
+	url_hash := Hash(normalised)
+	title_hash := TitleHash(title)
+
+	content_hash := ""
+	if item.ContentHash != nil {
+		content_hash = strings.ToLower(strings.TrimSpace(*item.ContentHash))
+	}
+	if content_hash == "" {
+		content_hash = Hash(strings.Join(content, "\n"))
+	}
+
+	agent := EVENT_AGENT
+	if item.Agent != nil && *item.Agent != "" {
+		agent = *item.Agent
+	}
+
+	version := int64(EVENT_VERSION)
+	threat_level := int64(1)
+	cut_count := int64(len(cuts))
+
+	e := &Event{
+		CaseID:          item.CaseID,
+		AssetID:         item.AssetID,
+		URL:             &normalised,
+		Site:            &site,
+		ContentHash:     &content_hash,
+		URLHash:         &url_hash,
+		TitleHash:       &title_hash,
+		SourceNetwork:   &source_network,
+		ConfidenceScore: confidence,
+		ThreatLevel:     &threat_level,
+		Cuts:            cuts,
+		CutCount:        &cut_count,
+		AssetMatches:    item.AssetMatches,
+		Agent:           &agent,
+		Version:         &version,
+		CreatedAt:       &now,
+		IngestedAt:      &now,
+	}
+
+	if title != "" {
+		e.Title = &title
+	}
+
+	content_type := item.ContentType
+	if item.DocumentData != nil {
+		if content_type == nil {
+			content_type = item.DocumentData.ContentType
+		}
+
+		if item.DocumentData.ContentLanguage != nil && *item.DocumentData.ContentLanguage != "" {
+			e.Language = item.DocumentData.ContentLanguage
+			e.Languages = &Strings{*item.DocumentData.ContentLanguage}
+		}
+	}
+	e.SourceContentType = content_type
+	e.SourceType = content_type
+
+	if item.Content != nil && *item.Content != "" {
+		digest := Hash(*item.Content)
+		key := SnapshotKey(digest)
+		size := int64(len(*item.Content))
+
+		e.ContentSHA256 = &digest
+		e.SnapshotKey = &key
+		e.SnapshotSize = &size
+		e.SnapshotContentType = content_type
+	}
+
+	ExtractIndicators(EventTexts(e)...).Apply(e)
+
+	return e, nil
+}
+
+// DecodeIngestRequest accepts either {"events": [...]} or a bare array of events.
+func DecodeIngestRequest(body string) (IngestRequest, error) {
+	var out IngestRequest
+
+	body = strings.TrimSpace(body)
+	if strings.HasPrefix(body, "[") {
+		err := json.Unmarshal([]byte(body), &out.Events)
+		return out, err
+	}
+
+	err := json.Unmarshal([]byte(body), &out)
+	return out, err
+}
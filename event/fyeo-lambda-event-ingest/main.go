@@ -0,0 +1,524 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	API_KEY_HEADER = "X-Api-Key"
+
+	DUPLICATE_KEY_CODE = 11000
+
+	DefaultThreatLevel = 3
+
+	//only events from the last week are looked at by the rules
+	LOOKBACK = 7 * 24 * time.Hour
+)
+
+var (
+	MongoClient *mongo.Client
+
+	INGEST_API_KEY = os.Getenv("INGEST_API_KEY")
+
+	defaultHeaders = map[string]string{
+		"Content-Type":                 "application/json",
+		"Access-Control-Allow-Headers": "*",
+		"Access-Control-Allow-Origin":  "*",
+		"Access-Control-Allow-Methods": "OPTIONS, POST",
+		"Allow":                        "OPTIONS, POST",
+	}
+)
+
+type Strings []string
+
+type Case struct {
+	ID    string `json:"id" bson:"_id"`
+	Group string `json:"group" bson:"group"`
+}
+
+type AssetName struct {
+	Common *string `json:"common,omitempty" bson:"common,omitempty"`
+	First  *string `json:"first,omitempty" bson:"first,omitempty"`
+	Middle *string `json:"middle,omitempty" bson:"middle,omitempty"`
+	Last   *string `json:"last,omitempty" bson:"last,omitempty"`
+}
+
+type Asset struct {
+	ID     string     `json:"id" bson:"_id"`
+	CaseID string     `json:"case_id" bson:"case_id"`
+	Type   *string    `json:"type,omitempty" bson:"type,omitempty"`
+	Name   *AssetName `json:"name,omitempty" bson:"name,omitempty"`
+}
+
+type ErrorResponse struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+func (data Asset) GetName() string {
+	if data.Name == nil {
+		return ""
+	}
+
+	if data.Name.Common != nil {
+		return *data.Name.Common
+	}
+
+	var parts []string
+	for _, part := range []*string{data.Name.First, data.Name.Middle, data.Name.Last} {
+		if part != nil && *part != "" {
+			parts = append(parts, *part)
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// ApplyAsset copies the asset details the rules and incident templates match on to the event,
+// filling in the ones the matcher left out of asset_matches.
+func ApplyAsset(asset Asset, e *Event) {
+	e.AssetType = asset.Type
+
+	name := asset.GetName()
+	if name != "" {
+		e.AssetName = &name
+	}
+
+	m := e.AssetMatches
+	if m == nil || m.Match == nil {
+		return
+	}
+
+	if m.CaseID == nil {
+		m.CaseID = e.CaseID
+	}
+
+	if m.Match.AssetType == nil {
+		m.Match.AssetType = asset.Type
+	}
+
+	if m.Match.AssetName == nil && name != "" {
+		m.Match.AssetName = &name
+	}
+
+	if m.Match.AssetCaseID == nil {
+		case_id := asset.CaseID
+		m.Match.AssetCaseID = &case_id
+	}
+}
+
+func ServeError(message string, code int) events.APIGatewayProxyResponse {
+	js, _ := json.Marshal(ErrorResponse{
+		Code:    code,
+		Message: message,
+	})
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: code,
+		Body:       string(js),
+		Headers:    defaultHeaders,
+	}
+}
+
+func main() {
+	lambda.Start(Handler)
+}
+
+func Init() error {
+	var err error
+	err = ReuseMongo()
+	if err != nil {
+		return err
+	}
+
+	err = ReuseStore()
+	if err != nil {
+		return err
+	}
+
+	return err
+}
+
+func ReuseMongo() error {
+	if MongoClient != nil {
+		return nil
+	} else {
+		var err error
+		ctx := context.Background()
+
+		uri := "mongodb://192.168.0.229:27017"
+
+		MongoClient, err = mongo.Connect(ctx, options.Client().ApplyURI(uri))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// VerifyServiceKey checks the service credential the matcher sends instead of cognito claims.
+func VerifyServiceKey(request events.APIGatewayProxyRequest) error {
+	if INGEST_API_KEY == "" {
+		return errors.New("Ingestion is not configured")
+	}
+
+	var key string
+	for k, v := range request.Headers {
+		if strings.EqualFold(k, API_KEY_HEADER) {
+			key = v
+			break
+		}
+	}
+
+	if key == "" {
+		return errors.New("No service credential provided")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(key), []byte(INGEST_API_KEY)) != 1 {
+		return errors.New("Invalid service credential")
+	}
+
+	return nil
+}
+
+func toObjectIDs(ids []string) []primitive.ObjectID {
+	var out []primitive.ObjectID
+	for _, id := range ids {
+		o_id, err := primitive.ObjectIDFromHex(id)
+		if err == nil {
+			out = append(out, o_id)
+		}
+	}
+	return out
+}
+
+func GetAssets(ctx context.Context, ids []string) (map[string]Asset, error) {
+	out := make(map[string]Asset)
+
+	filter := bson.M{"_id": bson.M{"$in": toObjectIDs(ids)}, "is_archived": bson.M{"$ne": true}}
+	res, err := MongoClient.Database("fyeo-di").Collection("assets").Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1, "case_id": 1, "type": 1, "name": 1}))
+	if err != nil {
+		return out, err
+	}
+
+	for res.Next(ctx) {
+		var doc Asset
+		err := res.Decode(&doc)
+		if err != nil {
+			return out, err
+		}
+		out[doc.ID] = doc
+	}
+
+	return out, nil
+}
+
+func GetCases(ctx context.Context, ids []string) (map[string]Case, error) {
+	out := make(map[string]Case)
+
+	filter := bson.M{"_id": bson.M{"$in": toObjectIDs(ids)}, "is_archived": bson.M{"$ne": true}, "status": bson.M{"$ne": "archived"}}
+	res, err := MongoClient.Database("fyeo-di").Collection("cases").Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1, "group": 1}))
+	if err != nil {
+		return out, err
+	}
+
+	for res.Next(ctx) {
+		var doc Case
+		err := res.Decode(&doc)
+		if err != nil {
+			return out, err
+		}
+		out[doc.ID] = doc
+	}
+
+	return out, nil
+}
+
+// GetResolvedRules returns the active rules with the copies made for the cases which change
+// them, as the rules engine runs them.
+func GetResolvedRules(ctx context.Context, now time.Time) ([]Rule, error) {
+	rules, _, err := GetActiveRules(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+
+	cases, err := CasesWithSettings(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return ResolveRules(rules, cases), nil
+}
+
+// EvaluateRules returns the names of the rules the event matches, see MatchingRules.
+func EvaluateRules(rules []Rule, e *Event, now time.Time) ([]string, error) {
+	doc, err := EventDocument(*e)
+	if err != nil {
+		return nil, err
+	}
+
+	return MatchingRules(rules, doc, now)
+}
+
+func StructToBsonMap(input interface{}) (bson.M, error) {
+	b, err := bson.Marshal(input)
+	if err != nil {
+		return bson.M{}, err
+	}
+	var data bson.M
+	err = bson.Unmarshal(b, &data)
+	if err != nil {
+		return bson.M{}, err
+	}
+
+	delete(data, "_id")
+
+	return data, nil
+}
+
+// InsertEvents writes the accepted events unordered so one duplicate does not stop the rest of the batch.
+// It returns the indexes of the documents that already existed, see the ingest_idempotency index
+// created by fyeo-lambda-event-indexes.
+func InsertEvents(ctx context.Context, docs []interface{}) (map[int]bool, map[int]string, error) {
+	duplicates := make(map[int]bool)
+	failed := make(map[int]string)
+
+	if len(docs) == 0 {
+		return duplicates, failed, nil
+	}
+
+	_, err := MongoClient.Database("fyeo-di").Collection("events").InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if err == nil {
+		return duplicates, failed, nil
+	}
+
+	var bwe mongo.BulkWriteException
+	if !errors.As(err, &bwe) || bwe.WriteConcernError != nil {
+		return duplicates, failed, err
+	}
+
+	for _, we := range bwe.WriteErrors {
+		if we.Code == DUPLICATE_KEY_CODE {
+			duplicates[we.Index] = true
+			continue
+		}
+		failed[we.Index] = we.Message
+	}
+
+	return duplicates, failed, nil
+}
+
+func Handler(rctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var err error
+	ctx, cancel := context.WithTimeout(context.Background(), 25*time.Second)
+	defer cancel()
+
+	err = VerifyServiceKey(request)
+	if err != nil {
+		return ServeError(err.Error(), 401), nil
+	}
+
+	input, err := DecodeIngestRequest(request.Body)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	if len(input.Events) == 0 {
+		return ServeError("No events provided", 400), nil
+	}
+
+	if len(input.Events) > MAX_BATCH_SIZE {
+		return ServeError("Too many events, the limit is "+strconv.Itoa(MAX_BATCH_SIZE)+" per batch", 400), nil
+	}
+
+	err = Init()
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	now := time.Now()
+	out := IngestResponse{}
+	validated := make([]*Event, len(input.Events))
+
+	var asset_ids, case_ids []string
+	for i, item := range input.Events {
+		result := &IngestResult{Index: i}
+		out.Results = append(out.Results, result)
+
+		e, err := item.Validate(now)
+		if err != nil {
+			msg := err.Error()
+			result.Status = STATUS_REJECTED
+			result.Error = &msg
+			continue
+		}
+
+		validated[i] = e
+		asset_ids = append(asset_ids, *e.AssetID)
+		case_ids = append(case_ids, *e.CaseID)
+	}
+
+	assets, err := GetAssets(ctx, asset_ids)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	cases, err := GetCases(ctx, case_ids)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	//the rules only tell the caller what the next run will do with the events, the batch is
+	//ingested without them when they cannot be loaded
+	rules, err := GetResolvedRules(ctx, now)
+	if err != nil {
+		log.Printf("rules not evaluated: %s", err.Error())
+	}
+
+	var docs []interface{}
+	var doc_index []int
+	for i, e := range validated {
+		if e == nil {
+			continue
+		}
+
+		result := out.Results[i]
+		reject := func(msg string) {
+			result.Status = STATUS_REJECTED
+			result.Error = &msg
+		}
+
+		asset, ok := assets[*e.AssetID]
+		if !ok {
+			reject("Unknown asset: " + *e.AssetID)
+			continue
+		}
+
+		_, ok = cases[*e.CaseID]
+		if !ok {
+			reject("Unknown case: " + *e.CaseID)
+			continue
+		}
+
+		if asset.CaseID != *e.CaseID {
+			reject("Asset " + asset.ID + " does not belong to case " + *e.CaseID)
+			continue
+		}
+
+		ApplyAsset(asset, e)
+
+		src, err := ResolveSourceDocument(ctx, e)
+		if err != nil {
+			reject("Could not resolve source document: " + err.Error())
+			continue
+		}
+
+		//only the first case to see a page stores it, the rest share that snapshot. A page
+		//that changed since keeps its own snapshot on the event, the source document keeps the first.
+		//rejected so the matcher retries, an event without its snapshot loses the evidence
+		if e.SnapshotKey != nil && !src.SameContent(e) {
+			err := StoreSnapshot(ctx, e, *input.Events[i].Content)
+			if err != nil {
+				reject("Could not store snapshot: " + err.Error())
+				continue
+			}
+
+			if src.SnapshotKey == nil {
+				src, err = SetSourceDocumentSnapshot(ctx, src, e)
+				if err != nil {
+					reject("Could not store snapshot: " + err.Error())
+					continue
+				}
+			}
+		}
+
+		ApplySourceDocument(src, e)
+
+		doc, err := StructToBsonMap(e)
+		if err != nil {
+			reject(err.Error())
+			continue
+		}
+
+		o_id := primitive.NewObjectID()
+		doc["_id"] = o_id
+
+		id := o_id.Hex()
+		result.ID = &id
+
+		if len(rules) > 0 {
+			result.Rules, err = EvaluateRules(rules, e, now)
+			if err != nil {
+				log.Printf("rules not evaluated for event %d: %s", i, err.Error())
+			}
+		}
+
+		docs = append(docs, doc)
+		doc_index = append(doc_index, i)
+	}
+
+	duplicates, failed, err := InsertEvents(ctx, docs)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	for j, i := range doc_index {
+		result := out.Results[i]
+
+		if duplicates[j] {
+			result.Status = STATUS_DUPLICATE
+			result.ID = nil
+			result.Rules = nil
+			continue
+		}
+
+		msg, ok := failed[j]
+		if ok {
+			result.Status = STATUS_REJECTED
+			result.Error = &msg
+			result.ID = nil
+			result.Rules = nil
+			continue
+		}
+
+		result.Status = STATUS_ACCEPTED
+	}
+
+	for _, result := range out.Results {
+		switch result.Status {
+		case STATUS_ACCEPTED:
+			out.Accepted++
+		case STATUS_DUPLICATE:
+			out.Duplicates++
+		default:
+			out.Rejected++
+		}
+	}
+
+	js, err := json.Marshal(out)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		Body:       string(js),
+		StatusCode: 200,
+		Headers:    defaultHeaders,
+	}, nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	STORE_S3    = "s3"
+	STORE_LOCAL = "local"
+
+	DEFAULT_SNAPSHOT_BUCKET = "fyeo-s3-event-snapshots"
+)
+
+var (
+	Store ObjectStore
+
+	OBJECT_STORE      = os.Getenv("OBJECT_STORE")
+	OBJECT_STORE_PATH = os.Getenv("OBJECT_STORE_PATH")
+	SNAPSHOT_BUCKET   = os.Getenv("SNAPSHOT_BUCKET")
+)
+
+// ObjectStore is where event snapshots and other blobs are kept.
+type ObjectStore interface {
+	Put(ctx context.Context, key string, body []byte, content_type string) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	Exists(ctx context.Context, key string) (bool, error)
+	Presign(ctx context.Context, key string, expires time.Duration) (string, error)
+}
+
+// S3Store keeps objects in a single bucket.
+type S3Store struct {
+	Client *s3.Client
+	Bucket string
+}
+
+func (s *S3Store) Put(ctx context.Context, key string, body []byte, content_type string) error {
+	_, err := s.Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.Bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String(content_type),
+	})
+	return err
+}
+
+func (s *S3Store) Get(ctx context.Context, key string) ([]byte, error) {
+	resp, err := s.Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (s *S3Store) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := s.Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var nf *types.NotFound
+		if errors.As(err, &nf) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (s *S3Store) Presign(ctx context.Context, key string, expires time.Duration) (string, error) {
+	psClient := s3.NewPresignClient(s.Client)
+	psresp, err := psClient.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(expires))
+	if err != nil {
+		return "", err
+	}
+
+	return psresp.URL, nil
+}
+
+// LocalStore keeps objects under a directory, for running outside AWS.
+type LocalStore struct {
+	Root string
+}
+
+func (s *LocalStore) path(key string) (string, error) {
+	p := filepath.Join(s.Root, filepath.FromSlash(key))
+	if !strings.HasPrefix(p, filepath.Clean(s.Root)+string(filepath.Separator)) {
+		return "", errors.New("Invalid object key: " + key)
+	}
+	return p, nil
+}
+
+func (s *LocalStore) Put(ctx context.Context, key string, body []byte, content_type string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(p, body, 0644)
+}
+
+func (s *LocalStore) Get(ctx context.Context, key string) ([]byte, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadFile(p)
+}
+
+func (s *LocalStore) Exists(ctx context.Context, key string) (bool, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = os.Stat(p)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// Presign has nothing to sign locally, the file url is only usable on the same machine.
+func (s *LocalStore) Presign(ctx context.Context, key string, expires time.Duration) (string, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return "", err
+	}
+
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+
+	u := url.URL{Scheme: "file", Path: filepath.ToSlash(abs)}
+	return u.String(), nil
+}
+
+// ReuseStore picks the store from OBJECT_STORE, S3 unless it is set to local.
+func ReuseStore() error {
+	if Store != nil {
+		return nil
+	}
+
+	if OBJECT_STORE == STORE_LOCAL {
+		if OBJECT_STORE_PATH == "" {
+			return errors.New("OBJECT_STORE_PATH is required for the local object store")
+		}
+		Store = &LocalStore{Root: OBJECT_STORE_PATH}
+		return nil
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		return err
+	}
+
+	bucket := SNAPSHOT_BUCKET
+	if bucket == "" {
+		bucket = DEFAULT_SNAPSHOT_BUCKET
+	}
+
+	Store = &S3Store{Client: s3.NewFromConfig(cfg), Bucket: bucket}
+
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+)
+
+const (
+	SNAPSHOT_PREFIX       = "snapshots/"
+	SNAPSHOT_CONTENT_TYPE = "application/gzip"
+)
+
+// SnapshotKey is where the content with this sha256 digest is stored. The same page
+// fetched twice is only stored once.
+func SnapshotKey(digest string) string {
+	return SNAPSHOT_PREFIX + digest[:2] + "/" + digest + ".gz"
+}
+
+func Gzip(input []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+
+	_, err := zw.Write(input)
+	if err != nil {
+		return nil, err
+	}
+
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// StoreSnapshot compresses and uploads the content of an item unless an object with
+// the same digest is already stored.
+func StoreSnapshot(ctx context.Context, e *Event, content string) error {
+	if e.SnapshotKey == nil {
+		return nil
+	}
+
+	exists, err := Store.Exists(ctx, *e.SnapshotKey)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		return nil
+	}
+
+	body, err := Gzip([]byte(content))
+	if err != nil {
+		return err
+	}
+
+	return Store.Put(ctx, *e.SnapshotKey, body, SNAPSHOT_CONTENT_TYPE)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SourceDocument is a page as it was fetched, shared by every case that matched it. It
+// holds nothing about the cases, those stay on the per-case events.
+type SourceDocument struct {
+	ID                  string     `json:"id" bson:"_id,omitempty"`
+	URLHash             *string    `json:"url_hash,omitempty" bson:"url_hash,omitempty"`
+	TitleHash           *string    `json:"title_hash,omitempty" bson:"title_hash,omitempty"`
+	URL                 *string    `json:"url,omitempty" bson:"url,omitempty"`
+	Site                *string    `json:"site,omitempty" bson:"site,omitempty"`
+	Title               *string    `json:"title,omitempty" bson:"title,omitempty"`
+	TranslatedTitle     *string    `json:"translated_title,omitempty" bson:"translated_title,omitempty"`
+	Language            *string    `json:"language,omitempty" bson:"language,omitempty"`
+	SourceNetwork       *string    `json:"source_network,omitempty" bson:"source_network,omitempty"`
+	ContentSHA256       *string    `json:"content_sha256,omitempty" bson:"content_sha256,omitempty"`
+	SnapshotKey         *string    `json:"snapshot_key,omitempty" bson:"snapshot_key,omitempty"`
+	SnapshotSize        *int64     `json:"snapshot_size,omitempty" bson:"snapshot_size,omitempty"`
+	SnapshotContentType *string    `json:"snapshot_content_type,omitempty" bson:"snapshot_content_type,omitempty"`
+	FirstSeenAt         *time.Time `json:"first_seen_at,omitempty" bson:"first_seen_at,omitempty"`
+	LastSeenAt          *time.Time `json:"last_seen_at,omitempty" bson:"last_seen_at,omitempty"`
+}
+
+func (d SourceDocument) ObjectID() primitive.ObjectID {
+	o_id, _ := primitive.ObjectIDFromHex(d.ID)
+	return o_id
+}
+
+// TitleHash hashes a title the way it is compared, trimmed and lower cased.
+func TitleHash(title string) string {
+	return Hash(strings.ToLower(strings.TrimSpace(title)))
+}
+
+// ResolveSourceDocument finds or creates the source document for an event. Two batches
+// racing on the same page both end up with the one that won the insert, the source_document
+// index created by fyeo-lambda-event-indexes keeps them from both inserting.
+func ResolveSourceDocument(ctx context.Context, e *Event) (SourceDocument, error) {
+	var doc SourceDocument
+
+	if e.URLHash == nil || e.TitleHash == nil {
+		return doc, errors.New("Event has no url or title hash")
+	}
+
+	filter := bson.M{"url_hash": *e.URLHash, "title_hash": *e.TitleHash}
+	update := bson.M{
+		"$setOnInsert": bson.M{
+			"url_hash":       e.URLHash,
+			"title_hash":     e.TitleHash,
+			"url":            e.URL,
+			"site":           e.Site,
+			"title":          e.Title,
+			"language":       e.Language,
+			"source_network": e.SourceNetwork,
+			"first_seen_at":  e.IngestedAt,
+		},
+		"$set": bson.M{"last_seen_at": e.IngestedAt},
+	}
+
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	coll := MongoClient.Database("fyeo-di").Collection("source_documents")
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		err = coll.FindOneAndUpdate(ctx, filter, update, opts).Decode(&doc)
+		if !mongo.IsDuplicateKeyError(err) {
+			break
+		}
+	}
+
+	return doc, err
+}
+
+// SetSourceDocumentSnapshot records the snapshot on the source document unless another event
+// got there first, and returns the one that is kept.
+func SetSourceDocumentSnapshot(ctx context.Context, doc SourceDocument, e *Event) (SourceDocument, error) {
+	filter := bson.M{"_id": doc.ObjectID(), "snapshot_key": nil}
+	update := bson.M{"$set": bson.M{
+		"content_sha256":        e.ContentSHA256,
+		"snapshot_key":          e.SnapshotKey,
+		"snapshot_size":         e.SnapshotSize,
+		"snapshot_content_type": e.SnapshotContentType,
+	}}
+
+	coll := MongoClient.Database("fyeo-di").Collection("source_documents")
+	err := coll.FindOneAndUpdate(ctx, filter, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		err = coll.FindOne(ctx, bson.M{"_id": doc.ObjectID()}).Decode(&doc)
+	}
+
+	return doc, err
+}
+
+// SameContent tells if the event fetched the content the source document has a snapshot of.
+func (d SourceDocument) SameContent(e *Event) bool {
+	return d.ContentSHA256 != nil && e.ContentSHA256 != nil && *d.ContentSHA256 == *e.ContentSHA256
+}
+
+// ApplySourceDocument points the event at its source document and takes the shared snapshot
+// when the event came without content of its own.
+func ApplySourceDocument(doc SourceDocument, e *Event) {
+	e.SourceDocumentID = &doc.ID
+
+	if doc.SnapshotKey != nil && e.SnapshotKey == nil {
+		e.ContentSHA256 = doc.ContentSHA256
+		e.SnapshotKey = doc.SnapshotKey
+		e.SnapshotSize = doc.SnapshotSize
+		e.SnapshotContentType = doc.SnapshotContentType
+	}
+
+	if e.TranslatedTitle == nil {
+		e.TranslatedTitle = doc.TranslatedTitle
+	}
+}
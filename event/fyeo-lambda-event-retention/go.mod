@@ -0,0 +1,11 @@
+module fyeo-lambda-event-retention
+
+go 1.16
+
+require (
+	github.com/aws/aws-lambda-go v1.27.0
+	github.com/aws/aws-sdk-go-v2 v1.10.0
+	github.com/aws/aws-sdk-go-v2/config v1.9.0
+	github.com/aws/aws-sdk-go-v2/service/s3 v1.17.0
+	go.mongodb.org/mongo-driver v1.7.3
+)
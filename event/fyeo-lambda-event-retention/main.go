@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	MongoClient *mongo.Client
+)
+
+type Strings []string
+
+// RetentionOptions is read from the detail of the scheduled event.
+type RetentionOptions struct {
+	DryRun bool `json:"dry_run"`
+}
+
+func main() {
+	lambda.Start(Handler)
+}
+
+func Init() error {
+	var err error
+
+	err = ReuseMongo()
+	if err != nil {
+		return err
+	}
+
+	err = ReuseStore()
+	if err != nil {
+		return err
+	}
+
+	return err
+}
+
+func ReuseMongo() error {
+	if MongoClient != nil {
+		return nil
+	} else {
+		var err error
+		ctx := context.Background()
+
+		uri := "mongodb://192.168.0.229:27017"
+
+		MongoClient, err = mongo.Connect(ctx, options.Client().ApplyURI(uri))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func Retention(ctx context.Context, now time.Time, dry_run bool) (RetentionReport, error) {
+	report := RetentionReport{DryRun: dry_run}
+
+	cases, err := GetRetentionCases(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	for _, c := range cases {
+		report.Cases++
+
+		r, err := ApplyRetention(ctx, c, now, dry_run)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", c.ID, err.Error()))
+		}
+
+		removed := r.Unlinked + r.ClosedIncident
+		if removed == 0 && r.Archived == 0 {
+			continue
+		}
+
+		if !dry_run {
+			report.Archived += r.Archived
+			report.Deleted += removed
+		}
+		report.PerCase = append(report.PerCase, r)
+	}
+
+	return report, nil
+}
+
+func Handler(ctx context.Context, event events.CloudWatchEvent) (RetentionReport, error) {
+	var opts RetentionOptions
+	if len(event.Detail) > 0 {
+		err := json.Unmarshal(event.Detail, &opts)
+		if err != nil {
+			return RetentionReport{}, err
+		}
+	}
+
+	err := Init()
+	if err != nil {
+		return RetentionReport{}, err
+	}
+
+	report, err := Retention(ctx, time.Now(), opts.DryRun)
+	if err != nil {
+		return report, err
+	}
+
+	for _, r := range report.PerCase {
+		log.Printf("case %s: %d unlinked, %d from closed incidents", r.CaseID, r.Unlinked, r.ClosedIncident)
+	}
+	log.Printf("checked %d cases, archived %d events, deleted %d", report.Cases, report.Archived, report.Deleted)
+	if len(report.Errors) > 0 {
+		log.Printf("errors: %s", strings.Join(report.Errors, "; "))
+	}
+
+	return report, nil
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	//unlinked events at or below this threat level are low threat unless the case says otherwise
+	DEFAULT_UNLINKED_MAX_THREAT_LEVEL = 1
+
+	//the rules engine looks back 7 days, nothing younger is removed whatever the case says
+	MIN_RETENTION_DAYS = 7
+
+	ARCHIVE_BATCH_SIZE = 1000
+	ARCHIVE_PREFIX     = "archive/events/"
+
+	REASON_UNLINKED        = "unlinked"
+	REASON_CLOSED_INCIDENT = "closed_incident"
+)
+
+type CaseRetention struct {
+	UnlinkedDays           *int64 `json:"unlinked_days,omitempty" bson:"unlinked_days,omitempty"`
+	UnlinkedMaxThreatLevel *int64 `json:"unlinked_max_threat_level,omitempty" bson:"unlinked_max_threat_level,omitempty"`
+	ClosedIncidentDays     *int64 `json:"closed_incident_days,omitempty" bson:"closed_incident_days,omitempty"`
+}
+
+type Case struct {
+	ID        string         `json:"id" bson:"_id"`
+	Retention *CaseRetention `json:"retention,omitempty" bson:"retention,omitempty"`
+}
+
+type ClosedIncident struct {
+	ID       string   `json:"id" bson:"_id"`
+	EventIDs *Strings `json:"event_ids,omitempty" bson:"event_ids,omitempty"`
+	Events   *Strings `json:"events,omitempty" bson:"events,omitempty"`
+}
+
+type CaseRetentionReport struct {
+	CaseID         string   `json:"case_id"`
+	Unlinked       int64    `json:"unlinked"`
+	ClosedIncident int64    `json:"closed_incident"`
+	Archived       int64    `json:"archived"`
+	Objects        []string `json:"objects,omitempty"`
+}
+
+type RetentionReport struct {
+	DryRun   bool                   `json:"dry_run"`
+	Cases    int64                  `json:"cases"`
+	Archived int64                  `json:"archived"`
+	Deleted  int64                  `json:"deleted"`
+	PerCase  []*CaseRetentionReport `json:"per_case,omitempty"`
+	Errors   []string               `json:"errors,omitempty"`
+}
+
+// AnyField matches a condition against the current and legacy names of an event field.
+func AnyField(canonical string, cond interface{}) bson.M {
+	names := EventFieldNames(canonical)
+	if len(names) == 1 {
+		return bson.M{canonical: cond}
+	}
+
+	var or []bson.M
+	for _, n := range names {
+		or = append(or, bson.M{n: cond})
+	}
+
+	return bson.M{"$or": or}
+}
+
+// NoField matches documents where none of the names of a field hold a value.
+func NoField(canonical string) bson.M {
+	out := bson.M{}
+	for _, n := range EventFieldNames(canonical) {
+		out[n] = nil
+	}
+	return out
+}
+
+// retentionCutoff is the time before which events may go, nil when the period is not set.
+func retentionCutoff(now time.Time, days *int64) *time.Time {
+	if days == nil {
+		return nil
+	}
+
+	d := *days
+	if d < MIN_RETENTION_DAYS {
+		d = MIN_RETENTION_DAYS
+	}
+
+	cutoff := now.AddDate(0, 0, -int(d))
+	return &cutoff
+}
+
+func GetRetentionCases(ctx context.Context) ([]Case, error) {
+	var out []Case
+
+	filter := bson.M{
+		"is_archived": bson.M{"$ne": true},
+		"$or": []bson.M{
+			{"retention.unlinked_days": bson.M{"$exists": true}},
+			{"retention.closed_incident_days": bson.M{"$exists": true}},
+		},
+	}
+	res, err := MongoClient.Database("fyeo-di").Collection("cases").Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1, "retention": 1}))
+	if err != nil {
+		return out, err
+	}
+
+	err = res.All(ctx, &out)
+	return out, err
+}
+
+// UnlinkedFilter matches old low threat events no incident was raised for. Starred events are kept,
+// and so are events an incident of the case lists without the event having its incident_id.
+func UnlinkedFilter(ctx context.Context, case_id string, r CaseRetention, cutoff time.Time) (bson.M, error) {
+	max_threat := int64(DEFAULT_UNLINKED_MAX_THREAT_LEVEL)
+	if r.UnlinkedMaxThreatLevel != nil {
+		max_threat = *r.UnlinkedMaxThreatLevel
+	}
+
+	and := []bson.M{
+		AnyField("case_id", case_id),
+		AnyField("created_at", bson.M{"$type": "date", "$lt": cutoff}),
+		AnyField("threat_level", bson.M{"$lte": max_threat}),
+		NoField("incident_id"),
+		{"starred_by.0": bson.M{"$exists": false}},
+	}
+
+	for _, n := range EventFieldNames("is_starred") {
+		and = append(and, bson.M{n: bson.M{"$ne": true}})
+	}
+
+	listed, err := ListedByCase(ctx, case_id)
+	if err != nil {
+		return nil, err
+	}
+	if len(listed) > 0 {
+		and = append(and, bson.M{"_id": bson.M{"$nin": listed}})
+	}
+
+	return bson.M{"$and": and}, nil
+}
+
+// ListedByCase returns the events the incidents of the case hold in their event_ids or events,
+// legacy incidents link their events only that way.
+func ListedByCase(ctx context.Context, case_id string) ([]primitive.ObjectID, error) {
+	var out []primitive.ObjectID
+
+	filter := bson.M{"$and": []bson.M{
+		{"$or": []bson.M{{"case_id": case_id}, {"parentId": case_id}}},
+		{"$or": []bson.M{
+			{"event_ids.0": bson.M{"$exists": true}},
+			{"events.0": bson.M{"$exists": true}},
+		}},
+	}}
+
+	projection := bson.M{"_id": 1, "event_ids": 1, "events": 1}
+	res, err := MongoClient.Database("fyeo-di").Collection("incidents").Find(ctx, filter, options.Find().SetProjection(projection))
+	if err != nil {
+		return out, err
+	}
+
+	var incidents []ClosedIncident
+	err = res.All(ctx, &incidents)
+	if err != nil {
+		return out, err
+	}
+
+	seen := make(map[string]bool)
+	for _, i := range incidents {
+		for _, id := range i.eventIDs() {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+
+			o_id, err := primitive.ObjectIDFromHex(id)
+			if err == nil {
+				out = append(out, o_id)
+			}
+		}
+	}
+
+	return out, nil
+}
+
+// ClosedIncidentFilter matches the events of incidents closed before the cutoff. Events another
+// incident still lists, or that were moved to another incident, are kept. It is nil when there
+// are none.
+func ClosedIncidentFilter(ctx context.Context, case_id string, cutoff time.Time) (bson.M, error) {
+	filter := bson.M{"$and": []bson.M{
+		{"$or": []bson.M{{"case_id": case_id}, {"parentId": case_id}}},
+		{"$or": []bson.M{
+			{"closed_at": bson.M{"$type": "date", "$lt": cutoff}},
+			{"closed_at": nil, "closed_date": bson.M{"$type": "date", "$lt": cutoff}},
+		}},
+		{"is_active": bson.M{"$ne": true}},
+		{"active": bson.M{"$ne": true}},
+	}}
+
+	projection := bson.M{"_id": 1, "event_ids": 1, "events": 1}
+	res, err := MongoClient.Database("fyeo-di").Collection("incidents").Find(ctx, filter, options.Find().SetProjection(projection))
+	if err != nil {
+		return nil, err
+	}
+
+	var incidents []ClosedIncident
+	err = res.All(ctx, &incidents)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(incidents) == 0 {
+		return nil, nil
+	}
+
+	var incident_ids []string
+	var listed []string
+	for _, i := range incidents {
+		incident_ids = append(incident_ids, i.ID)
+		listed = append(listed, i.eventIDs()...)
+	}
+
+	kept, err := ListedElsewhere(ctx, incident_ids, listed)
+	if err != nil {
+		return nil, err
+	}
+
+	var event_ids []primitive.ObjectID
+	for _, id := range listed {
+		if kept[id] {
+			continue
+		}
+		o_id, err := primitive.ObjectIDFromHex(id)
+		if err == nil {
+			event_ids = append(event_ids, o_id)
+		}
+	}
+
+	or := []bson.M{AnyField("incident_id", bson.M{"$in": incident_ids})}
+	if len(event_ids) > 0 {
+		//an event listed by a closed incident may since have been linked to another one
+		or = append(or, bson.M{"$and": []bson.M{
+			{"_id": bson.M{"$in": event_ids}},
+			{"$or": []bson.M{NoField("incident_id"), AnyField("incident_id", bson.M{"$in": incident_ids})}},
+		}})
+	}
+
+	and := []bson.M{
+		AnyField("case_id", case_id),
+		{"$or": or},
+	}
+
+	if len(kept) > 0 {
+		var kept_ids []primitive.ObjectID
+		for id := range kept {
+			o_id, err := primitive.ObjectIDFromHex(id)
+			if err == nil {
+				kept_ids = append(kept_ids, o_id)
+			}
+		}
+		and = append(and, bson.M{"_id": bson.M{"$nin": kept_ids}})
+	}
+
+	return bson.M{"$and": and}, nil
+}
+
+func (i ClosedIncident) eventIDs() []string {
+	var out []string
+	for _, list := range []*Strings{i.EventIDs, i.Events} {
+		if list != nil {
+			out = append(out, *list...)
+		}
+	}
+	return out
+}
+
+// ListedElsewhere returns the events of the list that an incident other than the given ones
+// still holds in its event_ids or events, open incidents and ones closed after the cutoff alike.
+func ListedElsewhere(ctx context.Context, incident_ids []string, event_ids []string) (map[string]bool, error) {
+	out := make(map[string]bool)
+	if len(event_ids) == 0 {
+		return out, nil
+	}
+
+	var exclude []interface{}
+	for _, id := range incident_ids {
+		o_id, err := primitive.ObjectIDFromHex(id)
+		if err == nil {
+			exclude = append(exclude, o_id)
+		} else {
+			exclude = append(exclude, id)
+		}
+	}
+
+	filter := bson.M{
+		"_id": bson.M{"$nin": exclude},
+		"$or": []bson.M{
+			{"event_ids": bson.M{"$in": event_ids}},
+			{"events": bson.M{"$in": event_ids}},
+		},
+	}
+
+	projection := bson.M{"_id": 1, "event_ids": 1, "events": 1}
+	res, err := MongoClient.Database("fyeo-di").Collection("incidents").Find(ctx, filter, options.Find().SetProjection(projection))
+	if err != nil {
+		return out, err
+	}
+
+	var others []ClosedIncident
+	err = res.All(ctx, &others)
+	if err != nil {
+		return out, err
+	}
+
+	wanted := make(map[string]bool, len(event_ids))
+	for _, id := range event_ids {
+		wanted[id] = true
+	}
+
+	for _, i := range others {
+		for _, id := range i.eventIDs() {
+			if wanted[id] {
+				out[id] = true
+			}
+		}
+	}
+
+	return out, nil
+}
+
+// ArchiveKey is where one batch of removed events is written.
+func ArchiveKey(case_id string, reason string, now time.Time, first string, count int) string {
+	return fmt.Sprintf("%s%s/%s/%s-%s-%d.json.gz", ARCHIVE_PREFIX, case_id, now.UTC().Format("2006-01-02"), reason, first, count)
+}
+
+// ArchiveJSON gzips the documents as a json array in canonical extended json, so types
+// such as ObjectIDs and dates survive a restore.
+func ArchiveJSON(docs []bson.Raw) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+
+	_, err := zw.Write([]byte("["))
+	if err != nil {
+		return nil, err
+	}
+
+	for i, d := range docs {
+		js, err := bson.MarshalExtJSON(d, true, false)
+		if err != nil {
+			return nil, err
+		}
+
+		if i > 0 {
+			js = append([]byte(","), js...)
+		}
+
+		_, err = zw.Write(js)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = zw.Write([]byte("]"))
+	if err != nil {
+		return nil, err
+	}
+
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// ArchiveEvents writes the matching events to the object store a batch at a time and
+// deletes each batch only once it is stored. It returns how many were removed.
+func ArchiveEvents(ctx context.Context, case_id string, reason string, filter bson.M, now time.Time, report *CaseRetentionReport) (int64, error) {
+	var removed int64
+	coll := MongoClient.Database("fyeo-di").Collection("events")
+
+	for {
+		res, err := coll.Find(ctx, filter, options.Find().SetSort(bson.M{"_id": 1}).SetLimit(ARCHIVE_BATCH_SIZE))
+		if err != nil {
+			return removed, err
+		}
+
+		var docs []bson.Raw
+		var ids []interface{}
+		for res.Next(ctx) {
+			raw := make(bson.Raw, len(res.Current))
+			copy(raw, res.Current)
+			docs = append(docs, raw)
+			ids = append(ids, raw.Lookup("_id"))
+		}
+
+		err = res.Err()
+		res.Close(ctx)
+		if err != nil {
+			return removed, err
+		}
+
+		if len(docs) == 0 {
+			return removed, nil
+		}
+
+		body, err := ArchiveJSON(docs)
+		if err != nil {
+			return removed, err
+		}
+
+		first := ""
+		if o_id, ok := docs[0].Lookup("_id").ObjectIDOK(); ok {
+			first = o_id.Hex()
+		}
+
+		key := ArchiveKey(case_id, reason, now, first, len(docs))
+		err = Store.Put(ctx, key, body, "application/gzip")
+		if err != nil {
+			return removed, err
+		}
+		report.Objects = append(report.Objects, key)
+		report.Archived += int64(len(docs))
+
+		del, err := coll.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+		if err != nil {
+			return removed, err
+		}
+		removed += del.DeletedCount
+
+		if len(docs) < ARCHIVE_BATCH_SIZE {
+			return removed, nil
+		}
+	}
+}
+
+// ApplyRetention removes the expired events of one case. A dry run only counts them.
+func ApplyRetention(ctx context.Context, c Case, now time.Time, dry_run bool) (*CaseRetentionReport, error) {
+	report := &CaseRetentionReport{CaseID: c.ID}
+	if c.Retention == nil {
+		return report, nil
+	}
+
+	run := func(reason string, filter bson.M) (int64, error) {
+		if dry_run {
+			return MongoClient.Database("fyeo-di").Collection("events").CountDocuments(ctx, filter)
+		}
+		return ArchiveEvents(ctx, c.ID, reason, filter, now, report)
+	}
+
+	cutoff := retentionCutoff(now, c.Retention.UnlinkedDays)
+	if cutoff != nil {
+		filter, err := UnlinkedFilter(ctx, c.ID, *c.Retention, *cutoff)
+		if err != nil {
+			return report, err
+		}
+
+		n, err := run(REASON_UNLINKED, filter)
+		report.Unlinked = n
+		if err != nil {
+			return report, err
+		}
+	}
+
+	cutoff = retentionCutoff(now, c.Retention.ClosedIncidentDays)
+	if cutoff != nil {
+		filter, err := ClosedIncidentFilter(ctx, c.ID, *cutoff)
+		if err != nil {
+			return report, err
+		}
+
+		if filter != nil {
+			n, err := run(REASON_CLOSED_INCIDENT, filter)
+			report.ClosedIncident = n
+			if err != nil {
+				return report, err
+			}
+		}
+	}
+
+	return report, nil
+}
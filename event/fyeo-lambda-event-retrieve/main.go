@@ -187,13 +187,12 @@ func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 	if res.Err() != nil {
 		return events.APIGatewayProxyResponse{
 			StatusCode: 400,
-			Body:       err.Error() + " for " + o_id.String(),
+			Body:       res.Err().Error() + " for " + o_id.String(),
 			Headers:    defaultHeaders,
 		}, nil
 	}
 
-	//var out event
-	var out map[string]interface{}
+	var out Event
 
 	err = res.Decode(&out)
 
@@ -207,7 +206,15 @@ func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 
 	//check case for groups
 
-	c_id, err := primitive.ObjectIDFromHex(out["caseId"].(string))
+	if out.CaseID == nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       errors.New("No case ID found for event " + id).Error(),
+			Headers:    defaultHeaders,
+		}, nil
+	}
+
+	c_id, err := primitive.ObjectIDFromHex(*out.CaseID)
 	if err != nil {
 		return events.APIGatewayProxyResponse{
 			StatusCode: 400,
@@ -219,10 +226,10 @@ func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 	filter = bson.M{"_id": c_id, "group": bson.M{"$in": groups}}
 	res2 := MongoClient.Database("fyeo-di").Collection("cases").FindOne(context.Background(), filter)
 
-	if res.Err() != nil {
+	if res2.Err() != nil {
 		return events.APIGatewayProxyResponse{
 			StatusCode: 400,
-			Body:       err.Error() + ": " + out["parentId"].(string),
+			Body:       res2.Err().Error() + ": " + *out.CaseID,
 			Headers:    defaultHeaders,
 		}, nil
 	}
@@ -239,8 +246,8 @@ func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 		}, nil
 	}
 
-	out["group"] = ca.Group
-	out["case_name"] = ca.Name
+	out.Group = &ca.Group
+	out.CaseName = &ca.Name
 
 	js, err := json.Marshal(out)
 	if err != nil {
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	LINK_EXPIRY = 15 * time.Minute
+)
+
+var (
+	MongoClient *mongo.Client
+
+	defaultHeaders = map[string]string{
+		"Content-Type":                 "application/json",
+		"Access-Control-Allow-Headers": "*",
+		"Access-Control-Allow-Origin":  "*",
+		"Access-Control-Allow-Methods": "GET, OPTIONS",
+		"Allow":                        "GET, OPTIONS",
+	}
+)
+
+type Strings []string
+
+type Case struct {
+	ID    string `json:"id" bson:"_id"`
+	Name  string `json:"name" bson:"caseName"`
+	Group string `json:"group" bson:"group"`
+}
+
+type SnapshotResponse struct {
+	EventID       string    `json:"event_id"`
+	SnapshotLink  string    `json:"snapshot_link"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	ContentSHA256 *string   `json:"content_sha256,omitempty"`
+	ContentType   *string   `json:"content_type,omitempty"`
+	Size          *int64    `json:"size,omitempty"`
+}
+
+type SourceDocument struct {
+	ID                  string  `json:"id" bson:"_id"`
+	ContentSHA256       *string `json:"content_sha256,omitempty" bson:"content_sha256,omitempty"`
+	SnapshotKey         *string `json:"snapshot_key,omitempty" bson:"snapshot_key,omitempty"`
+	SnapshotSize        *int64  `json:"snapshot_size,omitempty" bson:"snapshot_size,omitempty"`
+	SnapshotContentType *string `json:"snapshot_content_type,omitempty" bson:"snapshot_content_type,omitempty"`
+}
+
+func main() {
+	lambda.Start(Handler)
+}
+
+func Init() error {
+	var err error
+
+	err = ReuseMongo()
+	if err != nil {
+		return err
+	}
+
+	err = ReuseStore()
+	if err != nil {
+		return err
+	}
+
+	return err
+}
+
+func ReuseMongo() error {
+	if MongoClient != nil {
+		return nil
+	} else {
+		var err error
+		ctx := context.Background()
+
+		uri := "mongodb://192.168.0.229:27017"
+
+		MongoClient, err = mongo.Connect(ctx, options.Client().ApplyURI(uri))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ApplySourceSnapshot copies the snapshot of the event's source document onto it, if there is one.
+func ApplySourceSnapshot(ctx context.Context, e *Event) error {
+	o_id, err := primitive.ObjectIDFromHex(*e.SourceDocumentID)
+	if err != nil {
+		return err
+	}
+
+	var doc SourceDocument
+	err = MongoClient.Database("fyeo-di").Collection("source_documents").FindOne(ctx, bson.M{"_id": o_id}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	e.ContentSHA256 = doc.ContentSHA256
+	e.SnapshotKey = doc.SnapshotKey
+	e.SnapshotSize = doc.SnapshotSize
+	e.SnapshotContentType = doc.SnapshotContentType
+
+	return nil
+}
+
+func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var err error
+
+	id := request.PathParameters["id"]
+	if id == "" {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       errors.New("No ID provided").Error(),
+			Headers:    defaultHeaders,
+		}, nil
+	}
+
+	claims := request.RequestContext.Authorizer["claims"]
+	if claims == nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       errors.New("No claims found for " + request.RequestContext.Identity.CognitoIdentityID).Error(),
+			Headers:    defaultHeaders,
+		}, nil
+	}
+
+	rg := claims.(map[string]interface{})["cognito:groups"]
+
+	if rg == nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       errors.New("No group permissions set").Error(),
+			Headers:    defaultHeaders,
+		}, nil
+	}
+
+	groups := strings.Split(rg.(string), ",")
+
+	err = Init()
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       err.Error(),
+			Headers:    defaultHeaders,
+		}, nil
+	}
+
+	o_id, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       err.Error(),
+			Headers:    defaultHeaders,
+		}, nil
+	}
+
+	filter := bson.M{"_id": o_id}
+
+	res := MongoClient.Database("fyeo-di").Collection("events").FindOne(ctx, filter)
+
+	if res.Err() != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       res.Err().Error() + " for " + o_id.String(),
+			Headers:    defaultHeaders,
+		}, nil
+	}
+
+	var e Event
+
+	err = res.Decode(&e)
+
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       err.Error(),
+			Headers:    defaultHeaders,
+		}, nil
+	}
+
+	//check case for groups before saying anything about the snapshot
+
+	if e.CaseID == nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       errors.New("No case ID found for event " + id).Error(),
+			Headers:    defaultHeaders,
+		}, nil
+	}
+
+	c_id, err := primitive.ObjectIDFromHex(*e.CaseID)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       err.Error(),
+			Headers:    defaultHeaders,
+		}, nil
+	}
+
+	filter = bson.M{"_id": c_id, "group": bson.M{"$in": groups}}
+	res2 := MongoClient.Database("fyeo-di").Collection("cases").FindOne(ctx, filter)
+
+	if res2.Err() != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 403,
+			Body:       errors.New("No permission for case " + *e.CaseID).Error(),
+			Headers:    defaultHeaders,
+		}, nil
+	}
+
+	//events ingested before the page was snapshotted pick it up from the shared source document
+	if e.SnapshotKey == nil && e.SourceDocumentID != nil {
+		err = ApplySourceSnapshot(ctx, &e)
+		if err != nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 400,
+				Body:       err.Error(),
+				Headers:    defaultHeaders,
+			}, nil
+		}
+	}
+
+	if e.SnapshotKey == nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 404,
+			Body:       errors.New("No snapshot stored for event " + id).Error(),
+			Headers:    defaultHeaders,
+		}, nil
+	}
+
+	link, err := Store.Presign(ctx, *e.SnapshotKey, LINK_EXPIRY)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       err.Error(),
+			Headers:    defaultHeaders,
+		}, nil
+	}
+
+	out := SnapshotResponse{
+		EventID:       id,
+		SnapshotLink:  link,
+		ExpiresAt:     time.Now().Add(LINK_EXPIRY),
+		ContentSHA256: e.ContentSHA256,
+		ContentType:   e.SnapshotContentType,
+		Size:          e.SnapshotSize,
+	}
+
+	js, err := json.Marshal(out)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       err.Error(),
+			Headers:    defaultHeaders,
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		Body:       string(js),
+		StatusCode: 200,
+		Headers:    defaultHeaders,
+	}, nil
+}
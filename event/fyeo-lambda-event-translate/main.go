@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	MongoClient *mongo.Client
+)
+
+type Strings []string
+
+func main() {
+	lambda.Start(Handler)
+}
+
+func Init() error {
+	var err error
+
+	err = ReuseMongo()
+	if err != nil {
+		return err
+	}
+
+	err = ReuseTranslator()
+	if err != nil {
+		return err
+	}
+
+	return err
+}
+
+func ReuseMongo() error {
+	if MongoClient != nil {
+		return nil
+	} else {
+		var err error
+		ctx := context.Background()
+
+		uri := "mongodb://192.168.0.229:27017"
+
+		MongoClient, err = mongo.Connect(ctx, options.Client().ApplyURI(uri))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func Handler(ctx context.Context, event events.CloudWatchEvent) (TranslateReport, error) {
+	err := Init()
+	if err != nil {
+		return TranslateReport{}, err
+	}
+
+	report, err := TranslatePending(ctx, &MongoQueue{}, EventTranslator, time.Now())
+	if err != nil {
+		return report, err
+	}
+
+	log.Printf("checked %d events, translated %d (%d characters), skipped %d, %d over budget", report.Checked, report.Translated, report.Characters, report.Skipped, report.OverBudget)
+	if len(report.Errors) > 0 {
+		log.Printf("errors: %s", strings.Join(report.Errors, "; "))
+	}
+
+	return report, nil
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	TRANSLATE_BATCH_SIZE = 100
+	MAX_EVENTS_PER_RUN   = 1000
+)
+
+type TranslateReport struct {
+	Checked    int64    `json:"checked"`
+	Translated int64    `json:"translated"`
+	Skipped    int64    `json:"skipped"`
+	OverBudget int64    `json:"over_budget"`
+	Characters int64    `json:"characters"`
+	Errors     []string `json:"errors,omitempty"`
+}
+
+// Translation is what a translated event is updated with.
+type Translation struct {
+	Title   *string
+	Cuts    map[int]string
+	Version int64
+}
+
+// AnyField matches a condition against the current and legacy names of an event field.
+func AnyField(canonical string, cond interface{}) bson.M {
+	names := EventFieldNames(canonical)
+	if len(names) == 1 {
+		return bson.M{canonical: cond}
+	}
+
+	var or []bson.M
+	for _, n := range names {
+		or = append(or, bson.M{n: cond})
+	}
+
+	return bson.M{"$or": or}
+}
+
+// SourceLanguage is the language the event was detected in, or auto when it was not.
+func SourceLanguage(e Event) string {
+	if e.Language != nil && strings.TrimSpace(*e.Language) != "" {
+		return strings.ToLower(strings.TrimSpace(*e.Language))
+	}
+
+	if e.Languages != nil && len(*e.Languages) > 0 && (*e.Languages)[0] != "" {
+		return strings.ToLower((*e.Languages)[0])
+	}
+
+	return AUTO_LANGUAGE
+}
+
+// NeedsTranslation is false for events already in the target language.
+func NeedsTranslation(e Event) bool {
+	return SourceLanguage(e) != TARGET_LANGUAGE
+}
+
+// TranslationCost is what translating an event takes from the case wallet, one per character
+// of the title and the cuts. A title shared through the source document is not paid again.
+func TranslationCost(e Event, shared *string) int64 {
+	var cost int
+	if e.Title != nil && shared == nil {
+		cost += utf8.RuneCountInString(*e.Title)
+	}
+
+	for _, c := range e.Cuts {
+		if c != nil && c.Cut != nil {
+			cost += utf8.RuneCountInString(*c.Cut)
+		}
+	}
+
+	return int64(cost)
+}
+
+// TranslateEvent translates the title and every cut of an event, the title is taken from
+// shared when another case already had it translated.
+func TranslateEvent(ctx context.Context, t Translator, e Event, shared *string) (Translation, error) {
+	out := Translation{Cuts: make(map[int]string), Version: t.Version()}
+	source := SourceLanguage(e)
+
+	if shared != nil {
+		out.Title = shared
+	} else if e.Title != nil && strings.TrimSpace(*e.Title) != "" {
+		title, err := t.Translate(ctx, *e.Title, source, TARGET_LANGUAGE)
+		if err != nil {
+			return out, err
+		}
+		out.Title = &title
+	}
+
+	for i, c := range e.Cuts {
+		if c == nil || c.Cut == nil || strings.TrimSpace(*c.Cut) == "" {
+			continue
+		}
+
+		cut, err := t.Translate(ctx, *c.Cut, source, TARGET_LANGUAGE)
+		if err != nil {
+			return out, err
+		}
+		out.Cuts[i] = cut
+	}
+
+	return out, nil
+}
+
+// Queue holds the events waiting for translation and the wallets of their cases.
+type Queue interface {
+	GetPendingEvents(ctx context.Context, skip_cases []string, skip_events []primitive.ObjectID) ([]Event, error)
+	GetSharedTitle(ctx context.Context, e Event) (*string, error)
+	SetSharedTitle(ctx context.Context, e Event, title string) error
+	ChargeWallet(ctx context.Context, case_id string, cost int64) (int64, bool, error)
+	RefundWallet(ctx context.Context, case_id string, cost int64) error
+	MarkTranslated(ctx context.Context, e Event, tr Translation, remaining int64, cost int64, now time.Time) error
+	MarkNotNeeded(ctx context.Context, e Event) error
+}
+
+// MongoQueue is the queue kept on the events, the cases and the source documents.
+type MongoQueue struct{}
+
+// GetSharedTitle returns the title translation on the event's source document, nil when the
+// page has not been translated for any case yet.
+func (q *MongoQueue) GetSharedTitle(ctx context.Context, e Event) (*string, error) {
+	if e.SourceDocumentID == nil {
+		return nil, nil
+	}
+
+	o_id, err := primitive.ObjectIDFromHex(*e.SourceDocumentID)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc struct {
+		TranslatedTitle *string `bson:"translated_title"`
+	}
+
+	opts := options.FindOne().SetProjection(bson.M{"translated_title": 1})
+	err = MongoClient.Database("fyeo-di").Collection("source_documents").FindOne(ctx, bson.M{"_id": o_id}, opts).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+
+	return doc.TranslatedTitle, err
+}
+
+// SetSharedTitle stores the title translation on the source document for the other cases
+// sharing the page, unless one is already there.
+func (q *MongoQueue) SetSharedTitle(ctx context.Context, e Event, title string) error {
+	if e.SourceDocumentID == nil {
+		return nil
+	}
+
+	o_id, err := primitive.ObjectIDFromHex(*e.SourceDocumentID)
+	if err != nil {
+		return err
+	}
+
+	filter := bson.M{"_id": o_id, "translated_title": nil}
+	_, err = MongoClient.Database("fyeo-di").Collection("source_documents").UpdateOne(ctx, filter, bson.M{"$set": bson.M{"translated_title": title}})
+	return err
+}
+
+// ChargeWallet takes the cost from the case wallet if it holds enough. Cases without a
+// wallet have no budget.
+func (q *MongoQueue) ChargeWallet(ctx context.Context, case_id string, cost int64) (int64, bool, error) {
+	o_id, err := primitive.ObjectIDFromHex(case_id)
+	if err != nil {
+		return 0, false, err
+	}
+
+	var c struct {
+		TranslationWallet int64 `bson:"translation_wallet"`
+	}
+
+	filter := bson.M{"_id": o_id, "translation_wallet": bson.M{"$gte": cost}}
+	update := bson.M{"$inc": bson.M{"translation_wallet": -cost}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After).SetProjection(bson.M{"translation_wallet": 1})
+
+	err = MongoClient.Database("fyeo-di").Collection("cases").FindOneAndUpdate(ctx, filter, update, opts).Decode(&c)
+	if err == mongo.ErrNoDocuments {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	return c.TranslationWallet, true, nil
+}
+
+// RefundWallet gives the cost back when the translation did not happen.
+func (q *MongoQueue) RefundWallet(ctx context.Context, case_id string, cost int64) error {
+	o_id, err := primitive.ObjectIDFromHex(case_id)
+	if err != nil {
+		return err
+	}
+
+	_, err = MongoClient.Database("fyeo-di").Collection("cases").UpdateOne(ctx, bson.M{"_id": o_id}, bson.M{"$inc": bson.M{"translation_wallet": cost}})
+	return err
+}
+
+// legacyUnset drops the legacy spellings of the flags set, an old translationNeeded would
+// otherwise keep the event in the queue.
+func legacyUnset() bson.M {
+	unset := bson.M{}
+	for _, f := range []string{"translation_needed", "is_translated"} {
+		for _, n := range EventFieldNames(f) {
+			if n != f {
+				unset[n] = ""
+			}
+		}
+	}
+	return unset
+}
+
+func updateEvent(ctx context.Context, id string, set bson.M) error {
+	o_id, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+
+	update := bson.M{"$set": set}
+	unset := legacyUnset()
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+
+	_, err = MongoClient.Database("fyeo-di").Collection("events").UpdateOne(ctx, bson.M{"_id": o_id}, update)
+	return err
+}
+
+func (q *MongoQueue) MarkTranslated(ctx context.Context, e Event, tr Translation, remaining int64, cost int64, now time.Time) error {
+	set := bson.M{
+		"is_translated":       true,
+		"translation_needed":  false,
+		"translator_version":  tr.Version,
+		"translated_at":       now,
+		"translation_wallet":  remaining,
+		"translation_counter": cost,
+	}
+
+	if tr.Title != nil {
+		set["translated_title"] = *tr.Title
+	}
+
+	for i, cut := range tr.Cuts {
+		set["cuts."+strconv.Itoa(i)+".translated"] = cut
+	}
+
+	return updateEvent(ctx, *e.ID, set)
+}
+
+// MarkNotNeeded takes events already in the target language out of the queue without charging.
+func (q *MongoQueue) MarkNotNeeded(ctx context.Context, e Event) error {
+	return updateEvent(ctx, *e.ID, bson.M{"translation_needed": false})
+}
+
+// GetPendingEvents returns events waiting for translation, leaving out cases that ran out of
+// budget and events that already failed in this run.
+func (q *MongoQueue) GetPendingEvents(ctx context.Context, skip_cases []string, skip_events []primitive.ObjectID) ([]Event, error) {
+	var out []Event
+
+	and := []bson.M{
+		AnyField("translation_needed", true),
+		{"is_archived": bson.M{"$ne": true}},
+	}
+
+	for _, n := range EventFieldNames("is_translated") {
+		and = append(and, bson.M{n: bson.M{"$ne": true}})
+	}
+
+	if len(skip_cases) > 0 {
+		for _, n := range EventFieldNames("case_id") {
+			and = append(and, bson.M{n: bson.M{"$nin": skip_cases}})
+		}
+	}
+
+	if len(skip_events) > 0 {
+		and = append(and, bson.M{"_id": bson.M{"$nin": skip_events}})
+	}
+
+	res, err := MongoClient.Database("fyeo-di").Collection("events").Find(ctx, bson.M{"$and": and}, options.Find().SetLimit(TRANSLATE_BATCH_SIZE))
+	if err != nil {
+		return out, err
+	}
+
+	err = res.All(ctx, &out)
+	return out, err
+}
+
+// TranslatePending works through the queue until it is empty or the run limit is reached.
+func TranslatePending(ctx context.Context, q Queue, t Translator, now time.Time) (TranslateReport, error) {
+	var report TranslateReport
+
+	var skip_cases []string
+	var skip_events []primitive.ObjectID
+	exhausted := make(map[string]bool)
+
+	fail := func(e Event, err error) {
+		report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", *e.ID, err.Error()))
+		o_id, _ := primitive.ObjectIDFromHex(*e.ID)
+		skip_events = append(skip_events, o_id)
+	}
+
+	for report.Checked < MAX_EVENTS_PER_RUN {
+		pending, err := q.GetPendingEvents(ctx, skip_cases, skip_events)
+		if err != nil {
+			return report, err
+		}
+
+		if len(pending) == 0 {
+			break
+		}
+
+		for _, e := range pending {
+			if e.ID == nil {
+				continue
+			}
+			report.Checked++
+
+			if !NeedsTranslation(e) {
+				err := q.MarkNotNeeded(ctx, e)
+				if err != nil {
+					fail(e, err)
+					continue
+				}
+				report.Skipped++
+				continue
+			}
+
+			if e.CaseID == nil {
+				fail(e, errors.New("No case ID found for event"))
+				continue
+			}
+
+			case_id := *e.CaseID
+			if exhausted[case_id] {
+				continue
+			}
+
+			shared, err := q.GetSharedTitle(ctx, e)
+			if err != nil {
+				fail(e, err)
+				continue
+			}
+
+			cost := TranslationCost(e, shared)
+			remaining, ok, err := q.ChargeWallet(ctx, case_id, cost)
+			if err != nil {
+				fail(e, err)
+				continue
+			}
+
+			if !ok {
+				report.OverBudget++
+				exhausted[case_id] = true
+				skip_cases = append(skip_cases, case_id)
+				continue
+			}
+
+			tr, err := TranslateEvent(ctx, t, e, shared)
+			if err == nil {
+				err = q.MarkTranslated(ctx, e, tr, remaining, cost, now)
+			}
+
+			if err != nil {
+				refund_err := q.RefundWallet(ctx, case_id, cost)
+				if refund_err != nil {
+					err = errors.New(err.Error() + ", refund failed: " + refund_err.Error())
+				}
+				fail(e, err)
+				continue
+			}
+
+			if shared == nil && tr.Title != nil {
+				err := q.SetSharedTitle(ctx, e, *tr.Title)
+				if err != nil {
+					report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", *e.ID, err.Error()))
+				}
+			}
+
+			report.Translated++
+			report.Characters += cost
+		}
+	}
+
+	return report, nil
+}
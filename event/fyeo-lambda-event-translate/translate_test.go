@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// fakeQueue keeps the queue in memory and answers as the database would
+type fakeQueue struct {
+	events     []Event
+	done       map[string]bool
+	wallets    map[string]int64
+	titles     map[string]string
+	translated map[string]Translation
+	remaining  map[string]int64
+}
+
+func newFakeQueue(wallets map[string]int64, events ...Event) *fakeQueue {
+	return &fakeQueue{
+		events:     events,
+		done:       make(map[string]bool),
+		wallets:    wallets,
+		titles:     make(map[string]string),
+		translated: make(map[string]Translation),
+		remaining:  make(map[string]int64),
+	}
+}
+
+func (q *fakeQueue) GetPendingEvents(ctx context.Context, skip_cases []string, skip_events []primitive.ObjectID) ([]Event, error) {
+	skip := make(map[string]bool)
+	for _, c := range skip_cases {
+		skip[c] = true
+	}
+	for _, id := range skip_events {
+		skip[id.Hex()] = true
+	}
+
+	var out []Event
+	for _, e := range q.events {
+		if q.done[*e.ID] || skip[*e.ID] || (e.CaseID != nil && skip[*e.CaseID]) {
+			continue
+		}
+		out = append(out, e)
+		if len(out) == TRANSLATE_BATCH_SIZE {
+			break
+		}
+	}
+
+	return out, nil
+}
+
+func (q *fakeQueue) GetSharedTitle(ctx context.Context, e Event) (*string, error) {
+	if e.SourceDocumentID == nil {
+		return nil, nil
+	}
+	title, ok := q.titles[*e.SourceDocumentID]
+	if !ok {
+		return nil, nil
+	}
+	return &title, nil
+}
+
+func (q *fakeQueue) SetSharedTitle(ctx context.Context, e Event, title string) error {
+	if e.SourceDocumentID == nil {
+		return nil
+	}
+	if _, ok := q.titles[*e.SourceDocumentID]; !ok {
+		q.titles[*e.SourceDocumentID] = title
+	}
+	return nil
+}
+
+func (q *fakeQueue) ChargeWallet(ctx context.Context, case_id string, cost int64) (int64, bool, error) {
+	wallet, ok := q.wallets[case_id]
+	if !ok || wallet < cost {
+		return 0, false, nil
+	}
+	q.wallets[case_id] = wallet - cost
+	return wallet - cost, true, nil
+}
+
+func (q *fakeQueue) RefundWallet(ctx context.Context, case_id string, cost int64) error {
+	q.wallets[case_id] += cost
+	return nil
+}
+
+func (q *fakeQueue) MarkTranslated(ctx context.Context, e Event, tr Translation, remaining int64, cost int64, now time.Time) error {
+	q.done[*e.ID] = true
+	q.translated[*e.ID] = tr
+	q.remaining[*e.ID] = remaining
+	return nil
+}
+
+func (q *fakeQueue) MarkNotNeeded(ctx context.Context, e Event) error {
+	q.done[*e.ID] = true
+	return nil
+}
+
+// countingTranslator counts the texts sent to the fake translator
+type countingTranslator struct {
+	FakeTranslator
+	texts []string
+}
+
+func (t *countingTranslator) Translate(ctx context.Context, text string, source string, target string) (string, error) {
+	t.texts = append(t.texts, text)
+	return t.FakeTranslator.Translate(ctx, text, source, target)
+}
+
+type failingTranslator struct {
+	FakeTranslator
+}
+
+func (t *failingTranslator) Translate(ctx context.Context, text string, source string, target string) (string, error) {
+	return "", errors.New("translation service unavailable")
+}
+
+func testEvent(case_id string, language string, title string, cuts ...string) Event {
+	id := primitive.NewObjectID().Hex()
+	e := Event{ID: &id, CaseID: &case_id, Title: &title}
+	if language != "" {
+		e.Language = &language
+	}
+	for i := range cuts {
+		e.Cuts = append(e.Cuts, &EventCut{Cut: &cuts[i]})
+	}
+	return e
+}
+
+func TestTranslatePendingBudget(t *testing.T) {
+	a1 := testEvent("case-a", "de", "Hallo Welt")
+	a2 := testEvent("case-a", "de", "Guten Tag", "Kurz")
+	a3 := testEvent("case-a", "de", "Noch einer")
+	b1 := testEvent("case-b", "fr", "Bonjour")
+	c1 := testEvent("case-c", "EN", "Already english")
+
+	q := newFakeQueue(map[string]int64{"case-a": 25, "case-c": 100}, a1, a2, a3, b1, c1)
+
+	report, err := TranslatePending(context.Background(), q, &FakeTranslator{}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Checked != 5 || report.Translated != 2 || report.Skipped != 1 || report.OverBudget != 2 {
+		t.Errorf("report = %+v", report)
+	}
+	if report.Characters != 23 {
+		t.Errorf("characters = %d, want 23", report.Characters)
+	}
+
+	//10 and 13 characters charged, the third event does not fit in what is left
+	if q.wallets["case-a"] != 2 {
+		t.Errorf("case-a wallet = %d, want 2", q.wallets["case-a"])
+	}
+	if q.remaining[*a1.ID] != 15 || q.remaining[*a2.ID] != 2 {
+		t.Errorf("remaining = %d, %d, want 15, 2", q.remaining[*a1.ID], q.remaining[*a2.ID])
+	}
+	if q.done[*a3.ID] || q.done[*b1.ID] {
+		t.Error("events over budget were taken out of the queue")
+	}
+
+	//english events are not charged
+	if q.wallets["case-c"] != 100 || !q.done[*c1.ID] {
+		t.Errorf("case-c wallet = %d, done = %v", q.wallets["case-c"], q.done[*c1.ID])
+	}
+
+	tr := q.translated[*a2.ID]
+	if tr.Title == nil || *tr.Title != "[de>en] Guten Tag" || tr.Cuts[0] != "[de>en] Kurz" {
+		t.Errorf("translation = %+v", tr)
+	}
+	if tr.Version != FAKE_TRANSLATOR_VERSION {
+		t.Errorf("version = %d, want %d", tr.Version, FAKE_TRANSLATOR_VERSION)
+	}
+}
+
+func TestTranslatePendingSharedTitle(t *testing.T) {
+	doc := primitive.NewObjectID().Hex()
+
+	a := testEvent("case-a", "de", "Hallo Welt")
+	a.SourceDocumentID = &doc
+	b := testEvent("case-b", "de", "Hallo Welt", "Kurz")
+	b.SourceDocumentID = &doc
+
+	q := newFakeQueue(map[string]int64{"case-a": 100, "case-b": 100}, a, b)
+	translator := &countingTranslator{}
+
+	report, err := TranslatePending(context.Background(), q, translator, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Translated != 2 {
+		t.Errorf("report = %+v", report)
+	}
+
+	//the title is translated once, the second case only pays for its cut
+	if len(translator.texts) != 2 || translator.texts[0] != "Hallo Welt" || translator.texts[1] != "Kurz" {
+		t.Errorf("translated texts = %v", translator.texts)
+	}
+	if q.wallets["case-a"] != 90 || q.wallets["case-b"] != 96 {
+		t.Errorf("wallets = %v, want case-a 90, case-b 96", q.wallets)
+	}
+
+	if q.titles[doc] != "[de>en] Hallo Welt" {
+		t.Errorf("source document title = %q", q.titles[doc])
+	}
+	tr := q.translated[*b.ID]
+	if tr.Title == nil || *tr.Title != "[de>en] Hallo Welt" {
+		t.Errorf("shared title = %v", tr.Title)
+	}
+}
+
+func TestTranslatePendingRefund(t *testing.T) {
+	a := testEvent("case-a", "de", "Hallo Welt")
+	q := newFakeQueue(map[string]int64{"case-a": 100}, a)
+
+	report, err := TranslatePending(context.Background(), q, &failingTranslator{}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Translated != 0 || len(report.Errors) != 1 {
+		t.Errorf("report = %+v", report)
+	}
+	if q.wallets["case-a"] != 100 {
+		t.Errorf("wallet = %d, want the cost refunded", q.wallets["case-a"])
+	}
+	if q.done[*a.ID] {
+		t.Error("failed event was taken out of the queue")
+	}
+}
+
+func TestTranslationCost(t *testing.T) {
+	e := testEvent("case-a", "ru", "Привет", "мир", "")
+	shared := "Hello"
+
+	if cost := TranslationCost(e, nil); cost != 9 {
+		t.Errorf("TranslationCost() = %d, want 9", cost)
+	}
+	if cost := TranslationCost(e, &shared); cost != 3 {
+		t.Errorf("TranslationCost() with a shared title = %d, want 3", cost)
+	}
+}
+
+func TestTranslateEvent(t *testing.T) {
+	e := testEvent("case-a", "", "Titel", "eins", " ")
+
+	tr, err := TranslateEvent(context.Background(), &FakeTranslator{}, e, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tr.Title == nil || *tr.Title != "[auto>en] Titel" {
+		t.Errorf("title = %v", tr.Title)
+	}
+	if len(tr.Cuts) != 1 || tr.Cuts[0] != "[auto>en] eins" {
+		t.Errorf("cuts = %v", tr.Cuts)
+	}
+
+	again, _ := TranslateEvent(context.Background(), &FakeTranslator{}, e, nil)
+	if *again.Title != *tr.Title {
+		t.Error("fake translator is not deterministic")
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/translate"
+)
+
+const (
+	TARGET_LANGUAGE = "en"
+	AUTO_LANGUAGE   = "auto"
+
+	TRANSLATOR_AWS  = "aws"
+	TRANSLATOR_FAKE = "fake"
+
+	AWS_TRANSLATOR_VERSION = 1
+	//never a real translator version, so fake output is easy to find and clean up
+	FAKE_TRANSLATOR_VERSION = -1
+)
+
+var (
+	EventTranslator Translator
+
+	TRANSLATOR = os.Getenv("TRANSLATOR")
+)
+
+// Translator turns text in the source language into the target language. The source
+// may be "auto" when the event has no language.
+type Translator interface {
+	Translate(ctx context.Context, text string, source string, target string) (string, error)
+	Version() int64
+}
+
+// AWSTranslator uses Amazon Translate.
+type AWSTranslator struct {
+	Client *translate.Client
+}
+
+func (t *AWSTranslator) Translate(ctx context.Context, text string, source string, target string) (string, error) {
+	resp, err := t.Client.TranslateText(ctx, &translate.TranslateTextInput{
+		Text:               aws.String(text),
+		SourceLanguageCode: aws.String(source),
+		TargetLanguageCode: aws.String(target),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if resp.TranslatedText == nil {
+		return "", errors.New("No translation returned")
+	}
+
+	return *resp.TranslatedText, nil
+}
+
+func (t *AWSTranslator) Version() int64 {
+	return AWS_TRANSLATOR_VERSION
+}
+
+// FakeTranslator tags the text with the language pair instead of translating it, the same
+// input always gives the same output.
+type FakeTranslator struct{}
+
+func (t *FakeTranslator) Translate(ctx context.Context, text string, source string, target string) (string, error) {
+	return "[" + source + ">" + target + "] " + text, nil
+}
+
+func (t *FakeTranslator) Version() int64 {
+	return FAKE_TRANSLATOR_VERSION
+}
+
+// ReuseTranslator picks the translator from TRANSLATOR, Amazon Translate unless it is set to fake.
+func ReuseTranslator() error {
+	if EventTranslator != nil {
+		return nil
+	}
+
+	if TRANSLATOR == TRANSLATOR_FAKE {
+		EventTranslator = &FakeTranslator{}
+		return nil
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		return err
+	}
+
+	EventTranslator = &AWSTranslator{Client: translate.NewFromConfig(cfg)}
+
+	return nil
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	STAFF_GROUP = "staff"
+
+	ACTION_SEEN     = "seen"
+	ACTION_UNSEEN   = "unseen"
+	ACTION_STAR     = "star"
+	ACTION_UNSTAR   = "unstar"
+	ACTION_CLASSIFY = "classify"
+
+	MIN_THREAT_LEVEL = 0
+	MAX_THREAT_LEVEL = 5
+)
+
+var (
+	username    string
+	groups      []string
+	gMap        = make(map[string]bool)
+	MongoClient *mongo.Client
+
+	defaultHeaders = map[string]string{
+		"Content-Type":                 "application/json",
+		"Access-Control-Allow-Headers": "*",
+		"Access-Control-Allow-Origin":  "*",
+		"Access-Control-Allow-Methods": "OPTIONS, POST",
+		"Allow":                        "OPTIONS, POST",
+	}
+)
+
+type Strings []string
+
+type Case struct {
+	ID    string `json:"id" bson:"_id"`
+	Name  string `json:"name" bson:"caseName"`
+	Group string `json:"group" bson:"group"`
+}
+
+type TriageRequest struct {
+	Action      string `json:"action"`
+	ThreatLevel *int64 `json:"threat_level,omitempty"`
+}
+
+type ErrorResponse struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+func ServeError(message string, code int) events.APIGatewayProxyResponse {
+	js, _ := json.Marshal(ErrorResponse{
+		Code:    code,
+		Message: message,
+	})
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: code,
+		Body:       string(js),
+		Headers:    defaultHeaders,
+	}
+}
+
+func main() {
+	lambda.Start(Handler)
+}
+
+func Init() error {
+	var err error
+	err = ReuseMongo()
+	if err != nil {
+		return err
+	}
+
+	return err
+}
+
+func ReuseMongo() error {
+	if MongoClient != nil {
+		return nil
+	} else {
+		var err error
+		ctx := context.Background()
+
+		uri := "mongodb://192.168.0.229:27017"
+
+		MongoClient, err = mongo.Connect(ctx, options.Client().ApplyURI(uri))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func VerifyRequest(request events.APIGatewayProxyRequest) error {
+
+	claims := request.RequestContext.Authorizer["claims"]
+	if claims == nil {
+		return errors.New("No claims found for " + request.RequestContext.Identity.CognitoIdentityID)
+	}
+
+	c := claims.(map[string]interface{})
+
+	rg := c["cognito:groups"]
+	if rg == nil {
+		return errors.New("No group permissions set")
+	}
+
+	groups = strings.Split(rg.(string), ",")
+
+	//warm containers keep gMap, start from nothing for every caller
+	gMap = make(map[string]bool)
+	for _, g := range groups {
+		gMap[g] = true
+	}
+
+	username, _ = c["cognito:username"].(string)
+	if username == "" {
+		username, _ = c["sub"].(string)
+	}
+
+	if username == "" {
+		return errors.New("No user found in claims")
+	}
+
+	return nil
+}
+
+func IsStaff() bool {
+	return gMap[STAFF_GROUP]
+}
+
+func GetEvent(ctx context.Context, id string) (Event, error) {
+	var out Event
+	o_id, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return out, err
+	}
+
+	res := MongoClient.Database("fyeo-di").Collection("events").FindOne(ctx, bson.M{"_id": o_id})
+	if res.Err() != nil {
+		return out, res.Err()
+	}
+
+	err = res.Decode(&out)
+	if err != nil {
+		return out, err
+	}
+
+	return out, nil
+}
+
+func GetCase(ctx context.Context, id string) (Case, error) {
+	var out Case
+	o_id, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return out, err
+	}
+
+	filter := bson.M{"_id": o_id, "group": bson.M{"$in": groups}}
+	res := MongoClient.Database("fyeo-di").Collection("cases").FindOne(ctx, filter)
+	if res.Err() != nil {
+		return out, res.Err()
+	}
+
+	err = res.Decode(&out)
+	if err != nil {
+		return out, err
+	}
+
+	return out, nil
+}
+
+// TriageUpdate builds the update for an action. Seen and starred are kept per analyst in
+// seen_by and starred_by, the staff flags are only set when a staff member acts.
+func TriageUpdate(input TriageRequest, now time.Time) (bson.M, error) {
+	set := bson.M{"updated_at": now}
+	update := bson.M{"$set": set}
+
+	history := bson.M{"action": input.Action, "user": username, "date": now}
+
+	switch input.Action {
+	case ACTION_SEEN:
+		update["$addToSet"] = bson.M{"seen_by": username}
+		if IsStaff() {
+			set["staff_seen"] = true
+			set["seen_at"] = now
+		}
+
+	case ACTION_UNSEEN:
+		update["$pull"] = bson.M{"seen_by": username}
+		if IsStaff() {
+			set["staff_seen"] = false
+		}
+
+	case ACTION_STAR:
+		update["$addToSet"] = bson.M{"starred_by": username}
+		if IsStaff() {
+			set["staff_starred"] = true
+		}
+
+	case ACTION_UNSTAR:
+		update["$pull"] = bson.M{"starred_by": username}
+		if IsStaff() {
+			set["staff_starred"] = false
+		}
+
+	case ACTION_CLASSIFY:
+		if input.ThreatLevel == nil {
+			return nil, errors.New("threat_level is required to classify an event")
+		}
+
+		if *input.ThreatLevel < MIN_THREAT_LEVEL || *input.ThreatLevel > MAX_THREAT_LEVEL {
+			return nil, errors.New("threat_level must be between " + strconv.Itoa(MIN_THREAT_LEVEL) + " and " + strconv.Itoa(MAX_THREAT_LEVEL))
+		}
+
+		set["threat_level"] = *input.ThreatLevel
+		set["is_man_classified"] = true
+		set["man_classified_at"] = now
+		set["classified_by"] = username
+		//an analyst decision must not be overwritten by the rules engine
+		set["stop_auto_classifier"] = true
+		if IsStaff() {
+			set["staff_classified"] = true
+		}
+
+		history["threat_level"] = *input.ThreatLevel
+
+		//classifying an event also marks it seen for the analyst
+		update["$addToSet"] = bson.M{"seen_by": username}
+
+	default:
+		return nil, errors.New("Unknown action: " + input.Action)
+	}
+
+	update["$push"] = bson.M{"history": history}
+
+	return update, nil
+}
+
+func Handler(rctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var err error
+	ctx, cancel := context.WithTimeout(context.Background(), 14*time.Second)
+	defer cancel()
+
+	id := request.PathParameters["id"]
+	if id == "" {
+		return ServeError("No ID provided", 400), nil
+	}
+
+	err = VerifyRequest(request)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	var input TriageRequest
+	if strings.TrimSpace(request.Body) != "" {
+		err = json.Unmarshal([]byte(request.Body), &input)
+		if err != nil {
+			return ServeError(err.Error(), 400), nil
+		}
+	}
+
+	//the action may also be given in the path, e.g POST /events/{id}/star
+	action, ok := request.PathParameters["action"]
+	if ok && action != "" {
+		input.Action = action
+	}
+
+	input.Action = strings.ToLower(strings.TrimSpace(input.Action))
+
+	err = Init()
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	event, err := GetEvent(ctx, id)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	if event.CaseID == nil {
+		return ServeError("No case ID found for event "+id, 400), nil
+	}
+
+	ca, err := GetCase(ctx, *event.CaseID)
+	if err != nil {
+		return ServeError("Unable to verify case group permissions", 400), nil
+	}
+
+	update, err := TriageUpdate(input, time.Now())
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	o_id, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	res := MongoClient.Database("fyeo-di").Collection("events").FindOneAndUpdate(ctx, bson.M{"_id": o_id}, update, opts)
+	if res.Err() != nil {
+		return ServeError(res.Err().Error(), 400), nil
+	}
+
+	var out Event
+	err = res.Decode(&out)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	out.Group = &ca.Group
+	out.CaseName = &ca.Name
+
+	js, err := json.Marshal(out)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		Body:       string(js),
+		StatusCode: 200,
+		Headers:    defaultHeaders,
+	}, nil
+}
@@ -8,4 +8,5 @@ require (
 	github.com/aws/aws-sdk-go-v2/config v1.6.1
 	github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider v1.5.1
 	go.mongodb.org/mongo-driver v1.7.1
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -50,26 +50,48 @@ type Incident struct {
 	ClassifiedBy *string    `json:"classified_by,omitempty" bson:"classified_by,omitempty"`
 	ClassifiedAt *time.Time `json:"classified_at,omitempty" bson:"classified_at,omitempty"`
 	ClosedAt     *time.Time `json:"closed_at,omitempty" bson:"closed_at,omitempty"`
+	ClosedBy     *string    `json:"closed_by,omitempty" bson:"closed_by,omitempty"`
+	CloseReason  *string    `json:"close_reason,omitempty" bson:"close_reason,omitempty"`
 
 	Description *string `json:"description,omitempty" bson:"description,omitempty"` //used for summary?
 
 	Recommendations *string `json:"recommendations,omitempty" bson:"recommendations,omitempty"`
 
-	CreatedAt      *time.Time `json:"created_at,omitempty" bson:"created_at,omitempty"`
-	CaseID         *string    `json:"case_id,omitempty" bson:"case_id,omitempty"`
-	AssetID        *string    `json:"asset_id,omitempty" bson:"asset_id,omitempty"`
-	ThreatActors   []*Asset   `json:"threat_actors,omitempty" bson:"-"`
-	ThreatActorIDs *Strings   `json:"threat_actor_ids,omitempty" bson:"threat_actor_ids,omitempty"`
-	Source         *string    `json:"source,omitempty" bson:"source,omitempty"`
-	SourceType     *string    `json:"source_type,omitempty" bson:"source_type,omitempty"` //default to clear-net
-	Severity       *int64     `json:"severity,omitempty" bson:"severity,omitempty"`
-	TargetIDs      *Strings   `json:"target_ids,omitempty" bson:"target_ids,omitempty"`
-	TargetAssets   []*Asset   `json:"target_assets,omitempty" bson:"-"`
-	Agent          *string    `json:"agent,omitempty" bson:"agent,omitempty"`
-	IsActive       *bool      `json:"is_active,omitempty" bson:"is_active,omitempty"`
-	IsReported     *bool      `json:"is_reported,omitempty" bson:"is_reported,omitempty"`
-	EventIDs       *Strings   `json:"event_ids,omitempty" bson:"event_ids,omitempty"`
-	Events         []*Event   `json:"events,omitempty" bson:"-"`
+	CreatedAt      *time.Time     `json:"created_at,omitempty" bson:"created_at,omitempty"`
+	CaseID         *string        `json:"case_id,omitempty" bson:"case_id,omitempty"`
+	AssetID        *string        `json:"asset_id,omitempty" bson:"asset_id,omitempty"`
+	ThreatActors   []*Asset       `json:"threat_actors,omitempty" bson:"-"`
+	ThreatActorIDs *Strings       `json:"threat_actor_ids,omitempty" bson:"threat_actor_ids,omitempty"`
+	Source         *string        `json:"source,omitempty" bson:"source,omitempty"`
+	SourceType     *string        `json:"source_type,omitempty" bson:"source_type,omitempty"` //default to clear-net
+	Severity       *int64         `json:"severity,omitempty" bson:"severity,omitempty"`
+	SeverityScore  *SeverityScore `json:"severity_score,omitempty" bson:"severity_score,omitempty"`
+	TargetIDs      *Strings       `json:"target_ids,omitempty" bson:"target_ids,omitempty"`
+	TargetAssets   []*Asset       `json:"target_assets,omitempty" bson:"-"`
+	Agent          *string        `json:"agent,omitempty" bson:"agent,omitempty"`
+	IsActive       *bool          `json:"is_active,omitempty" bson:"is_active,omitempty"`
+	IsReported     *bool          `json:"is_reported,omitempty" bson:"is_reported,omitempty"`
+	EventIDs       *Strings       `json:"event_ids,omitempty" bson:"event_ids,omitempty"`
+	Events         []*Event       `json:"events,omitempty" bson:"-"`
+}
+
+// SeverityScore is the severity the incident's events suggest, next to the severity the
+// analyst sets, with the factors it was worked out from.
+type SeverityScore struct {
+	Suggested  *int64            `json:"suggested,omitempty" bson:"suggested,omitempty"`
+	Score      *float64          `json:"score,omitempty" bson:"score,omitempty"`
+	Confidence *float64          `json:"confidence,omitempty" bson:"confidence,omitempty"`
+	Events     *int64            `json:"events,omitempty" bson:"events,omitempty"`
+	Factors    []*SeverityFactor `json:"factors,omitempty" bson:"factors,omitempty"`
+	ScoredAt   *time.Time        `json:"scored_at,omitempty" bson:"scored_at,omitempty"`
+}
+
+type SeverityFactor struct {
+	Factor       *string  `json:"factor,omitempty" bson:"factor,omitempty"`
+	Value        *float64 `json:"value,omitempty" bson:"value,omitempty"`
+	Weight       *float64 `json:"weight,omitempty" bson:"weight,omitempty"`
+	Contribution *float64 `json:"contribution,omitempty" bson:"contribution,omitempty"`
+	Detail       *string  `json:"detail,omitempty" bson:"detail,omitempty"`
 }
 
 type AssetNetloc struct {
@@ -153,47 +175,28 @@ type TagPair struct {
 	Value *string `json:"value,omitempty" bson:"value,omitempty"`
 }
 
-type Event struct {
-	ID                *string    `json:"id,omitempty" bson:"_id,omitempty"`
-	CaseID            *string    `json:"case_id" bson:"case_id,omitempty"`
-	AssetID           *string    `json:"asset_id,omitempty" bson:"asset_id,omitempty"`
-	IncidentID        *string    `json:"incident_id,omitempty" bson:"incident_id,omitempty"`
-	Url               *string    `json:"url,omitempty" bson:"url,omitempty"`
-	Title             *string    `json:"title,omitempty" bson:"title,omitempty"`
-	SourceType        *string    `json:"source_type,omitempty" bson:"source_type,omitempty"`
-	SourceContentType *string    `json:"source_content_type,omitempty" bson:"source_content_type,omitempty"`
-	SourceNetwork     *string    `json:"source_network,omitempty" bson:"source_network,omitempty"`
-	Type              *string    `json:"type,omitempty" bson:"type,omitempty"`
-	Site              *string    `json:"site,omitempty" bson:"site,omitempty"`
-	ThreatLevel       *int64     `json:"threat_level,omitempty" bson:"threat_level,omitempty"`
-	CreatedAt         *time.Time `json:"created_at,omitempty" bson:"created_at,omitempty"`
-	ConfidenceScore   *int64     `json:"confidence_score,omitempty" bson:"confidence_score,omitempty"`
-}
-
 type ErrorResponse struct {
 	Code    int    `json:"code,omitempty"`
 	Message string `json:"message,omitempty"`
 }
 
 func (data Asset) GetName() string {
-	var name string
-	if data.Name.Common != nil {
-		name = *data.Name.Common
-	} else {
-		if data.Name.Last != nil {
-			name = *data.Name.Last
-		}
+	if data.Name == nil {
+		return ""
+	}
 
-		if data.Name.Middle != nil {
-			name += " " + *data.Name.Middle
-		}
+	if data.Name.Common != nil {
+		return *data.Name.Common
+	}
 
-		if data.Name.First != nil {
-			name += " " + *data.Name.First
+	var parts []string
+	for _, part := range []*string{data.Name.First, data.Name.Middle, data.Name.Last} {
+		if part != nil && *part != "" {
+			parts = append(parts, *part)
 		}
 	}
 
-	return name
+	return strings.Join(parts, " ")
 }
 
 func ServeError(message string, code int) events.APIGatewayProxyResponse {
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type ThreatActor struct {
+	ID          *string
+	Name        *string
+	Description *string
+}
+
+// FormatTitle fills the %s of a legacy template with as many of the values as it has room for.
+func FormatTitle(template string, values ...string) string {
+	n := strings.Count(template, "%s")
+
+	args := make([]interface{}, n)
+	for i := range args {
+		if i < len(values) {
+			args[i] = values[i]
+		} else {
+			args[i] = ""
+		}
+	}
+
+	return fmt.Sprintf(template, args...)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	MongoClient *mongo.Client
+
+	//incident type fields the engine renders
+	templateFields = []string{"title", "description", "recommendation"}
+)
+
+type Strings []string
+
+// MigrateOptions is read from the detail of the event the migration is invoked with.
+type MigrateOptions struct {
+	DryRun bool `json:"dry_run"`
+}
+
+type TemplateChange struct {
+	Class string `json:"class"`
+	Field string `json:"field"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+}
+
+type MigrateReport struct {
+	DryRun   bool              `json:"dry_run,omitempty"`
+	Types    int64             `json:"types"`
+	Migrated int64             `json:"migrated"`
+	Changes  []*TemplateChange `json:"changes,omitempty"`
+	Errors   []string          `json:"errors,omitempty"`
+}
+
+func main() {
+	lambda.Start(Handler)
+}
+
+func Init() error {
+	var err error
+
+	err = ReuseMongo()
+	if err != nil {
+		return err
+	}
+
+	return err
+}
+
+func ReuseMongo() error {
+	if MongoClient != nil {
+		return nil
+	} else {
+		var err error
+		ctx := context.Background()
+
+		uri := "mongodb://192.168.0.229:27017"
+
+		MongoClient, err = mongo.Connect(ctx, options.Client().ApplyURI(uri))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Migrate rewrites the %s templates of the incident types with named variables. The old
+// templates are kept under legacy_templates, and types already migrated are left alone, so
+// it can run again safely.
+func Migrate(ctx context.Context, dry_run bool) (MigrateReport, error) {
+	report := MigrateReport{DryRun: dry_run}
+
+	res, err := MongoClient.Database("fyeo-di").Collection("incident_types").Find(ctx, bson.D{})
+	if err != nil {
+		return report, err
+	}
+	defer res.Close(ctx)
+
+	for res.Next(ctx) {
+		report.Types++
+
+		var doc struct {
+			ID    primitive.ObjectID `bson:"_id"`
+			Class string             `bson:"class"`
+		}
+		err := res.Decode(&doc)
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			continue
+		}
+
+		set := bson.M{}
+		for _, field := range templateFields {
+			text, ok := res.Current.Lookup(field).StringValueOK()
+			if !ok || !IsLegacyTemplate(text) {
+				continue
+			}
+
+			migrated, err := MigrateTemplate(text)
+			if err == nil {
+				err = ValidateTemplate(migrated)
+			}
+			if err != nil {
+				report.Errors = append(report.Errors, doc.Class+" "+field+": "+err.Error())
+				continue
+			}
+
+			set[field] = migrated
+			set["legacy_templates."+field] = text
+			report.Changes = append(report.Changes, &TemplateChange{Class: doc.Class, Field: field, From: text, To: migrated})
+		}
+
+		if len(set) == 0 {
+			continue
+		}
+		report.Migrated++
+
+		if dry_run {
+			continue
+		}
+
+		_, err = MongoClient.Database("fyeo-di").Collection("incident_types").UpdateOne(ctx, bson.M{"_id": doc.ID}, bson.M{"$set": set})
+		if err != nil {
+			report.Errors = append(report.Errors, doc.Class+": "+err.Error())
+		}
+	}
+
+	return report, res.Err()
+}
+
+func Handler(ctx context.Context, event events.CloudWatchEvent) (MigrateReport, error) {
+	var opts MigrateOptions
+	if len(event.Detail) > 0 {
+		err := json.Unmarshal(event.Detail, &opts)
+		if err != nil {
+			return MigrateReport{}, err
+		}
+	}
+
+	err := Init()
+	if err != nil {
+		return MigrateReport{}, err
+	}
+
+	report, err := Migrate(ctx, opts.DryRun)
+	if err != nil {
+		return report, err
+	}
+
+	log.Printf("checked %d incident types, migrated %d, dry run: %t", report.Types, report.Migrated, report.DryRun)
+	if len(report.Errors) > 0 {
+		log.Printf("errors: %s", strings.Join(report.Errors, "; "))
+	}
+
+	return report, nil
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"net/url"
 	"reflect"
 	"strings"
@@ -71,6 +72,9 @@ type Incident struct {
 	IsReported     *bool      `json:"is_reported,omitempty" bson:"is_reported,omitempty"`
 	EventIDs       *Strings   `json:"event_ids,omitempty" bson:"event_ids,omitempty"`
 	Events         []*Event   `json:"events,omitempty" bson:"-"`
+
+	//worked out from the events, never written from a request
+	SeverityScore *SeverityScore `json:"severity_score,omitempty" bson:"-"`
 }
 
 type AssetNetloc struct {
@@ -177,24 +181,22 @@ type ErrorResponse struct {
 }
 
 func (data Asset) GetName() string {
-	var name string
-	if data.Name.Common != nil {
-		name = *data.Name.Common
-	} else {
-		if data.Name.Last != nil {
-			name = *data.Name.Last
-		}
+	if data.Name == nil {
+		return ""
+	}
 
-		if data.Name.Middle != nil {
-			name += " " + *data.Name.Middle
-		}
+	if data.Name.Common != nil {
+		return *data.Name.Common
+	}
 
-		if data.Name.First != nil {
-			name += " " + *data.Name.First
+	var parts []string
+	for _, part := range []*string{data.Name.First, data.Name.Middle, data.Name.Last} {
+		if part != nil && *part != "" {
+			parts = append(parts, *part)
 		}
 	}
 
-	return name
+	return strings.Join(parts, " ")
 }
 
 func ServeError(message string, code int) events.APIGatewayProxyResponse {
@@ -1055,6 +1057,14 @@ func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 		return ServeError(err.Error(), 400), nil
 	}
 
+	//attached events change the suggested severity, the analyst's severity is left as set
+	if input.EventIDs != nil {
+		_, err := ScoreIncident(context.Background(), id, time.Now())
+		if err != nil {
+			log.Printf("unable to score incident %s: %s", id, err.Error())
+		}
+	}
+
 	return events.APIGatewayProxyResponse{
 		Body:       "",
 		StatusCode: 200,
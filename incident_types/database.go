@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type AssetName struct {
+	Common *string `json:"common,omitempty" bson:"common,omitempty"`
+	First  *string `json:"first,omitempty" bson:"first,omitempty"`
+	Middle *string `json:"middle,omitempty" bson:"middle,omitempty"`
+	Last   *string `json:"last,omitempty" bson:"last,omitempty"`
+}
+
+type Asset struct {
+	ID          *string    `json:"id,omitempty" bson:"_id,omitempty"`
+	Type        *string    `json:"type,omitempty" bson:"type,omitempty"`
+	AssetType   *string    `json:"asset_type,omitempty" bson:"asset_type,omitempty"`
+	Name        *AssetName `json:"name,omitempty" bson:"name,omitempty"`
+	Description *string    `json:"description,omitempty" bson:"description,omitempty"`
+}
+
+type ThreatActor struct {
+	ID          *string
+	Name        *string
+	Description *string
+}
+
+// GetName is the common name of organisations and domains and the full name of people.
+func (a Asset) GetName() string {
+	t := a.Type
+	if t == nil {
+		t = a.AssetType
+	}
+
+	if t == nil || a.Name == nil {
+		return "unknown"
+	}
+
+	switch *t {
+	case "organisation", "organization", "domain":
+		if a.Name.Common != nil {
+			return *a.Name.Common
+		}
+	case "person":
+		var parts []string
+		for _, p := range []*string{a.Name.First, a.Name.Middle, a.Name.Last} {
+			if p != nil && *p != "" {
+				parts = append(parts, *p)
+			}
+		}
+		if len(parts) > 0 {
+			return strings.Join(parts, " ")
+		}
+	}
+
+	return "unknown"
+}
+
+func (threat_actor_info *ThreatActor) GetName() string {
+	if threat_actor_info.Name != nil {
+		return *threat_actor_info.Name
+	} else {
+		return "unknown"
+	}
+}
+
+func GetThreatActorInfo(ctx context.Context, id string) (ThreatActor, error) {
+	var out ThreatActor
+	o_id, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return out, err
+	}
+
+	var doc Asset
+	err = MongoClient.Database("fyeo-di").Collection("assets").FindOne(ctx, bson.M{"_id": o_id, "is_threat_actor": true}).Decode(&doc)
+	if err != nil {
+		return out, err
+	}
+
+	name := doc.GetName()
+
+	return ThreatActor{
+		ID:          &id,
+		Name:        &name,
+		Description: doc.Description,
+	}, nil
+}
+
+// Render fills the templates of the incident type, a type without a title is named after
+// its class.
+func (t IncidentType) Render(data TemplateData) (*string, *string, *string, error) {
+	var out [3]*string
+
+	for i, text := range []*string{t.Title, t.Description, t.Recommendation} {
+		if text == nil {
+			continue
+		}
+
+		v, err := RenderTemplate(*text, data)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		out[i] = &v
+	}
+
+	if out[0] == nil {
+		title := data.IncidentType
+		out[0] = &title
+	}
+
+	return out[0], out[1], out[2], nil
+}
+
+// FormatTitle fills the %s of a legacy template with as many of the values as it has room for.
+func FormatTitle(template string, values ...string) string {
+	n := strings.Count(template, "%s")
+
+	args := make([]interface{}, n)
+	for i := range args {
+		if i < len(values) {
+			args[i] = values[i]
+		} else {
+			args[i] = ""
+		}
+	}
+
+	return fmt.Sprintf(template, args...)
+}
@@ -3,16 +3,23 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/url"
+	"strings"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+const (
+	STAFF_GROUP = "staff"
+)
+
 type Strings []string
 
 type IncidentType struct {
@@ -25,7 +32,25 @@ type IncidentType struct {
 	Description    *string `json:"description,omitempty" bson:"description,omitempty"`
 }
 
+// PreviewRequest renders an incident type, stored or as edited, against an event, stored or
+// given in full, or the sample event otherwise.
+type PreviewRequest struct {
+	Class        *string       `json:"class,omitempty"`
+	IncidentType *IncidentType `json:"incident_type,omitempty"`
+	EventID      *string       `json:"event_id,omitempty"`
+	Event        *Event        `json:"event,omitempty"`
+	Source       *string       `json:"source,omitempty"`
+}
+
+type PreviewResponse struct {
+	Title          *string      `json:"title,omitempty"`
+	Description    *string      `json:"description,omitempty"`
+	Recommendation *string      `json:"recommendation,omitempty"`
+	Variables      TemplateData `json:"variables"`
+}
+
 var (
+	gMap        = make(map[string]bool)
 	MongoClient *mongo.Client
 
 	defaultHeaders = map[string]string{
@@ -103,6 +128,159 @@ func ServeError(message string, code int) events.APIGatewayProxyResponse {
 	}
 }
 
+func VerifyRequest(request events.APIGatewayProxyRequest) error {
+	//the container is reused between requests, groups from an earlier caller must not carry over
+	gMap = make(map[string]bool)
+
+	claims := request.RequestContext.Authorizer["claims"]
+	if claims == nil {
+		return errors.New("No claims found for " + request.RequestContext.Identity.CognitoIdentityID)
+	}
+
+	c := claims.(map[string]interface{})
+
+	rg := c["cognito:groups"]
+	if rg == nil {
+		return errors.New("No group permissions set")
+	}
+
+	for _, g := range strings.Split(rg.(string), ",") {
+		gMap[g] = true
+	}
+
+	return nil
+}
+
+func IsStaff() bool {
+	return gMap[STAFF_GROUP]
+}
+
+// Validate checks the templates of the incident type before it is saved.
+func (t IncidentType) Validate() error {
+	if t.Class == nil || *t.Class == "" {
+		return errors.New("Incident type must contain class")
+	}
+
+	if t.Severity != nil && (*t.Severity < 0 || *t.Severity > 5) {
+		return errors.New("severity must be between 0 and 5")
+	}
+
+	fields := map[string]*string{"title": t.Title, "description": t.Description, "recommendation": t.Recommendation}
+	for name, text := range fields {
+		if text == nil {
+			continue
+		}
+
+		err := ValidateTemplate(*text)
+		if err != nil {
+			return errors.New(name + ": " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+func GetIncidentType(ctx context.Context, class string) (IncidentType, error) {
+	var out IncidentType
+	err := MongoClient.Database("fyeo-di").Collection("incident_types").FindOne(ctx, bson.M{"class": class}).Decode(&out)
+	return out, err
+}
+
+// SaveIncidentType creates the incident type of the class or updates the fields given.
+func SaveIncidentType(ctx context.Context, t IncidentType) (IncidentType, error) {
+	t.ID = nil
+
+	_, err := MongoClient.Database("fyeo-di").Collection("incident_types").UpdateOne(ctx, bson.M{"class": *t.Class}, bson.M{"$set": t}, options.Update().SetUpsert(true))
+	if err != nil {
+		return t, err
+	}
+
+	return GetIncidentType(ctx, *t.Class)
+}
+
+func GetEvent(ctx context.Context, id string) (Event, error) {
+	var out Event
+	o_id, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return out, err
+	}
+
+	err = MongoClient.Database("fyeo-di").Collection("events").FindOne(ctx, bson.M{"_id": o_id}).Decode(&out)
+	return out, err
+}
+
+// Preview renders the incident type the way the rules engine would for the event.
+func Preview(ctx context.Context, input PreviewRequest) (PreviewResponse, error) {
+	var out PreviewResponse
+
+	var t IncidentType
+	switch {
+	case input.IncidentType != nil:
+		t = *input.IncidentType
+	case input.Class != nil:
+		var err error
+		t, err = GetIncidentType(ctx, *input.Class)
+		if err == mongo.ErrNoDocuments {
+			return out, errors.New("No incident type " + *input.Class)
+		}
+		if err != nil {
+			return out, err
+		}
+	default:
+		return out, errors.New("Request must contain class or incident_type")
+	}
+
+	data := SampleTemplateData()
+
+	var event *Event
+	if input.EventID != nil {
+		e, err := GetEvent(ctx, *input.EventID)
+		if err != nil {
+			return out, err
+		}
+		event = &e
+	} else if input.Event != nil {
+		event = input.Event
+	}
+
+	if event != nil {
+		source := templateString(event.Site)
+		if input.Source != nil {
+			source = *input.Source
+		}
+
+		var threat_actor ThreatActor
+		if event.ThreatActors != nil && len(*event.ThreatActors) > 0 {
+			threat_actor, _ = GetThreatActorInfo(ctx, (*event.ThreatActors)[0])
+		}
+
+		data = NewTemplateData(*event, source, threat_actor)
+	} else if input.Source != nil {
+		data.Source = *input.Source
+	}
+
+	data.IncidentType = templateString(t.Class)
+	//no rule is behind a preview
+	data.Rule = ""
+	if t.Severity != nil {
+		data.Severity = *t.Severity
+	}
+
+	title, description, recommendation, err := t.Render(data)
+	if err != nil {
+		return out, err
+	}
+
+	out.Title = title
+	out.Description = description
+	out.Recommendation = recommendation
+	out.Variables = data
+
+	return out, nil
+}
+
+// Handler lists the incident types on GET. Staff save one with POST /incident_types and
+// preview one against an event with POST /incident_types/preview.
 func Handler(rctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	var err error
 
@@ -111,6 +289,58 @@ func Handler(rctx context.Context, request events.APIGatewayProxyRequest) (event
 		return ServeError(err.Error(), 400), nil
 	}
 
+	if request.HTTPMethod == "POST" {
+		err = VerifyRequest(request)
+		if err != nil {
+			return ServeError(err.Error(), 400), nil
+		}
+
+		if !IsStaff() {
+			return ServeError("Only staff can change incident types", 403), nil
+		}
+
+		var out interface{}
+		if strings.HasSuffix(request.Resource, "/preview") {
+			var input PreviewRequest
+			err = json.Unmarshal([]byte(request.Body), &input)
+			if err != nil {
+				return ServeError(err.Error(), 400), nil
+			}
+
+			out, err = Preview(rctx, input)
+			if err != nil {
+				return ServeError(err.Error(), 400), nil
+			}
+		} else {
+			var input IncidentType
+			err = json.Unmarshal([]byte(request.Body), &input)
+			if err != nil {
+				return ServeError(err.Error(), 400), nil
+			}
+
+			err = input.Validate()
+			if err != nil {
+				return ServeError(err.Error(), 400), nil
+			}
+
+			out, err = SaveIncidentType(rctx, input)
+			if err != nil {
+				return ServeError(err.Error(), 400), nil
+			}
+		}
+
+		js, err := json.Marshal(out)
+		if err != nil {
+			return ServeError(err.Error(), 400), nil
+		}
+
+		return events.APIGatewayProxyResponse{
+			Body:       string(js),
+			StatusCode: 200,
+			Headers:    defaultHeaders,
+		}, nil
+	}
+
 	res, err := MongoClient.Database("fyeo-di").Collection("incident_types").Find(context.Background(), bson.D{})
 	if err != nil {
 		return ServeError(err.Error(), 400), nil
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const EARTH_RADIUS_KM = 6378.1
+
+// GeoPoint is a GeoJSON point. Coordinates are ordered [lng, lat] as GeoJSON requires.
+type GeoPoint struct {
+	Type        *string   `json:"type,omitempty" bson:"type,omitempty"`
+	Coordinates []float64 `json:"coordinates,omitempty" bson:"coordinates,omitempty"`
+}
+
+func parseFloats(input string, n int) ([]float64, error) {
+	parts := strings.Split(input, ",")
+	if len(parts) != n {
+		return nil, errors.New("Expected " + strconv.Itoa(n) + " comma separated numbers: " + input)
+	}
+
+	var out []float64
+	for _, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return nil, errors.New("Invalid number: " + p)
+		}
+		out = append(out, f)
+	}
+
+	return out, nil
+}
+
+func validLatLng(lat float64, lng float64) error {
+	if lat < -90 || lat > 90 {
+		return errors.New("Invalid latitude: " + strconv.FormatFloat(lat, 'f', -1, 64))
+	}
+
+	if lng < -180 || lng > 180 {
+		return errors.New("Invalid longitude: " + strconv.FormatFloat(lng, 'f', -1, 64))
+	}
+
+	return nil
+}
+
+// NearFilter matches located assets within radius_km of a "lat,lng" point.
+func NearFilter(near string, radius string) (bson.M, error) {
+	point, err := parseFloats(near, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validLatLng(point[0], point[1])
+	if err != nil {
+		return nil, err
+	}
+
+	radius_km, err := strconv.ParseFloat(radius, 64)
+	if err != nil || radius_km <= 0 {
+		return nil, errors.New("radius_km must be a positive number")
+	}
+
+	return bson.M{"location.geo": bson.M{
+		"$geoWithin": bson.M{
+			"$centerSphere": bson.A{bson.A{point[1], point[0]}, radius_km / EARTH_RADIUS_KM},
+		},
+	}}, nil
+}
+
+// WithinFilter matches located assets inside a "minLng,minLat,maxLng,maxLat" bounding box.
+func WithinFilter(bbox string) (bson.M, error) {
+	b, err := parseFloats(bbox, 4)
+	if err != nil {
+		return nil, err
+	}
+
+	min_lng, min_lat, max_lng, max_lat := b[0], b[1], b[2], b[3]
+
+	err = validLatLng(min_lat, min_lng)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validLatLng(max_lat, max_lng)
+	if err != nil {
+		return nil, err
+	}
+
+	if min_lng >= max_lng || min_lat >= max_lat {
+		return nil, errors.New("Bounding box must be ordered minLng,minLat,maxLng,maxLat")
+	}
+
+	ring := bson.A{
+		bson.A{min_lng, min_lat},
+		bson.A{max_lng, min_lat},
+		bson.A{max_lng, max_lat},
+		bson.A{min_lng, max_lat},
+		bson.A{min_lng, min_lat},
+	}
+
+	return bson.M{"location.geo": bson.M{
+		"$geoWithin": bson.M{
+			"$geometry": bson.M{"type": "Polygon", "coordinates": bson.A{ring}},
+		},
+	}}, nil
+}
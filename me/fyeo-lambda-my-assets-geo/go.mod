@@ -0,0 +1,8 @@
+module fyeo-lambda-my-assets-geo
+
+go 1.16
+
+require (
+	github.com/aws/aws-lambda-go v1.26.0
+	go.mongodb.org/mongo-driver v1.4.0-beta2.0.20211117233819-48ca24629ba8
+)
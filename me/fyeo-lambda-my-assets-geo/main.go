@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	groups      []string
+	gMap        = make(map[string]bool)
+	MongoClient *mongo.Client
+
+	defaultHeaders = map[string]string{
+		"Content-Type":                 "application/json",
+		"Access-Control-Allow-Headers": "*",
+		"Access-Control-Allow-Origin":  "*",
+		"Access-Control-Allow-Methods": "GET, OPTIONS",
+		"Allow":                        "GET, OPTIONS",
+	}
+)
+
+type Strings []string
+
+type Case struct {
+	ID           *string  `json:"id,omitempty" bson:"_id,omitempty"`
+	Name         *string  `json:"name,omitempty" bson:"name,omitempty"`
+	Evidence     *bool    `json:"evidence,omitempty" bson:"evidence,omitempty"` //not sure what this is for?
+	Emails       *Strings `json:"emails,omitempty" bson:"emails,omitempty"`
+	AlertLevel   *int64   `json:"alert_level,omitempty" bson:"alert_level,omitempty"`
+	Group        *string  `json:"group,omitempty" bson:"group,omitempty"`
+	ShouldNotify *bool    `json:"should_notify,omitempty" bson:"should_notify,omitempty"`
+}
+
+type AssetName struct {
+	Common *string `json:"common,omitempty" bson:"common,omitempty"`
+	First  *string `json:"first,omitempty" bson:"first,omitempty"`
+	Last   *string `json:"last,omitempty" bson:"last,omitempty"`
+	Middle *string `json:"middle,omitempty" bson:"middle,omitempty"`
+	Nick   *string `json:"nick,omitempty" bson:"nick,omitempty"`
+}
+
+type AssetLocation struct {
+	Country    *string   `json:"country,omitempty" bson:"country,omitempty"`
+	PostalTown *string   `json:"postal_town,omitempty" bson:"postal_town,omitempty"`
+	Geo        *GeoPoint `json:"geo,omitempty" bson:"geo,omitempty"`
+}
+
+type Asset struct {
+	ID            *string        `json:"id,omitempty" bson:"_id,omitempty"`
+	CaseID        *string        `json:"case_id,omitempty" bson:"case_id,omitempty"`
+	Name          *AssetName     `json:"name,omitempty" bson:"name,omitempty"`
+	Type          *string        `json:"type,omitempty" bson:"type,omitempty"`
+	IsActive      *bool          `json:"is_active,omitempty" bson:"is_active,omitempty"`
+	IsThreatActor *bool          `json:"is_threat_actor,omitempty" bson:"is_threat_actor,omitempty"`
+	Location      *AssetLocation `json:"location,omitempty" bson:"location,omitempty"`
+}
+
+type Incident struct {
+	ID        *string  `json:"id,omitempty" bson:"_id,omitempty"`
+	TargetIDs *Strings `json:"target_ids,omitempty" bson:"target_ids,omitempty"`
+}
+
+type FeatureProperties struct {
+	Name          string  `json:"name"`
+	Type          *string `json:"type,omitempty"`
+	CaseID        *string `json:"case_id,omitempty"`
+	CaseName      *string `json:"case_name,omitempty"`
+	Country       *string `json:"country,omitempty"`
+	PostalTown    *string `json:"postal_town,omitempty"`
+	IsActive      *bool   `json:"is_active,omitempty"`
+	IsThreatActor *bool   `json:"is_threat_actor,omitempty"`
+	OpenIncidents int64   `json:"open_incidents"`
+}
+
+type Feature struct {
+	Type       string            `json:"type"`
+	ID         string            `json:"id"`
+	Geometry   *GeoPoint         `json:"geometry"`
+	Properties FeatureProperties `json:"properties"`
+}
+
+type FeatureCollection struct {
+	Type     string     `json:"type"`
+	Features []*Feature `json:"features"`
+}
+
+type ErrorResponse struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+func ServeError(message string, code int) events.APIGatewayProxyResponse {
+	js, _ := json.Marshal(ErrorResponse{
+		Code:    code,
+		Message: message,
+	})
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: code,
+		Body:       string(js),
+		Headers:    defaultHeaders,
+	}
+}
+
+func main() {
+	lambda.Start(Handler)
+}
+
+func Init() error {
+	var err error
+
+	err = ReuseMongo()
+	if err != nil {
+		return err
+	}
+
+	return err
+}
+
+func UrlEncoded(str string) (string, error) {
+	u, err := url.Parse(str)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+func ReuseMongo() error {
+
+	if MongoClient != nil {
+		return nil
+	} else {
+		var err error
+		username := "stage"
+		password := "GK!2f&Wf#z&RS3"
+
+		password, err = UrlEncoded(password)
+		if err != nil {
+			return err
+		}
+
+		ctx := context.Background()
+
+		MongoClient, err = mongo.Connect(ctx, options.Client().ApplyURI(fmt.Sprintf("mongodb://%s:%s@192.168.0.17:27017/?authSource=admin&ssl=false", username, password)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func GetCases(filter bson.M) ([]Case, error) {
+	var out []Case
+
+	filter["is_archived"] = bson.M{"$ne": true}
+
+	res, err := MongoClient.Database("fyeo-di").Collection("cases").Find(context.Background(), filter)
+
+	if err != nil {
+		return out, err
+	}
+
+	for res.Next(context.Background()) {
+		var doc Case
+		err := res.Decode(&doc)
+		if err != nil {
+			return out, err
+		}
+		out = append(out, doc)
+	}
+
+	return out, nil
+}
+
+func VerifyRequest(request events.APIGatewayProxyRequest) error {
+
+	claims := request.RequestContext.Authorizer["claims"]
+	if claims == nil {
+		return errors.New("No claims found for " + request.RequestContext.Identity.CognitoIdentityID)
+	}
+
+	rg := claims.(map[string]interface{})["cognito:groups"]
+
+	if rg == nil {
+		return errors.New("No group permissions set")
+	}
+
+	groups = strings.Split(rg.(string), ",")
+
+	//warm containers keep gMap, start from nothing for every caller
+	gMap = make(map[string]bool)
+	for _, g := range groups {
+		gMap[g] = true
+	}
+
+	return nil
+}
+
+func (data Asset) GetName() string {
+	if data.Name == nil {
+		return ""
+	}
+
+	if data.Name.Common != nil {
+		return *data.Name.Common
+	}
+
+	var parts []string
+	for _, part := range []*string{data.Name.First, data.Name.Middle, data.Name.Last} {
+		if part != nil && *part != "" {
+			parts = append(parts, *part)
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func GetLocatedAssets(filter bson.M) ([]Asset, error) {
+	var out []Asset
+
+	filter["is_archived"] = bson.M{"$ne": true}
+	filter["location.geo"] = bson.M{"$exists": true}
+
+	projection := bson.M{"_id": 1, "case_id": 1, "name": 1, "type": 1, "is_active": 1, "is_threat_actor": 1, "location": 1}
+
+	res, err := MongoClient.Database("fyeo-di").Collection("assets").Find(context.Background(), filter, options.Find().SetProjection(projection))
+
+	if err != nil {
+		return out, err
+	}
+
+	for res.Next(context.Background()) {
+		var doc Asset
+		err := res.Decode(&doc)
+		if err != nil {
+			return out, err
+		}
+		out = append(out, doc)
+	}
+
+	return out, nil
+}
+
+// GetOpenIncidentCounts counts the incidents which are neither closed nor deactivated per target asset.
+func GetOpenIncidentCounts(asset_ids []string) (map[string]int64, error) {
+	out := make(map[string]int64)
+
+	if len(asset_ids) == 0 {
+		return out, nil
+	}
+
+	filter := bson.M{
+		"target_ids":  bson.M{"$in": asset_ids},
+		"is_archived": bson.M{"$ne": true},
+		"is_active":   bson.M{"$ne": false},
+		"closed_at":   nil,
+	}
+
+	res, err := MongoClient.Database("fyeo-di").Collection("incidents").Find(context.Background(), filter, options.Find().SetProjection(bson.M{"_id": 1, "target_ids": 1}))
+	if err != nil {
+		return out, err
+	}
+
+	for res.Next(context.Background()) {
+		var doc Incident
+		err := res.Decode(&doc)
+		if err != nil {
+			return out, err
+		}
+
+		if doc.TargetIDs != nil {
+			for _, target_id := range *doc.TargetIDs {
+				out[target_id]++
+			}
+		}
+	}
+
+	return out, nil
+}
+
+func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var err error
+
+	err = VerifyRequest(request)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	err = Init()
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	cases, err := GetCases(bson.M{"group": bson.M{"$in": groups}})
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	if len(cases) < 1 {
+		return ServeError("No cases found with provided group permissions", 400), nil
+	}
+
+	var case_ids []string
+	case_map := make(map[string]Case)
+	for _, c := range cases {
+		case_map[*c.ID] = c
+		case_ids = append(case_ids, *c.ID)
+	}
+
+	filter := bson.M{"case_id": bson.M{"$in": case_ids}}
+
+	q_cases, ok := request.QueryStringParameters["cases"]
+	if ok {
+		var cases_arr []string
+		for _, id := range strings.Split(q_cases, ",") {
+			_, ok := case_map[id]
+			if ok {
+				cases_arr = append(cases_arr, id)
+			}
+		}
+		filter["case_id"] = bson.M{"$in": cases_arr}
+	}
+
+	q_kind, ok := request.QueryStringParameters["type"]
+	if ok {
+		filter["type"] = q_kind
+	}
+
+	var geo_filters []bson.M
+
+	q_near, ok := request.QueryStringParameters["near"]
+	if ok {
+		near, err := NearFilter(q_near, request.QueryStringParameters["radius_km"])
+		if err != nil {
+			return ServeError(err.Error(), 400), nil
+		}
+		geo_filters = append(geo_filters, near)
+	}
+
+	q_within, ok := request.QueryStringParameters["within"]
+	if ok {
+		within, err := WithinFilter(q_within)
+		if err != nil {
+			return ServeError(err.Error(), 400), nil
+		}
+		geo_filters = append(geo_filters, within)
+	}
+
+	if len(geo_filters) > 0 {
+		filter["$and"] = geo_filters
+	}
+
+	assets, err := GetLocatedAssets(filter)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	var asset_ids []string
+	for _, a := range assets {
+		asset_ids = append(asset_ids, *a.ID)
+	}
+
+	counts, err := GetOpenIncidentCounts(asset_ids)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	out := FeatureCollection{
+		Type:     "FeatureCollection",
+		Features: []*Feature{},
+	}
+
+	for _, a := range assets {
+		properties := FeatureProperties{
+			Name:          a.GetName(),
+			Type:          a.Type,
+			CaseID:        a.CaseID,
+			IsActive:      a.IsActive,
+			IsThreatActor: a.IsThreatActor,
+			OpenIncidents: counts[*a.ID],
+		}
+
+		if a.CaseID != nil {
+			properties.CaseName = case_map[*a.CaseID].Name
+		}
+
+		properties.Country = a.Location.Country
+		properties.PostalTown = a.Location.PostalTown
+
+		out.Features = append(out.Features, &Feature{
+			Type:       "Feature",
+			ID:         *a.ID,
+			Geometry:   a.Location.Geo,
+			Properties: properties,
+		})
+	}
+
+	js, err := json.Marshal(out)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		Body:       string(js),
+		StatusCode: 200,
+		Headers:    defaultHeaders,
+	}, nil
+}
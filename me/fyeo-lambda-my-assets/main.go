@@ -92,13 +92,14 @@ type AssetWhois struct {
 }
 
 type AssetLocation struct {
-	StreetNumber *int64   `json:"street_number,omitempty" bson:"street_number,omitempty"`
-	PostalTown   *string  `json:"postal_town,omitempty" bson:"postal_town,omitempty"`
-	Country      *string  `json:"country,omitempty" bson:"country,omitempty"`
-	StreetName   *string  `json:"street_name,omitempty" bson:"street_name,omitempty"`
-	Premise      *string  `json:"premise,omitempty" bson:"premise,omitempty"`
-	Lat          *float64 `json:"lat,omitempty" bson:"lat,omitempty"`
-	Lng          *float64 `json:"lng,omitempty" bson:"lng,omitempty"`
+	StreetNumber *int64    `json:"street_number,omitempty" bson:"street_number,omitempty"`
+	PostalTown   *string   `json:"postal_town,omitempty" bson:"postal_town,omitempty"`
+	Country      *string   `json:"country,omitempty" bson:"country,omitempty"`
+	StreetName   *string   `json:"street_name,omitempty" bson:"street_name,omitempty"`
+	Premise      *string   `json:"premise,omitempty" bson:"premise,omitempty"`
+	Lat          *float64  `json:"lat,omitempty" bson:"lat,omitempty"`
+	Lng          *float64  `json:"lng,omitempty" bson:"lng,omitempty"`
+	Geo          *GeoPoint `json:"geo,omitempty" bson:"geo,omitempty"`
 }
 
 type AssetName struct {
@@ -149,6 +150,8 @@ type Asset struct {
 	//person
 	Brands *Strings `json:"brands,omitempty" bson:"brands,omitempty"`
 
+	SearchKeys []*SearchKey `json:"search_keys,omitempty" bson:"search_keys,omitempty"`
+
 	IncidentCount *int64 `json:"incident_count,omitempty" bson:"-"`
 }
 
@@ -157,6 +160,14 @@ type TagPair struct {
 	Value *string `json:"value,omitempty" bson:"value,omitempty"`
 }
 
+type SearchKey struct {
+	Value      *string `json:"value,omitempty" bson:"value,omitempty"`
+	Kind       *string `json:"kind,omitempty" bson:"kind,omitempty"`
+	Source     *string `json:"source,omitempty" bson:"source,omitempty"`
+	Manual     *bool   `json:"manual,omitempty" bson:"manual,omitempty"`
+	Suppressed *bool   `json:"suppressed,omitempty" bson:"suppressed,omitempty"`
+}
+
 type Event struct {
 	ID                *string    `json:"id,omitempty" bson:"_id,omitempty"`
 	CaseID            *string    `json:"case_id" bson:"case_id,omitempty"`
@@ -180,24 +191,22 @@ type ErrorResponse struct {
 }
 
 func (data Asset) GetName() string {
-	var name string
-	if data.Name.Common != nil {
-		name = *data.Name.Common
-	} else {
-		if data.Name.Last != nil {
-			name = *data.Name.Last
-		}
+	if data.Name == nil {
+		return ""
+	}
 
-		if data.Name.Middle != nil {
-			name += " " + *data.Name.Middle
-		}
+	if data.Name.Common != nil {
+		return *data.Name.Common
+	}
 
-		if data.Name.First != nil {
-			name += " " + *data.Name.First
+	var parts []string
+	for _, part := range []*string{data.Name.First, data.Name.Middle, data.Name.Last} {
+		if part != nil && *part != "" {
+			parts = append(parts, *part)
 		}
 	}
 
-	return name
+	return strings.Join(parts, " ")
 }
 
 func ServeError(message string, code int) events.APIGatewayProxyResponse {
@@ -1220,6 +1229,30 @@ func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 		}
 	}
 
+	var geo_filters []bson.M
+
+	q_near, ok := request.QueryStringParameters["near"]
+	if ok {
+		near, err := NearFilter(q_near, request.QueryStringParameters["radius_km"])
+		if err != nil {
+			return ServeError(err.Error(), 400), nil
+		}
+		geo_filters = append(geo_filters, near)
+	}
+
+	q_within, ok := request.QueryStringParameters["within"]
+	if ok {
+		within, err := WithinFilter(q_within)
+		if err != nil {
+			return ServeError(err.Error(), 400), nil
+		}
+		geo_filters = append(geo_filters, within)
+	}
+
+	if len(geo_filters) > 0 {
+		filter2["$and"] = geo_filters
+	}
+
 	var incident_count_min int64
 	q_incident_count_min, ok := request.QueryStringParameters["incident_count_min"]
 	if ok {
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var (
+	//query parameter and the indicator array it searches
+	indicatorParams = map[string]string{
+		"email":   "emails",
+		"ip":      "ips",
+		"crypto":  "crypto",
+		"hashtag": "hashtags",
+		"keyword": "keywords",
+		"hash":    "hashes",
+		"phone":   "phones",
+	}
+)
+
+// AnyField matches a condition against the current and legacy names of a field.
+func AnyField(canonical string, cond interface{}) map[string]interface{} {
+	names := EventFieldNames(canonical)
+	if len(names) == 1 {
+		return map[string]interface{}{canonical: cond}
+	}
+
+	var or []map[string]interface{}
+	for _, n := range names {
+		or = append(or, map[string]interface{}{n: cond})
+	}
+
+	return map[string]interface{}{"$or": or}
+}
+
+// NoField matches documents where none of the names of a field hold a value.
+func NoField(canonical string) map[string]interface{} {
+	out := make(map[string]interface{})
+	for _, n := range EventFieldNames(canonical) {
+		out[n] = nil
+	}
+	return out
+}
+
+// SplitParam splits a comma separated query parameter, dropping empty values.
+func SplitParam(input string) []string {
+	var out []string
+	for _, s := range strings.Split(input, ",") {
+		s = strings.TrimSpace(s)
+		if s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// RangeParams builds a $gte/$lte condition from a pair of optional numeric parameters.
+func RangeParams(params map[string]string, min_key string, max_key string) (map[string]interface{}, error) {
+	cond := make(map[string]interface{})
+
+	q_min, ok := params[min_key]
+	if ok {
+		min, err := strconv.ParseFloat(q_min, 64)
+		if err != nil {
+			return nil, errors.New("Invalid " + min_key + ": " + q_min)
+		}
+		cond["$gte"] = min
+	}
+
+	q_max, ok := params[max_key]
+	if ok {
+		max, err := strconv.ParseFloat(q_max, 64)
+		if err != nil {
+			return nil, errors.New("Invalid " + max_key + ": " + q_max)
+		}
+		cond["$lte"] = max
+	}
+
+	if len(cond) == 0 {
+		return nil, nil
+	}
+
+	return cond, nil
+}
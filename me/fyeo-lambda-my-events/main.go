@@ -66,14 +66,6 @@ type Incident struct {
 	CaseName  string `json:"case_name"`
 }
 
-// type Event struct {
-// 	ID          string `json:"id" bson:"_id"`
-// 	CaseID      string `json:"caseId" bson:"caseId"`
-// 	Url         string `json:"url" bson:"url"`
-// 	Title       string `json:"title" bson:"title"`
-// 	ContentHash string `json:"contentHash" bson:"contentHash"`
-// }
-
 var (
 	MongoClient *mongo.Client
 
@@ -148,6 +140,11 @@ func Handler(rctx context.Context, request events.APIGatewayProxyRequest) (event
 		gMap[g] = true
 	}
 
+	username, _ := claims.(map[string]interface{})["cognito:username"].(string)
+	if username == "" {
+		username, _ = claims.(map[string]interface{})["sub"].(string)
+	}
+
 	err = Init()
 	if err != nil {
 		return events.APIGatewayProxyResponse{
@@ -194,7 +191,6 @@ func Handler(rctx context.Context, request events.APIGatewayProxyRequest) (event
 	}
 
 	filter := map[string]interface{}{
-		"caseId": map[string]interface{}{"$in": case_ids},
 		"status": map[string]interface{}{"$ne": "archived"},
 	}
 
@@ -219,13 +215,23 @@ func Handler(rctx context.Context, request events.APIGatewayProxyRequest) (event
 					cases_arr = append(cases_arr, id)
 				}
 			}
-			filter["caseId"] = map[string]interface{}{
-				"$in": cases_arr,
-			}
+			case_ids = cases_arr
 		}
 
 	}
 
+	//legacy events hold the case under caseId, every field below is matched under both names
+	var and []map[string]interface{}
+	and = append(and, AnyField("case_id", map[string]interface{}{"$in": case_ids}))
+
+	bad_request := func(err error) events.APIGatewayProxyResponse {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       err.Error(),
+			Headers:    defaultHeaders,
+		}
+	}
+
 	q_title, ok := request.QueryStringParameters["title"]
 	if ok {
 		filter["title"] = map[string]interface{}{
@@ -234,48 +240,126 @@ func Handler(rctx context.Context, request events.APIGatewayProxyRequest) (event
 		}
 	}
 
-	q_date_from, ok := request.QueryStringParameters["date_from"]
+	for param, field := range map[string]string{
+		"site":           "site",
+		"source_network": "source_network",
+		"source_type":    "source_type",
+		"asset_id":       "asset_id",
+	} {
+		q, ok := request.QueryStringParameters[param]
+		if ok {
+			and = append(and, AnyField(field, map[string]interface{}{"$in": SplitParam(q)}))
+		}
+	}
+
+	q_event_type, ok := request.QueryStringParameters["event_type"]
 	if ok {
-		date_from, err := strconv.ParseInt(q_date_from, 10, 64)
+		in := map[string]interface{}{"$in": SplitParam(q_event_type)}
+		//monitoring events only set type
+		and = append(and, map[string]interface{}{"$or": []map[string]interface{}{
+			AnyField("event_type", in),
+			{"type": in},
+		}})
+	}
+
+	threat_level, err := RangeParams(request.QueryStringParameters, "threat_level_min", "threat_level_max")
+	if err != nil {
+		return bad_request(err), nil
+	}
+	if threat_level != nil {
+		and = append(and, AnyField("threat_level", threat_level))
+	}
+
+	confidence, err := RangeParams(request.QueryStringParameters, "confidence_min", "confidence_max")
+	if err != nil {
+		return bad_request(err), nil
+	}
+	if confidence != nil {
+		and = append(and, AnyField("confidence_score", confidence))
+	}
+
+	q_incident, ok := request.QueryStringParameters["incident"]
+	if ok {
+		switch q_incident {
+		case "linked":
+			and = append(and, AnyField("incident_id", map[string]interface{}{"$exists": true, "$nin": []interface{}{nil, ""}}))
+		case "unlinked":
+			and = append(and, NoField("incident_id"))
+		default:
+			return bad_request(errors.New("incident must be linked or unlinked")), nil
+		}
+	}
+
+	for param, field := range indicatorParams {
+		q, ok := request.QueryStringParameters[param]
+		if !ok {
+			continue
+		}
+
+		values := SplitParam(q)
+		if param == "email" {
+			for i := range values {
+				values[i] = strings.ToLower(values[i])
+			}
+		}
+
+		and = append(and, AnyField(field, map[string]interface{}{"$in": values}))
+	}
+
+	q_unseen, ok := request.QueryStringParameters["unseen"]
+	if ok {
+		unseen, err := strconv.ParseBool(q_unseen)
 		if err != nil {
-			return events.APIGatewayProxyResponse{
-				StatusCode: 400,
-				Body:       err.Error(),
-				Headers:    defaultHeaders,
-			}, nil
+			return bad_request(err), nil
+		}
+
+		if unseen {
+			filter["seen_by"] = map[string]interface{}{
+				"$ne": username,
+			}
 		}
+	}
 
-		df_unix := time.Unix(date_from, 0)
+	q_starred, ok := request.QueryStringParameters["starred"]
+	if ok {
+		starred, err := strconv.ParseBool(q_starred)
+		if err != nil {
+			return bad_request(err), nil
+		}
 
-		filter["time"] = map[string]interface{}{
-			"$gte": df_unix,
+		if starred {
+			filter["starred_by"] = username
 		}
 	}
 
+	created_at := make(map[string]interface{})
+
+	q_date_from, ok := request.QueryStringParameters["date_from"]
+	if ok {
+		date_from, err := strconv.ParseInt(q_date_from, 10, 64)
+		if err != nil {
+			return bad_request(err), nil
+		}
+
+		created_at["$gte"] = time.Unix(date_from, 0)
+	}
+
 	q_date_to, ok := request.QueryStringParameters["date_to"]
 	if ok {
 		date_to, err := strconv.ParseInt(q_date_to, 10, 64)
 		if err != nil {
-			return events.APIGatewayProxyResponse{
-				StatusCode: 400,
-				Body:       err.Error(),
-				Headers:    defaultHeaders,
-			}, nil
+			return bad_request(err), nil
 		}
 
-		dt_unix := time.Unix(date_to, 0)
+		created_at["$lte"] = time.Unix(date_to, 0)
+	}
 
-		_, ok := filter["time"]
-		if ok {
-			filter["time"].(map[string]interface{})["$lte"] = dt_unix
-		}
-		if !ok {
-			filter["time"] = map[string]interface{}{
-				"$lte": date_to,
-			}
-		}
+	if len(created_at) > 0 {
+		and = append(and, AnyField("created_at", created_at))
 	}
 
+	filter["$and"] = and
+
 	js, err := json.Marshal(filter)
 	if err != nil {
 		return events.APIGatewayProxyResponse{
@@ -306,17 +390,20 @@ func Handler(rctx context.Context, request events.APIGatewayProxyRequest) (event
 		}, nil
 	}
 
-	var data []map[string]interface{}
+	var data []Event
 	for res.Next(ctx) {
-		doc := make(map[string]interface{})
+		var doc Event
 
 		err := res.Decode(&doc)
-		if err != nil {
+		if err != nil || doc.CaseID == nil {
 			continue
 		}
 
-		doc["group"] = cases[doc["caseId"].(string)].Group
-		doc["case_name"] = cases[doc["caseId"].(string)].Name
+		ca, ok := cases[*doc.CaseID]
+		if ok {
+			doc.Group = &ca.Group
+			doc.CaseName = &ca.Name
+		}
 
 		data = append(data, doc)
 	}
@@ -0,0 +1,680 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The evaluator applies rule filters to events in memory with the semantics Mongo gives them,
+// so rules can be tried without a database. Only the operators rule filters use are supported:
+// comparisons, $in and $nin, $exists, $regex, $not, $all, $size, $elemMatch and the logical
+// operators. A field holding an array matches when the array or any of its elements does.
+
+// EventDocument is the event as stored, with the current field names.
+func EventDocument(e Event) (bson.M, error) {
+	var out bson.M
+
+	b, err := bson.Marshal(e)
+	if err != nil {
+		return out, err
+	}
+
+	err = bson.Unmarshal(b, &out)
+	return out, err
+}
+
+// CanonicalFilter renames the legacy fields of a filter, the document it is matched against
+// is always in current names.
+func CanonicalFilter(filter map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(filter))
+
+	for key, cond := range filter {
+		if key == "$or" || key == "$and" || key == "$nor" {
+			if list, ok := cond.([]interface{}); ok {
+				sub := make([]interface{}, len(list))
+				for i, c := range list {
+					if m, ok := c.(map[string]interface{}); ok {
+						sub[i] = CanonicalFilter(m)
+					} else {
+						sub[i] = c
+					}
+				}
+				cond = sub
+			}
+			out[key] = cond
+			continue
+		}
+
+		if strings.HasPrefix(key, "$") {
+			out[key] = cond
+			continue
+		}
+
+		out[FieldPaths(key)[0]] = cond
+	}
+
+	return out
+}
+
+// BaseFilter is BaseQuery for the evaluator.
+func BaseFilter(now time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"created_at":           map[string]interface{}{"$gt": now.Add(-LOOKBACK)},
+		"is_man_classified":    map[string]interface{}{"$ne": true},
+		"stop_auto_classifier": map[string]interface{}{"$ne": true},
+		"is_archived":          map[string]interface{}{"$ne": true},
+	}
+}
+
+// Matches is true when the rule would pick up the event on a run at now.
+func (rule *Rule) Matches(doc bson.M, now time.Time) (bool, error) {
+	ok, err := MatchFilter(doc, BaseFilter(now))
+	if err != nil || !ok {
+		return false, err
+	}
+
+	if rule.Action == ACTION_UPDATE {
+		ok, err := MatchFilter(doc, map[string]interface{}{"history.rule": map[string]interface{}{"$ne": rule.Name}})
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+
+	return MatchFilter(doc, CanonicalFilter(rule.Filter))
+}
+
+// Simulate makes the changes the rule would make to a matching event, so the rules after it
+// see the event as they would on a real run.
+func (rule *Rule) Simulate(doc bson.M, now time.Time) {
+	history, _ := doc["history"].(primitive.A)
+	doc["history"] = append(history, bson.M{"rule": rule.Name, "date": now})
+	doc["is_auto_classified"] = true
+
+	if rule.Action == ACTION_UPDATE {
+		for k, v := range rule.Update {
+			doc[CanonicalEventKey(k)] = v
+		}
+		return
+	}
+
+	doc["is_man_classified"] = true
+	doc["threat_level"] = rule.Params.Level()
+}
+
+// MatchingRules runs the rules over the document in order, as a run would, and returns the names
+// of the ones which match it. The document is changed as the rules would change the event.
+func MatchingRules(rules []Rule, doc bson.M, now time.Time) ([]string, error) {
+	var out []string
+
+	for i := range rules {
+		rule := &rules[i]
+
+		ok, err := rule.Matches(doc, now)
+		if err != nil {
+			return out, errors.New(rule.Name + ": " + err.Error())
+		}
+		if !ok {
+			continue
+		}
+
+		out = append(out, rule.Name)
+		rule.Simulate(doc, now)
+	}
+
+	return out, nil
+}
+
+// MatchFilter evaluates a Mongo query document against a document.
+func MatchFilter(doc bson.M, filter map[string]interface{}) (bool, error) {
+	for key, cond := range filter {
+		var ok bool
+		var err error
+
+		switch key {
+		case "$and", "$or", "$nor":
+			ok, err = matchLogical(doc, key, cond)
+		default:
+			if strings.HasPrefix(key, "$") {
+				return false, errors.New("Unsupported operator " + key)
+			}
+			values, found := lookupPath(doc, strings.Split(key, "."))
+			ok, err = matchCondition(values, found, cond)
+		}
+
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func matchLogical(doc bson.M, op string, cond interface{}) (bool, error) {
+	list, ok := cond.([]interface{})
+	if !ok {
+		return false, errors.New(op + " must be a list")
+	}
+
+	for _, c := range list {
+		sub, ok := asMap(c)
+		if !ok {
+			return false, errors.New(op + " must be a list of documents")
+		}
+
+		ok, err := MatchFilter(doc, sub)
+		if err != nil {
+			return false, err
+		}
+
+		switch {
+		case op == "$and" && !ok:
+			return false, nil
+		case op == "$or" && ok:
+			return true, nil
+		case op == "$nor" && ok:
+			return false, nil
+		}
+	}
+
+	return op != "$or", nil
+}
+
+func asMap(v interface{}) (map[string]interface{}, bool) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		return t, true
+	case bson.M:
+		return t, true
+	case bson.D:
+		return t.Map(), true
+	}
+	return nil, false
+}
+
+func asList(v interface{}) ([]interface{}, bool) {
+	switch t := v.(type) {
+	case []interface{}:
+		return t, true
+	case primitive.A:
+		return t, true
+	case []string:
+		out := make([]interface{}, len(t))
+		for i := range t {
+			out[i] = t[i]
+		}
+		return out, true
+	}
+	return nil, false
+}
+
+// lookupPath returns the values at a dotted path. Arrays of documents are walked into, so
+// cuts.cut is the cut of every cut, and a numeric part indexes the array.
+func lookupPath(v interface{}, parts []string) ([]interface{}, bool) {
+	if len(parts) == 0 {
+		return []interface{}{v}, true
+	}
+
+	if m, ok := asMap(v); ok {
+		next, ok := m[parts[0]]
+		if !ok {
+			return nil, false
+		}
+		return lookupPath(next, parts[1:])
+	}
+
+	list, ok := asList(v)
+	if !ok {
+		return nil, false
+	}
+
+	if i, err := strconv.Atoi(parts[0]); err == nil {
+		if i < 0 || i >= len(list) {
+			return nil, false
+		}
+		return lookupPath(list[i], parts[1:])
+	}
+
+	var out []interface{}
+	found := false
+	for _, el := range list {
+		vals, ok := lookupPath(el, parts)
+		if ok {
+			out = append(out, vals...)
+			found = true
+		}
+	}
+
+	return out, found
+}
+
+// expand adds the elements of array values, the candidates an operator is tried against.
+func expand(values []interface{}) []interface{} {
+	var out []interface{}
+	for _, v := range values {
+		out = append(out, v)
+		if list, ok := asList(v); ok {
+			out = append(out, list...)
+		}
+	}
+	return out
+}
+
+func isOperatorDocument(cond interface{}) (map[string]interface{}, bool) {
+	m, ok := asMap(cond)
+	if !ok || len(m) == 0 {
+		return nil, false
+	}
+
+	for k := range m {
+		if !strings.HasPrefix(k, "$") {
+			return nil, false
+		}
+	}
+
+	return m, true
+}
+
+func matchCondition(values []interface{}, found bool, cond interface{}) (bool, error) {
+	ops, ok := isOperatorDocument(cond)
+	if !ok {
+		return matchEqual(values, found, cond)
+	}
+
+	for op, arg := range ops {
+		if op == "$options" {
+			continue
+		}
+
+		ok, err := matchOperator(values, found, op, arg, ops)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func matchEqual(values []interface{}, found bool, target interface{}) (bool, error) {
+	if target == nil && !found {
+		return true, nil
+	}
+
+	if re, ok := target.(primitive.Regex); ok {
+		return matchRegex(values, re.Pattern, re.Options)
+	}
+
+	for _, v := range expand(values) {
+		if equal(v, target) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func matchOperator(values []interface{}, found bool, op string, arg interface{}, ops map[string]interface{}) (bool, error) {
+	switch op {
+	case "$eq":
+		return matchEqual(values, found, arg)
+	case "$ne":
+		ok, err := matchEqual(values, found, arg)
+		return !ok, err
+	case "$gt", "$gte", "$lt", "$lte":
+		return matchCompare(values, op, arg), nil
+	case "$in", "$nin":
+		list, ok := asList(arg)
+		if !ok {
+			return false, errors.New(op + " must be a list")
+		}
+		in := false
+		for _, target := range list {
+			ok, err := matchEqual(values, found, target)
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				in = true
+				break
+			}
+		}
+		return in == (op == "$in"), nil
+	case "$exists":
+		return found == truthy(arg), nil
+	case "$regex":
+		options, _ := ops["$options"].(string)
+		switch t := arg.(type) {
+		case string:
+			return matchRegex(values, t, options)
+		case primitive.Regex:
+			return matchRegex(values, t.Pattern, t.Options+options)
+		}
+		return false, errors.New("$regex must be a string")
+	case "$not":
+		var ok bool
+		var err error
+		if re, isRegex := arg.(primitive.Regex); isRegex {
+			ok, err = matchRegex(values, re.Pattern, re.Options)
+		} else if _, isOps := isOperatorDocument(arg); isOps {
+			ok, err = matchCondition(values, found, arg)
+		} else {
+			return false, errors.New("$not must be a regex or an operator document")
+		}
+		return !ok, err
+	case "$size":
+		n, ok := toFloat(arg)
+		if !ok {
+			return false, errors.New("$size must be a number")
+		}
+		for _, v := range values {
+			if list, ok := asList(v); ok && float64(len(list)) == n {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$all":
+		list, ok := asList(arg)
+		if !ok {
+			return false, errors.New("$all must be a list")
+		}
+		if len(list) == 0 {
+			return false, nil
+		}
+		for _, target := range list {
+			ok, err := matchEqual(values, found, target)
+			if err != nil || !ok {
+				return false, err
+			}
+		}
+		return true, nil
+	case "$elemMatch":
+		for _, v := range values {
+			list, ok := asList(v)
+			if !ok {
+				continue
+			}
+			for _, el := range list {
+				ok, err := matchElement(el, arg)
+				if err != nil {
+					return false, err
+				}
+				if ok {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	}
+
+	return false, errors.New("Unsupported operator " + op)
+}
+
+// matchElement applies an $elemMatch condition, operators for scalar elements and a query
+// for embedded documents.
+func matchElement(el interface{}, cond interface{}) (bool, error) {
+	if _, ok := isOperatorDocument(cond); ok {
+		return matchCondition([]interface{}{el}, true, cond)
+	}
+
+	m, ok := asMap(cond)
+	if !ok {
+		return false, errors.New("$elemMatch must be a document")
+	}
+
+	doc, ok := asMap(el)
+	if !ok {
+		return false, nil
+	}
+
+	return MatchFilter(bson.M(doc), m)
+}
+
+func truthy(v interface{}) bool {
+	if b, ok := v.(bool); ok {
+		return b
+	}
+	if n, ok := toFloat(v); ok {
+		return n != 0
+	}
+	return v != nil
+}
+
+func isRegexSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+// ExtendedPattern takes the whitespace and # comments out of a pattern written for the x
+// option, as Mongo does. Whitespace inside a character class or escaped with \ is kept.
+func ExtendedPattern(pattern string) string {
+	var b strings.Builder
+	in_class := false
+
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+
+		switch {
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			//Go rejects an escaped space, once the pattern is no longer extended a plain one is the same
+			if !isRegexSpace(pattern[i]) {
+				b.WriteByte(c)
+			}
+			b.WriteByte(pattern[i])
+		case in_class:
+			if c == ']' {
+				in_class = false
+			}
+			b.WriteByte(c)
+		case c == '[':
+			in_class = true
+			b.WriteByte(c)
+			//a ] right after the opening bracket is part of the class
+			if i+1 < len(pattern) && pattern[i+1] == '^' {
+				i++
+				b.WriteByte('^')
+			}
+			if i+1 < len(pattern) && pattern[i+1] == ']' {
+				i++
+				b.WriteByte(']')
+			}
+		case isRegexSpace(c):
+		case c == '#':
+			for i+1 < len(pattern) && pattern[i+1] != '\n' {
+				i++
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
+
+// CompileRegex compiles a pattern with Mongo's regex options. i, m and s are Go's flags of the
+// same name, x is applied to the pattern itself.
+func CompileRegex(pattern string, options string) (*regexp.Regexp, error) {
+	var flags string
+	for _, o := range options {
+		if o == 'i' || o == 'm' || o == 's' {
+			flags += string(o)
+		}
+	}
+
+	if strings.ContainsRune(options, 'x') {
+		pattern = ExtendedPattern(pattern)
+	}
+
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+
+	return regexp.Compile(pattern)
+}
+
+func matchRegex(values []interface{}, pattern string, options string) (bool, error) {
+	re, err := CompileRegex(pattern, options)
+	if err != nil {
+		return false, err
+	}
+
+	for _, v := range expand(values) {
+		if s, ok := v.(string); ok && re.MatchString(s) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func matchCompare(values []interface{}, op string, target interface{}) bool {
+	for _, v := range expand(values) {
+		c, ok := compare(v, target)
+		if !ok {
+			continue
+		}
+
+		switch {
+		case op == "$gt" && c > 0, op == "$gte" && c >= 0, op == "$lt" && c < 0, op == "$lte" && c <= 0:
+			return true
+		}
+	}
+
+	return false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch t := v.(type) {
+	case int:
+		return float64(t), true
+	case int32:
+		return float64(t), true
+	case int64:
+		return float64(t), true
+	case uint:
+		return float64(t), true
+	case uint32:
+		return float64(t), true
+	case uint64:
+		return float64(t), true
+	case float32:
+		return float64(t), true
+	case float64:
+		return t, true
+	}
+	return 0, false
+}
+
+func toTime(v interface{}) (time.Time, bool) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, true
+	case *time.Time:
+		if t != nil {
+			return *t, true
+		}
+	case primitive.DateTime:
+		return t.Time(), true
+	}
+	return time.Time{}, false
+}
+
+// compare orders two values of the same kind, values of different kinds are not comparable
+// and match no comparison, as in Mongo.
+func compare(a interface{}, b interface{}) (int, bool) {
+	if x, ok := toFloat(a); ok {
+		y, ok := toFloat(b)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	}
+
+	if x, ok := a.(string); ok {
+		y, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(x, y), true
+	}
+
+	if x, ok := toTime(a); ok {
+		y, ok := toTime(b)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case x.Before(y):
+			return -1, true
+		case x.After(y):
+			return 1, true
+		}
+		return 0, true
+	}
+
+	if x, ok := a.(bool); ok {
+		y, ok := b.(bool)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case x == y:
+			return 0, true
+		case y:
+			return -1, true
+		}
+		return 1, true
+	}
+
+	return 0, false
+}
+
+func equal(a interface{}, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+
+	if c, ok := compare(a, b); ok {
+		return c == 0
+	}
+
+	x, aList := asList(a)
+	y, bList := asList(b)
+	if aList && bList {
+		if len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !equal(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if x, ok := asMap(a); ok {
+		y, ok := asMap(b)
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for k := range x {
+			if !equal(x[k], y[k]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	STAFF_GROUP = "staff"
+
+	DefaultThreatLevel = 3
+
+	//threat level of events about an asset that is itself one of the event's threat actors
+	ThreatActorThreatLevel = 3
+
+	RULES_ENGINE_USER  = "rules-engine"
+	RULES_ENGINE_AGENT = "rules_engine"
+
+	//only events from the last week are looked at by the rules
+	LOOKBACK = 7 * 24 * time.Hour
+)
+
+var (
+	gMap        = make(map[string]bool)
+	username    string
+	MongoClient *mongo.Client
+
+	defaultHeaders = map[string]string{
+		"Content-Type":                 "application/json",
+		"Access-Control-Allow-Headers": "*",
+		"Access-Control-Allow-Origin":  "*",
+		"Access-Control-Allow-Methods": "POST, OPTIONS",
+		"Allow":                        "POST, OPTIONS",
+	}
+)
+
+type Strings []string
+
+func main() {
+	lambda.Start(Handler)
+}
+
+func Init() error {
+	var err error
+
+	err = ReuseMongo()
+	if err != nil {
+		return err
+	}
+
+	return err
+}
+
+func ReuseMongo() error {
+	if MongoClient != nil {
+		return nil
+	} else {
+		var err error
+		ctx := context.Background()
+
+		uri := "mongodb://192.168.0.229:27017"
+
+		MongoClient, err = mongo.Connect(ctx, options.Client().ApplyURI(uri))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type ErrorResponse struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+func ServeError(message string, code int) events.APIGatewayProxyResponse {
+	js, _ := json.Marshal(ErrorResponse{
+		Code:    code,
+		Message: message,
+	})
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: code,
+		Body:       string(js),
+		Headers:    defaultHeaders,
+	}
+}
+
+func VerifyRequest(request events.APIGatewayProxyRequest) error {
+	//the container is reused between requests, groups from an earlier caller must not carry over
+	gMap = make(map[string]bool)
+
+	claims := request.RequestContext.Authorizer["claims"]
+	if claims == nil {
+		return errors.New("No claims found for " + request.RequestContext.Identity.CognitoIdentityID)
+	}
+
+	c := claims.(map[string]interface{})
+
+	rg := c["cognito:groups"]
+	if rg == nil {
+		return errors.New("No group permissions set")
+	}
+
+	for _, g := range strings.Split(rg.(string), ",") {
+		gMap[g] = true
+	}
+
+	username, _ = c["cognito:username"].(string)
+	if username == "" {
+		username, _ = c["sub"].(string)
+	}
+
+	if username == "" {
+		return errors.New("No user found in claims")
+	}
+
+	return nil
+}
+
+func IsStaff() bool {
+	return gMap[STAFF_GROUP]
+}
+
+// RollbackRequest picks the version a rollback activates, by default the one active before
+// the current version.
+type RollbackRequest struct {
+	Version *int64 `json:"version,omitempty"`
+}
+
+// Handler activates a version on POST /rules/versions/{version}/activate, and rolls back to an
+// earlier one on POST /rules/rollback.
+func Handler(rctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var err error
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err = VerifyRequest(request)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	if !IsStaff() {
+		return ServeError("Only staff can activate rules", 403), nil
+	}
+
+	err = Init()
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	var version int64
+	if v := request.PathParameters["version"]; v != "" {
+		version, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return ServeError("Invalid version "+v, 400), nil
+		}
+	} else {
+		var input RollbackRequest
+		if strings.TrimSpace(request.Body) != "" {
+			err = json.Unmarshal([]byte(request.Body), &input)
+			if err != nil {
+				return ServeError(err.Error(), 400), nil
+			}
+		}
+
+		if input.Version != nil {
+			version = *input.Version
+		} else {
+			version, err = PreviousVersion(ctx)
+			if err != nil {
+				return ServeError(err.Error(), 400), nil
+			}
+		}
+	}
+
+	out, err := ActivateRuleSet(ctx, version, username, time.Now())
+	if err == ErrUnknownVersion {
+		return ServeError(err.Error(), 404), nil
+	}
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	js, err := json.Marshal(out)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		Body:       string(js),
+		StatusCode: 200,
+		Headers:    defaultHeaders,
+	}, nil
+}
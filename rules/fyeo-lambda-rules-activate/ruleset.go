@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	SEED_AUTHOR  = "seed"
+	SEED_COMMENT = "imported from " + RULES_FILE
+
+	//attempts at taking the next version number when another writer takes it first
+	VERSION_RETRIES = 3
+
+	MAX_VERSIONS = 100
+)
+
+var (
+	ErrNoActiveRules  = errors.New("No active rules version")
+	ErrUnknownVersion = errors.New("No such rules version")
+)
+
+// StoredRule is a rule as kept in the rules collection. Filters and updates hold $ and dotted
+// keys, which Mongo does not take as field names, so they are stored as json.
+type StoredRule struct {
+	Name   string     `bson:"name"`
+	Action string     `bson:"action"`
+	Filter string     `bson:"filter,omitempty"`
+	Update string     `bson:"update,omitempty"`
+	Params RuleParams `bson:"params"`
+}
+
+type RuleActivation struct {
+	By *string    `json:"by,omitempty" bson:"by,omitempty"`
+	At *time.Time `json:"at,omitempty" bson:"at,omitempty"`
+}
+
+// RuleSet is one version of the rules. Versions are never changed once written, only their
+// activations are recorded on them; the active version is the one activated last.
+type RuleSet struct {
+	ID          *string           `json:"id,omitempty" bson:"_id,omitempty"`
+	Version     int64             `json:"version" bson:"version"`
+	BaseVersion *int64            `json:"base_version,omitempty" bson:"base_version,omitempty"`
+	Rules       []Rule            `json:"rules,omitempty" bson:"-"`
+	Stored      []StoredRule      `json:"-" bson:"rules"`
+	Author      *string           `json:"author,omitempty" bson:"author,omitempty"`
+	Comment     *string           `json:"comment,omitempty" bson:"comment,omitempty"`
+	CreatedAt   *time.Time        `json:"created_at,omitempty" bson:"created_at,omitempty"`
+	ActivatedAt *time.Time        `json:"activated_at,omitempty" bson:"activated_at,omitempty"`
+	ActivatedBy *string           `json:"activated_by,omitempty" bson:"activated_by,omitempty"`
+	Activations []*RuleActivation `json:"activations,omitempty" bson:"activations,omitempty"`
+	IsActive    bool              `json:"is_active" bson:"-"`
+	RuleCount   int               `json:"rule_count" bson:"-"`
+}
+
+func (rs *RuleSet) store() error {
+	rs.Stored = nil
+
+	for _, r := range rs.Rules {
+		s := StoredRule{Name: r.Name, Action: r.Action, Params: r.Params}
+
+		if len(r.Filter) > 0 {
+			b, err := json.Marshal(r.Filter)
+			if err != nil {
+				return err
+			}
+			s.Filter = string(b)
+		}
+
+		if len(r.Update) > 0 {
+			b, err := json.Marshal(r.Update)
+			if err != nil {
+				return err
+			}
+			s.Update = string(b)
+		}
+
+		rs.Stored = append(rs.Stored, s)
+	}
+
+	return nil
+}
+
+func (rs *RuleSet) load() error {
+	rs.Rules = nil
+
+	for _, s := range rs.Stored {
+		r := Rule{Name: s.Name, Action: s.Action, Params: s.Params}
+
+		if s.Filter != "" {
+			err := json.Unmarshal([]byte(s.Filter), &r.Filter)
+			if err != nil {
+				return err
+			}
+		}
+
+		if s.Update != "" {
+			err := json.Unmarshal([]byte(s.Update), &r.Update)
+			if err != nil {
+				return err
+			}
+		}
+
+		rs.Rules = append(rs.Rules, r)
+	}
+
+	rs.RuleCount = len(rs.Rules)
+	return PrepareRules(rs.Rules)
+}
+
+func EnsureRuleIndexes(ctx context.Context) error {
+	_, err := MongoClient.Database("fyeo-di").Collection("rules").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "version", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "activated_at", Value: -1}}},
+	})
+	return err
+}
+
+func findRuleSet(ctx context.Context, filter bson.M, opts *options.FindOneOptions) (RuleSet, error) {
+	var out RuleSet
+
+	err := MongoClient.Database("fyeo-di").Collection("rules").FindOne(ctx, filter, opts).Decode(&out)
+	if err != nil {
+		return out, err
+	}
+
+	err = out.load()
+	return out, err
+}
+
+// GetActiveRuleSet returns the version the engine runs.
+func GetActiveRuleSet(ctx context.Context) (RuleSet, error) {
+	filter := bson.M{"activated_at": bson.M{"$exists": true}}
+	opts := options.FindOne().SetSort(bson.M{"activated_at": -1})
+
+	out, err := findRuleSet(ctx, filter, opts)
+	if err == mongo.ErrNoDocuments {
+		return out, ErrNoActiveRules
+	}
+	if err != nil {
+		return out, err
+	}
+
+	out.IsActive = true
+	return out, nil
+}
+
+func GetRuleSet(ctx context.Context, version int64) (RuleSet, error) {
+	out, err := findRuleSet(ctx, bson.M{"version": version}, nil)
+	if err == mongo.ErrNoDocuments {
+		return out, ErrUnknownVersion
+	}
+	if err != nil {
+		return out, err
+	}
+
+	active, err := GetActiveRuleSet(ctx)
+	if err == nil && active.Version == out.Version {
+		out.IsActive = true
+	}
+
+	return out, nil
+}
+
+// GetRuleVersions lists the newest versions without their rules.
+func GetRuleVersions(ctx context.Context) ([]RuleSet, error) {
+	opts := options.Find().SetSort(bson.M{"version": -1}).SetLimit(MAX_VERSIONS)
+
+	res, err := MongoClient.Database("fyeo-di").Collection("rules").Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []RuleSet
+	err = res.All(ctx, &out)
+	if err != nil {
+		return nil, err
+	}
+
+	active, err := GetActiveRuleSet(ctx)
+	if err != nil && err != ErrNoActiveRules {
+		return nil, err
+	}
+
+	for i := range out {
+		out[i].RuleCount = len(out[i].Stored)
+		out[i].IsActive = err == nil && out[i].Version == active.Version
+	}
+
+	return out, nil
+}
+
+// GetLatestRuleSet returns the newest version, active or not, which new versions are based on.
+func GetLatestRuleSet(ctx context.Context) (RuleSet, error) {
+	return findRuleSet(ctx, bson.M{}, options.FindOne().SetSort(bson.M{"version": -1}))
+}
+
+// InsertRuleSet writes the rules as the next version.
+func InsertRuleSet(ctx context.Context, rs *RuleSet, now time.Time) error {
+	err := PrepareRules(rs.Rules)
+	if err != nil {
+		return err
+	}
+
+	err = EnsureRuleIndexes(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = rs.store()
+	if err != nil {
+		return err
+	}
+
+	rs.CreatedAt = &now
+	rs.ActivatedAt = nil
+	rs.ActivatedBy = nil
+	rs.Activations = nil
+	rs.IsActive = false
+	rs.RuleCount = len(rs.Rules)
+
+	for i := 0; i < VERSION_RETRIES; i++ {
+		latest, err := GetLatestRuleSet(ctx)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return err
+		}
+		rs.Version = latest.Version + 1
+
+		res, err := MongoClient.Database("fyeo-di").Collection("rules").InsertOne(ctx, rs)
+		if mongo.IsDuplicateKeyError(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if id, ok := res.InsertedID.(interface{ Hex() string }); ok {
+			nid := id.Hex()
+			rs.ID = &nid
+		}
+
+		return nil
+	}
+
+	return errors.New("Unable to take the next rules version, try again")
+}
+
+// ActivateRuleSet makes the version the one the engine runs.
+func ActivateRuleSet(ctx context.Context, version int64, by string, now time.Time) (RuleSet, error) {
+	update := bson.M{
+		"$set":  bson.M{"activated_at": now, "activated_by": by},
+		"$push": bson.M{"activations": RuleActivation{By: &by, At: &now}},
+	}
+
+	res, err := MongoClient.Database("fyeo-di").Collection("rules").UpdateOne(ctx, bson.M{"version": version}, update)
+	if err != nil {
+		return RuleSet{}, err
+	}
+
+	if res.MatchedCount < 1 {
+		return RuleSet{}, ErrUnknownVersion
+	}
+
+	return GetRuleSet(ctx, version)
+}
+
+// PreviousVersion is the version that was active before the current one.
+func PreviousVersion(ctx context.Context) (int64, error) {
+	opts := options.Find().SetProjection(bson.M{"version": 1, "activations": 1})
+
+	res, err := MongoClient.Database("fyeo-di").Collection("rules").Find(ctx, bson.M{"activations.0": bson.M{"$exists": true}}, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	var docs []RuleSet
+	err = res.All(ctx, &docs)
+	if err != nil {
+		return 0, err
+	}
+
+	type activation struct {
+		version int64
+		at      time.Time
+	}
+
+	var all []activation
+	for _, d := range docs {
+		for _, a := range d.Activations {
+			if a != nil && a.At != nil {
+				all = append(all, activation{d.Version, *a.At})
+			}
+		}
+	}
+
+	sort.Slice(all, func(i, j int) bool { return all[i].at.After(all[j].at) })
+
+	if len(all) == 0 {
+		return 0, ErrNoActiveRules
+	}
+
+	for _, a := range all[1:] {
+		if a.version != all[0].version {
+			return a.version, nil
+		}
+	}
+
+	return 0, errors.New("No earlier rules version to roll back to")
+}
+
+// SeedRuleSet imports the rules file as the first version and activates it, when there are
+// no versions yet.
+func SeedRuleSet(ctx context.Context, path string, now time.Time) (RuleSet, error) {
+	rules, err := GetRules(path)
+	if err != nil {
+		return RuleSet{}, err
+	}
+
+	author := SEED_AUTHOR
+	comment := SEED_COMMENT
+	rs := RuleSet{Rules: rules, Author: &author, Comment: &comment}
+
+	err = InsertRuleSet(ctx, &rs, now)
+	if err != nil {
+		return rs, err
+	}
+
+	return ActivateRuleSet(ctx, rs.Version, author, now)
+}
+
+// GetActiveRules returns the rules of the active version, seeding the collection from the
+// rules file the first time.
+func GetActiveRules(ctx context.Context, now time.Time) ([]Rule, int64, error) {
+	rs, err := GetActiveRuleSet(ctx)
+	if err == ErrNoActiveRules {
+		_, latest_err := GetLatestRuleSet(ctx)
+		if latest_err != mongo.ErrNoDocuments {
+			//versions exist but none was activated, which is left to staff
+			return nil, 0, err
+		}
+
+		rs, err = SeedRuleSet(ctx, RulesPath(), now)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return rs.Rules, rs.Version, nil
+}
@@ -0,0 +1,9 @@
+module fyeo-lambda-rules-retrieve
+
+go 1.16
+
+require (
+	github.com/aws/aws-lambda-go v1.27.0
+	go.mongodb.org/mongo-driver v1.7.3
+	gopkg.in/yaml.v2 v2.4.0
+)
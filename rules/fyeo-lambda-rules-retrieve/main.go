@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	STAFF_GROUP = "staff"
+
+	DefaultThreatLevel = 3
+
+	//threat level of events about an asset that is itself one of the event's threat actors
+	ThreatActorThreatLevel = 3
+
+	RULES_ENGINE_USER  = "rules-engine"
+	RULES_ENGINE_AGENT = "rules_engine"
+
+	//only events from the last week are looked at by the rules
+	LOOKBACK = 7 * 24 * time.Hour
+)
+
+var (
+	gMap        = make(map[string]bool)
+	MongoClient *mongo.Client
+
+	defaultHeaders = map[string]string{
+		"Content-Type":                 "application/json",
+		"Access-Control-Allow-Headers": "*",
+		"Access-Control-Allow-Origin":  "*",
+		"Access-Control-Allow-Methods": "GET, OPTIONS",
+		"Allow":                        "GET, OPTIONS",
+	}
+)
+
+type Strings []string
+
+func main() {
+	lambda.Start(Handler)
+}
+
+func Init() error {
+	var err error
+
+	err = ReuseMongo()
+	if err != nil {
+		return err
+	}
+
+	return err
+}
+
+func ReuseMongo() error {
+	if MongoClient != nil {
+		return nil
+	} else {
+		var err error
+		ctx := context.Background()
+
+		uri := "mongodb://192.168.0.229:27017"
+
+		MongoClient, err = mongo.Connect(ctx, options.Client().ApplyURI(uri))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type ErrorResponse struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+func ServeError(message string, code int) events.APIGatewayProxyResponse {
+	js, _ := json.Marshal(ErrorResponse{
+		Code:    code,
+		Message: message,
+	})
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: code,
+		Body:       string(js),
+		Headers:    defaultHeaders,
+	}
+}
+
+func VerifyRequest(request events.APIGatewayProxyRequest) error {
+	//the container is reused between requests, groups from an earlier caller must not carry over
+	gMap = make(map[string]bool)
+
+	claims := request.RequestContext.Authorizer["claims"]
+	if claims == nil {
+		return errors.New("No claims found for " + request.RequestContext.Identity.CognitoIdentityID)
+	}
+
+	c := claims.(map[string]interface{})
+
+	rg := c["cognito:groups"]
+	if rg == nil {
+		return errors.New("No group permissions set")
+	}
+
+	for _, g := range strings.Split(rg.(string), ",") {
+		gMap[g] = true
+	}
+
+	return nil
+}
+
+func IsStaff() bool {
+	return gMap[STAFF_GROUP]
+}
+
+// Handler serves the active rules on /rules, the list of versions on /rules/versions and a
+// single version on /rules/versions/{version}.
+func Handler(rctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var err error
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err = VerifyRequest(request)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	if !IsStaff() {
+		return ServeError("Only staff can view rules", 403), nil
+	}
+
+	err = Init()
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	var out interface{}
+	version := request.PathParameters["version"]
+
+	switch {
+	case version != "":
+		v, err := strconv.ParseInt(version, 10, 64)
+		if err != nil {
+			return ServeError("Invalid version "+version, 400), nil
+		}
+
+		out, err = GetRuleSet(ctx, v)
+		if err == ErrUnknownVersion {
+			return ServeError(err.Error(), 404), nil
+		}
+		if err != nil {
+			return ServeError(err.Error(), 400), nil
+		}
+	case strings.HasSuffix(request.Resource, "/versions"):
+		out, err = GetRuleVersions(ctx)
+		if err != nil {
+			return ServeError(err.Error(), 400), nil
+		}
+	default:
+		out, err = GetActiveRuleSet(ctx)
+		if err == ErrNoActiveRules {
+			return ServeError(err.Error(), 404), nil
+		}
+		if err != nil {
+			return ServeError(err.Error(), 400), nil
+		}
+	}
+
+	js, err := json.Marshal(out)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		Body:       string(js),
+		StatusCode: 200,
+		Headers:    defaultHeaders,
+	}, nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	STAFF_GROUP = "staff"
+
+	DefaultThreatLevel = 3
+
+	//threat level of events about an asset that is itself one of the event's threat actors
+	ThreatActorThreatLevel = 3
+
+	RULES_ENGINE_USER  = "rules-engine"
+	RULES_ENGINE_AGENT = "rules_engine"
+
+	//only events from the last week are looked at by the rules
+	LOOKBACK = 7 * 24 * time.Hour
+)
+
+var (
+	gMap        = make(map[string]bool)
+	MongoClient *mongo.Client
+
+	defaultHeaders = map[string]string{
+		"Content-Type":                 "application/json",
+		"Access-Control-Allow-Headers": "*",
+		"Access-Control-Allow-Origin":  "*",
+		"Access-Control-Allow-Methods": "POST, OPTIONS",
+		"Allow":                        "POST, OPTIONS",
+	}
+)
+
+type Strings []string
+
+// Incident is the part of an incident the simulation compares against.
+type Incident struct {
+	ID     string  `json:"id" bson:"_id"`
+	Type   *string `json:"type,omitempty" bson:"type,omitempty"`
+	Source *string `json:"source,omitempty" bson:"source,omitempty"`
+}
+
+func main() {
+	lambda.Start(Handler)
+}
+
+func Init() error {
+	var err error
+
+	err = ReuseMongo()
+	if err != nil {
+		return err
+	}
+
+	return err
+}
+
+func ReuseMongo() error {
+	if MongoClient != nil {
+		return nil
+	} else {
+		var err error
+		ctx := context.Background()
+
+		uri := "mongodb://192.168.0.229:27017"
+
+		MongoClient, err = mongo.Connect(ctx, options.Client().ApplyURI(uri))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type ErrorResponse struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+func ServeError(message string, code int) events.APIGatewayProxyResponse {
+	js, _ := json.Marshal(ErrorResponse{
+		Code:    code,
+		Message: message,
+	})
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: code,
+		Body:       string(js),
+		Headers:    defaultHeaders,
+	}
+}
+
+func VerifyRequest(request events.APIGatewayProxyRequest) error {
+	//the container is reused between requests, groups from an earlier caller must not carry over
+	gMap = make(map[string]bool)
+
+	claims := request.RequestContext.Authorizer["claims"]
+	if claims == nil {
+		return errors.New("No claims found for " + request.RequestContext.Identity.CognitoIdentityID)
+	}
+
+	c := claims.(map[string]interface{})
+
+	rg := c["cognito:groups"]
+	if rg == nil {
+		return errors.New("No group permissions set")
+	}
+
+	for _, g := range strings.Split(rg.(string), ",") {
+		gMap[g] = true
+	}
+
+	return nil
+}
+
+func IsStaff() bool {
+	return gMap[STAFF_GROUP]
+}
+
+func Handler(rctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var err error
+	ctx, cancel := context.WithTimeout(context.Background(), 28*time.Second)
+	defer cancel()
+
+	err = VerifyRequest(request)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	if !IsStaff() {
+		return ServeError("Only staff can simulate rules", 403), nil
+	}
+
+	var input SimulateRequest
+	if strings.TrimSpace(request.Body) != "" {
+		err = json.Unmarshal([]byte(request.Body), &input)
+		if err != nil {
+			return ServeError(err.Error(), 400), nil
+		}
+	}
+
+	from, to, err := input.Window(time.Now())
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	err = Init()
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	var base RuleSet
+	if len(input.Rules) == 0 {
+		if input.Version != nil {
+			base, err = GetRuleSet(ctx, *input.Version)
+		} else {
+			base, err = GetActiveRuleSet(ctx)
+		}
+		if err != nil {
+			return ServeError(err.Error(), 400), nil
+		}
+	}
+
+	rules, err := CandidateRules(base.Rules, input)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	out, err := Simulate(ctx, rules, from, to)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+	out.Version = base.Version
+
+	js, err := json.Marshal(out)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		Body:       string(js),
+		StatusCode: 200,
+		Headers:    defaultHeaders,
+	}, nil
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	DEFAULT_WINDOW = 7 * 24 * time.Hour
+	MAX_WINDOW     = 31 * 24 * time.Hour
+
+	MAX_SIMULATE_EVENTS = 20000
+
+	//event ids listed per rule and per incident, the counts are always complete
+	MAX_SAMPLES = 50
+)
+
+// SimulateRequest is a candidate rule set, either given in full or as changes to the active
+// rules, or to a stored version, and the window of events to replay it over.
+type SimulateRequest struct {
+	Version  *int64     `json:"version,omitempty"`
+	Rules    []Rule     `json:"rules,omitempty"`
+	Changes  []Rule     `json:"changes,omitempty"`
+	Remove   []string   `json:"remove,omitempty"`
+	DateFrom *time.Time `json:"date_from,omitempty"`
+	DateTo   *time.Time `json:"date_to,omitempty"`
+}
+
+type EventChange struct {
+	EventID           string   `json:"event_id"`
+	CaseID            *string  `json:"case_id,omitempty"`
+	ThreatLevel       *int64   `json:"threat_level,omitempty"`
+	ActualThreatLevel *int64   `json:"actual_threat_level,omitempty"`
+	ActualRules       []string `json:"actual_rules,omitempty"`
+}
+
+type SimulatedIncident struct {
+	CaseID   string   `json:"case_id"`
+	Type     string   `json:"type"`
+	Source   string   `json:"source"`
+	Title    string   `json:"title"`
+	Events   int64    `json:"events"`
+	EventIDs []string `json:"event_ids"`
+	//an incident for the same case, type and source was created for these events
+	Existing bool `json:"existing"`
+}
+
+type RuleSimulation struct {
+	Name   string `json:"name"`
+	Action string `json:"action,omitempty"`
+
+	//events the candidate rule matches, and those the rule of the same name actually matched
+	Matched         int64 `json:"matched"`
+	ActuallyMatched int64 `json:"actually_matched"`
+
+	Added        int64          `json:"added"`
+	Removed      int64          `json:"removed"`
+	Reclassified []*EventChange `json:"reclassified,omitempty"`
+	AddedIDs     []string       `json:"added_ids,omitempty"`
+	RemovedIDs   []string       `json:"removed_ids,omitempty"`
+
+	Incidents []*SimulatedIncident `json:"incidents,omitempty"`
+}
+
+type SimulateResponse struct {
+	//the stored version the changes were applied to
+	Version   int64             `json:"version,omitempty"`
+	DateFrom  time.Time         `json:"date_from"`
+	DateTo    time.Time         `json:"date_to"`
+	Events    int64             `json:"events"`
+	Truncated bool              `json:"truncated"`
+	Changed   int64             `json:"changed"`
+	Rules     []*RuleSimulation `json:"rules"`
+}
+
+// Outcome is what the rules did, or would do, to an event.
+type Outcome struct {
+	Rules        []string
+	ThreatLevel  *int64
+	IncidentRule string
+	IncidentType string
+	Source       string
+}
+
+func (o Outcome) matched(rule string) bool {
+	for _, r := range o.Rules {
+		if r == rule {
+			return true
+		}
+	}
+	return false
+}
+
+func (o Outcome) equal(other Outcome) bool {
+	if len(o.Rules) != len(other.Rules) || o.IncidentType != other.IncidentType || o.Source != other.Source {
+		return false
+	}
+
+	for i := range o.Rules {
+		if o.Rules[i] != other.Rules[i] {
+			return false
+		}
+	}
+
+	if o.ThreatLevel == nil || other.ThreatLevel == nil {
+		return o.ThreatLevel == other.ThreatLevel
+	}
+
+	return *o.ThreatLevel == *other.ThreatLevel
+}
+
+// CandidateRules applies the request to the current rules.
+func CandidateRules(current []Rule, input SimulateRequest) ([]Rule, error) {
+	rules := current
+	if len(input.Rules) > 0 {
+		rules = input.Rules
+	}
+
+	out := make([]Rule, 0, len(rules)+len(input.Changes))
+	index := make(map[string]int)
+	for _, r := range rules {
+		index[r.Name] = len(out)
+		out = append(out, r)
+	}
+
+	//a change replaces the rule of the same name in place, new rules go last
+	for _, r := range input.Changes {
+		if i, ok := index[r.Name]; ok {
+			out[i] = r
+			continue
+		}
+		index[r.Name] = len(out)
+		out = append(out, r)
+	}
+
+	if len(input.Remove) > 0 {
+		remove := make(map[string]bool)
+		for _, name := range input.Remove {
+			if _, ok := index[name]; !ok {
+				return nil, errors.New("No rule " + name + " to remove")
+			}
+			remove[name] = true
+		}
+
+		kept := out[:0]
+		for _, r := range out {
+			if !remove[r.Name] {
+				kept = append(kept, r)
+			}
+		}
+		out = kept
+	}
+
+	err := PrepareRules(out)
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// Window is the replayed period, the last week unless given.
+func (input SimulateRequest) Window(now time.Time) (time.Time, time.Time, error) {
+	to := now
+	if input.DateTo != nil {
+		to = *input.DateTo
+	}
+
+	from := to.Add(-DEFAULT_WINDOW)
+	if input.DateFrom != nil {
+		from = *input.DateFrom
+	}
+
+	if !from.Before(to) {
+		return from, to, errors.New("date_from must be before date_to")
+	}
+
+	if to.Sub(from) > MAX_WINDOW {
+		return from, to, errors.New("The window can not be longer than 31 days")
+	}
+
+	return from, to, nil
+}
+
+// GetWindowEvents returns the events created in the window, oldest first.
+func GetWindowEvents(ctx context.Context, from time.Time, to time.Time) ([]Event, bool, error) {
+	var out []Event
+
+	var or []bson.M
+	for _, n := range EventFieldNames("created_at") {
+		or = append(or, bson.M{n: bson.M{"$gte": from, "$lt": to}})
+	}
+
+	filter := bson.M{"$or": or, "is_archived": bson.M{"$ne": true}}
+	opts := options.Find().SetSort(bson.M{"_id": 1}).SetLimit(MAX_SIMULATE_EVENTS + 1)
+
+	res, err := MongoClient.Database("fyeo-di").Collection("events").Find(ctx, filter, opts)
+	if err != nil {
+		return out, false, err
+	}
+
+	err = res.All(ctx, &out)
+	if err != nil {
+		return out, false, err
+	}
+
+	if len(out) > MAX_SIMULATE_EVENTS {
+		return out[:MAX_SIMULATE_EVENTS], true, nil
+	}
+
+	return out, false, nil
+}
+
+// GetEngineIncidents returns the incidents the rules engine linked the events to, by id.
+func GetEngineIncidents(ctx context.Context, events []Event) (map[string]Incident, error) {
+	out := make(map[string]Incident)
+
+	var ids []primitive.ObjectID
+	for _, e := range events {
+		if e.IncidentID == nil {
+			continue
+		}
+		o_id, err := primitive.ObjectIDFromHex(*e.IncidentID)
+		if err == nil {
+			ids = append(ids, o_id)
+		}
+	}
+
+	if len(ids) == 0 {
+		return out, nil
+	}
+
+	filter := bson.M{"_id": bson.M{"$in": ids}, "agent": RULES_ENGINE_AGENT}
+	opts := options.Find().SetProjection(bson.M{"type": 1, "source": 1})
+
+	res, err := MongoClient.Database("fyeo-di").Collection("incidents").Find(ctx, filter, opts)
+	if err != nil {
+		return out, err
+	}
+
+	var docs []Incident
+	err = res.All(ctx, &docs)
+	if err != nil {
+		return out, err
+	}
+
+	for _, d := range docs {
+		out[d.ID] = d
+	}
+
+	return out, nil
+}
+
+func isEngineEntry(h *EventHistory) bool {
+	return h != nil && h.User != nil && *h.User == RULES_ENGINE_USER
+}
+
+// ActualOutcome reads what the rules engine did to the event from its history.
+func ActualOutcome(e Event, incidents map[string]Incident) Outcome {
+	var out Outcome
+
+	for _, h := range e.History {
+		if !isEngineEntry(h) || h.Rule == nil {
+			continue
+		}
+		out.Rules = append(out.Rules, *h.Rule)
+		if h.ThreatLevel != nil {
+			out.ThreatLevel = h.ThreatLevel
+		}
+	}
+
+	if e.IncidentID != nil {
+		if i, ok := incidents[*e.IncidentID]; ok {
+			if i.Type != nil {
+				out.IncidentType = *i.Type
+			}
+			if i.Source != nil {
+				out.Source = *i.Source
+			}
+		}
+	}
+
+	return out
+}
+
+// RestoreEvent is the event as it was when ingested, before the rules engine or an analyst
+// classified it. Matcher fields such as the threat level are left as they are now.
+func RestoreEvent(e Event) (bson.M, error) {
+	var history []*EventHistory
+	for _, h := range e.History {
+		if !isEngineEntry(h) {
+			history = append(history, h)
+		}
+	}
+
+	e.History = history
+	e.IsManClassified = nil
+	e.IsAutoClassified = nil
+	e.AutoClassifiedAt = nil
+	e.ManClassifiedAt = nil
+	e.IncidentID = nil
+
+	return EventDocument(e)
+}
+
+// SimulatedOutcome runs the rules over the restored event in order, as a run shortly after
+// the event was created would have.
+func SimulatedOutcome(rules []Rule, e Event, doc bson.M) (Outcome, error) {
+	var out Outcome
+
+	now := time.Now()
+	if e.CreatedAt != nil {
+		now = *e.CreatedAt
+	}
+
+	for i := range rules {
+		rule := &rules[i]
+
+		ok, err := rule.Matches(doc, now)
+		if err != nil {
+			return out, errors.New(rule.Name + ": " + err.Error())
+		}
+		if !ok {
+			continue
+		}
+
+		out.Rules = append(out.Rules, rule.Name)
+
+		if rule.Action == ACTION_UPDATE {
+			for k, v := range rule.Update {
+				if l, ok := toFloat(v); ok && CanonicalEventKey(k) == "threat_level" {
+					level := int64(l)
+					out.ThreatLevel = &level
+				}
+			}
+			rule.Simulate(doc, now)
+			continue
+		}
+
+		level := rule.Params.Level()
+		if !e.IsOwnThreatActor() {
+			out.IncidentRule = rule.Name
+			out.IncidentType = rule.Params.IncidentType
+			out.Source = rule.Source(e)
+		} else {
+			level = ThreatActorThreatLevel
+		}
+
+		out.ThreatLevel = &level
+		rule.Simulate(doc, now)
+	}
+
+	return out, nil
+}
+
+func sample(list []string, id string) []string {
+	if len(list) < MAX_SAMPLES {
+		return append(list, id)
+	}
+	return list
+}
+
+// Simulate replays the candidate rules over the events of the window and compares the result
+// with what the engine did. Nothing is written.
+func Simulate(ctx context.Context, rules []Rule, from time.Time, to time.Time) (SimulateResponse, error) {
+	out := SimulateResponse{DateFrom: from, DateTo: to}
+
+	types, err := GetIncidentTypes(ctx)
+	if err != nil {
+		return out, err
+	}
+
+	for _, r := range rules {
+		if r.Action == ACTION_INCIDENT {
+			if _, ok := types[r.Params.IncidentType]; !ok {
+				return out, errors.New("Rule " + r.Name + " has unknown incident type " + r.Params.IncidentType)
+			}
+		}
+	}
+
+	events, truncated, err := GetWindowEvents(ctx, from, to)
+	if err != nil {
+		return out, err
+	}
+	out.Events = int64(len(events))
+	out.Truncated = truncated
+
+	incidents, err := GetEngineIncidents(ctx, events)
+	if err != nil {
+		return out, err
+	}
+
+	sims := make(map[string]*RuleSimulation)
+	by_name := make(map[string]*Rule)
+	for i, r := range rules {
+		s := &RuleSimulation{Name: r.Name, Action: r.Action}
+		sims[r.Name] = s
+		by_name[r.Name] = &rules[i]
+		out.Rules = append(out.Rules, s)
+	}
+
+	simFor := func(name string) *RuleSimulation {
+		s, ok := sims[name]
+		if !ok {
+			//a rule which fired but is no longer in the candidate set
+			s = &RuleSimulation{Name: name}
+			sims[name] = s
+			out.Rules = append(out.Rules, s)
+		}
+		return s
+	}
+
+	grouped := make(map[string]*SimulatedIncident)
+	owner := make(map[string]string)
+	var keys []string
+	threat_actors := make(map[string]ThreatActor)
+
+	for _, e := range events {
+		if e.ID == nil {
+			continue
+		}
+
+		doc, err := RestoreEvent(e)
+		if err != nil {
+			return out, err
+		}
+
+		simulated, err := SimulatedOutcome(rules, e, doc)
+		if err != nil {
+			return out, err
+		}
+
+		actual := ActualOutcome(e, incidents)
+		if !simulated.equal(actual) {
+			out.Changed++
+		}
+
+		for _, name := range simulated.Rules {
+			s := simFor(name)
+			s.Matched++
+
+			if !actual.matched(name) {
+				s.Added++
+				s.AddedIDs = sample(s.AddedIDs, *e.ID)
+			}
+
+			if len(s.Reclassified) < MAX_SAMPLES && !simulated.equal(actual) {
+				s.Reclassified = append(s.Reclassified, &EventChange{
+					EventID:           *e.ID,
+					CaseID:            e.CaseID,
+					ThreatLevel:       simulated.ThreatLevel,
+					ActualThreatLevel: actual.ThreatLevel,
+					ActualRules:       actual.Rules,
+				})
+			}
+		}
+
+		for _, name := range actual.Rules {
+			s := simFor(name)
+			s.ActuallyMatched++
+
+			if !simulated.matched(name) {
+				s.Removed++
+				s.RemovedIDs = sample(s.RemovedIDs, *e.ID)
+			}
+		}
+
+		if simulated.IncidentType == "" || e.CaseID == nil {
+			continue
+		}
+
+		key := *e.CaseID + "|" + simulated.IncidentType + "|" + simulated.Source
+		inc, ok := grouped[key]
+		if !ok {
+			inc = &SimulatedIncident{
+				CaseID: *e.CaseID,
+				Type:   simulated.IncidentType,
+				Source: simulated.Source,
+				Title:  simulatedTitle(ctx, by_name[simulated.IncidentRule], simulated, e, types[simulated.IncidentType], threat_actors),
+			}
+			grouped[key] = inc
+			owner[key] = simulated.IncidentRule
+			keys = append(keys, key)
+		}
+
+		inc.Events++
+		inc.EventIDs = sample(inc.EventIDs, *e.ID)
+		if actual.IncidentType == simulated.IncidentType && actual.Source == simulated.Source {
+			inc.Existing = true
+		}
+	}
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := sims[owner[key]]
+		s.Incidents = append(s.Incidents, grouped[key])
+	}
+
+	return out, nil
+}
+
+func simulatedTitle(ctx context.Context, rule *Rule, o Outcome, e Event, t IncidentType, threat_actors map[string]ThreatActor) string {
+	var threat_actor ThreatActor
+	if rule.Params.ThreatActor && e.ThreatActors != nil && len(*e.ThreatActors) > 0 {
+		id := (*e.ThreatActors)[0]
+		info, ok := threat_actors[id]
+		if !ok {
+			info, _ = GetThreatActorInfo(ctx, id)
+			threat_actors[id] = info
+		}
+		threat_actor = info
+	}
+
+	data := NewTemplateData(e, o.Source, threat_actor)
+	data.IncidentType = o.IncidentType
+	data.Rule = rule.Name
+	if rule.Params.Severity != nil {
+		data.Severity = *rule.Params.Severity
+	} else if t.Severity != nil {
+		data.Severity = *t.Severity
+	}
+
+	title, _, _, err := t.Render(data)
+	if err != nil {
+		return o.IncidentType
+	}
+
+	return *title
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+)
+
+var (
+	ErrUnknownRule = errors.New("No such rule")
+)
+
+// RulesChange is an edit of the rules. It is saved as a new version on top of the latest one,
+// base_version guards against overwriting a version saved meanwhile.
+type RulesChange struct {
+	Rule        *Rule   `json:"rule,omitempty"`
+	Rules       []Rule  `json:"rules,omitempty"`
+	Position    *int    `json:"position,omitempty"`
+	BaseVersion *int64  `json:"base_version,omitempty"`
+	Comment     *string `json:"comment,omitempty"`
+	Activate    bool    `json:"activate,omitempty"`
+}
+
+func findRule(rules []Rule, name string) int {
+	for i, r := range rules {
+		if r.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func insertRule(rules []Rule, rule Rule, position *int) []Rule {
+	i := len(rules)
+	if position != nil && *position >= 0 && *position < len(rules) {
+		i = *position
+	}
+
+	out := make([]Rule, 0, len(rules)+1)
+	out = append(out, rules[:i]...)
+	out = append(out, rule)
+	return append(out, rules[i:]...)
+}
+
+// AddRule adds the rule at the position, rules are applied in order, or last.
+func AddRule(rules []Rule, rule Rule, position *int) ([]Rule, error) {
+	if findRule(rules, rule.Name) >= 0 {
+		return nil, errors.New("Rule " + rule.Name + " already exists")
+	}
+
+	return insertRule(rules, rule, position), nil
+}
+
+// ReplaceRule replaces the named rule in place, or moves it when a position is given.
+func ReplaceRule(rules []Rule, name string, rule Rule, position *int) ([]Rule, error) {
+	i := findRule(rules, name)
+	if i < 0 {
+		return nil, ErrUnknownRule
+	}
+
+	if rule.Name != name && findRule(rules, rule.Name) >= 0 {
+		return nil, errors.New("Rule " + rule.Name + " already exists")
+	}
+
+	if position == nil {
+		out := append([]Rule{}, rules...)
+		out[i] = rule
+		return out, nil
+	}
+
+	out, _ := RemoveRule(rules, name)
+	return insertRule(out, rule, position), nil
+}
+
+func RemoveRule(rules []Rule, name string) ([]Rule, error) {
+	i := findRule(rules, name)
+	if i < 0 {
+		return nil, ErrUnknownRule
+	}
+
+	out := make([]Rule, 0, len(rules)-1)
+	out = append(out, rules[:i]...)
+	return append(out, rules[i+1:]...), nil
+}
+
+// ValidateIncidentTypes checks the incident rules create incidents of a known type.
+func ValidateIncidentTypes(rules []Rule, types map[string]IncidentType) error {
+	for _, r := range rules {
+		if r.Action != ACTION_INCIDENT {
+			continue
+		}
+
+		if _, ok := types[r.Params.IncidentType]; !ok {
+			return errors.New("Rule " + r.Name + " has unknown incident type " + r.Params.IncidentType)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// IncidentType is the template incidents of a class are created from. The title, description
+// and recommendation are templates filled in when an incident is created.
+type IncidentType struct {
+	ID             *string `json:"id,omitempty" bson:"_id,omitempty"`
+	Severity       *int64  `json:"severity,omitempty" bson:"severity,omitempty"`
+	Title          *string `json:"title,omitempty" bson:"title,omitempty"`
+	Recommendation *string `json:"recommendation,omitempty" bson:"recommendation,omitempty"`
+	BusinessImpact *string `json:"business_impact,omitempty" bson:"business_impact,omitempty"`
+	Class          *string `json:"class,omitempty" bson:"class,omitempty"`
+	Description    *string `json:"description,omitempty" bson:"description,omitempty"`
+}
+
+func GetIncidentTypes(ctx context.Context) (map[string]IncidentType, error) {
+	out := make(map[string]IncidentType)
+
+	res, err := MongoClient.Database("fyeo-di").Collection("incident_types").Find(ctx, bson.D{})
+	if err != nil {
+		return out, err
+	}
+	defer res.Close(ctx)
+
+	for res.Next(ctx) {
+		var doc IncidentType
+
+		err := res.Decode(&doc)
+		if err != nil {
+			return out, err
+		}
+
+		if doc.Class != nil {
+			out[*doc.Class] = doc
+		}
+	}
+
+	return out, res.Err()
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	STAFF_GROUP = "staff"
+
+	DefaultThreatLevel = 3
+
+	//threat level of events about an asset that is itself one of the event's threat actors
+	ThreatActorThreatLevel = 3
+
+	RULES_ENGINE_USER  = "rules-engine"
+	RULES_ENGINE_AGENT = "rules_engine"
+
+	//only events from the last week are looked at by the rules
+	LOOKBACK = 7 * 24 * time.Hour
+)
+
+var (
+	gMap        = make(map[string]bool)
+	username    string
+	MongoClient *mongo.Client
+
+	defaultHeaders = map[string]string{
+		"Content-Type":                 "application/json",
+		"Access-Control-Allow-Headers": "*",
+		"Access-Control-Allow-Origin":  "*",
+		"Access-Control-Allow-Methods": "POST, PUT, DELETE, OPTIONS",
+		"Allow":                        "POST, PUT, DELETE, OPTIONS",
+	}
+)
+
+type Strings []string
+
+func main() {
+	lambda.Start(Handler)
+}
+
+func Init() error {
+	var err error
+
+	err = ReuseMongo()
+	if err != nil {
+		return err
+	}
+
+	return err
+}
+
+func ReuseMongo() error {
+	if MongoClient != nil {
+		return nil
+	} else {
+		var err error
+		ctx := context.Background()
+
+		uri := "mongodb://192.168.0.229:27017"
+
+		MongoClient, err = mongo.Connect(ctx, options.Client().ApplyURI(uri))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type ErrorResponse struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+func ServeError(message string, code int) events.APIGatewayProxyResponse {
+	js, _ := json.Marshal(ErrorResponse{
+		Code:    code,
+		Message: message,
+	})
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: code,
+		Body:       string(js),
+		Headers:    defaultHeaders,
+	}
+}
+
+func VerifyRequest(request events.APIGatewayProxyRequest) error {
+	//the container is reused between requests, groups from an earlier caller must not carry over
+	gMap = make(map[string]bool)
+
+	claims := request.RequestContext.Authorizer["claims"]
+	if claims == nil {
+		return errors.New("No claims found for " + request.RequestContext.Identity.CognitoIdentityID)
+	}
+
+	c := claims.(map[string]interface{})
+
+	rg := c["cognito:groups"]
+	if rg == nil {
+		return errors.New("No group permissions set")
+	}
+
+	for _, g := range strings.Split(rg.(string), ",") {
+		gMap[g] = true
+	}
+
+	username, _ = c["cognito:username"].(string)
+	if username == "" {
+		username, _ = c["sub"].(string)
+	}
+
+	if username == "" {
+		return errors.New("No user found in claims")
+	}
+
+	return nil
+}
+
+func IsStaff() bool {
+	return gMap[STAFF_GROUP]
+}
+
+// Handler saves an edit of the rules as a new version. POST /rules adds a rule, PUT and
+// DELETE /rules/{name} replace and remove one, POST /rules/versions replaces the whole set.
+func Handler(rctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var err error
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err = VerifyRequest(request)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	if !IsStaff() {
+		return ServeError("Only staff can change rules", 403), nil
+	}
+
+	var input RulesChange
+	if strings.TrimSpace(request.Body) != "" {
+		err = json.Unmarshal([]byte(request.Body), &input)
+		if err != nil {
+			return ServeError(err.Error(), 400), nil
+		}
+	}
+
+	err = Init()
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	now := time.Now()
+
+	base, err := GetLatestRuleSet(ctx)
+	if err == mongo.ErrNoDocuments {
+		//the first edit is made on top of the rules file
+		base, err = SeedRuleSet(ctx, RulesPath(), now)
+	}
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	if input.BaseVersion != nil && *input.BaseVersion != base.Version {
+		return ServeError(fmt.Sprintf("Rules were changed since version %d, the latest version is %d", *input.BaseVersion, base.Version), 409), nil
+	}
+
+	var rules []Rule
+	name := request.PathParameters["name"]
+
+	switch {
+	case request.HTTPMethod == "DELETE" && name != "":
+		rules, err = RemoveRule(base.Rules, name)
+	case request.HTTPMethod == "PUT" && name != "":
+		if input.Rule == nil {
+			return ServeError("Request must contain rule", 400), nil
+		}
+		if input.Rule.Name == "" {
+			input.Rule.Name = name
+		}
+		rules, err = ReplaceRule(base.Rules, name, *input.Rule, input.Position)
+	case request.HTTPMethod == "POST" && strings.HasSuffix(request.Resource, "/versions"):
+		if len(input.Rules) == 0 {
+			return ServeError("Request must contain rules", 400), nil
+		}
+		rules = input.Rules
+	case request.HTTPMethod == "POST":
+		if input.Rule == nil {
+			return ServeError("Request must contain rule", 400), nil
+		}
+		rules, err = AddRule(base.Rules, *input.Rule, input.Position)
+	default:
+		return ServeError("Unsupported request "+request.HTTPMethod+" "+request.Resource, 405), nil
+	}
+	if err == ErrUnknownRule {
+		return ServeError(err.Error()+" "+name, 404), nil
+	}
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	err = PrepareRules(rules)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	types, err := GetIncidentTypes(ctx)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	err = ValidateIncidentTypes(rules, types)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	out := RuleSet{Rules: rules, BaseVersion: &base.Version, Author: &username, Comment: input.Comment}
+
+	err = InsertRuleSet(ctx, &out, now)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	if input.Activate {
+		out, err = ActivateRuleSet(ctx, out.Version, username, now)
+		if err != nil {
+			return ServeError(err.Error(), 400), nil
+		}
+	}
+
+	js, err := json.Marshal(out)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		Body:       string(js),
+		StatusCode: 200,
+		Headers:    defaultHeaders,
+	}, nil
+}
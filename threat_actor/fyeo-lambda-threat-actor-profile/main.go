@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	STAFF_GROUP = "staff"
+)
+
+var (
+	gMap        = make(map[string]bool)
+	groups      []string
+	MongoClient *mongo.Client
+
+	defaultHeaders = map[string]string{
+		"Content-Type":                 "application/json",
+		"Access-Control-Allow-Headers": "*",
+		"Access-Control-Allow-Origin":  "*",
+		"Access-Control-Allow-Methods": "GET, OPTIONS",
+		"Allow":                        "GET, OPTIONS",
+	}
+)
+
+type Strings []string
+
+type Case struct {
+	ID    *string `json:"id,omitempty" bson:"_id,omitempty"`
+	Name  *string `json:"name,omitempty" bson:"name,omitempty"`
+	Group *string `json:"group,omitempty" bson:"group,omitempty"`
+}
+
+type ErrorResponse struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+func ServeError(message string, code int) events.APIGatewayProxyResponse {
+	js, _ := json.Marshal(ErrorResponse{
+		Code:    code,
+		Message: message,
+	})
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: code,
+		Body:       string(js),
+		Headers:    defaultHeaders,
+	}
+}
+
+func main() {
+	lambda.Start(Handler)
+}
+
+func Init() error {
+	var err error
+
+	err = ReuseMongo()
+	if err != nil {
+		return err
+	}
+
+	return err
+}
+
+func ReuseMongo() error {
+	if MongoClient != nil {
+		return nil
+	} else {
+		var err error
+		ctx := context.Background()
+
+		uri := "mongodb://192.168.0.229:27017"
+
+		MongoClient, err = mongo.Connect(ctx, options.Client().ApplyURI(uri))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func GetCases(ctx context.Context, filter bson.M) ([]Case, error) {
+	var out []Case
+
+	res, err := MongoClient.Database("fyeo-di").Collection("cases").Find(ctx, filter, options.Find().SetProjection(bson.M{"name": 1, "group": 1}))
+	if err != nil {
+		return out, err
+	}
+
+	err = res.All(ctx, &out)
+	return out, err
+}
+
+func CasePermissions(input Case) bool {
+	if input.Group != nil {
+		_, ok := gMap[*input.Group]
+		return ok
+	}
+
+	return false
+}
+
+func VerifyRequest(request events.APIGatewayProxyRequest) error {
+
+	claims := request.RequestContext.Authorizer["claims"]
+	if claims == nil {
+		return errors.New("No claims found for " + request.RequestContext.Identity.CognitoIdentityID)
+	}
+
+	rg := claims.(map[string]interface{})["cognito:groups"]
+
+	if rg == nil {
+		return errors.New("No group permissions set")
+	}
+
+	groups = strings.Split(rg.(string), ",")
+
+	//warm containers keep gMap, start from nothing for every caller
+	gMap = make(map[string]bool)
+	for _, g := range groups {
+		gMap[g] = true
+	}
+
+	return nil
+}
+
+func IsStaff() bool {
+	return gMap[STAFF_GROUP]
+}
+
+// VisibleCases are the cases the caller may see the threat actor's incidents in, nil for
+// staff who see them across every case.
+func VisibleCases(ctx context.Context) (map[string]Case, error) {
+	if IsStaff() {
+		return nil, nil
+	}
+
+	cases, err := GetCases(ctx, bson.M{"group": bson.M{"$in": groups}, "is_archived": bson.M{"$ne": true}})
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]Case)
+	for _, c := range cases {
+		if c.ID != nil && CasePermissions(c) {
+			out[*c.ID] = c
+		}
+	}
+
+	return out, nil
+}
+
+func Handler(rctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var err error
+	ctx, cancel := context.WithTimeout(context.Background(), 25*time.Second)
+	defer cancel()
+
+	id := request.PathParameters["id"]
+	if id == "" {
+		return ServeError("No ID provided", 400), nil
+	}
+
+	if _, err := primitive.ObjectIDFromHex(id); err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	err = VerifyRequest(request)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	err = Init()
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	actor, err := GetThreatActor(ctx, id)
+	if err == mongo.ErrNoDocuments {
+		return ServeError("Threat actor not found", 404), nil
+	}
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	cases, err := VisibleCases(ctx)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	if cases != nil && len(cases) < 1 {
+		return ServeError("No cases found with provided group permissions", 400), nil
+	}
+
+	out, err := BuildProfile(ctx, actor, cases)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	//customers only learn of threat actors seen in or kept on their own cases
+	if cases != nil && len(out.Cases) == 0 {
+		if _, ok := cases[stringValue(actor.CaseID)]; !ok {
+			return ServeError("Threat actor not found", 404), nil
+		}
+	}
+
+	js, err := json.Marshal(out)
+	if err != nil {
+		return ServeError(err.Error(), 400), nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		Body:       string(js),
+		StatusCode: 200,
+		Headers:    defaultHeaders,
+	}, nil
+}
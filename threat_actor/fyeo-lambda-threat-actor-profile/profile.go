@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	MAX_PROFILE_INCIDENTS = 1000
+	MAX_PROFILE_EVENTS    = 5000
+)
+
+type AssetName struct {
+	Common *string `json:"common,omitempty" bson:"common,omitempty"`
+	First  *string `json:"first,omitempty" bson:"first,omitempty"`
+	Last   *string `json:"last,omitempty" bson:"last,omitempty"`
+	Middle *string `json:"middle,omitempty" bson:"middle,omitempty"`
+	Nick   *string `json:"nick,omitempty" bson:"nick,omitempty"`
+}
+
+type TagPair struct {
+	Tag   *string `json:"tag,omitempty" bson:"tag,omitempty"`
+	Value *string `json:"value,omitempty" bson:"value,omitempty"`
+}
+
+type SearchKey struct {
+	Value      *string `json:"value,omitempty" bson:"value,omitempty"`
+	Kind       *string `json:"kind,omitempty" bson:"kind,omitempty"`
+	Suppressed *bool   `json:"suppressed,omitempty" bson:"suppressed,omitempty"`
+}
+
+type Asset struct {
+	ID          *string      `json:"id,omitempty" bson:"_id,omitempty"`
+	CaseID      *string      `json:"case_id,omitempty" bson:"case_id,omitempty"`
+	Name        *AssetName   `json:"name,omitempty" bson:"name,omitempty"`
+	Type        *string      `json:"type,omitempty" bson:"type,omitempty"`
+	Description *string      `json:"description,omitempty" bson:"description,omitempty"`
+	SocialMedia []*TagPair   `json:"social_media,omitempty" bson:"social_media,omitempty"`
+	SearchKeys  []*SearchKey `json:"search_keys,omitempty" bson:"search_keys,omitempty"`
+}
+
+type Incident struct {
+	ID             *string    `json:"id,omitempty" bson:"_id,omitempty"`
+	Title          *string    `json:"title,omitempty" bson:"title,omitempty"`
+	Type           *string    `json:"type,omitempty" bson:"type,omitempty"`
+	Severity       *int64     `json:"severity,omitempty" bson:"severity,omitempty"`
+	IsActive       *bool      `json:"is_active,omitempty" bson:"is_active,omitempty"`
+	CreatedAt      *time.Time `json:"created_at,omitempty" bson:"created_at,omitempty"`
+	CaseID         *string    `json:"case_id,omitempty" bson:"case_id,omitempty"`
+	AssetID        *string    `json:"asset_id,omitempty" bson:"asset_id,omitempty"`
+	TargetIDs      *Strings   `json:"target_ids,omitempty" bson:"target_ids,omitempty"`
+	ThreatActorIDs *Strings   `json:"-" bson:"threat_actor_ids,omitempty"`
+	EventIDs       *Strings   `json:"-" bson:"event_ids,omitempty"`
+}
+
+type Event struct {
+	ID            *string    `bson:"_id,omitempty"`
+	Site          *string    `bson:"site,omitempty"`
+	SourceNetwork *string    `bson:"source_network,omitempty"`
+	CreatedAt     *time.Time `bson:"created_at,omitempty"`
+}
+
+type ProfileCase struct {
+	ID        string      `json:"id"`
+	Name      string      `json:"name,omitempty"`
+	Incidents []*Incident `json:"incidents"`
+}
+
+// ProfileCount is a site, network or target and how many of the actor's events or
+// incidents it appears in.
+type ProfileCount struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+}
+
+type ProfileTarget struct {
+	ID     string `json:"id"`
+	Name   string `json:"name,omitempty"`
+	Type   string `json:"type,omitempty"`
+	CaseID string `json:"case_id,omitempty"`
+	Count  int64  `json:"count"`
+}
+
+type ThreatActorProfile struct {
+	ID            string           `json:"id"`
+	Name          string           `json:"name"`
+	Description   *string          `json:"description,omitempty"`
+	Aliases       []string         `json:"aliases"`
+	FirstSeen     *time.Time       `json:"first_seen,omitempty"`
+	LastSeen      *time.Time       `json:"last_seen,omitempty"`
+	IncidentCount int64            `json:"incident_count"`
+	Cases         []*ProfileCase   `json:"cases"`
+	Sites         []*ProfileCount  `json:"sites"`
+	Networks      []*ProfileCount  `json:"networks"`
+	Targets       []*ProfileTarget `json:"targets"`
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func objectIDs(ids []string) []primitive.ObjectID {
+	var out []primitive.ObjectID
+	for _, id := range ids {
+		o_id, err := primitive.ObjectIDFromHex(id)
+		if err == nil {
+			out = append(out, o_id)
+		}
+	}
+	return out
+}
+
+func (data Asset) GetName() string {
+	if data.Name == nil {
+		return ""
+	}
+
+	if data.Name.Common != nil {
+		return *data.Name.Common
+	}
+
+	var parts []string
+	for _, part := range []*string{data.Name.First, data.Name.Middle, data.Name.Last} {
+		if part != nil && *part != "" {
+			parts = append(parts, *part)
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// Aliases are the other names the actor is known by: its full and nick names, social media
+// handles and the search keys it is matched on, each once and without its display name.
+func (data Asset) Aliases() []string {
+	var values []*string
+	if data.Name != nil {
+		full := strings.Join(strings.Fields(stringValue(data.Name.First)+" "+stringValue(data.Name.Middle)+" "+stringValue(data.Name.Last)), " ")
+		values = append(values, &full, data.Name.Nick)
+	}
+	for _, t := range data.SocialMedia {
+		if t != nil {
+			values = append(values, t.Value)
+		}
+	}
+	for _, k := range data.SearchKeys {
+		if k != nil && (k.Suppressed == nil || !*k.Suppressed) {
+			values = append(values, k.Value)
+		}
+	}
+
+	seen := map[string]bool{strings.ToLower(data.GetName()): true}
+	out := []string{}
+	for _, v := range values {
+		s := strings.TrimSpace(stringValue(v))
+		if s == "" || seen[strings.ToLower(s)] {
+			continue
+		}
+		seen[strings.ToLower(s)] = true
+		out = append(out, s)
+	}
+
+	return out
+}
+
+func GetThreatActor(ctx context.Context, id string) (Asset, error) {
+	var out Asset
+	o_id, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return out, err
+	}
+
+	filter := bson.M{"_id": o_id, "is_threat_actor": true, "is_archived": bson.M{"$ne": true}}
+	err = MongoClient.Database("fyeo-di").Collection("assets").FindOne(ctx, filter).Decode(&out)
+
+	return out, err
+}
+
+// GetActorIncidents returns the incidents the actor appears in, within the cases when given.
+func GetActorIncidents(ctx context.Context, id string, cases map[string]Case) ([]Incident, error) {
+	var out []Incident
+
+	filter := bson.M{"threat_actor_ids": id, "is_archived": bson.M{"$ne": true}}
+	if cases != nil {
+		case_ids := []string{}
+		for c_id := range cases {
+			case_ids = append(case_ids, c_id)
+		}
+		filter["case_id"] = bson.M{"$in": case_ids}
+	}
+
+	opts := options.Find().SetSort(bson.M{"created_at": -1}).SetLimit(MAX_PROFILE_INCIDENTS)
+	res, err := MongoClient.Database("fyeo-di").Collection("incidents").Find(ctx, filter, opts)
+	if err != nil {
+		return out, err
+	}
+
+	err = res.All(ctx, &out)
+	return out, err
+}
+
+func GetProfileEvents(ctx context.Context, ids []string) ([]Event, error) {
+	var out []Event
+	if len(ids) == 0 {
+		return out, nil
+	}
+
+	opts := options.Find().SetProjection(bson.M{"site": 1, "source_network": 1, "created_at": 1}).SetLimit(MAX_PROFILE_EVENTS)
+	res, err := MongoClient.Database("fyeo-di").Collection("events").Find(ctx, bson.M{"_id": bson.M{"$in": objectIDs(ids)}}, opts)
+	if err != nil {
+		return out, err
+	}
+
+	err = res.All(ctx, &out)
+	return out, err
+}
+
+func GetAssets(ctx context.Context, ids []string) (map[string]Asset, error) {
+	out := make(map[string]Asset)
+	if len(ids) == 0 {
+		return out, nil
+	}
+
+	opts := options.Find().SetProjection(bson.M{"name": 1, "type": 1, "case_id": 1})
+	res, err := MongoClient.Database("fyeo-di").Collection("assets").Find(ctx, bson.M{"_id": bson.M{"$in": objectIDs(ids)}}, opts)
+	if err != nil {
+		return out, err
+	}
+
+	var docs []Asset
+	err = res.All(ctx, &docs)
+	for _, d := range docs {
+		if d.ID != nil {
+			out[*d.ID] = d
+		}
+	}
+
+	return out, err
+}
+
+// counter keeps the order values were first seen in, so ties keep a stable order.
+type counter struct {
+	counts map[string]*ProfileCount
+	order  []*ProfileCount
+}
+
+func newCounter() *counter {
+	return &counter{counts: make(map[string]*ProfileCount)}
+}
+
+func (c *counter) add(v string) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return
+	}
+
+	p, ok := c.counts[strings.ToLower(v)]
+	if !ok {
+		p = &ProfileCount{Value: v}
+		c.counts[strings.ToLower(v)] = p
+		c.order = append(c.order, p)
+	}
+	p.Count++
+}
+
+func (c *counter) sorted() []*ProfileCount {
+	out := append([]*ProfileCount{}, c.order...)
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Count > out[j].Count })
+	return out
+}
+
+func seenAt(first **time.Time, last **time.Time, t *time.Time) {
+	if t == nil || t.IsZero() {
+		return
+	}
+	if *first == nil || t.Before(**first) {
+		*first = t
+	}
+	if *last == nil || t.After(**last) {
+		*last = t
+	}
+}
+
+// BuildProfile gathers what the incidents the actor appears in say about it. Staff pass nil
+// cases and see every case, customers only the cases they may see.
+func BuildProfile(ctx context.Context, actor Asset, cases map[string]Case) (ThreatActorProfile, error) {
+	id := stringValue(actor.ID)
+	out := ThreatActorProfile{
+		ID:          id,
+		Name:        actor.GetName(),
+		Description: actor.Description,
+		Aliases:     actor.Aliases(),
+		Cases:       []*ProfileCase{},
+		Sites:       []*ProfileCount{},
+		Networks:    []*ProfileCount{},
+		Targets:     []*ProfileTarget{},
+	}
+
+	incidents, err := GetActorIncidents(ctx, id, cases)
+	if err != nil {
+		return out, err
+	}
+	out.IncidentCount = int64(len(incidents))
+
+	by_case := make(map[string]*ProfileCase)
+	targets := newCounter()
+	var event_ids []string
+
+	for i := range incidents {
+		incident := &incidents[i]
+		c_id := stringValue(incident.CaseID)
+
+		pc, ok := by_case[c_id]
+		if !ok {
+			pc = &ProfileCase{ID: c_id}
+			by_case[c_id] = pc
+			out.Cases = append(out.Cases, pc)
+		}
+		pc.Incidents = append(pc.Incidents, incident)
+
+		seenAt(&out.FirstSeen, &out.LastSeen, incident.CreatedAt)
+
+		targets.add(stringValue(incident.AssetID))
+		if incident.TargetIDs != nil {
+			for _, t := range *incident.TargetIDs {
+				if t != stringValue(incident.AssetID) {
+					targets.add(t)
+				}
+			}
+		}
+
+		if incident.EventIDs != nil {
+			event_ids = append(event_ids, *incident.EventIDs...)
+		}
+	}
+
+	//staff see every case, their names are looked up for the cases the actor appears in
+	if cases == nil && len(by_case) > 0 {
+		var case_ids []string
+		for c_id := range by_case {
+			case_ids = append(case_ids, c_id)
+		}
+
+		found, err := GetCases(ctx, bson.M{"_id": bson.M{"$in": objectIDs(case_ids)}})
+		if err != nil {
+			return out, err
+		}
+
+		cases = make(map[string]Case)
+		for _, c := range found {
+			if c.ID != nil {
+				cases[*c.ID] = c
+			}
+		}
+	}
+	for _, pc := range out.Cases {
+		pc.Name = stringValue(cases[pc.ID].Name)
+	}
+
+	events, err := GetProfileEvents(ctx, event_ids)
+	if err != nil {
+		return out, err
+	}
+
+	sites := newCounter()
+	networks := newCounter()
+	for _, e := range events {
+		sites.add(stringValue(e.Site))
+		networks.add(stringValue(e.SourceNetwork))
+		seenAt(&out.FirstSeen, &out.LastSeen, e.CreatedAt)
+	}
+	out.Sites = sites.sorted()
+	out.Networks = networks.sorted()
+
+	counted := targets.sorted()
+	var target_ids []string
+	for _, t := range counted {
+		target_ids = append(target_ids, t.Value)
+	}
+
+	assets, err := GetAssets(ctx, target_ids)
+	if err != nil {
+		return out, err
+	}
+
+	for _, t := range counted {
+		a := assets[t.Value]
+		out.Targets = append(out.Targets, &ProfileTarget{
+			ID:     t.Value,
+			Name:   a.GetName(),
+			Type:   stringValue(a.Type),
+			CaseID: stringValue(a.CaseID),
+			Count:  t.Count,
+		})
+	}
+
+	return out, nil
+}